@@ -22,18 +22,46 @@ import "net"
 import "flag"
 import "strconv"
 import "tools"
+import "context"
+import "strings"
+import "os/signal"
 
 func main() {
 	var err error
 	var serverHost *string  = flag.String("host", "",  "Host name for the STUN server.")
 	var serverPort *int     = flag.Int("port",    3478, "Pot number for the host server.")
 	var verbosityLevel *int = flag.Int("verbose", 0,    "Verbosity level.")
+	var behavior *bool      = flag.Bool("behavior", false, "Discover the mapping and filtering behaviors (RFC 5780).")
+	var lifetime *bool      = flag.Bool("lifetime", false, "Measure the lifetime of the NAT binding (RFC 5780). This may take several minutes.")
+	var allocation *int     = flag.Int("allocation", 0, "Analyze the port allocation of the NAT, using the given number of sockets.")
+	var serve *string       = flag.String("serve", "", "Run a STUN server on the given transport addresses (comma separated), instead of a client.")
+	var serve3489 *string   = flag.String("serve3489", "", "Run a RFC 3489 STUN server (RFC 5780 with -rfc5389) on IP1:P1,IP2:P2 (the server also listens on IP1:P2 and IP2:P1), instead of a client.")
+	var rfc5389 *bool       = flag.Bool("rfc5389", false, "Be compliant with RFC 5389 (instead of RFC 3489).")
+	var turn *string        = flag.String("turn", "", "Run a TURN server on the given transport address, instead of a client (implies -rfc5389).")
+	var turnUsers *string   = flag.String("turnusers", "", "The users of the TURN server (user1:password1,user2:password2...).")
+	var turnRealm *string   = flag.String("turnrealm", "gostun", "The realm of the TURN server.")
+	var turnPorts *string   = flag.String("turnports", "49152-65535", "The range of ports of the TURN server's relay sockets.")
+	var turnRelay *string   = flag.String("turnrelay", "", "The IP address of the TURN server's relay sockets (default: the server's IP address).")
 	var ips []string
 	var ip string
-	var nat int
+	var result stun.DiscoveryResult
+	var client *stun.Client
 		
 	// Parse the command line.
 	flag.Parse()
+	stun.ActivateOutput(*verbosityLevel, nil)
+	if (*rfc5389) { stun.SetRfc5389() }
+	
+	if ("" != *turn) {
+		stun.SetRfc5389()
+		runTurnServer(*turn, *turnUsers, *turnRealm, *turnPorts, *turnRelay)
+		return
+	}
+	
+	if ("" != *serve) || ("" != *serve3489) {
+		runServer(strings.Split(*serve, ","), *serve3489)
+		return
+	}
 	
 	if ("" == *serverHost) {
 		fmt.Println("ERROR: You must specify the host name of the STUN server (option -host).")
@@ -94,10 +122,29 @@ func main() {
 	fmt.Println(fmt.Sprintf("\nUsing transport address \"%s\".\n", ip))
 	
 	// Perform discovery.
-	stun.ClientInit(ip)
-	stun.ActivateOutput(*verbosityLevel, nil)
+	client, err = stun.ClientCreate(ip)
+	if (nil != err) {
+		fmt.Println(fmt.Sprintf("ERROR: %s", err))
+		os.Exit(1)
+	}
+	defer client.Close()
 	
-	nat, err = stun.ClientDiscover()
+	if (*behavior) {
+		discoverBehavior(client)
+		return
+	}
+
+	if (*lifetime) {
+		probeLifetime(client)
+		return
+	}
+
+	if (*allocation > 0) {
+		analyzeAllocation(client, *allocation)
+		return
+	}
+	
+	result, err = client.ClientDiscover()
 	if (nil != err) {
 		fmt.Println(fmt.Sprintf("An error occured: %s", err))
 		os.Exit(1)
@@ -106,7 +153,7 @@ func main() {
 	// Print result.
 	fmt.Println("\n\nCONCLUSION\n")
 	
-	switch nat {
+	switch result.NatType {
 		case stun.STUN_NAT_ERROR:
 			fmt.Println(fmt.Sprintf("Test failed: %s", err))
 		case stun.STUN_NAT_BLOCKED:
@@ -126,7 +173,179 @@ func main() {
 		case stun.STUN_NAT_SYMETRIC_UDP_FIREWALL:
 			fmt.Println(fmt.Sprintf("We are behind a symetric UDP firewall."))
 	}
+	
+	fmt.Println(fmt.Sprintf("\n% -20s: %s", "Local address", result.LocalAddress))
+	fmt.Println(fmt.Sprintf("% -20s: %s", "Mapped address", result.MappedAddress))
+	if (stun.STUN_HAIRPINNING_UNKNOWN != result.Hairpinning) { fmt.Println(fmt.Sprintf("% -20s: %s", "Hairpinning", result.Hairpinning)) }
+	for i:=0; i<len(result.Tests); i++ {
+		if result.Tests[i].Answered {
+			fmt.Println(fmt.Sprintf("% -20s: response from %s in %s", result.Tests[i].Name, result.Tests[i].Destination, result.Tests[i].Rtt))
+		} else {
+			fmt.Println(fmt.Sprintf("% -20s: no response from %s", result.Tests[i].Name, result.Tests[i].Destination))
+		}
+	}
+}
+
+// This function discovers the mapping and filtering behaviors of the NAT (RFC 5780) and prints the result.
+//
+// INPUT
+// - in_client: the STUN client.
+func discoverBehavior(in_client *stun.Client) {
+	stun.SetRfc5389()
+	result, err := in_client.ClientDiscoverBehavior(context.Background())
+	if (nil != err) {
+		fmt.Println(fmt.Sprintf("An error occured: %s", err))
+		os.Exit(1)
+	}
+	
+	fmt.Print("\n\nCONCLUSION\n\n")
+	if (result.Blocked) {
+		fmt.Println("UDP is blocked.")
+		return
+	}
+	if (result.NoNat) { fmt.Println("We are not behind a NAT.") }
+	fmt.Println(fmt.Sprintf("% -20s: %s", "Mapping",   result.Mapping))
+	fmt.Println(fmt.Sprintf("% -20s: %s", "Filtering", result.Filtering))
+	fmt.Println(fmt.Sprintf("\n% -20s: %s", "Local address", result.LocalAddress))
+	fmt.Println(fmt.Sprintf("% -20s: %s", "Mapped address", result.MappedAddress))
+	fmt.Println(fmt.Sprintf("% -20s: %s", "Other address", result.OtherAddress))
+	for i:=0; i<len(result.Tests); i++ {
+		if result.Tests[i].Answered {
+			fmt.Println(fmt.Sprintf("% -20s: response from %s in %s", result.Tests[i].Name, result.Tests[i].Destination, result.Tests[i].Rtt))
+		} else {
+			fmt.Println(fmt.Sprintf("% -20s: no response from %s", result.Tests[i].Name, result.Tests[i].Destination))
+		}
+	}
+}
+
+// This function measures the lifetime of the NAT binding (RFC 5780) and prints the result.
+//
+// INPUT
+// - in_client: the client.
+func probeLifetime(in_client *stun.Client) {
+	stun.SetRfc5389()
+	result, err := in_client.ClientProbeLifetime(context.Background(), stun.LifetimePolicyDefault())
+	if (nil != err) {
+		fmt.Println(fmt.Sprintf("An error occured: %s", err))
+		os.Exit(1)
+	}
+
+	fmt.Print("\n\nCONCLUSION\n\n")
+	if (0 == result.Expired) {
+		fmt.Println(fmt.Sprintf("The binding survived %s without traffic.", result.Lifetime))
+	} else {
+		fmt.Println(fmt.Sprintf("% -20s: %s (expired after %s)", "Binding lifetime", result.Lifetime, result.Expired))
+	}
+	if (! result.ResponsePort) { fmt.Println("The server does not support RESPONSE-PORT: the result may be inaccurate.") }
 }
 
+// This function analyzes the port allocation of the NAT and prints the result.
+//
+// INPUT
+// - in_client: the client.
+// - in_sockets: the number of sockets to open.
+func analyzeAllocation(in_client *stun.Client, in_sockets int) {
+	result, err := in_client.ClientAnalyzePortAllocation(context.Background(), in_sockets, nil)
+	if (nil != err) {
+		fmt.Println(fmt.Sprintf("An error occured: %s", err))
+		os.Exit(1)
+	}
+
+	fmt.Print("\n\nCONCLUSION\n\n")
+	fmt.Println(fmt.Sprintf("% -20s: %v", "Port preservation", result.Preservation))
+	fmt.Println(fmt.Sprintf("% -20s: %v", "Port parity", result.Parity))
+	fmt.Println(fmt.Sprintf("% -20s: %v (delta %d)", "Sequential", result.Sequential, result.Delta))
+	fmt.Println(fmt.Sprintf("% -20s: %v", "Random", result.Random))
+	if port, ok := result.PredictNextPort(0); ok { fmt.Println(fmt.Sprintf("% -20s: %d", "Next mapped port", port)) }
+	for i:=0; i<len(result.Samples); i++ {
+		fmt.Println(fmt.Sprintf("% -20s: %s -> %s", result.Samples[i].LocalAddress, result.Samples[i].Server, result.Samples[i].MappedAddress))
+	}
+}
 
+// This function runs a STUN server, until the process is interrupted.
+//
+// INPUT
+// - in_addresses: the local transport addresses the server listens on.
+// - in_rfc3489: the primary and alternate transport addresses of a RFC 3489 server ("IP1:P1,IP2:P2").
+//   If this value is not empty, then the previous parameter is ignored.
+func runServer(in_addresses []string, in_rfc3489 string) {
+	var server *stun.Server
+	var err error
 
+	if ("" != in_rfc3489) {
+		var ips [2]string
+		var ports [2]int
+		addresses := strings.Split(in_rfc3489, ",")
+		if (2 != len(addresses)) {
+			fmt.Println("ERROR: The RFC 3489 server needs two transport addresses (IP1:P1,IP2:P2).")
+			os.Exit(1)
+		}
+		for i := 0; i < 2; i++ {
+			ips[i], ports[i], err = tools.InetSplit(addresses[i])
+			if (nil != err) {
+				fmt.Println(fmt.Sprintf("ERROR: %s", err))
+				os.Exit(1)
+			}
+		}
+		server, err = stun.ServerCreateRfc3489(ips[0], ips[1], ports[0], ports[1])
+	} else {
+		server, err = stun.ServerCreate(in_addresses)
+	}
+	if (nil != err) {
+		fmt.Println(fmt.Sprintf("ERROR: %s", err))
+		os.Exit(1)
+	}
+	defer server.Close()
+	server.Start()
+	for _, address := range server.Addresses() { fmt.Println(fmt.Sprintf("% -15s: %s", "Listening on", address)) }
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+}
+
+// This function runs a TURN server, until the process is interrupted.
+//
+// INPUT
+// - in_address: the local transport address the server listens on.
+// - in_users: the users ("user1:password1,user2:password2...").
+// - in_realm: the realm.
+// - in_ports: the range of ports of the relay sockets ("min-max").
+// - in_relay: the IP address of the relay sockets ("" means "the server's IP address").
+func runTurnServer(in_address string, in_users string, in_realm string, in_ports string, in_relay string) {
+	var err error
+
+	policy := stun.TurnServerPolicyDefault()
+	policy.Realm   = in_realm
+	policy.RelayIp = in_relay
+	for _, user := range strings.Split(in_users, ",") {
+		credentials := strings.SplitN(user, ":", 2)
+		if (2 != len(credentials)) || ("" == credentials[0]) {
+			fmt.Println(fmt.Sprintf("ERROR: Invalid user \"%s\" (expected user:password).", user))
+			os.Exit(1)
+		}
+		policy.Users[credentials[0]] = credentials[1]
+	}
+	ports := strings.Split(in_ports, "-")
+	if (2 == len(ports)) {
+		policy.MinPort, err = strconv.Atoi(ports[0])
+		if (nil == err) { policy.MaxPort, err = strconv.Atoi(ports[1]) }
+	}
+	if (2 != len(ports)) || (nil != err) {
+		fmt.Println(fmt.Sprintf("ERROR: Invalid range of ports \"%s\" (expected min-max).", in_ports))
+		os.Exit(1)
+	}
+
+	server, err := stun.TurnServerCreate(in_address, policy)
+	if (nil != err) {
+		fmt.Println(fmt.Sprintf("ERROR: %s", err))
+		os.Exit(1)
+	}
+	defer server.Close()
+	server.Start()
+	fmt.Println(fmt.Sprintf("% -15s: %s", "Listening on", server.Address()))
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+}
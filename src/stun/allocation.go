@@ -0,0 +1,228 @@
+// Copyright (C) 2012 Denis BEURIVE
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stun
+
+import "fmt"
+import "errors"
+import "context"
+import "tools"
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Port allocation analysis.                                                                        */
+/* This analysis helps to traverse NATs that allocate a new mapping for each destination            */
+/* (symmetric NATs). It tells how the NAT chooses the mapped ports, and predicts the next one.      */
+/* ------------------------------------------------------------------------------------------------ */
+
+// The proportion of deltas (between consecutive mapped ports) that must be identical for the allocation to be
+// considered sequential. The most frequent delta must represent strictly more than this proportion.
+const allocation_sequential_ratio = 0.5
+
+// The minimum number of identical deltas for the allocation to be considered sequential.
+// A single delta (two new mappings) is always "the most frequent": it says nothing about the allocation.
+const allocation_sequential_min = 2
+
+// This type represents a mapping observed during the analysis.
+type PortSample struct {
+	// The local transport address of the socket.
+	LocalAddress string
+	// The transport address of the server.
+	Server string
+	// The mapped transport address.
+	MappedAddress string
+	// The local port.
+	LocalPort uint16
+	// The mapped port.
+	MappedPort uint16
+}
+
+// This type represents the result of the port allocation analysis.
+type AllocationResult struct {
+	// The mappings observed, in chronological order.
+	Samples []PortSample
+	// This flag indicates whether the NAT preserves the local ports (all the mapped ports are equal to the local ports).
+	Preservation bool
+	// This flag indicates whether the NAT preserves the parity of the local ports.
+	Parity bool
+	// This flag indicates whether the NAT allocates the ports sequentially (see Delta).
+	Sequential bool
+	// The most frequent difference between two consecutive new mapped ports.
+	// Ties are broken deterministically: the smallest absolute value wins, then the positive value.
+	// If the allocation is sequential, then the next mapped port should be the last one plus this value.
+	Delta int
+	// This flag indicates whether the NAT allocates the ports randomly (no preservation, no sequence).
+	Random bool
+	// The tests performed, in chronological order.
+	Tests []DiscoveryTest
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* API                                                                                              */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function analyzes the way the NAT allocates the mapped ports.
+// The function opens several sockets (one after the other). From each socket, it sends a BINDING request to each
+// given server, and records the mapped port.
+//
+// INPUT
+// - in_ctx: the context. It can be used to cancel the analysis.
+// - in_sockets: the number of sockets to open (at least 2).
+// - in_servers: the transport addresses of the servers to query from each socket.
+//   These values should be written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+//   If the list is empty, then the server's transport address is used.
+//   Note: For a symmetric NAT, querying several servers (or several ports of the same server) creates several
+//         mappings per socket.
+//
+// OUTPUT
+// - The result of the analysis.
+// - The error flag.
+func (v *Client) ClientAnalyzePortAllocation(in_ctx context.Context, in_sockets int, in_servers []string) (AllocationResult, error) {
+	var result AllocationResult
+
+	if (in_sockets < 2) { return result, errors.New(fmt.Sprintf("Invalid number of sockets (%d): at least 2 sockets are required.", in_sockets)) }
+	if (0 == len(in_servers)) { in_servers = []string{ v.server_transport_address } }
+
+	for i := 0; i < in_sockets; i++ {
+		err := v.__allocationSamples(in_ctx, in_servers, &result)
+		if (nil != err) { return result, err }
+	}
+	if (0 == len(result.Samples)) { return result, errors.New("The servers did not answer any request.") }
+
+	result.__analyze()
+	if verbosity > 0 {
+		tools.AddText(output, fmt.Sprintf("% -25s: %v", "Port preservation", result.Preservation))
+		tools.AddText(output, fmt.Sprintf("% -25s: %v", "Port parity", result.Parity))
+		tools.AddText(output, fmt.Sprintf("% -25s: %v (delta %d)", "Sequential allocation", result.Sequential, result.Delta))
+		tools.AddText(output, fmt.Sprintf("% -25s: %v", "Random allocation", result.Random))
+	}
+	return result, nil
+}
+
+// This function predicts the mapped port of the next mapping created by the NAT.
+//
+// INPUT
+// - in_local_port: the local port of the socket that will create the mapping (0 if unknown).
+//   This value is used if the NAT preserves the local ports.
+//
+// OUTPUT
+// - The predicted port.
+// - This flag indicates whether a prediction is possible or not.
+//   If the NAT allocates the ports randomly, then no prediction is possible.
+func (v AllocationResult) PredictNextPort(in_local_port uint16) (uint16, bool) {
+	if (v.Preservation) && (0 != in_local_port) { return in_local_port, true }
+	if (! v.Sequential) || (0 == len(v.Samples)) { return 0, false }
+	return uint16(int(v.Samples[len(v.Samples) - 1].MappedPort) + v.Delta), true
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Privates                                                                                         */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function opens a socket and records the mappings created by sending a BINDING request to each server.
+//
+// INPUT
+// - in_ctx: the context.
+// - in_servers: the transport addresses of the servers.
+// - out_result: the result of the analysis.
+//
+// OUTPUT
+// - The error flag.
+func (v *Client) __allocationSamples(in_ctx context.Context, in_servers []string, out_result *AllocationResult) error {
+	var sample PortSample
+
+	connection, err := v.__secondarySocket()
+	if (nil != err) { return err }
+	defer connection.Close()
+
+	// This client shares the parameters of the main client, but it uses the new socket.
+	probe := Client{
+		connection:               connection,
+		server_transport_address: v.server_transport_address,
+		transport_local:          connection.LocalAddr().String(),
+		policy:                   v.policy,
+		credentials:              v.credentials,
+	}
+	_, local_port, err := tools.InetSplit(probe.transport_local)
+	if (nil != err) { return err }
+
+	for j := 0; j < len(in_servers); j++ {
+		response, err := probe.ClientSendBinding(in_ctx, &in_servers[j])
+		out_result.Tests = append(out_result.Tests, __discoveryTest(fmt.Sprintf("Allocation (%s)", probe.transport_local), response))
+		if (nil != err) { return err }
+		if (! response.response) { continue }
+
+		sample.LocalAddress  = probe.transport_local
+		sample.Server        = in_servers[j]
+		sample.LocalPort     = uint16(local_port)
+		sample.MappedAddress, err = __mappedAddress(response.packet)
+		if (nil != err) { return err }
+		_, mapped_port, err := tools.InetSplit(sample.MappedAddress)
+		if (nil != err) { return err }
+		sample.MappedPort = uint16(mapped_port)
+		out_result.Samples = append(out_result.Samples, sample)
+		if verbosity > 0 { tools.AddText(output, fmt.Sprintf("% -25s: %s -> %s", sample.LocalAddress, sample.Server, sample.MappedAddress)) }
+	}
+	return nil
+}
+
+// This function analyzes the mappings observed.
+func (v *AllocationResult) __analyze() {
+	var deltas = make(map[int]int)
+	var count int = 0
+	var seen = make(map[string]bool)
+	var last int = -1
+
+	v.Preservation = true
+	v.Parity       = true
+	for i := 0; i < len(v.Samples); i++ {
+		s := v.Samples[i]
+		if (s.MappedPort != s.LocalPort) { v.Preservation = false }
+		if (s.MappedPort % 2 != s.LocalPort % 2) { v.Parity = false }
+
+		// Only new mappings are considered. A mapping reused by the same socket says nothing about the allocation.
+		if (seen[s.MappedAddress]) { continue }
+		seen[s.MappedAddress] = true
+		if (last >= 0) {
+			// The difference is taken modulo 65536 (the NAT may wrap around).
+			delta := int(int16(s.MappedPort - uint16(last)))
+			deltas[delta]++
+			count++
+		}
+		last = int(s.MappedPort)
+	}
+
+	// The order of iteration over a map is random: the comparison must not depend on it.
+	v.Delta = 0
+	for delta, n := range deltas {
+		if (n > deltas[v.Delta]) { v.Delta = delta; continue }
+		if (n < deltas[v.Delta]) { continue }
+		if (__abs(delta) < __abs(v.Delta)) || ((__abs(delta) == __abs(v.Delta)) && (delta > v.Delta)) { v.Delta = delta }
+	}
+	v.Sequential = (deltas[v.Delta] >= allocation_sequential_min) && (0 != v.Delta) && (float64(deltas[v.Delta]) / float64(count) > allocation_sequential_ratio)
+	if (! v.Sequential) { v.Delta = 0 }
+	v.Random = (! v.Preservation) && (! v.Sequential) && (count > 0)
+}
+
+// This function returns the absolute value of an integer.
+//
+// INPUT
+// - in_value: the integer.
+//
+// OUTPUT
+// - The absolute value.
+func __abs(in_value int) int {
+	if (in_value < 0) { return -in_value }
+	return in_value
+}
@@ -18,10 +18,14 @@ package stun
 import "encoding/binary"
 import "unicode/utf8"
 import "hash/crc32"
+import "crypto/hmac"
+import "crypto/sha1"
+import "crypto/md5"
 import "bytes"
 import "tools"
 import "errors"
 import "fmt"
+import "strings"
 
 // IP family is IPV4
 const STUN_ATTRIBUT_FAMILY_IPV4   = 0x01
@@ -324,13 +328,16 @@ func AttributeCreate(in_type uint16, in_value []byte, in_packet *StunPacket) (St
 // - The error flag.
 //
 // WARNING
-// The FINGERPRINT attribute should be the last attribute of the STUN packet.
+// The FINGERPRINT attribute must be the last attribute of the STUN packet.
 func AttributeCreateFingerprint(in_packet *StunPacket) (StunAttribute, error) {
 	var err error
 	var res StunAttribute
 	buf := new(bytes.Buffer)
 
-    crc := __stunCrc32(in_packet.ToBytes())
+	// RFC 5389: the length field of the header must include the FINGERPRINT attribute (8 bytes).
+	bin := in_packet.ToBytes()
+	copy(bin[2:4], tools.Uint16toBytesMSF(in_packet.GetLength() + 8))
+	crc := __stunCrc32(bin)
 	
 	err = binary.Write(buf, binary.BigEndian, crc)
 	if (nil != err) { panic("Internal error"); }
@@ -342,6 +349,68 @@ func AttributeCreateFingerprint(in_packet *StunPacket) (StunAttribute, error) {
 	return res, nil
 }
 
+// This function creates a "MESSAGE-INTEGRITY" attribute.
+// RFC 5389: The text used as input to HMAC is the STUN message, including the header, up to and including the
+//           attribute preceding the MESSAGE-INTEGRITY attribute. [...] the length field of the STUN message header
+//           [is adjusted] to point to the end of the MESSAGE-INTEGRITY attribute.
+//
+// INPUT
+// - in_packet: Pointer to the STUN packet that is used to calculate the HMAC.
+// - in_key: the key used to calculate the HMAC.
+//   + For short-term credentials, the key is the password (see ShortTermKey()).
+//   + For long-term credentials, the key is MD5(username ":" realm ":" password) (see LongTermKey()).
+//
+// OUTPUT
+// - The STUN's attribute.
+// - The error flag.
+//
+// WARNING
+// The MESSAGE-INTEGRITY attribute should be the last attribute of the STUN packet, except for FINGERPRINT.
+func AttributeCreateMessageIntegrity(in_packet *StunPacket, in_key []byte) (StunAttribute, error) {
+	var res StunAttribute
+	
+	if (in_packet.GetLength() > 65535 - 24) { return res, errors.New("Can not create MESSAGE-INTEGRITY: the packet is too long.") }
+	
+	res, err := AttributeCreate(STUN_ATTRIBUT_MESSAGE_INTEGRITY, __hmac(in_packet.ToBytes(), in_key), in_packet)
+	if (nil != err) { return res, err }
+	
+	return res, nil
+}
+
+// This function creates a key for the short-term credential mechanism.
+// RFC 5389: For short-term credentials: key = SASLprep(password)
+//
+// INPUT
+// - in_password: the password.
+//
+// OUTPUT
+// - The key.
+//
+// WARNING
+// SASLprep is not applied to the password. Passwords must therefore be given in their prepared form.
+func ShortTermKey(in_password string) []byte {
+	return []byte(in_password)
+}
+
+// This function creates a key for the long-term credential mechanism.
+// RFC 5389: For long-term credentials, the key is 16 bytes:
+//           key = MD5(username ":" realm ":" SASLprep(password))
+//
+// INPUT
+// - in_username: the user name.
+// - in_realm: the realm, as given by the server.
+// - in_password: the password.
+//
+// OUTPUT
+// - The key.
+//
+// WARNING
+// SASLprep is not applied to the password. Passwords must therefore be given in their prepared form.
+func LongTermKey(in_username string, in_realm string, in_password string) []byte {
+	key := md5.Sum([]byte(in_username + ":" + in_realm + ":" + in_password))
+	return key[:]
+}
+
 // This function creates a "SOFTWARE" attribute.
 //
 // INPUT
@@ -392,6 +461,253 @@ func AttributeCreateChangeRequest(in_packet *StunPacket, in_ip bool, in_port boo
 	return res, nil
 }
 
+// This function creates an "ERROR-CODE" attribute.
+// RFC 5389: The Class represents the hundreds digit of the error code.  The value MUST be between 3 and 6.  The Number
+//           represents the error code modulo 100, and its value MUST be between 0 and 99. [...] The reason phrase MUST
+//           be a UTF-8 [RFC3629] encoded sequence of less than 128 characters (which can be as long as 763 bytes).
+//
+// INPUT
+// - in_packet: pointer to the STUN packet.
+// - in_code: the error code (constant STUN_ERROR_...).
+// - in_reason: the reason phrase. If the value of this parameter is "", then the name of the error is used.
+//
+// OUTPUT
+// - The STUN's attribute.
+// - The error flag.
+func AttributeCreateErrorCode(in_packet *StunPacket, in_code uint16, in_reason string) (StunAttribute, error) {
+	var res StunAttribute
+	
+	if (in_code < 300) || (in_code > 699) {
+		return res, errors.New(fmt.Sprintf("Invalid error code (%d). It must be between 300 and 699.", in_code))
+	}
+	if ("" == in_reason) { in_reason = error_names[in_code] }
+	if (len(in_reason) > 763) {
+		return res, errors.New("Reason phrase is too long (more than 763 bytes!)")
+	}
+	// RFC 3489: The reason phrase [...] MUST be a multiple of 4 bytes. [...] it may be padded with spaces.
+	for (STUN_RFC_3489 == rfc) && (0 != len(in_reason) % 4) { in_reason += " " }
+	
+	value := []byte{ 0x00, 0x00, byte(in_code / 100), byte(in_code % 100) }
+	value  = append(value, []byte(in_reason)...)
+	return AttributeCreate(STUN_ATTRIBUT_ERROR_CODE, value, in_packet)
+}
+
+// This function creates a "XOR-MAPPED-ADDRESS" attribute.
+//
+// INPUT
+// - in_packet: pointer to the STUN packet.
+//   Please note that the packet's transaction ID must be set before the attribute is created (IPV6).
+// - in_ip: the IP address.
+//   + Example for IPV4: "192.168.0.1"
+//   + Example for IPV6: "0011:2233:4455:6677:8899:AABB:CCDD:EEFF"
+// - in_port: the port number.
+//
+// OUTPUT
+// - The STUN's attribute.
+// - The error flag.
+func AttributeCreateXorMappedAddress(in_packet *StunPacket, in_ip string, in_port uint16) (StunAttribute, error) {
+	return __createXorAddress(STUN_ATTRIBUT_XOR_MAPPED_ADDRESS, in_packet, in_ip, in_port)
+}
+
+// This function creates a "XOR-PEER-ADDRESS" attribute (RFC 5766).
+//
+// INPUT
+// - in_packet: pointer to the STUN packet.
+//   Please note that the packet's transaction ID must be set before the attribute is created (IPV6).
+// - in_ip: the IP address.
+// - in_port: the port number.
+//
+// OUTPUT
+// - The STUN's attribute.
+// - The error flag.
+func AttributeCreateXorPeerAddress(in_packet *StunPacket, in_ip string, in_port uint16) (StunAttribute, error) {
+	return __createXorAddress(STUN_ATTRIBUT_XOR_PEER_ADDRESS, in_packet, in_ip, in_port)
+}
+
+// This function creates a "XOR-RELAYED-ADDRESS" attribute (RFC 5766).
+//
+// INPUT
+// - in_packet: pointer to the STUN packet.
+//   Please note that the packet's transaction ID must be set before the attribute is created (IPV6).
+// - in_ip: the IP address.
+// - in_port: the port number.
+//
+// OUTPUT
+// - The STUN's attribute.
+// - The error flag.
+func AttributeCreateXorRelayedAddress(in_packet *StunPacket, in_ip string, in_port uint16) (StunAttribute, error) {
+	return __createXorAddress(STUN_ATTRIBUT_XOR_RELAYED_ADDRESS, in_packet, in_ip, in_port)
+}
+
+// This function creates a "RESPONSE-PORT" attribute (RFC 5780).
+// RFC 5780: The RESPONSE-PORT attribute contains a port. [...] It is a 16-bit unsigned integer in network byte order
+//           followed by 2 bytes of padding.
+//
+// INPUT
+// - in_packet: pointer to the STUN packet.
+// - in_port: the port number the response must be sent to.
+//
+// OUTPUT
+// - The STUN's attribute.
+// - The error flag.
+func AttributeCreateResponsePort(in_packet *StunPacket, in_port uint16) (StunAttribute, error) {
+	value := append(tools.Uint16toBytesMSF(in_port), 0x00, 0x00)
+	return AttributeCreate(STUN_ATTRIBUT_RESPONSE_PORT, value, in_packet)
+}
+
+// This function creates a "LIFETIME" attribute (RFC 5766).
+// RFC 5766: The LIFETIME attribute represents the duration for which the server will maintain an allocation in the
+//           absence of a refresh. The value portion of this attribute is 4-bytes long and consists of a 32-bit unsigned
+//           integral value representing the number of seconds remaining until expiration.
+//
+// INPUT
+// - in_packet: pointer to the STUN packet.
+// - in_seconds: the number of seconds.
+//
+// OUTPUT
+// - The STUN's attribute.
+// - The error flag.
+func AttributeCreateLifetime(in_packet *StunPacket, in_seconds uint32) (StunAttribute, error) {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, in_seconds)
+	return AttributeCreate(STUN_ATTRIBUT_LIFETIME, value, in_packet)
+}
+
+// This function creates a "CHANNEL-NUMBER" attribute (RFC 5766).
+// RFC 5766: The CHANNEL-NUMBER attribute contains the number of the channel. The value portion of this attribute is
+//           4 bytes long and consists of a 16-bit unsigned integer, followed by a two-octet RFFU (Reserved For Future
+//           Use) field, which MUST be set to 0 on transmission and MUST be ignored on reception.
+//
+// INPUT
+// - in_packet: pointer to the STUN packet.
+// - in_number: the channel number.
+//
+// OUTPUT
+// - The STUN's attribute.
+// - The error flag.
+func AttributeCreateChannelNumber(in_packet *StunPacket, in_number uint16) (StunAttribute, error) {
+	value := append(tools.Uint16toBytesMSF(in_number), 0x00, 0x00)
+	return AttributeCreate(STUN_ATTRIBUT_CHANNEL_NUMBER, value, in_packet)
+}
+
+// This function creates a "DATA" attribute (RFC 5766).
+// RFC 5766: The DATA attribute is present in all Send and Data indications. The value portion of this attribute is
+//           variable length and consists of the application data.
+//
+// INPUT
+// - in_packet: pointer to the STUN packet.
+// - in_data: the application data.
+//
+// OUTPUT
+// - The STUN's attribute.
+// - The error flag.
+func AttributeCreateData(in_packet *StunPacket, in_data []byte) (StunAttribute, error) {
+	return AttributeCreate(STUN_ATTRIBUT_DATA, in_data, in_packet)
+}
+
+// This function creates a "REQUESTED-TRANSPORT" attribute (RFC 5766).
+// RFC 5766: This attribute is used by the client to request a specific transport protocol for the allocated
+//           transport address. [...] The Protocol field specifies the desired protocol. [...] The RFFU field MUST be
+//           set to zero on transmission.
+//
+// INPUT
+// - in_packet: pointer to the STUN packet.
+// - in_protocol: the IANA protocol number (for example: STUN_TRANSPORT_UDP).
+//
+// OUTPUT
+// - The STUN's attribute.
+// - The error flag.
+func AttributeCreateRequestedTransport(in_packet *StunPacket, in_protocol byte) (StunAttribute, error) {
+	return AttributeCreate(STUN_ATTRIBUT_REQUESTED_TRANSPORT, []byte{ in_protocol, 0x00, 0x00, 0x00 }, in_packet)
+}
+
+// This function creates an "UNKNOWN-ATTRIBUTES" attribute.
+// RFC 5389: The attribute contains a list of 16-bit values, each of which represents an attribute type that was not
+//           understood by the server.
+// RFC 3489: [...] if the number of unknown attributes is an odd number, one of the attributes MUST be repeated in the
+//           list, so that the total length of the list is a multiple of 4 bytes.
+//
+// INPUT
+// - in_packet: pointer to the STUN packet.
+// - in_types: the types of the attributes that were not understood.
+//
+// OUTPUT
+// - The STUN's attribute.
+// - The error flag.
+func AttributeCreateUnknownAttributes(in_packet *StunPacket, in_types []uint16) (StunAttribute, error) {
+	var res StunAttribute
+	var value []byte
+
+	if (0 == len(in_types)) {
+		return res, errors.New("The list of unknown attributes is empty.")
+	}
+	for i := 0; i < len(in_types); i++ {
+		value = append(value, tools.Uint16toBytesMSF(in_types[i])...)
+	}
+	if (STUN_RFC_3489 == rfc) && (0 != len(in_types) % 2) {
+		value = append(value, tools.Uint16toBytesMSF(in_types[0])...)
+	}
+	return AttributeCreate(STUN_ATTRIBUT_UNKNOWN_ATTRIBUTES, value, in_packet)
+}
+
+// This function creates a "USERNAME" attribute.
+// RFC 5389: It MUST contain a UTF-8 [RFC3629] encoded sequence of less than 513 bytes.
+//
+// INPUT
+// - in_packet: pointer to the STUN packet.
+// - in_username: the user name.
+//
+// OUTPUT
+// - The STUN's attribute.
+// - The error flag.
+func AttributeCreateUsername(in_packet *StunPacket, in_username string) (StunAttribute, error) {
+	var res StunAttribute
+	
+	if (len(in_username) > 512) {
+		return res, errors.New("User name is too long (more than 512 bytes!)")
+	}
+	return AttributeCreate(STUN_ATTRIBUT_USERNAME, []byte(in_username), in_packet)
+}
+
+// This function creates a "REALM" attribute.
+// RFC 5389: It MUST be a UTF-8 [RFC3629] encoded sequence of less than 128 characters (which can be as long as 763
+//           bytes).
+//
+// INPUT
+// - in_packet: pointer to the STUN packet.
+// - in_realm: the realm.
+//
+// OUTPUT
+// - The STUN's attribute.
+// - The error flag.
+func AttributeCreateRealm(in_packet *StunPacket, in_realm string) (StunAttribute, error) {
+	var res StunAttribute
+	
+	if (len(in_realm) > 763) {
+		return res, errors.New("Realm is too long (more than 763 bytes!)")
+	}
+	return AttributeCreate(STUN_ATTRIBUT_REALM, []byte(in_realm), in_packet)
+}
+
+// This function creates a "NONCE" attribute.
+// RFC 5389: It MUST be less than 128 characters (which can be as long as 763 bytes).
+//
+// INPUT
+// - in_packet: pointer to the STUN packet.
+// - in_nonce: the nonce, as given by the server.
+//
+// OUTPUT
+// - The STUN's attribute.
+// - The error flag.
+func AttributeCreateNonce(in_packet *StunPacket, in_nonce string) (StunAttribute, error) {
+	var res StunAttribute
+	
+	if (len(in_nonce) > 763) {
+		return res, errors.New("Nonce is too long (more than 763 bytes!)")
+	}
+	return AttributeCreate(STUN_ATTRIBUT_NONCE, []byte(in_nonce), in_packet)
+}
+
 /* ------------------------------------------------------------------------------------------------ */
 /* Get                                                                                              */
 /* ------------------------------------------------------------------------------------------------ */
@@ -456,6 +772,8 @@ func (v *StunAttribute) AttributeGetXorMappedAddress() (uint16, string, uint16,
 	var xored_ip []byte = make([]byte, 0, 16)
 	var xored_port uint16
 	
+	if (len(v.Value) < 4) { return 0, "", 0, "", 0, errors.New(fmt.Sprintf("Invalid address (% x).", v.Value)) }
+	
 	err = binary.Read(bytes.NewBuffer(v.Value[0:2]), binary.BigEndian, &family)
 	if (nil != err) { return 0, "", 0, "", 0, err }
 	
@@ -479,10 +797,11 @@ func (v *StunAttribute) AttributeGetXorMappedAddress() (uint16, string, uint16,
 		if (len(v.Value[4:]) != 16) {
 			return 0, "", 0, "", 0, errors.New(fmt.Sprintf("Invalid IPV6 address: % x", v.Value[4:]))
 		}
+		if (nil == v.Packet) { return 0, "", 0, "", 0, errors.New("Can not decode an IPV6 address: the transaction ID is unknown.") }
 		long_magic = append(long_magic, cookie...)
-		long_magic = append(long_magic, v.Packet.id[0:12]...)
+		long_magic = append(long_magic, v.Packet.GetId()...)
 		for i := 0; i<16; i++ {
-			xored_ip = append(xored_ip, v.Value[i+4] ^ cookie[i])
+			xored_ip = append(xored_ip, v.Value[i+4] ^ long_magic[i])
 		}
 	}
 	
@@ -504,19 +823,148 @@ func (v *StunAttribute) AttributeGetXorMappedAddress() (uint16, string, uint16,
 	return family, ip_string, port, xored_ip_string, xored_port, nil
 }
 
+// Given an attribute that represents a "XOR-PEER-ADDRESS", this function returns the (decoded) transport address.
+//
+// OUTPUT
+// - The address' family (1 for IPV4 or 2 for IPV6).
+// - The IP address.
+// - The port number.
+// - The error flag.
+func (v *StunAttribute) AttributeGetXorPeerAddress() (uint16, string, uint16, error) {
+	family, _, _, ip, port, err := v.AttributeGetXorMappedAddress()
+	return family, ip, port, err
+}
+
+// Given an attribute that represents a "XOR-RELAYED-ADDRESS", this function returns the (decoded) transport address.
+//
+// OUTPUT
+// - The address' family (1 for IPV4 or 2 for IPV6).
+// - The IP address.
+// - The port number.
+// - The error flag.
+func (v *StunAttribute) AttributeGetXorRelayedAddress() (uint16, string, uint16, error) {
+	family, _, _, ip, port, err := v.AttributeGetXorMappedAddress()
+	return family, ip, port, err
+}
+
 // Given an attribute that represents a "SOFTWARE" attribute, this function returns the name of the software.
 //
 // OUTPUT
 // - The name of the software.
 func (v *StunAttribute) AttributeGetSoftware() (string) {
-	for i:=0; i<len(v.Value); i++ {
-		r, size := utf8.DecodeRune(v.Value[i:])
+	value := v.__unpadded()
+	for i:=0; i<len(value); i++ {
+		r, size := utf8.DecodeRune(value[i:])
 		if (utf8.RuneError == r) {
 			return "Can not convert this list of bytes into a string. It is not UTF8 encoded."
 		}
 		i += size - 1
 	}
-	return string(v.Value)
+	return string(value)
+}
+
+// Given an attribute that contains a text ("USERNAME", "REALM" or "NONCE"), this function returns the text.
+// Unlike AttributeGetSoftware(), the value is returned as is: it must be sent back to the server unchanged.
+//
+// OUTPUT
+// - The text.
+func (v *StunAttribute) AttributeGetText() string {
+	return string(v.__unpadded())
+}
+
+// This function returns the value of an attribute which type is "ERROR-CODE".
+//
+// OUTPUT
+// - The error code (for example: 401).
+// - The reason phrase.
+// - The error flag.
+func (v *StunAttribute) AttributeGetErrorCode() (uint16, string, error) {
+	value := v.__unpadded()
+	
+	if (len(value) < 4) {
+		return 0, "", errors.New(fmt.Sprintf("Invalid error code (% x)", v.Value))
+	}
+	class  := uint16(value[2] & 0x07)
+	number := uint16(value[3])
+	if (class < 3) || (class > 6) || (number > 99) {
+		return 0, "", errors.New(fmt.Sprintf("Invalid error code (% x)", v.Value))
+	}
+	return class * 100 + number, string(value[4:]), nil
+}
+
+// This function returns the value of an attribute which type is "RESPONSE-PORT".
+//
+// OUTPUT
+// - The port number.
+// - The error flag.
+func (v *StunAttribute) AttributeGetResponsePort() (uint16, error) {
+	if (4 != len(v.Value)) {
+		return 0, errors.New(fmt.Sprintf("Invalid response port (% x)", v.Value))
+	}
+	return binary.BigEndian.Uint16(v.Value[0:2]), nil
+}
+
+// This function returns the value of an attribute which type is "LIFETIME".
+//
+// OUTPUT
+// - The number of seconds.
+// - The error flag.
+func (v *StunAttribute) AttributeGetLifetime() (uint32, error) {
+	if (4 != len(v.Value)) {
+		return 0, errors.New(fmt.Sprintf("Invalid lifetime (% x)", v.Value))
+	}
+	return binary.BigEndian.Uint32(v.Value), nil
+}
+
+// This function returns the value of an attribute which type is "CHANNEL-NUMBER".
+//
+// OUTPUT
+// - The channel number.
+// - The error flag.
+func (v *StunAttribute) AttributeGetChannelNumber() (uint16, error) {
+	if (4 != len(v.Value)) {
+		return 0, errors.New(fmt.Sprintf("Invalid channel number (% x)", v.Value))
+	}
+	return binary.BigEndian.Uint16(v.Value[0:2]), nil
+}
+
+// This function returns the value of an attribute which type is "DATA".
+//
+// OUTPUT
+// - The application data (without padding).
+func (v *StunAttribute) AttributeGetData() []byte {
+	return v.__unpadded()
+}
+
+// This function returns the value of an attribute which type is "REQUESTED-TRANSPORT".
+//
+// OUTPUT
+// - The IANA protocol number.
+// - The error flag.
+func (v *StunAttribute) AttributeGetRequestedTransport() (byte, error) {
+	if (4 != len(v.Value)) {
+		return 0, errors.New(fmt.Sprintf("Invalid requested transport (% x)", v.Value))
+	}
+	return v.Value[0], nil
+}
+
+// This function returns the value of an attribute which type is "UNKNOWN-ATTRIBUTES".
+//
+// OUTPUT
+// - The types of the attributes that were not understood.
+//   Please note that a type may be repeated (see RFC 3489).
+// - The error flag.
+func (v *StunAttribute) AttributeGetUnknownAttributes() ([]uint16, error) {
+	var res []uint16
+
+	value := v.__unpadded()
+	if (0 != len(value) % 2) {
+		return nil, errors.New(fmt.Sprintf("Invalid list of unknown attributes (% x)", value))
+	}
+	for i := 0; i < len(value); i += 2 {
+		res = append(res, binary.BigEndian.Uint16(value[i:i+2]))
+	}
+	return res, nil
 }
 
 // This function returns a 32-bit integer that represents the fingerprint.
@@ -546,7 +994,7 @@ func (v *StunAttribute) AttributeGetChangeRequest() (bool, bool, error) {
 	if (4 != len(v.Value)) {
 		return false, false, errors.New(fmt.Sprintf("Invalid change requested value (% x)", v.Value))
 	}
-	return (0x04 | v.Value[3]) != 0, (0x02 | v.Value[3]) != 0, nil
+	return (0x04 & v.Value[3]) != 0, (0x02 & v.Value[3]) != 0, nil
 }
 
 
@@ -561,9 +1009,11 @@ func (v *StunAttribute) AttributeGetChangeRequest() (bool, bool, error) {
 // - The flag that indicates whether the function can generate a textual representation of the attribute or not.
 func (v *StunAttribute) String() (string, bool) {
 
-	if (STUN_ATTRIBUT_MAPPED_ADDRESS  == v.Type ||
-	    STUN_ATTRIBUT_SOURCE_ADDRESS  == v.Type ||
-	    STUN_ATTRIBUT_CHANGED_ADDRESS == v.Type) {
+	if (STUN_ATTRIBUT_MAPPED_ADDRESS   == v.Type ||
+	    STUN_ATTRIBUT_SOURCE_ADDRESS   == v.Type ||
+	    STUN_ATTRIBUT_CHANGED_ADDRESS  == v.Type ||
+	    STUN_ATTRIBUT_OTHER_ADDRESS    == v.Type ||
+	    STUN_ATTRIBUT_RESPONSE_ORIGIN  == v.Type) {
 		family, ip, port, err := v.__getAddress()
 		if (nil != err) { return "This attribute is not valid.", true }
 		if (0x01 == family) {
@@ -574,7 +1024,9 @@ func (v *StunAttribute) String() (string, bool) {
 	}
 	
 	if (STUN_ATTRIBUT_XOR_MAPPED_ADDRESS     == v.Type ||
-	    STUN_ATTRIBUT_XOR_MAPPED_ADDRESS_EXP == v.Type) {
+	    STUN_ATTRIBUT_XOR_MAPPED_ADDRESS_EXP == v.Type ||
+	    STUN_ATTRIBUT_XOR_PEER_ADDRESS       == v.Type ||
+	    STUN_ATTRIBUT_XOR_RELAYED_ADDRESS    == v.Type) {
 		family, ip, port, xored_ip, xored_port, err := v.AttributeGetXorMappedAddress()
 		if (nil != err) { return "This attribute is not valid.", true }
 		if (0x01 == family) {
@@ -588,6 +1040,68 @@ func (v *StunAttribute) String() (string, bool) {
 		return v.AttributeGetSoftware(), true
 	}
 	
+	if (STUN_ATTRIBUT_RESPONSE_PORT == v.Type) {
+		port, err := v.AttributeGetResponsePort()
+		if (nil != err) {
+			return fmt.Sprintf("This attribute is not valid: %s", err), true
+		}
+		return fmt.Sprintf("%d", port), true
+	}
+	
+	if (STUN_ATTRIBUT_LIFETIME == v.Type) {
+		seconds, err := v.AttributeGetLifetime()
+		if (nil != err) {
+			return fmt.Sprintf("This attribute is not valid: %s", err), true
+		}
+		return fmt.Sprintf("%d s", seconds), true
+	}
+	
+	if (STUN_ATTRIBUT_CHANNEL_NUMBER == v.Type) {
+		number, err := v.AttributeGetChannelNumber()
+		if (nil != err) {
+			return fmt.Sprintf("This attribute is not valid: %s", err), true
+		}
+		return fmt.Sprintf("0x%04X", number), true
+	}
+	
+	if (STUN_ATTRIBUT_DATA == v.Type) {
+		return fmt.Sprintf("%d bytes", len(v.AttributeGetData())), true
+	}
+	
+	if (STUN_ATTRIBUT_REQUESTED_TRANSPORT == v.Type) {
+		protocol, err := v.AttributeGetRequestedTransport()
+		if (nil != err) {
+			return fmt.Sprintf("This attribute is not valid: %s", err), true
+		}
+		return fmt.Sprintf("%d", protocol), true
+	}
+	
+	if (STUN_ATTRIBUT_ERROR_CODE == v.Type) {
+		code, reason, err := v.AttributeGetErrorCode()
+		if (nil != err) {
+			return fmt.Sprintf("This attribute is not valid: %s", err), true
+		}
+		name, ok := error_names[code]
+		if (! ok) { name = "Unknown error" }
+		return fmt.Sprintf("%d %s (%s)", code, name, reason), true
+	}
+	
+	if (STUN_ATTRIBUT_UNKNOWN_ATTRIBUTES == v.Type) {
+		types, err := v.AttributeGetUnknownAttributes()
+		if (nil != err) {
+			return fmt.Sprintf("This attribute is not valid: %s", err), true
+		}
+		var names []string
+		for i := 0; i < len(types); i++ { names = append(names, fmt.Sprintf("0x%04x", types[i])) }
+		return strings.Join(names, " "), true
+	}
+	
+	if (STUN_ATTRIBUT_USERNAME == v.Type ||
+	    STUN_ATTRIBUT_REALM    == v.Type ||
+	    STUN_ATTRIBUT_NONCE    == v.Type) {
+		return fmt.Sprintf("\"%s\"", v.AttributeGetText()), true
+	}
+	
 	if (STUN_ATTRIBUT_FINGERPRINT == v.Type) {
 		crc, err := v.AttributeGetFingerprint()
 		if (nil != err) {
@@ -628,6 +1142,8 @@ func (v *StunAttribute) __getAddress() (uint16, string, uint16, error) {
 	var ip string
 	var err error
 	
+	if (len(v.Value) < 4) { return 0, "", 0, errors.New(fmt.Sprintf("Invalid address (% x).", v.Value)) }
+	
 	err = binary.Read(bytes.NewBuffer(v.Value[0:2]), binary.BigEndian, &family)
 	if (nil != err) { return 0, "", 0, err }
 	
@@ -640,6 +1156,96 @@ func (v *StunAttribute) __getAddress() (uint16, string, uint16, error) {
 	return family, ip, port, nil
 }
 
+// This function creates an attribute that represents an address (MAPPED-ADDRESS, OTHER-ADDRESS, RESPONSE-ORIGIN...).
+//
+// INPUT
+// - in_type: the attribute's type.
+// - in_packet: pointer to the STUN packet.
+// - in_ip: the IP address.
+// - in_port: the port number.
+//
+// OUTPUT
+// - The STUN's attribute.
+// - The error flag.
+func __createAddress(in_type uint16, in_packet *StunPacket, in_ip string, in_port uint16) (StunAttribute, error) {
+	var res StunAttribute
+	var family uint16 = STUN_ATTRIBUT_FAMILY_IPV4
+	
+	ip, err := tools.IpToBytes(in_ip)
+	if (nil != err) { return res, err }
+	if (16 == len(ip)) { family = STUN_ATTRIBUT_FAMILY_IPV6 }
+	
+	value := tools.Uint16toBytesMSF(family)
+	value  = append(value, tools.Uint16toBytesMSF(in_port)...)
+	value  = append(value, ip...)
+	return AttributeCreate(in_type, value, in_packet)
+}
+
+// This function creates an attribute that represents a "xored" address (XOR-MAPPED-ADDRESS, XOR-PEER-ADDRESS or
+// XOR-RELAYED-ADDRESS).
+// RFC 5389: X-Port is computed by taking the mapped port in host byte order, XOR'ing it with the most significant 16
+//           bits of the magic cookie [...]. If the IP address family is IPv4, X-Address is computed by taking the
+//           mapped IP address in host byte order, XOR'ing it with the magic cookie [...]. If the IP address family is
+//           IPv6, X-Address is computed by taking the mapped IP address in host byte order, XOR'ing it with the
+//           concatenation of the magic cookie and the 96-bit transaction ID [...].
+//
+// INPUT
+// - in_type: the attribute's type.
+// - in_packet: pointer to the STUN packet.
+// - in_ip: the IP address.
+// - in_port: the port number.
+//
+// OUTPUT
+// - The STUN's attribute.
+// - The error flag.
+func __createXorAddress(in_type uint16, in_packet *StunPacket, in_ip string, in_port uint16) (StunAttribute, error) {
+	var res StunAttribute
+	var family uint16 = STUN_ATTRIBUT_FAMILY_IPV4
+	
+	ip, err := tools.IpToBytes(in_ip)
+	if (nil != err) { return res, err }
+	if (16 == len(ip)) { family = STUN_ATTRIBUT_FAMILY_IPV6 }
+	
+	magic := tools.Uint16toBytesMSF(STUN_MAGIC_COOKIE >> 16)
+	magic  = append(magic, tools.Uint16toBytesMSF(STUN_MAGIC_COOKIE & 0xFFFF)...)
+	magic  = append(magic, in_packet.GetId()...)
+	
+	value := tools.Uint16toBytesMSF(family)
+	value  = append(value, tools.Uint16toBytesMSF(in_port ^ (STUN_MAGIC_COOKIE >> 16))...)
+	for i := range ip {
+		value = append(value, ip[i] ^ magic[i])
+	}
+	return AttributeCreate(in_type, value, in_packet)
+}
+
+// This function calculates the HMAC-SHA1 used by the attribute MESSAGE-INTEGRITY.
+//
+// INPUT
+// - in_bytes: the packet's header and the attributes preceding the MESSAGE-INTEGRITY attribute.
+//   Please note that the value of the length field is adjusted, so that it includes the MESSAGE-INTEGRITY attribute.
+//   The given slice is not modified.
+// - in_key: the key.
+//
+// OUTPUT
+// - The HMAC (20 bytes).
+func __hmac(in_bytes []byte, in_key []byte) []byte {
+	text := make([]byte, len(in_bytes), len(in_bytes))
+	copy(text, in_bytes)
+	copy(text[2:4], tools.Uint16toBytesMSF(uint16(len(in_bytes) - 20 + 24)))
+	mac := hmac.New(sha1.New, in_key)
+	mac.Write(text)
+	return mac.Sum(nil)
+}
+
+// This function returns the attribute's value, without the padding.
+//
+// OUTPUT
+// - The value.
+func (v *StunAttribute) __unpadded() []byte {
+	if (int(v.Length) > len(v.Value)) { return v.Value }
+	return v.Value[0:v.Length]
+}
+
 // The function calculates the STUN's fingerprint.
 // RFC 5389: The value of the attribute is computed as the CRC-32 of the STUN message
 //           up to (but excluding) the FINGERPRINT attribute itself, XOR'ed with
@@ -658,18 +1264,22 @@ func __stunCrc32(in_byte []byte) (uint32) {
 	return crc32.ChecksumIEEE(in_byte) ^ 0x5354554e
 }
 
-// This function adds zeros prior to a slice of bytes. The length of the resulting slice is a multiple of 4.
+// This function adds zeros after a slice of bytes. The length of the resulting slice is a multiple of 4.
 //
 // INPUT
 // - in_byte: the slice of bytes to padd.
 //
 // OUTPUT
 // - The padded slice.
+//
+// NOTE
+// The given slice is never modified: if padding is required, a new slice is allocated.
 func __padding(in_byte []byte) []byte {
 	rest := len(in_byte) % 4
 	if (0 == rest) { return in_byte }
-	padding := make([]byte, 4-rest, 4-rest)  // all zeros
-	return append(in_byte, padding...)
+	padded := make([]byte, len(in_byte) + 4 - rest, len(in_byte) + 4 - rest)  // padding is all zeros
+	copy(padded, in_byte)
+	return padded
 }
 
 // Given a value, this function calculates the next multiple of 4.
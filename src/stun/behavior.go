@@ -0,0 +1,364 @@
+// Copyright (C) 2012 Denis BEURIVE
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stun
+
+import "fmt"
+import "net"
+import "errors"
+import "context"
+import "tools"
+
+/* ------------------------------------------------------------------------------------------------ */
+/* NAT behavior discovery (RFC 5780).                                                               */
+/*                                                                                                  */
+/* RFC 3489 classifies NATs as "full cone", "restricted", "port restricted" or "symmetric". This    */
+/* classification mixes two independent behaviors: the mapping behavior (how the NAT allocates      */
+/* external transport addresses) and the filtering behavior (which incoming packets the NAT lets    */
+/* through). RFC 5780 determines these behaviors separately.                                        */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This type represents a mapping or a filtering behavior.
+type NatBehavior int
+
+// This value indicates that an error occurred.
+const STUN_BEHAVIOR_ERROR                       NatBehavior = -1
+
+// This value indicates that the client can not determine the behavior.
+const STUN_BEHAVIOR_UNKNOWN                     NatBehavior = 0
+
+// Mapping: the NAT reuses the mapping for all the destinations.
+// Filtering: the NAT lets through all the packets sent to the mapped address.
+const STUN_BEHAVIOR_ENDPOINT_INDEPENDENT        NatBehavior = 1
+
+// Mapping: the NAT reuses the mapping for all the destinations that share the same IP address.
+// Filtering: the NAT lets through the packets that come from an IP address the client sent packets to.
+const STUN_BEHAVIOR_ADDRESS_DEPENDENT           NatBehavior = 2
+
+// Mapping: the NAT reuses the mapping only for the same destination (IP address and port number).
+// Filtering: the NAT lets through the packets that come from a transport address the client sent packets to.
+const STUN_BEHAVIOR_ADDRESS_AND_PORT_DEPENDENT  NatBehavior = 3
+
+// This map associates a behavior with its name.
+// Note: These names are used for textual serialization. They must not be changed.
+var nat_behavior_names = map[NatBehavior] string {
+	STUN_BEHAVIOR_ERROR:                         "ERROR",
+	STUN_BEHAVIOR_UNKNOWN:                       "UNKNOWN",
+	STUN_BEHAVIOR_ENDPOINT_INDEPENDENT:          "ENDPOINT_INDEPENDENT",
+	STUN_BEHAVIOR_ADDRESS_DEPENDENT:             "ADDRESS_DEPENDENT",
+	STUN_BEHAVIOR_ADDRESS_AND_PORT_DEPENDENT:    "ADDRESS_AND_PORT_DEPENDENT",
+}
+
+// This type represents the result of the behavior discovery process.
+// Transport addresses are written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6). Empty strings mean "unknown".
+type BehaviorResult struct {
+	// The mapping behavior.
+	Mapping NatBehavior
+	// The filtering behavior.
+	Filtering NatBehavior
+	// This flag indicates that the server did not answer the first request (UDP is blocked).
+	Blocked bool
+	// This flag indicates that the mapped address is the local address (the client is not behind a NAT).
+	NoNat bool
+	// The local transport address of the client's socket.
+	LocalAddress string
+	// The mapped transport address given by the server (XOR-MAPPED-ADDRESS or MAPPED-ADDRESS).
+	MappedAddress string
+	// The transport address given by the attribute "OTHER-ADDRESS".
+	OtherAddress string
+	// The transport address given by the attribute "RESPONSE-ORIGIN".
+	ResponseOrigin string
+	// The tests performed, in chronological order.
+	Tests []DiscoveryTest
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* API                                                                                              */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function returns the name of the behavior.
+//
+// OUTPUT
+// - The name of the behavior.
+func (v NatBehavior) String() string {
+	name, ok := nat_behavior_names[v]
+	if (! ok) { return fmt.Sprintf("NatBehavior(%d)", int(v)) }
+	return name
+}
+
+// This function returns the textual representation of the behavior.
+// It implements the interface "encoding.TextMarshaler".
+//
+// OUTPUT
+// - The textual representation.
+// - The error flag.
+func (v NatBehavior) MarshalText() ([]byte, error) {
+	name, ok := nat_behavior_names[v]
+	if (! ok) { return nil, errors.New(fmt.Sprintf("Invalid NAT behavior (%d).", int(v))) }
+	return []byte(name), nil
+}
+
+// This function sets the behavior from its textual representation.
+// It implements the interface "encoding.TextUnmarshaler".
+//
+// INPUT
+// - in_text: the textual representation.
+//
+// OUTPUT
+// - The error flag.
+func (v *NatBehavior) UnmarshalText(in_text []byte) error {
+	for b, name := range nat_behavior_names {
+		if (name == string(in_text)) {
+			*v = b
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("Invalid NAT behavior \"%s\".", in_text))
+}
+
+// This function discovers the mapping behavior and the filtering behavior of the NAT, as described by RFC 5780
+// (sections 4.3 and 4.4).
+// The server must support RFC 5780: its responses must contain the attribute OTHER-ADDRESS, and it must honor
+// CHANGE-REQUEST.
+//
+// INPUT
+// - in_ctx: the context. It can be used to cancel the discovery process.
+//
+// OUTPUT
+// - The result of the discovery process.
+// - The error flag.
+//
+// WARNING
+// RFC 5780 servers are RFC 5389 servers. STUN should be configured to be compliant with RFC 5389 (see SetRfc5389()).
+func (v *Client) ClientDiscoverBehavior(in_ctx context.Context) (BehaviorResult, error) {
+	var result BehaviorResult
+	var err error
+	var found bool
+	var other_ip, origin_ip string
+	var other_port, origin_port uint16
+	var response requestResponse
+
+	result.LocalAddress = v.transport_local
+	result.Mapping      = STUN_BEHAVIOR_UNKNOWN
+	result.Filtering    = STUN_BEHAVIOR_UNKNOWN
+
+	// RFC 5780: The client sends a Binding Request to the server, without any CHANGE-REQUEST flags set. The server
+	//           returns the mapped address, and the alternate address in OTHER-ADDRESS.
+	if verbosity > 0 { tools.AddText(output, "Test I\n") }
+	response, result.MappedAddress, err = v.__behaviorBinding(in_ctx, &result, "Test I", nil)
+	if (nil != err) { return result.__error(err) }
+	if (! response.response) {
+		if verbosity > 0 { tools.AddText(output, fmt.Sprintf("% -25s: %s", "Conclusion", "UDP is blocked.")) }
+		result.Blocked = true
+		return result, nil
+	}
+
+	found, _, other_ip, other_port, err = response.packet.GetOtherAddress()
+	if (nil != err) { return result.__error(err) }
+	if (! found) { return result.__error(errors.New("The server does not support RFC 5780: the response does not contain any OTHER-ADDRESS attribute.")) }
+	result.OtherAddress, err = tools.MakeTransportAddress(other_ip, int(other_port))
+	if (nil != err) { return result.__error(err) }
+
+	found, _, origin_ip, origin_port, err = response.packet.GetResponseOrigin()
+	if (nil != err) { return result.__error(err) }
+	if (found) {
+		result.ResponseOrigin, err = tools.MakeTransportAddress(origin_ip, int(origin_port))
+		if (nil != err) { return result.__error(err) }
+	}
+
+	// Please note that the filtering tests are performed first. Indeed, the mapping tests send packets to the
+	// alternate address, which would open the NAT's filter for the responses to the filtering tests.
+	result.Filtering, err = v.__discoverFiltering(in_ctx, &result)
+	if (nil != err) { return result.__error(err) }
+
+	result.Mapping, err = v.__discoverMapping(in_ctx, &result, other_ip)
+	if (nil != err) { return result.__error(err) }
+
+	if verbosity > 0 {
+		tools.AddText(output, fmt.Sprintf("% -25s: %s", "Mapping",   result.Mapping))
+		tools.AddText(output, fmt.Sprintf("% -25s: %s", "Filtering", result.Filtering))
+	}
+	return result, nil
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Privates                                                                                         */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function determines the mapping behavior.
+// RFC 5780, section 4.3.
+//
+// INPUT
+// - in_ctx: the context.
+// - out_result: the result of the discovery process. Test I must have been performed.
+// - in_other_ip: the IP address given by the attribute "OTHER-ADDRESS".
+//
+// OUTPUT
+// - The mapping behavior.
+// - The error flag.
+func (v *Client) __discoverMapping(in_ctx context.Context, out_result *BehaviorResult, in_other_ip string) (NatBehavior, error) {
+	var err error
+	var server *net.UDPAddr
+	var response requestResponse
+	var destination, mapped2, mapped3 string
+
+	// RFC 5780: If the XOR-MAPPED-ADDRESS is equal to the local address, then the client is not behind a NAT.
+	if (out_result.MappedAddress == v.transport_local) {
+		out_result.NoNat = true
+		return STUN_BEHAVIOR_ENDPOINT_INDEPENDENT, nil
+	}
+
+	// RFC 5780: [Test II] the client sends a Binding Request to the alternate address, but primary port. If the
+	//           XOR-MAPPED-ADDRESS in the Binding Response is the same as test I the NAT currently has
+	//           Endpoint-Independent Mapping.
+	server, err = net.ResolveUDPAddr("udp", v.server_transport_address)
+	if (nil != err) { return STUN_BEHAVIOR_ERROR, err }
+	destination, err = tools.MakeTransportAddress(in_other_ip, server.Port)
+	if (nil != err) { return STUN_BEHAVIOR_ERROR, err }
+
+	if verbosity > 0 { tools.AddText(output, "Mapping test II\n") }
+	response, mapped2, err = v.__behaviorBinding(in_ctx, out_result, "Mapping test II", &destination)
+	if (nil != err) { return STUN_BEHAVIOR_ERROR, err }
+	if (! response.response) { return STUN_BEHAVIOR_UNKNOWN, nil }
+	if (mapped2 == out_result.MappedAddress) { return STUN_BEHAVIOR_ENDPOINT_INDEPENDENT, nil }
+
+	// RFC 5780: [Test III] the client sends a Binding Request to the alternate address and port. If the
+	//           XOR-MAPPED-ADDRESS matches test II, the NAT currently has Address-Dependent Mapping; if it doesn't
+	//           match it currently has Address and Port-Dependent Mapping.
+	if verbosity > 0 { tools.AddText(output, "Mapping test III\n") }
+	destination = out_result.OtherAddress
+	response, mapped3, err = v.__behaviorBinding(in_ctx, out_result, "Mapping test III", &destination)
+	if (nil != err) { return STUN_BEHAVIOR_ERROR, err }
+	if (! response.response) { return STUN_BEHAVIOR_UNKNOWN, nil }
+	if (mapped3 == mapped2) { return STUN_BEHAVIOR_ADDRESS_DEPENDENT, nil }
+	return STUN_BEHAVIOR_ADDRESS_AND_PORT_DEPENDENT, nil
+}
+
+// This function determines the filtering behavior.
+// RFC 5780, section 4.4.
+//
+// INPUT
+// - in_ctx: the context.
+// - out_result: the result of the discovery process. Test I must have been performed.
+//
+// OUTPUT
+// - The filtering behavior.
+// - The error flag.
+func (v *Client) __discoverFiltering(in_ctx context.Context, out_result *BehaviorResult) (NatBehavior, error) {
+	var err error
+	var response requestResponse
+
+	// RFC 5780: [Test II] the client sends a binding request to the primary address of the server with the "change
+	//           IP" and "change port" flags set in the CHANGE-REQUEST attribute. If the client receives a response,
+	//           the NAT currently has Endpoint-Independent Filtering.
+	if verbosity > 0 { tools.AddText(output, "Filtering test II\n") }
+	response, err = v.ClientSendChangeRequest(in_ctx, true)
+	out_result.Tests = append(out_result.Tests, __discoveryTest("Filtering test II", response))
+	if (nil != err) { return STUN_BEHAVIOR_ERROR, err }
+	if (response.response) {
+		err = out_result.__checkOrigin(response)
+		if (nil != err) { return STUN_BEHAVIOR_ERROR, err }
+		return STUN_BEHAVIOR_ENDPOINT_INDEPENDENT, nil
+	}
+
+	// RFC 5780: [Test III] the client sends a binding request to the original server address with CHANGE-REQUEST
+	//           set to change port only. If the client receives a response, the NAT currently has Address-Dependent
+	//           Filtering; if no response is received, the NAT currently has Address and Port-Dependent Filtering.
+	if verbosity > 0 { tools.AddText(output, "Filtering test III\n") }
+	response, err = v.ClientSendChangeRequest(in_ctx, false)
+	out_result.Tests = append(out_result.Tests, __discoveryTest("Filtering test III", response))
+	if (nil != err) { return STUN_BEHAVIOR_ERROR, err }
+	if (response.response) {
+		err = out_result.__checkOrigin(response)
+		if (nil != err) { return STUN_BEHAVIOR_ERROR, err }
+		return STUN_BEHAVIOR_ADDRESS_DEPENDENT, nil
+	}
+	return STUN_BEHAVIOR_ADDRESS_AND_PORT_DEPENDENT, nil
+}
+
+// This function sends a BINDING request, records the test and extracts the mapped address from the response.
+//
+// INPUT
+// - in_ctx: the context.
+// - out_result: the result of the discovery process.
+// - in_name: the name of the test.
+// - in_destination_address: the transport address of the request's destination (nil for the server's address).
+//
+// OUTPUT
+// - The response.
+// - The mapped address ("" if no response has been received).
+// - The error flag.
+func (v *Client) __behaviorBinding(in_ctx context.Context, out_result *BehaviorResult, in_name string, in_destination_address *string) (requestResponse, string, error) {
+	response, err := v.ClientSendBinding(in_ctx, in_destination_address)
+	out_result.Tests = append(out_result.Tests, __discoveryTest(in_name, response))
+	if (nil != err) || (! response.response) { return response, "", err }
+	mapped, err := __mappedAddress(response.packet)
+	if (nil != err) { return response, "", err }
+	if verbosity > 0 { tools.AddText(output, fmt.Sprintf("% -25s: %s", "Mapped address", mapped)) }
+	return response, mapped, nil
+}
+
+// This function checks that the server honored the CHANGE-REQUEST attribute.
+// If the response contains the attribute RESPONSE-ORIGIN, then it must differ from the one of test I.
+//
+// INPUT
+// - in_response: the response to the CHANGE-REQUEST request.
+//
+// OUTPUT
+// - The error flag.
+func (v *BehaviorResult) __checkOrigin(in_response requestResponse) error {
+	found, _, ip, port, err := in_response.packet.GetResponseOrigin()
+	if (nil != err) || (! found) || ("" == v.ResponseOrigin) { return err }
+	origin, err := tools.MakeTransportAddress(ip, int(port))
+	if (nil != err) { return err }
+	if (origin == v.ResponseOrigin) {
+		return errors.New(fmt.Sprintf("The server did not honor CHANGE-REQUEST: the response comes from %s.", origin))
+	}
+	return nil
+}
+
+// This function sets the result of the discovery process in case of error.
+//
+// INPUT
+// - in_err: the error.
+//
+// OUTPUT
+// - The result of the discovery process.
+// - The error.
+func (v *BehaviorResult) __error(in_err error) (BehaviorResult, error) {
+	if (STUN_BEHAVIOR_UNKNOWN == v.Mapping)   { v.Mapping   = STUN_BEHAVIOR_ERROR }
+	if (STUN_BEHAVIOR_UNKNOWN == v.Filtering) { v.Filtering = STUN_BEHAVIOR_ERROR }
+	return *v, in_err
+}
+
+// This function extracts the mapped address from a response.
+// The attribute XOR-MAPPED-ADDRESS is preferred. If it is not present, then the attribute MAPPED-ADDRESS is used.
+//
+// INPUT
+// - in_packet: the response.
+//
+// OUTPUT
+// - The mapped address.
+// - The error flag. An error is returned if the response does not contain any mapped address.
+func __mappedAddress(in_packet StunPacket) (string, error) {
+	found, _, ip, port, err := in_packet.GetXorMappedAddress()
+	if (nil != err) { return "", err }
+	if (! found) {
+		found, _, ip, port, err = in_packet.GetMappedAddress()
+		if (nil != err) { return "", err }
+		if (! found) { return "", errors.New("The response does not contain any mapped address.") }
+	}
+	return tools.MakeTransportAddress(ip, int(port))
+}
@@ -0,0 +1,210 @@
+// Copyright (C) 2012 Denis BEURIVE
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stun
+
+import "fmt"
+import "errors"
+import "encoding/binary"
+
+/* ------------------------------------------------------------------------------------------------ */
+/* ChannelData messages (RFC 5766).                                                                 */
+/* A ChannelData message carries application data between a TURN client and a TURN server, over a   */
+/* channel. It is not a STUN message: it only has a 4-byte header (channel number and length).     */
+/* ChannelData messages and STUN messages are sent on the same socket. They are told apart by the   */
+/* first two bits.                                                                                  */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This type represents the kind of a message received on a socket shared by STUN and ChannelData.
+type MessageKind int
+
+// This value indicates that the message is neither a STUN message nor a ChannelData message.
+const STUN_MESSAGE_UNKNOWN      MessageKind = 0
+
+// This value indicates that the message is a STUN message.
+const STUN_MESSAGE_STUN         MessageKind = 1
+
+// This value indicates that the message is a ChannelData message.
+const STUN_MESSAGE_CHANNEL_DATA MessageKind = 2
+
+// This map associates a kind of message with its name.
+var message_kind_names = map[MessageKind] string {
+	STUN_MESSAGE_UNKNOWN:         "UNKNOWN",
+	STUN_MESSAGE_STUN:            "STUN",
+	STUN_MESSAGE_CHANNEL_DATA:    "CHANNEL_DATA",
+}
+
+// The size of the ChannelData header.
+const STUN_CHANNEL_DATA_HEADER_SIZE = 4
+
+// This type represents a ChannelData message.
+type ChannelData struct {
+	// The channel number (between STUN_CHANNEL_MIN and STUN_CHANNEL_MAX).
+	Number uint16
+	// The application data.
+	Data []byte
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* API                                                                                              */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function returns the name of the kind of message.
+// It implements the interface "fmt.Stringer".
+//
+// OUTPUT
+// - The name.
+func (v MessageKind) String() string {
+	name, ok := message_kind_names[v]
+	if (! ok) { return fmt.Sprintf("MessageKind(%d)", int(v)) }
+	return name
+}
+
+// This function tells whether a sequence of bytes is a STUN message or a ChannelData message.
+// Only the first byte is examined: the message is not validated (see FromBytes() and ChannelDataFromBytes()).
+// RFC 5766: The first two bits of a ChannelData message are 0b01, thus allowing the ChannelData message to be
+//           distinguished from STUN messages (which have 0b00 in the first two bits).
+//
+// INPUT
+// - in_bin: the sequence of bytes.
+//
+// OUTPUT
+// - The kind of message.
+func Demultiplex(in_bin []byte) MessageKind {
+	if (0 == len(in_bin)) { return STUN_MESSAGE_UNKNOWN }
+	switch (in_bin[0] & 0xC0) {
+		case 0x00:
+			return STUN_MESSAGE_STUN
+		case 0x40:
+			return STUN_MESSAGE_CHANNEL_DATA
+	}
+	return STUN_MESSAGE_UNKNOWN
+}
+
+// This function returns the size of a message, given its first 4 bytes.
+// This is useful to split a stream (TCP) into messages.
+//
+// INPUT
+// - in_header: the first 4 bytes (at least) of the message.
+// - in_padding: this flag indicates whether the ChannelData messages are padded (TCP) or not (UDP).
+//
+// OUTPUT
+// - The size of the message (header included), in bytes.
+// - The error flag.
+func MessageSize(in_header []byte, in_padding bool) (int, error) {
+	if (len(in_header) < STUN_CHANNEL_DATA_HEADER_SIZE) { return 0, errors.New(fmt.Sprintf("The header is too short (%d bytes).", len(in_header))) }
+	length := int(binary.BigEndian.Uint16(in_header[2:4]))
+	switch (Demultiplex(in_header)) {
+		case STUN_MESSAGE_STUN:
+			return 20 + length, nil
+		case STUN_MESSAGE_CHANNEL_DATA:
+			if (in_padding) { length = __channelDataPadded(length) }
+			return STUN_CHANNEL_DATA_HEADER_SIZE + length, nil
+	}
+	return 0, errors.New(fmt.Sprintf("The message is neither a STUN message nor a ChannelData message (first byte: 0x%02X).", in_header[0]))
+}
+
+// This function creates a ChannelData message.
+//
+// INPUT
+// - in_number: the channel number (between STUN_CHANNEL_MIN and STUN_CHANNEL_MAX).
+// - in_data: the application data.
+//
+// OUTPUT
+// - The ChannelData message.
+// - The error flag.
+func ChannelDataCreate(in_number uint16, in_data []byte) (ChannelData, error) {
+	var res ChannelData
+
+	if (in_number < STUN_CHANNEL_MIN) || (in_number > STUN_CHANNEL_MAX) { return res, errors.New(fmt.Sprintf("Invalid channel number 0x%04X.", in_number)) }
+	if (len(in_data) > 65535) { return res, errors.New(fmt.Sprintf("The application data is too long (%d bytes).", len(in_data))) }
+	res.Number = in_number
+	res.Data   = in_data
+	return res, nil
+}
+
+// This function creates a sequence of bytes from a ChannelData message, that can be sent to the network.
+// RFC 5766: Over TCP and TLS-over-TCP, the ChannelData message MUST be padded to a multiple of four bytes in order to
+//           ensure the alignment of subsequent messages. [...] Over UDP, the padding is not required but MAY be
+//           included.
+//
+// INPUT
+// - in_padding: this flag indicates whether the message must be padded (TCP) or not (UDP).
+//
+// OUTPUT
+// - The sequence of bytes.
+//
+// WARNING
+// The message must be valid (see ChannelDataCreate()).
+func (v *ChannelData) ToBytes(in_padding bool) []byte {
+	data := v.Data
+	if (in_padding) { data = __padding(data) }
+	res := make([]byte, STUN_CHANNEL_DATA_HEADER_SIZE + len(data))
+	binary.BigEndian.PutUint16(res[0:2], v.Number)
+	binary.BigEndian.PutUint16(res[2:4], uint16(len(v.Data)))
+	copy(res[STUN_CHANNEL_DATA_HEADER_SIZE:], data)
+	return res
+}
+
+// This function converts a sequence of bytes into a ChannelData message.
+// The sequence of bytes is considered untrusted: it is fully validated, and the function never panics.
+// The message may be padded.
+//
+// INPUT
+// - in_bin: the sequence of bytes.
+//
+// OUTPUT
+// - The ChannelData message. The application data is a copy.
+// - The error flag. If the sequence of bytes is not a valid ChannelData message, then the error flag is a pointer to
+//   a DecodeError.
+func ChannelDataFromBytes(in_bin []byte) (ChannelData, error) {
+	var res ChannelData
+
+	if (len(in_bin) < STUN_CHANNEL_DATA_HEADER_SIZE) {
+		return res, __decodeError(STUN_DECODE_ERROR_SIZE, 0, fmt.Sprintf("only %d bytes, the ChannelData header is 4 bytes long", len(in_bin)))
+	}
+	number := binary.BigEndian.Uint16(in_bin[0:2])
+	if (number < STUN_CHANNEL_MIN) || (number > STUN_CHANNEL_MAX) {
+		return res, __decodeError(STUN_DECODE_ERROR_CHANNEL, 0, fmt.Sprintf("invalid channel number 0x%04X", number))
+	}
+	length    := int(binary.BigEndian.Uint16(in_bin[2:4]))
+	available := len(in_bin) - STUN_CHANNEL_DATA_HEADER_SIZE
+	if (length > available) {
+		return res, __decodeError(STUN_DECODE_ERROR_LENGTH, 2, fmt.Sprintf("the length (%d) exceeds the size of the datagram (%d bytes of data)", length, available))
+	}
+	if (available > __channelDataPadded(length)) {
+		return res, __decodeError(STUN_DECODE_ERROR_PADDING, STUN_CHANNEL_DATA_HEADER_SIZE + length, fmt.Sprintf("%d bytes follow the application data (%d bytes)", available - length, length))
+	}
+	res.Number = number
+	res.Data   = make([]byte, length)
+	copy(res.Data, in_bin[STUN_CHANNEL_DATA_HEADER_SIZE:])
+	return res, nil
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Privates                                                                                         */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function returns the length of the application data, once padded.
+// Note: the length of the application data may be 65535, so the padded length does not fit into 16 bits.
+//
+// INPUT
+// - in_length: the length of the application data.
+//
+// OUTPUT
+// - The next multiple of 4.
+func __channelDataPadded(in_length int) int {
+	return (in_length + 3) &^ 3
+}
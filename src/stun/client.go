@@ -17,42 +17,83 @@ package stun
 
 import "fmt"
 import "net"
-// import "errors"
+import "bytes"
+import "errors"
+import "context"
+import "time"
 import "tools"
 
-var client_initialized bool = false
-var server_transport_address string
-
 /* ------------------------------------------------------------------------------------------------ */
 /* Return values for the discobery process.                                                         */
 /* ------------------------------------------------------------------------------------------------ */
 
+// This type represents the type of NAT discovered by the discovery process.
+type NatType int
+
 // This value indicates that an error occurred.
-const STUN_NAT_ERROR                 = -1
+const STUN_NAT_ERROR                 NatType = -1
 
 // This value indicates that UDP is blocked.
-const STUN_NAT_BLOCKED               = 0
+const STUN_NAT_BLOCKED               NatType = 0
 
 // This value indicates that the client can not determine the NAT's type.
-const STUN_NAT_UNKNOWN               = 1
+const STUN_NAT_UNKNOWN               NatType = 1
 
 // This value indicates that the client is behind a full cone NAT.
-const STUN_NAT_FULL_CONE             = 2
+const STUN_NAT_FULL_CONE             NatType = 2
 
 // This value indicates that the client is behind a symetric NAT.
-const STUN_NAT_SYMETRIC              = 3
+const STUN_NAT_SYMETRIC              NatType = 3
 
 // This value indicates that the client is behind a restricted NAT.
-const STUN_NAT_RESTRICTED            = 4
+const STUN_NAT_RESTRICTED            NatType = 4
 
 // This value indicates that the client is behind a port restricted NAT.
-const STUN_NAT_PORT_RESTRICTED       = 5
+const STUN_NAT_PORT_RESTRICTED       NatType = 5
 
 // This value indicates that the client is not behind a NAT.
-const STUN_NAT_NO_NAT                = 6
+const STUN_NAT_NO_NAT                NatType = 6
 
 // This value indicates that the client is behind a symetric UDP firewall.
-const STUN_NAT_SYMETRIC_UDP_FIREWALL = 7
+const STUN_NAT_SYMETRIC_UDP_FIREWALL NatType = 7
+
+// This map associates a NAT's type with its name.
+// Note: These names are used for textual serialization. They must not be changed.
+var nat_type_names = map[NatType] string {
+	STUN_NAT_ERROR:                    "ERROR",
+	STUN_NAT_BLOCKED:                  "BLOCKED",
+	STUN_NAT_UNKNOWN:                  "UNKNOWN",
+	STUN_NAT_FULL_CONE:                "FULL_CONE",
+	STUN_NAT_SYMETRIC:                 "SYMMETRIC",
+	STUN_NAT_RESTRICTED:               "RESTRICTED",
+	STUN_NAT_PORT_RESTRICTED:          "PORT_RESTRICTED",
+	STUN_NAT_NO_NAT:                   "NO_NAT",
+	STUN_NAT_SYMETRIC_UDP_FIREWALL:    "SYMMETRIC_UDP_FIREWALL",
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Client.                                                                                          */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This type represents a STUN client.
+// A client owns a single UDP socket, bound for the client's lifetime.
+// All the requests sent by the client are sent from this socket. Therefore, all the tests of the discovery process are
+// performed from the same local transport address.
+type Client struct {
+	// The UDP socket used to send requests and to receive responses.
+	// Please note that the socket is not "connected": responses may come from any transport address (see CHANGE-REQUEST).
+	connection net.PacketConn
+	// The transport address of the server.
+	// This value is written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+	server_transport_address string
+	// The local transport address of the socket.
+	// This value is written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+	transport_local string
+	// The retransmission policy used for all the requests.
+	policy RetransmitPolicy
+	// The long-term credentials (nil if the server does not require authentication).
+	credentials *credentials
+}
 
 /* ------------------------------------------------------------------------------------------------ */
 /* Value types for the test functions.                                                              */
@@ -72,6 +113,17 @@ type requestResponse struct {
 	transport_local string
 	// Error detected wile waiting for a response.
 	err error
+	// The transaction ID of the request.
+	// If a response has been received, then its transaction ID is identical.
+	transaction_id []byte
+	// The transport address of the request's destination.
+	destination string
+	// The request, as sent to the network.
+	raw_request []byte
+	// The response, as received from the network.
+	raw_response []byte
+	// The round trip time, if a response has been received.
+	rtt time.Duration
 }
 
 // This type represents the specific information returned by test I.
@@ -86,6 +138,13 @@ type test1Info struct {
 	changed_port uint16 
 	// This flag indicates wether the local IP address id equal to the mapped one, or not.
 	identical bool 
+	// The transport address given by the attribute "MAPPED-ADDRESS" ("" if none).
+	mapped_address string
+	// The transport address given by the attribute "XOR-MAPPED-ADDRESS" ("" if none).
+	xor_mapped_address string
+	// The mapped transport address used for comparisons.
+	// This is the XORED mapped address, if given by the server. Otherwise, this is the mapped address.
+	transport_mapped string
 }
 
 // This type represents the specific information returned by test II.
@@ -111,42 +170,245 @@ type testResponse struct {
 	extra interface{}
 }
 
+/* ------------------------------------------------------------------------------------------------ */
+/* Value types for the discovery process.                                                           */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This type represents a test performed during the discovery process.
+type DiscoveryTest struct {
+	// The name of the test ("Test I", "Test II", "Test I(b)", "Test III", "Hairpinning (binding)" or "Hairpinning").
+	Name string
+	// The transport address of the request's destination.
+	// This value is written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+	Destination string
+	// This flag indicates whether a response has been received or not.
+	Answered bool
+	// The round trip time, if a response has been received.
+	// It is measured from the last transmission of the request.
+	Rtt time.Duration
+	// The transaction ID of the request.
+	TransactionId []byte
+	// The request, as sent to the network.
+	Request []byte
+	// The response, as received from the network (nil if no response has been received).
+	Response []byte
+}
+
+// This type represents the result of the discovery process.
+// Transport addresses are written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6). Empty strings mean "unknown".
+type DiscoveryResult struct {
+	// The type of NAT.
+	NatType NatType
+	// The local transport address of the client's socket.
+	LocalAddress string
+	// The transport address given by the attribute "MAPPED-ADDRESS" (test I).
+	MappedAddress string
+	// The transport address given by the attribute "XOR-MAPPED-ADDRESS" (test I).
+	XorMappedAddress string
+	// The transport address given by the attribute "CHANGED-ADDRESS" (test I).
+	ChangedAddress string
+	// This value indicates whether the NAT supports hairpinning or not.
+	// Hairpinning is tested only if the client is behind a NAT. Otherwise, the value is STUN_HAIRPINNING_UNKNOWN.
+	Hairpinning Hairpinning
+	// The tests performed, in chronological order.
+	Tests []DiscoveryTest
+}
+
 /* ------------------------------------------------------------------------------------------------ */
 /* API                                                                                              */
 /* ------------------------------------------------------------------------------------------------ */
 
+// This function returns the name of the NAT's type.
+//
+// OUTPUT
+// - The name of the NAT's type.
+func (v NatType) String() string {
+	name, ok := nat_type_names[v]
+	if (! ok) { return fmt.Sprintf("NatType(%d)", int(v)) }
+	return name
+}
+
+// This function returns the textual representation of the NAT's type.
+// It implements the interface "encoding.TextMarshaler".
+//
+// OUTPUT
+// - The textual representation.
+// - The error flag.
+func (v NatType) MarshalText() ([]byte, error) {
+	name, ok := nat_type_names[v]
+	if (! ok) { return nil, errors.New(fmt.Sprintf("Invalid NAT type (%d).", int(v))) }
+	return []byte(name), nil
+}
+
+// This function sets the NAT's type from its textual representation.
+// It implements the interface "encoding.TextUnmarshaler".
+//
+// INPUT
+// - in_text: the textual representation.
+//
+// OUTPUT
+// - The error flag.
+func (v *NatType) UnmarshalText(in_text []byte) error {
+	for t, name := range nat_type_names {
+		if (name == string(in_text)) {
+			*v = t
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("Invalid NAT type \"%s\".", in_text))
+}
+
+// This function records a test in the result of the discovery process.
+//
+// INPUT
+// - in_name: the name of the test.
+// - in_response: the response to the test.
+func (v *DiscoveryResult) __addTest(in_name string, in_response testResponse) {
+	v.Tests = append(v.Tests, __discoveryTest(in_name, in_response.request))
+}
+
+// This function creates the description of a test, from the response to the test's request.
+//
+// INPUT
+// - in_name: the name of the test.
+// - in_response: the response to the request.
+//
+// OUTPUT
+// - The description of the test.
+func __discoveryTest(in_name string, in_response requestResponse) DiscoveryTest {
+	var test DiscoveryTest
+	test.Name          = in_name
+	test.Destination   = in_response.destination
+	test.Answered      = in_response.response
+	test.Rtt           = in_response.rtt
+	test.TransactionId = in_response.transaction_id
+	test.Request       = in_response.raw_request
+	test.Response      = in_response.raw_response
+	return test
+}
+
 // Initialize the information returned by a request.
 func (v *requestResponse) init() {
 	v.response = false
 	v.err = nil
+	v.transaction_id = nil
+	v.raw_request = nil
+	v.raw_response = nil
+	v.rtt = 0
+}
+
+// This function returns the transaction ID of the request.
+// It can be used to correlate logs with the packets exchanged with the server.
+//
+// OUTPUT
+// - The transaction ID (12 bytes).
+func (v *requestResponse) GetTransactionId() []byte {
+	return v.transaction_id
 }
 
-// This function opens a UDP connection.
+// This function creates a client and opens its UDP socket.
+// The socket is bound to the local IP address used to reach the server, and to a port number chosen by the system.
+// It remains open until the client is closed.
 //
 // INPUT
 // - in_server: transport address of the server.
 //   This value should be written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
-func ClientInit(in_server string) {
-	server_transport_address = in_server
-	client_initialized       = true
+//
+// OUTPUT
+// - The client.
+// - The error flag.
+func ClientCreate(in_server string) (*Client, error) {
+	var err error
+	var server *net.UDPAddr
+	var probe *net.UDPConn
+	var connection *net.UDPConn
+	var client Client
+
+	server, err = net.ResolveUDPAddr("udp", in_server)
+	if (nil != err) { return nil, err }
+
+	// Find out the local IP address used to reach the server.
+	// Note: "connecting" a UDP socket does not send anything to the network.
+	probe, err = net.DialUDP("udp", nil, server)
+	if (nil != err) { return nil, err }
+	local := probe.LocalAddr().(*net.UDPAddr)
+	err = probe.Close()
+	if (nil != err) { return nil, err }
+
+	// Open the socket used for all the requests.
+	connection, err = net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Port: 0})
+	if (nil != err) { return nil, err }
+
+	client.connection               = connection
+	client.server_transport_address = in_server
+	client.transport_local          = connection.LocalAddr().String()
+	client.policy                   = RetransmitPolicyRfc3489()
+	return &client, nil
 }
 
+// This function sets the retransmission policy used by the client.
+// By default, the client uses the policy described by RFC 3489.
+//
+// INPUT
+// - in_policy: the retransmission policy.
+//
+// OUTPUT
+// - The error flag.
+func (v *Client) SetRetransmitPolicy(in_policy RetransmitPolicy) error {
+	err := in_policy.Check()
+	if (nil != err) { return err }
+	v.policy = in_policy
+	return nil
+}
+
+// This function sets the long-term credentials used to authenticate the client's requests.
+// The first request is sent without credentials. If the server challenges it (error 401), then the client learns the
+// realm and the nonce, and sends the request again with the attributes USERNAME, REALM, NONCE and MESSAGE-INTEGRITY.
+// The following requests are authenticated right away. If the nonce expires (error 438), then the client sends the
+// request again with the new nonce.
+//
+// INPUT
+// - in_username: the user name.
+// - in_password: the password.
+//
+// WARNING
+// The long-term credential mechanism is defined by RFC 5389 (see SetRfc5389()).
+func (v *Client) SetCredentials(in_username string, in_password string) {
+	v.credentials = __credentialsCreate(in_username, in_password)
+}
+
+// This function closes the client's socket.
+//
+// OUTPUT
+// - The error flag.
+func (v *Client) Close() error {
+	return v.connection.Close()
+}
+
+// This function returns the local transport address of the client's socket.
+//
+// OUTPUT
+// - The local transport address.
+//   This value is written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+func (v *Client) LocalAddr() string {
+	return v.transport_local
+}
 
 // This function sends a BINDING request.
 //
 // INPUT
+// - in_ctx: the context. It can be used to cancel the request.
 // - in_destination_address: this string represents the transport address of the request's destination.
 //   This value should be written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
-//   If the value of this parameter is nil, then the default server's transport address will be used.
-//   Note: The default server's transport address is the one defined through the call to the function "ClientInit()".
+//   If the value of this parameter is nil, then the server's transport address will be used.
+//   Note: The server's transport address is the one given to the function "ClientCreate()".
 //
 // OUTPUT
 // - The response.
 // - The error flag.
-func ClientSendBinding(in_destination_address *string) (requestResponse, error) {
+func (v *Client) ClientSendBinding(in_ctx context.Context, in_destination_address *string) (requestResponse, error) {
 	var attribute StunAttribute
 	var err error
-	var connection net.Conn
 	var resp requestResponse
 	var packet StunPacket
 	var dest_address string
@@ -156,7 +418,8 @@ func ClientSendBinding(in_destination_address *string) (requestResponse, error)
 	
 	// Build the packet. 	
 	packet.SetType(STUN_TYPE_BINDING_REQUEST)
-	packet.SetId([]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x10, 0x11, 0x12})
+	err = packet.SetRandomId()
+	if (nil != err) { return resp, err }
 		
 	// Add The software attribute.
 	attribute, err = AttributeCreateSoftware(&packet, "TestClient01")
@@ -168,35 +431,28 @@ func ClientSendBinding(in_destination_address *string) (requestResponse, error)
 	if (nil != err) { return resp, err }
 	packet.AddAttribute(attribute)
 	
-	// Open a connection to the server.
+	// Select the destination.
 	if nil != in_destination_address {
 		dest_address = *in_destination_address
 	} else {
-		dest_address = server_transport_address
+		dest_address = v.server_transport_address
 	}
 	
-	connection, err = net.Dial("udp", dest_address)
-	if (err != nil) { return resp, err }
-	resp.transport_local = connection.LocalAddr().String()
-	
-	// Send the packet.
-	resp.packet, resp.response, resp.err = SendRequest(connection, packet)
-	
-	return resp, connection.Close()
+	return v.__send(in_ctx, dest_address, packet)
 }
 
 // This function sends a CHANGE-REQUEST request.
 //
 // INPUT
+// - in_ctx: the context. It can be used to cancel the request.
 // - in_change_ip: this flag indicates whether the "change IP flag" should be set or not.
 //
 // OUTPUT
 // - The response.
 // - The error flag.
-func ClientSendChangeRequest(in_change_ip bool) (requestResponse, error) {
+func (v *Client) ClientSendChangeRequest(in_ctx context.Context, in_change_ip bool) (requestResponse, error) {
 	var attribute StunAttribute
 	var err error
-	var connection net.Conn
 	var resp requestResponse
 	var packet StunPacket
 	
@@ -205,7 +461,8 @@ func ClientSendChangeRequest(in_change_ip bool) (requestResponse, error) {
 	
 	// Build the packet. 	
 	packet.SetType(STUN_TYPE_BINDING_REQUEST)
-	packet.SetId([]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x10, 0x11, 0x12})
+	err = packet.SetRandomId()
+	if (nil != err) { return resp, err }
 		
 	// Add The software attribute
 	attribute, err = AttributeCreateSoftware(&packet, "TestClient01")
@@ -221,16 +478,221 @@ func ClientSendChangeRequest(in_change_ip bool) (requestResponse, error) {
 	attribute, err = AttributeCreateFingerprint(&packet)
 	if (nil != err) { return resp, err }
 	packet.AddAttribute(attribute)
-		
-	// Open a connection to the server.
-	connection, err = net.Dial("udp", server_transport_address)
-	if (err != nil) { return resp, err }
-	resp.transport_local = connection.LocalAddr().String()
 	
+	return v.__send(in_ctx, v.server_transport_address, packet)
+}
+
+// This function sends a BINDING indication.
+// RFC 5389: A Binding indication [...] can be used to refresh the bindings in the intervening NATs. No response is
+//           expected, and the indication is not retransmitted.
+//
+// INPUT
+// - in_destination_address: this string represents the transport address of the indication's destination.
+//   This value should be written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+//   If the value of this parameter is nil, then the server's transport address will be used.
+//
+// OUTPUT
+// - The error flag.
+func (v *Client) ClientSendBindingIndication(in_destination_address *string) error {
+	var attribute StunAttribute
+	var err error
+	var destination *net.UDPAddr
+	var dest_address string = v.server_transport_address
+
+	if (nil != in_destination_address) { dest_address = *in_destination_address }
+	destination, err = net.ResolveUDPAddr("udp", dest_address)
+	if (nil != err) { return err }
+
+	packet := PacketCreate()
+	packet.SetType(STUN_TYPE_BINDING_INDICATION)
+	err = packet.SetRandomId()
+	if (nil != err) { return err }
+	attribute, err = AttributeCreateFingerprint(&packet)
+	if (nil != err) { return err }
+	packet.AddAttribute(attribute)
+
+	return SendIndication(v.connection, destination, packet)
+}
+
+// This function sends a request from the client's socket and waits for the response.
+// If the client has credentials, then the request is authenticated, and the server's challenges are handled.
+//
+// INPUT
+// - in_ctx: the context. It can be used to cancel the request.
+// - in_destination_address: the transport address of the request's destination.
+//   This value should be written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+// - in_packet: the request to send.
+//
+// OUTPUT
+// - The response. If the request has been authenticated, then the response describes the last request sent.
+// - The error flag.
+//   + If the context is cancelled, then the error flag is the context's error.
+//   + If the response is an error response, then the error flag is a pointer to an ErrorResponse.
+func (v *Client) __send(in_ctx context.Context, in_destination_address string, in_packet StunPacket) (requestResponse, error) {
+	var err error
+	var resp requestResponse
+	var retry bool
+	var request StunPacket = in_packet
+
+	if (nil == v.credentials) {
+		resp, err = v.__exchange(in_ctx, in_destination_address, in_packet)
+		if (nil != err) || (! resp.response) { return resp, err }
+		return resp, __errorResponse(resp.packet)
+	}
+
+	// If the realm and the nonce are already known, then do not wait for a challenge.
+	if (v.credentials.__ready()) {
+		request, err = v.credentials.__sign(in_packet)
+		if (nil != err) { return resp, err }
+	}
+
+	for challenges := 0; ; challenges++ {
+		resp, err = v.__exchange(in_ctx, in_destination_address, request)
+		if (nil != err) || (! resp.response) { return resp, err }
+		if (challenges == credentials_max_challenges) { break }
+
+		retry, err = v.credentials.__challenge(request, resp.packet)
+		if (nil != err) { return resp, err }
+		if (! retry) { break }
+
+		if verbosity > 0 { tools.AddText(output, "The server challenged the request. Send it again with credentials.") }
+		request, err = v.credentials.__sign(in_packet)
+		if (nil != err) { return resp, err }
+	}
+
+	return resp, __errorResponse(resp.packet)
+}
+
+// This function sends a request from the client's socket and waits for the response.
+// The request is retransmitted according to the client's retransmission policy.
+//
+// INPUT
+// - in_ctx: the context. It can be used to cancel the request.
+// - in_destination_address: the transport address of the request's destination.
+//   This value should be written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+// - in_packet: the request to send.
+//
+// OUTPUT
+// - The response.
+// - The error flag. If the context is cancelled, then the error flag is the context's error.
+func (v *Client) __exchange(in_ctx context.Context, in_destination_address string, in_packet StunPacket) (requestResponse, error) {
+	var err error
+	var resp requestResponse
+	var destination *net.UDPAddr
+
+	resp.init()
+	resp.transport_local = v.transport_local
+	resp.transaction_id  = in_packet.GetId()
+	resp.destination     = in_destination_address
+	resp.raw_request     = in_packet.ToBytes()
+
+	destination, err = net.ResolveUDPAddr("udp", in_destination_address)
+	if (nil != err) { return resp, err }
+
 	// Send the packet.
-	resp.packet, resp.response, resp.err = SendRequest(connection, packet)
-	
-	return resp, connection.Close()
+	// If the client uses credentials, then responses with an invalid MESSAGE-INTEGRITY are discarded.
+	var check func(StunPacket) error
+	if (nil != v.credentials) { check = v.credentials.__check }
+	resp.packet, resp.raw_response, resp.rtt, resp.response, resp.err = __transaction(in_ctx, v.connection, destination, in_packet, v.policy, check)
+	if (nil != in_ctx.Err()) { return resp, in_ctx.Err() }
+	return resp, nil
+}
+
+// This function opens a secondary socket, on the same IP address as the client's socket.
+//
+// OUTPUT
+// - The secondary socket.
+// - The error flag.
+func (v *Client) __secondarySocket() (*net.UDPConn, error) {
+	local, err := net.ResolveUDPAddr("udp", v.transport_local)
+	if (nil != err) { return nil, err }
+	return net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Port: 0})
+}
+
+// This function replaces the client's socket by a new one, bound to the same IP address and to another port.
+// The previous socket is closed.
+//
+// OUTPUT
+// - The error flag.
+func (v *Client) __renewSocket() error {
+	connection, err := v.__secondarySocket()
+	if (nil != err) { return err }
+	v.connection.Close()
+	v.connection      = connection
+	v.transport_local = connection.LocalAddr().String()
+	return nil
+}
+
+// This function sends a packet from a secondary socket and waits for a packet with the same transaction ID on the
+// client's socket.
+// The packet is retransmitted according to the client's retransmission policy, until a packet with the same
+// transaction ID is received on the client's socket, or on the secondary socket.
+//
+// INPUT
+// - in_ctx: the context. It can be used to cancel the exchange.
+// - in_secondary: the secondary socket.
+// - in_destination_address: the transport address of the packet's destination.
+//   This value should be written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+// - in_packet: the packet to send.
+//
+// OUTPUT
+// - The packet received on the client's socket, if any.
+// - This flag indicates whether a response has been received on the secondary socket or not.
+//   If so, the response is given by the field "packet" of the first returned value.
+// - The error flag. If the context is cancelled, then the error flag is the context's error.
+//
+// WARNING
+// While this function runs, the client's socket must not be used for anything else.
+func (v *Client) __crossExchange(in_ctx context.Context, in_secondary net.PacketConn, in_destination_address string, in_packet StunPacket) (requestResponse, bool, error) {
+	var err error
+	var resp requestResponse
+	var destination *net.UDPAddr
+	var answered bool
+
+	resp.init()
+	resp.transport_local = v.transport_local
+	resp.transaction_id  = in_packet.GetId()
+	resp.destination     = in_destination_address
+	resp.raw_request     = in_packet.ToBytes()
+
+	destination, err = net.ResolveUDPAddr("udp", in_destination_address)
+	if (nil != err) { return resp, false, err }
+
+	// Wait for the packet on the client's socket.
+	// As soon as the packet is received, the transaction on the secondary socket is cancelled.
+	ctx, cancel := context.WithCancel(in_ctx)
+	defer cancel()
+	received := make(chan []byte, 1)
+	v.connection.SetReadDeadline(time.Now().Add(v.policy.__total()))
+	go func() {
+		b := make([]byte, 65536)
+		for {
+			count, _, err := v.connection.ReadFrom(b)
+			if (nil != err) { received <- nil; return }
+			p, err := FromBytes(b[0:count])
+			if (nil != err) || (! bytes.Equal(p.GetId(), in_packet.GetId())) { continue }
+			received <- b[0:count]
+			cancel()
+			return
+		}
+	}()
+
+	sent_at := time.Now()
+	resp.packet, _, _, answered, err = __transaction(ctx, in_secondary, destination, in_packet, v.policy, nil)
+
+	// Stop waiting on the client's socket.
+	v.connection.SetReadDeadline(time.Now())
+	resp.raw_response = <-received
+	v.connection.SetReadDeadline(time.Time{})
+
+	if (nil != resp.raw_response) {
+		resp.response = true
+		resp.rtt      = time.Since(sent_at)
+		resp.packet, _ = FromBytes(resp.raw_response)
+		return resp, false, nil
+	}
+	if (nil != in_ctx.Err()) { return resp, false, in_ctx.Err() }
+	return resp, answered, err
 }
 
 // Perform Test I.
@@ -241,15 +703,16 @@ func ClientSendChangeRequest(in_change_ip bool) (requestResponse, error) {
 //           port that the request came from.
 //
 // INPUT
+// - in_ctx: the context. It can be used to cancel the test.
 // - in_destination_address: this string represents the transport address of the request's destination.
 //   This value should be written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
-//   If the value of this parameter is nil, then the default server's transport address will be used.
-//   Note: The default server's transport address is the one defined through the call to the function "ClientInit()".
+//   If the value of this parameter is nil, then the server's transport address will be used.
+//   Note: The server's transport address is the one given to the function "ClientCreate()".
 //
 // OUTPUT
 // - The response.
 // - The error flag.
-func ClientTest1(in_destination_address *string) (testResponse, error) {
+func (v *Client) ClientTest1(in_ctx context.Context, in_destination_address *string) (testResponse, error) {
 	var err, err_mapped error
 	var ip_mapped, ip_xored_mapped string
 	var family_mapped, family_xored_mapped, port_mapped, port_xored_mapped uint16
@@ -259,7 +722,7 @@ func ClientTest1(in_destination_address *string) (testResponse, error) {
 	
 	if verbosity > 0 {	tools.AddText(output, fmt.Sprintf("%s", "Test I\n")) }
 	
-	response.request, err = ClientSendBinding(in_destination_address)
+	response.request, err = v.ClientSendBinding(in_ctx, in_destination_address)
 	if (nil != err) { return response, err }
 	if (! response.request.response) { return response, nil }
 	
@@ -267,9 +730,16 @@ func ClientTest1(in_destination_address *string) (testResponse, error) {
 	// Note: Some STUN servers don't set the XORED mapped address (RFC 3489 does not define XORED mapped IP address).
 	//       Therefore, we consider that no XORED mapped address is not an error.
 	_ = family_mapped // Really not used
+	response.extra = info
 	found, family_mapped, ip_mapped, port_mapped, err = response.request.packet.GetMappedAddress()
 	if (nil != err) || (! found) { return response, err }
+	info.mapped_address, err = tools.MakeTransportAddress(ip_mapped, int(port_mapped))
+	if nil != err { return response, err }
 	found, family_xored_mapped, ip_xored_mapped, port_xored_mapped, err = response.request.packet.GetXorMappedAddress()
+	if (nil == err) && found {
+		info.xor_mapped_address, err = tools.MakeTransportAddress(ip_xored_mapped, int(port_xored_mapped))
+		if nil != err { return response, err }
+	}
 	
 	if verbosity > 0 {	
 		tools.AddText(output, fmt.Sprintf("% -25s: %s:%d", "Mapped address", ip_mapped, port_mapped))
@@ -298,6 +768,7 @@ func ClientTest1(in_destination_address *string) (testResponse, error) {
 	// Compare local IP with mapped IP.
 	if verbosity > 0 {	tools.AddText(output, fmt.Sprintf("% -25s: %s", "Local address", response.request.transport_local)) }
 	info.identical = response.request.transport_local == ip_mapped
+	info.transport_mapped = ip_mapped
 	response.extra = info
 	
 	return response, nil
@@ -307,17 +778,20 @@ func ClientTest1(in_destination_address *string) (testResponse, error) {
 // RFC 3489: In test II, the client sends a Binding Request with both the "change IP" and "change port" flags
 //           from the CHANGE-REQUEST attribute set.
 //
+// INPUT
+// - in_ctx: the context. It can be used to cancel the test.
+//
 // OUTPUT
 // - A boolean that indicates wether the client received a response or not.
 // - The error flag.
-func CientTest2() (testResponse, error) {
+func (v *Client) ClientTest2(in_ctx context.Context) (testResponse, error) {
 	var err error
 	var r requestResponse
 	var response testResponse
 	var info test2Info
 
 	if verbosity > 0 {	tools.AddText(output, fmt.Sprintf("%s", "Test II.\n")) }
-	r, err = ClientSendChangeRequest(true)
+	r, err = v.ClientSendChangeRequest(in_ctx, true)
 	response.request = r
 	response.extra   = info
    	if (nil != err) { return response, err }
@@ -327,17 +801,20 @@ func CientTest2() (testResponse, error) {
 // Perform Test III.
 // RFC 3489: In test III, the client sends a Binding Request with only the "change port" flag set.
 //
+// INPUT
+// - in_ctx: the context. It can be used to cancel the test.
+//
 // OUTPUT
 // - A boolean that indicates wether the client received a response or not.
 // - The error flag.
-func CientTest3() (testResponse, error) {
+func (v *Client) ClientTest3(in_ctx context.Context) (testResponse, error) {
 	var err error
 	var r requestResponse
 	var response testResponse
 	var info test2Info
 
 	if verbosity > 0 {	tools.AddText(output, fmt.Sprintf("%s", "Test III.\n")) }
-	r, err = ClientSendChangeRequest(false)
+	r, err = v.ClientSendChangeRequest(in_ctx, false)
 	response.request = r
 	response.extra   = info
    	if (nil != err) { return response, err }
@@ -346,14 +823,78 @@ func CientTest3() (testResponse, error) {
 
 // Perform the discovery process.
 // See RFC 3489, section "Discovery Process".
+// All the tests are performed from the client's socket.
+//
+// OUTPUT
+// - The result of the discovery process. It contains the type of NAT we are behind from, and the details of all the
+//   tests performed.
+// - The error flag.
+//
+// WARNING
+// If the client is behind a NAT, then the discovery process also tests hairpinning (see ClientDiscoverContext()). If
+// the NAT does not support hairpinning, then this test lasts a full retransmission timeout (about 9.5 seconds with the
+// default retransmission policy, see SetRetransmitPolicy()).
+func (v *Client) ClientDiscover() (DiscoveryResult, error) {
+	return v.ClientDiscoverContext(context.Background())
+}
+
+// Perform the discovery process.
+// See RFC 3489, section "Discovery Process".
+// All the tests are performed from the client's socket.
+// If the client is behind a NAT, then the discovery process also tests whether the NAT supports hairpinning or not
+// (see RFC 5780, section 4.5). This test uses a second local socket. If the NAT does not support hairpinning, then the
+// test lasts a full retransmission timeout. If the test fails, then the hairpinning support is STUN_HAIRPINNING_UNKNOWN:
+// the NAT type is still returned, without error.
+//
+// INPUT
+// - in_ctx: the context. If the context is cancelled, or if its deadline expires, then the discovery process is
+//   aborted, and the function returns the context's error.
 //
 // OUTPUT
-// - The type of NAT we are behind from.
+// - The result of the discovery process. It contains the type of NAT we are behind from, and the details of all the
+//   tests performed.
 // - The error flag.
-func ClientDiscover() (int, error) {
+func (v *Client) ClientDiscoverContext(in_ctx context.Context) (DiscoveryResult, error) {
+	result, err := v.__discover(in_ctx)
+	if (nil != err) { return result, err }
+
+	// Hairpinning is meaningful only if the client is behind a NAT.
+	switch result.NatType {
+		case STUN_NAT_FULL_CONE, STUN_NAT_SYMETRIC, STUN_NAT_RESTRICTED, STUN_NAT_PORT_RESTRICTED:
+		case STUN_NAT_UNKNOWN:
+			if (result.MappedAddress == result.LocalAddress) { return result, nil }
+		default:
+			return result, nil
+	}
+
+	hairpinning, tests, err := v.ClientTestHairpinning(in_ctx)
+	result.Tests = append(result.Tests, tests...)
+	if (nil != in_ctx.Err()) { return result, in_ctx.Err() }
+	if (nil != err) {
+		// The NAT type is known. The failure of the hairpinning test must not hide it.
+		if verbosity > 0 { tools.AddText(output, fmt.Sprintf("% -25s: %s", "Hairpinning", err)) }
+		hairpinning = STUN_HAIRPINNING_UNKNOWN
+	}
+	result.Hairpinning = hairpinning
+	return result, nil
+}
+
+// Perform the discovery process, as described by RFC 3489 (see ClientDiscoverContext()).
+//
+// INPUT
+// - in_ctx: the context.
+//
+// OUTPUT
+// - The result of the discovery process.
+// - The error flag.
+func (v *Client) __discover(in_ctx context.Context) (DiscoveryResult, error) {
+	var result DiscoveryResult
 	var err error
 	var changer_transport string
 	var test1_response, test2_response, test3_response testResponse
+	var mapped_transport string
+	
+	result.LocalAddress = v.transport_local
 	
 	// RFC 3489: The client begins by initiating test I.  If this test yields no
 	// response, the client knows right away that it is not capable of UDP
@@ -366,16 +907,23 @@ func ClientDiscover() (int, error) {
 	/// TEST I (a)
 	/// ----------
 	
-	test1_response, err = ClientTest1(nil)
-	
-	if (nil != err) { return STUN_NAT_ERROR, err }
+	test1_response, err = v.ClientTest1(in_ctx, nil)
+	result.__addTest("Test I", test1_response)
+	if (nil != err) {
+		result.NatType = STUN_NAT_ERROR
+		return result, err
+	}
 	if (! test1_response.request.response) {
 		if verbosity > 0 {
 			tools.AddText(output, fmt.Sprintf("% -25s%s", "Result:", "Got no response for test I."))
 			tools.AddText(output, fmt.Sprintf("% -25s%s", "Conclusion:", "UDP is blocked."))
 		}
-		return STUN_NAT_BLOCKED, err
+		result.NatType = STUN_NAT_BLOCKED
+		return result, err
 	}
+	result.MappedAddress    = test1_response.extra.(test1Info).mapped_address
+	result.XorMappedAddress = test1_response.extra.(test1Info).xor_mapped_address
+	mapped_transport        = test1_response.extra.(test1Info).transport_mapped
 		
 	// Save "changed transport address" for later test.
 	// Please note that some servers don't set this attribute.
@@ -385,13 +933,18 @@ func ClientDiscover() (int, error) {
 			tools.AddText(output, fmt.Sprintf("% -25s: %d", "Change port", int(test1_response.extra.(test1Info).changed_port)))
 		}	
 		changer_transport, err = tools.MakeTransportAddress(test1_response.extra.(test1Info).changed_ip, int(test1_response.extra.(test1Info).changed_port))
-		if (nil != err) { return STUN_NAT_ERROR, err }
+		if (nil != err) {
+			result.NatType = STUN_NAT_ERROR
+			return result, err
+		}
+		result.ChangedAddress = changer_transport
 	} else {
 		if verbosity > 0 {
 			tools.AddText(output, fmt.Sprintf("% -25s: %s", "Result",   "The response does not contain any \"changed\" address."))
 			tools.AddText(output, fmt.Sprintf("% -25s: %s", "Conclusion", "The only thing we can say is that we are behind a NAT.\n"))
 		}	
-		return STUN_NAT_UNKNOWN, nil
+		result.NatType = STUN_NAT_UNKNOWN
+		return result, nil
 	}
 	
 	if ! test1_response.extra.(test1Info).identical { // Test I (a): The local transport address is different than the mapped transport address.
@@ -409,8 +962,12 @@ func ClientDiscover() (int, error) {
    			tools.AddText(output, fmt.Sprintf("% -25s: %s", "Conclusion", "We are behind a NAT.\n"))
    		}
    		
-		test2_response, err = CientTest2()
-		if (nil != err) { return STUN_NAT_ERROR, err }
+		test2_response, err = v.ClientTest2(in_ctx)
+		result.__addTest("Test II", test2_response)
+		if (nil != err) {
+			result.NatType = STUN_NAT_ERROR
+			return result, err
+		}
 		if (!test2_response.request.response) { // Test II (a): We did not receive any valid response from the server.
 
 			// RFC 3489:  If no response is received, it performs test I again, but this time,
@@ -426,27 +983,35 @@ func ClientDiscover() (int, error) {
 			/// TEST I (b)
 			/// ----------
 			
-			test1_response, err = ClientTest1(&changer_transport)
-			if (nil != err) { return STUN_NAT_ERROR, err }	
+			test1_response, err = v.ClientTest1(in_ctx, &changer_transport)
+			result.__addTest("Test I(b)", test1_response)
+			if (nil != err) {
+				result.NatType = STUN_NAT_ERROR
+				return result, err
+			}
 			if !test1_response.request.response  {
 				// No response from the server. This should not happend.
 				if verbosity > 0 {
 					tools.AddText(output, fmt.Sprintf("% -25s: %s", "Result", "Got no response for test I. This is unexpected!"))
 					tools.AddText(output, fmt.Sprintf("% -25s: %s", "Conclusion", "The only thing we can say is that we are behind a NAT.\n"))
 				}
-				return STUN_NAT_UNKNOWN, nil
+				result.NatType = STUN_NAT_UNKNOWN
+				return result, nil
 			}
 			
-			if !test1_response.extra.(test1Info).identical { // Test I (b)
+			// RFC 3489: If the IP address and port returned in test I (b) differ from the ones of test I (a), the client
+			//           knows that it is behind a symmetric NAT.
+			if test1_response.extra.(test1Info).transport_mapped != mapped_transport { // Test I (b)
 				if verbosity > 0 {
-					tools.AddText(output, fmt.Sprintf("% -25s: %s", "Result", "Got a response for test I. Test I is not OK."))
+					tools.AddText(output, fmt.Sprintf("% -25s: %s", "Result", "Got a response for test I. The mapped address differs from the one of test I (a)."))
 					tools.AddText(output, fmt.Sprintf("% -25s: %s", "Conclusion", "We are behind a symetric NAT.\n"))
 				}
-				return STUN_NAT_SYMETRIC, nil
+				result.NatType = STUN_NAT_SYMETRIC
+				return result, nil
 			} else { // Test I (b)
 				
 				if verbosity > 0 {
-					tools.AddText(output, fmt.Sprintf("% -25s: %s", "Result", "Got a response for test I. Test I is OK.\n"))
+					tools.AddText(output, fmt.Sprintf("% -25s: %s", "Result", "Got a response for test I. The mapped address is the one of test I (a).\n"))
 					tools.AddText(output, fmt.Sprintf("% -25s: %s", "Conclusion", "Perform Test III.\n"))
 				}
 				
@@ -454,20 +1019,26 @@ func ClientDiscover() (int, error) {
 				/// TEST III
 				/// --------
 				
-				test3_response, err = CientTest3()
-				if (nil != err) { return STUN_NAT_ERROR, err }
+				test3_response, err = v.ClientTest3(in_ctx)
+				result.__addTest("Test III", test3_response)
+				if (nil != err) {
+					result.NatType = STUN_NAT_ERROR
+					return result, err
+				}
 				if (! test3_response.request.response) {
 					if verbosity > 0 {
 						tools.AddText(output, fmt.Sprintf("% -25s: %s", "Result", "Got no response for test III."))
 						tools.AddText(output, fmt.Sprintf("% -25s: %s", "Conclusion", "We are behind a \"port sestricted\" NAT.\n"))
 					}
-					return STUN_NAT_PORT_RESTRICTED, nil
+					result.NatType = STUN_NAT_PORT_RESTRICTED
+					return result, nil
 				} else {
 					if verbosity > 0 {
 						tools.AddText(output, fmt.Sprintf("% -25s: %s", "Result", "Got a response for test III."))
 						tools.AddText(output, fmt.Sprintf("% -25s: %s", "Conclusion", "We are behind a \"restricted\" NAT.\n"))
 					}
-					return STUN_NAT_RESTRICTED, nil
+					result.NatType = STUN_NAT_RESTRICTED
+					return result, nil
 				}
 				
 				// End of branch.
@@ -480,10 +1051,9 @@ func ClientDiscover() (int, error) {
 				tools.AddText(output, fmt.Sprintf("% -25s: %s", "Result", "Test II is OK."))
 				tools.AddText(output, fmt.Sprintf("% -25s: %s", "Conclusion", "We are behind a \"full cone\" NAT.\n"))
 			}
-			return STUN_NAT_FULL_CONE, nil
+			result.NatType = STUN_NAT_FULL_CONE
+			return result, nil
 		}
-		
-		return 0, nil
 	} else { // Test I (a): The local transport address is identical to the mapped transport address.
 	
 		// RFC 3489: If this address and port are the same
@@ -504,22 +1074,26 @@ func ClientDiscover() (int, error) {
    		// like a full-cone NAT, but without the translation).  If no response
    		// is received, the client knows its behind a symmetric UDP firewall.
    		
-   		test2_response, err = CientTest2()
-		if (nil != err) { return STUN_NAT_ERROR, err }
+   		test2_response, err = v.ClientTest2(in_ctx)
+		result.__addTest("Test II", test2_response)
+		if (nil != err) {
+			result.NatType = STUN_NAT_ERROR
+			return result, err
+		}
 		if test2_response.request.response { //
 		   	if verbosity > 0 {
 	   			tools.AddText(output, fmt.Sprintf("% -25s: %s", "Result", "Got a response for test II.\n"))
 	   			tools.AddText(output, fmt.Sprintf("% -25s: %s", "Conclusion", "We are *not* behind a NAT."))
    			}
-			return STUN_NAT_NO_NAT, nil
+			result.NatType = STUN_NAT_NO_NAT
+			return result, nil
 		}
 		 
 		if verbosity > 0 {
 	   		tools.AddText(output, fmt.Sprintf("% -25s: %s", "Result", "Got no response for test II.\n"))
 	   		tools.AddText(output, fmt.Sprintf("% -25s: %s", "Conclusion", "We are behind a symmetric UDP firewall."))
    		}
-		return STUN_NAT_SYMETRIC_UDP_FIREWALL, nil
+		result.NatType = STUN_NAT_SYMETRIC_UDP_FIREWALL
+		return result, nil
 	}
-	
-	return 2, nil
 }
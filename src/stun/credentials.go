@@ -0,0 +1,216 @@
+// Copyright (C) 2012 Denis BEURIVE
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stun
+
+import "fmt"
+import "errors"
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Long-term credentials.                                                                           */
+/* See RFC 5389, section 10.2.                                                                      */
+/* ------------------------------------------------------------------------------------------------ */
+
+// The maximum number of times a request is sent again after a challenge (401 or 438).
+const credentials_max_challenges = 2
+
+// This type represents the state of the long-term credential mechanism for a given server.
+// The realm and the nonce are learned from the server's challenges (error 401 or 438). Once they are known, all the
+// requests are authenticated, without waiting for a challenge.
+type credentials struct {
+	// The user name.
+	username string
+	// The password.
+	password string
+	// The realm given by the server ("" if unknown).
+	realm string
+	// The nonce given by the server ("" if unknown).
+	nonce string
+	// The key used to calculate MESSAGE-INTEGRITY: MD5(username ":" realm ":" password).
+	key []byte
+}
+
+// This function creates the state of the long-term credential mechanism.
+//
+// INPUT
+// - in_username: the user name.
+// - in_password: the password.
+//
+// OUTPUT
+// - The state.
+func __credentialsCreate(in_username string, in_password string) *credentials {
+	return &credentials{ username: in_username, password: in_password }
+}
+
+// This function tells whether the realm and the nonce are known or not.
+//
+// OUTPUT
+// - true: requests can be authenticated.
+// - false: requests can not be authenticated yet.
+func (v *credentials) __ready() bool {
+	return ("" != v.realm) && ("" != v.nonce)
+}
+
+// This function builds an authenticated version of a request.
+// RFC 5389: the client [...] forms a new request [...] with a USERNAME, REALM, NONCE, and MESSAGE-INTEGRITY attribute.
+// The authenticated request has a new transaction ID. If the given request contains a FINGERPRINT attribute, then the
+// authenticated request contains a new FINGERPRINT attribute. The "xored" addresses are encoded again, since they
+// depend on the transaction ID.
+//
+// INPUT
+// - in_request: the request to authenticate.
+//   Any attribute USERNAME, REALM, NONCE, MESSAGE-INTEGRITY or FINGERPRINT in this request is discarded.
+//
+// OUTPUT
+// - The authenticated request.
+// - The error flag.
+func (v *credentials) __sign(in_request StunPacket) (StunPacket, error) {
+	var attribute StunAttribute
+	var err error
+	var fingerprint bool = false
+
+	packet := PacketCreate()
+	packet.SetType(in_request.GetType())
+	err = packet.SetRandomId()
+	if (nil != err) { return packet, err }
+
+	for i := 0; i < in_request.GetAttributesCount(); i++ {
+		a := in_request.GetAttribute(i)
+		switch a.Type {
+			case STUN_ATTRIBUT_USERNAME, STUN_ATTRIBUT_REALM, STUN_ATTRIBUT_NONCE, STUN_ATTRIBUT_MESSAGE_INTEGRITY:
+				continue
+			case STUN_ATTRIBUT_FINGERPRINT:
+				fingerprint = true
+				continue
+			case STUN_ATTRIBUT_XOR_MAPPED_ADDRESS, STUN_ATTRIBUT_XOR_PEER_ADDRESS, STUN_ATTRIBUT_XOR_RELAYED_ADDRESS:
+				// The value depends on the transaction ID (IPV6): it must be encoded again.
+				a.Packet = &in_request
+				_, _, _, ip, port, err := a.AttributeGetXorMappedAddress()
+				if (nil != err) { return packet, err }
+				a, err = __createXorAddress(a.Type, &packet, ip, port)
+				if (nil != err) { return packet, err }
+				packet.AddAttribute(a)
+				continue
+		}
+		a.Packet = &packet
+		packet.AddAttribute(a)
+	}
+
+	attribute, err = AttributeCreateUsername(&packet, v.username)
+	if (nil != err) { return packet, err }
+	packet.AddAttribute(attribute)
+
+	attribute, err = AttributeCreateRealm(&packet, v.realm)
+	if (nil != err) { return packet, err }
+	packet.AddAttribute(attribute)
+
+	attribute, err = AttributeCreateNonce(&packet, v.nonce)
+	if (nil != err) { return packet, err }
+	packet.AddAttribute(attribute)
+
+	attribute, err = AttributeCreateMessageIntegrity(&packet, v.key)
+	if (nil != err) { return packet, err }
+	packet.AddAttribute(attribute)
+
+	if (fingerprint) {
+		attribute, err = AttributeCreateFingerprint(&packet)
+		if (nil != err) { return packet, err }
+		packet.AddAttribute(attribute)
+	}
+
+	return packet, nil
+}
+
+// This function examines the response to a request and updates the realm and the nonce, if required.
+// RFC 5389: If the response is an error response with an error code of 401 (Unauthorized), the client SHOULD retry
+//           the request with a new transaction. [...] If the response is an error response with an error code of 438
+//           (Stale Nonce), the client MUST retry the request, using the new NONCE supplied in the 438 (Stale Nonce)
+//           response.
+//
+// INPUT
+// - in_request: the request.
+// - in_response: the response.
+//
+// OUTPUT
+// - This flag indicates whether the request should be sent again (authenticated) or not.
+// - The error flag.
+func (v *credentials) __challenge(in_request StunPacket, in_response StunPacket) (bool, error) {
+	var found, authenticated bool
+	var code uint16
+	var realm, nonce string
+	var err error
+
+	// Error responses only.
+	if (STUN_CLASS_ERROR_RESPONSE != in_response.GetClass()) { return false, nil }
+	found, code, _, err = in_response.GetErrorCode()
+	if (nil != err) || (! found) { return false, err }
+	if (STUN_ERROR_UNAUTHORIZED != code) && (STUN_ERROR_STALE_NONCE != code) { return false, nil }
+
+	found, nonce = in_response.GetNonce()
+	if (! found) { return false, errors.New(fmt.Sprintf("The server sent an error %d without NONCE.", code)) }
+	found, realm = in_response.GetRealm()
+	if (! found) {
+		// RFC 5389 does not require REALM in the 438 response.
+		if (STUN_ERROR_UNAUTHORIZED == code) { return false, errors.New("The server sent an error 401 without REALM.") }
+		realm = v.realm
+	}
+
+	_, authenticated = __hasMessageIntegrity(in_request)
+	if (STUN_ERROR_UNAUTHORIZED == code) && authenticated && (realm == v.realm) && (nonce == v.nonce) {
+		// The credentials have been rejected. Sending the request again would not change anything.
+		return false, nil
+	}
+
+	v.realm = realm
+	v.nonce = nonce
+	v.key   = LongTermKey(v.username, v.realm, v.password)
+	return true, nil
+}
+
+// This function checks the MESSAGE-INTEGRITY attribute of a response, if present.
+// RFC 5389: If the response is an error response with an error code of 401 or 438, [...]. For all other responses,
+//           the client [...] MUST discard the response if the computed HMAC differs from the MESSAGE-INTEGRITY value.
+//
+// INPUT
+// - in_response: the response.
+//
+// OUTPUT
+// - The error flag. An error is returned if the HMAC is not valid.
+//
+// WARNING
+// This function is called for every packet that matches the transaction: a response that does not pass the check
+// is discarded, and the client keeps waiting for the genuine response.
+func (v *credentials) __check(in_response StunPacket) error {
+	if _, found := __hasMessageIntegrity(in_response); (! found) || (nil == v.key) { return nil }
+	ok, err := in_response.CheckMessageIntegrity(v.key)
+	if (nil != err) { return err }
+	if (! ok) { return errors.New("The response's MESSAGE-INTEGRITY is not valid.") }
+	return nil
+}
+
+// This function tells whether a packet contains a MESSAGE-INTEGRITY attribute or not.
+//
+// INPUT
+// - in_packet: the packet.
+//
+// OUTPUT
+// - The index of the attribute within the packet (-1 if none).
+// - This flag indicates whether the packet contains a MESSAGE-INTEGRITY attribute or not.
+func __hasMessageIntegrity(in_packet StunPacket) (int, bool) {
+	for i := 0; i < in_packet.GetAttributesCount(); i++ {
+		if (STUN_ATTRIBUT_MESSAGE_INTEGRITY == in_packet.GetAttribute(i).Type) { return i, true }
+	}
+	return -1, false
+}
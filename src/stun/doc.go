@@ -64,7 +64,8 @@ func main() {
 	var verbosityLevel *int = flag.Int("verbose", 0,    "Verbosity level.")
 	var ips []string
 	var ip string
-	var nat int
+	var result stun.DiscoveryResult
+	var client *stun.Client
 		
 	// Parse the command line.
 	flag.Parse()
@@ -128,10 +129,15 @@ func main() {
 	fmt.Println(fmt.Sprintf("\nUsing transport address \"%s\".\n", ip))
 	
 	// Perform discovery.
-	stun.ClientInit(ip)
+	client, err = stun.ClientCreate(ip)
+	if (nil != err) {
+		fmt.Println(fmt.Sprintf("ERROR: %s", err))
+		os.Exit(1)
+	}
+	defer client.Close()
 	stun.ActivateOutput(*verbosityLevel, nil)
 	
-	nat, err = stun.ClientDiscover()
+	result, err = client.ClientDiscover()
 	if (nil != err) {
 		fmt.Println(fmt.Sprintf("An error occured: %s", err))
 		os.Exit(1)
@@ -140,7 +146,7 @@ func main() {
 	// Print result.
 	fmt.Println("\n\nCONCLUSION\n")
 	
-	switch nat {
+	switch result.NatType {
 		case stun.STUN_NAT_ERROR:
 			fmt.Println(fmt.Sprintf("Test failed: %s", err))
 		case stun.STUN_NAT_BLOCKED:
@@ -160,5 +166,15 @@ func main() {
 		case stun.STUN_NAT_SYMETRIC_UDP_FIREWALL:
 			fmt.Println(fmt.Sprintf("We are behind a symetric UDP firewall."))
 	}
+	
+	fmt.Println(fmt.Sprintf("\n% -20s: %s", "Local address", result.LocalAddress))
+	fmt.Println(fmt.Sprintf("% -20s: %s", "Mapped address", result.MappedAddress))
+	for i:=0; i<len(result.Tests); i++ {
+		if result.Tests[i].Answered {
+			fmt.Println(fmt.Sprintf("% -20s: response from %s in %s", result.Tests[i].Name, result.Tests[i].Destination, result.Tests[i].Rtt))
+		} else {
+			fmt.Println(fmt.Sprintf("% -20s: no response from %s", result.Tests[i].Name, result.Tests[i].Destination))
+		}
+	}
 }
 */
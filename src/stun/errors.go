@@ -0,0 +1,121 @@
+// Copyright (C) 2012 Denis BEURIVE
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stun
+
+import "fmt"
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Errors.                                                                                          */
+/* ------------------------------------------------------------------------------------------------ */
+
+// Decoding error: the size of the datagram is not valid.
+const STUN_DECODE_ERROR_SIZE        = 1
+
+// Decoding error: the message type is not valid (the two leading bits are not zeroes).
+const STUN_DECODE_ERROR_TYPE        = 2
+
+// Decoding error: the length field of the header is not valid.
+const STUN_DECODE_ERROR_LENGTH      = 3
+
+// Decoding error: the magic cookie is not valid (RFC 5389 only).
+const STUN_DECODE_ERROR_COOKIE      = 4
+
+// Decoding error: an attribute is not valid (truncated header or value).
+const STUN_DECODE_ERROR_ATTRIBUTE   = 5
+
+// Decoding error: an attribute is not correctly padded.
+const STUN_DECODE_ERROR_PADDING     = 6
+
+// Decoding error: the attribute FINGERPRINT is not valid, or it is not the last attribute.
+const STUN_DECODE_ERROR_FINGERPRINT = 7
+
+// Decoding error: the channel number of a ChannelData message is not valid.
+const STUN_DECODE_ERROR_CHANNEL     = 8
+
+// This type represents an error detected while decoding a sequence of bytes (see FromBytes() and ChannelDataFromBytes()).
+type DecodeError struct {
+	// The kind of error (constant STUN_DECODE_ERROR_...).
+	Kind int
+	// The offset, within the sequence of bytes, of the faulty element.
+	Offset int
+	// The description of the error.
+	Message string
+}
+
+// This function returns a textual representation of the error.
+// It implements the interface "error".
+//
+// OUTPUT
+// - The textual representation of the error.
+func (v *DecodeError) Error() string {
+	return fmt.Sprintf("Invalid STUN packet (offset %d): %s.", v.Offset, v.Message)
+}
+
+// This type represents an error response sent by a server.
+// It is returned (as an error) when the response to a request is an error response.
+type ErrorResponse struct {
+	// The error code (constant STUN_ERROR_...).
+	// The value 0 means that the response does not contain any valid ERROR-CODE attribute.
+	Code uint16
+	// The reason phrase given by the server.
+	Reason string
+	// The error response.
+	// It may contain additional information (for example: UNKNOWN-ATTRIBUTES or ALTERNATE-SERVER).
+	Packet StunPacket
+}
+
+// This function returns a textual representation of the error.
+// It implements the interface "error".
+//
+// OUTPUT
+// - The textual representation of the error.
+func (v *ErrorResponse) Error() string {
+	name, ok := error_names[v.Code]
+	if (! ok) { name = "Unknown error" }
+	return fmt.Sprintf("The server returned the error %d %s (%s).", v.Code, name, v.Reason)
+}
+
+// This function returns the error that represents an error response.
+//
+// INPUT
+// - in_packet: the response.
+//
+// OUTPUT
+// - If the given packet is an error response, then the function returns a pointer to an ErrorResponse.
+//   Otherwise, the function returns nil.
+func __errorResponse(in_packet StunPacket) error {
+	if (STUN_CLASS_ERROR_RESPONSE != in_packet.GetClass()) { return nil }
+	res := ErrorResponse{ Packet: in_packet }
+	found, code, reason, err := in_packet.GetErrorCode()
+	if (found) && (nil == err) {
+		res.Code   = code
+		res.Reason = reason
+	}
+	return &res
+}
+
+// This function creates a decoding error.
+//
+// INPUT
+// - in_kind: the kind of error (constant STUN_DECODE_ERROR_...).
+// - in_offset: the offset of the faulty element.
+// - in_message: the description of the error.
+//
+// OUTPUT
+// - The error.
+func __decodeError(in_kind int, in_offset int, in_message string) error {
+	return &DecodeError{ Kind: in_kind, Offset: in_offset, Message: in_message }
+}
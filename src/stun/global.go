@@ -21,6 +21,8 @@ import "errors"
 import "time"
 import "net"
 import "strings"
+import "bytes"
+import "context"
 
 // Verbosity level for the STUN package.
 var verbosity int = 0
@@ -39,95 +41,320 @@ func ActivateOutput (in_vebosity int, out_verbose *[]string) {
 	output = out_verbose
 }
 
+/* ------------------------------------------------------------------------------------------------ */
+/* Retransmission policy.                                                                           */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This type represents the retransmission policy used when requests are sent over UDP.
+// See RFC 5389, section 7.2.1.
+type RetransmitPolicy struct {
+	// The initial retransmission timeout (RTO).
+	// RFC 5389: The RTO is doubled after each retransmission.
+	InitialRto time.Duration
+	// The maximum value of the retransmission timeout.
+	// RFC 3489 caps the RTO to 1.6s. RFC 5389 does not cap the RTO: the value 0 means "no limit".
+	MaxRto time.Duration
+	// Rc: the maximum number of requests to send (the first transmission included).
+	Rc int
+	// Rm: after the last request, the client waits Rm times the initial RTO before it gives up.
+	Rm int
+}
+
+// This function returns the retransmission policy described by RFC 3489.
+// RFC 3489: Clients SHOULD retransmit the request starting with an interval of 100ms, doubling
+//           every retransmit until the interval reaches 1.6s.  Retransmissions
+//           continue with intervals of 1.6s until a response is received, or a
+//           total of 9 requests have been sent.
+//
+// OUTPUT
+// - The retransmission policy.
+func RetransmitPolicyRfc3489() RetransmitPolicy {
+	return RetransmitPolicy{ InitialRto: 100 * time.Millisecond, MaxRto: 1600 * time.Millisecond, Rc: 9, Rm: 16 }
+}
+
+// This function returns the default retransmission policy described by RFC 5389.
+// RFC 5389: Rc SHOULD be configurable and SHOULD have a default of 7. Rm SHOULD be configurable and SHOULD have a
+//           default of 16. The RTO SHOULD be greater than 500 ms.
+//
+// OUTPUT
+// - The retransmission policy.
+func RetransmitPolicyRfc5389() RetransmitPolicy {
+	return RetransmitPolicy{ InitialRto: 500 * time.Millisecond, MaxRto: 0, Rc: 7, Rm: 16 }
+}
+
+// This function checks that the retransmission policy is valid.
+//
+// OUTPUT
+// - The error flag.
+func (v RetransmitPolicy) Check() error {
+	if (v.InitialRto <= 0) { return errors.New(fmt.Sprintf("Invalid retransmission policy: the initial RTO must be positive (%s).", v.InitialRto)) }
+	if (v.MaxRto < 0) || ((v.MaxRto > 0) && (v.MaxRto < v.InitialRto)) {
+		return errors.New(fmt.Sprintf("Invalid retransmission policy: invalid maximum RTO (%s).", v.MaxRto))
+	}
+	if (v.Rc < 1) { return errors.New(fmt.Sprintf("Invalid retransmission policy: Rc must be at least 1 (%d).", v.Rc)) }
+	if (v.Rm < 1) { return errors.New(fmt.Sprintf("Invalid retransmission policy: Rm must be at least 1 (%d).", v.Rm)) }
+	return nil
+}
+
+// This function returns the time to wait for a response after a given transmission of a request.
+//
+// INPUT
+// - in_index: the index of the transmission (0 for the first transmission).
+//
+// OUTPUT
+// - The time to wait.
+func (v RetransmitPolicy) __timeout(in_index int) time.Duration {
+	if (in_index >= v.Rc - 1) { return time.Duration(v.Rm) * v.InitialRto }
+	rto := v.InitialRto
+	for i := 0; i < in_index; i++ {
+		rto *= 2
+		if (v.MaxRto > 0) && (rto >= v.MaxRto) { return v.MaxRto }
+	}
+	return rto
+}
+
+// This function returns the maximum time spent on a request that gets no response.
+//
+// OUTPUT
+// - The time spent.
+func (v RetransmitPolicy) __total() time.Duration {
+	var total time.Duration = 0
+	for i := 0; i < v.Rc; i++ { total += v.__timeout(i) }
+	return total
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Requests.                                                                                        */
+/* ------------------------------------------------------------------------------------------------ */
+
 // This function sends a given request and returns the received packet.
+// The request is retransmitted according to RFC 3489.
 //
 // INPUT
 // - in_connexion: connexion to use.
+//   Please note that the connexion should not be "connected", since responses may come from a transport address that
+//   differs from the request's destination (see CHANGE-REQUEST).
+// - in_destination: the transport address of the request's destination.
 // - in_request: the request to send.
 //
 // OUTPUT
 // - The receive STUN packet.
+//   Its transaction ID is the one of the request. Packets with other transaction IDs are discarded, as well as packets
+//   that are not responses (success or error) to the request's method.
 // - A flag that indicates whether the client received a response or not.
 //   + true: the client received a response.
 //   + false: the client did not receive any response
+// - The error flag. If the response is an error response, then the error flag is a pointer to an ErrorResponse.
+func SendRequest (in_connexion net.PacketConn, in_destination net.Addr, in_request StunPacket)  (StunPacket, bool, error) {
+	return SendRequestContext(context.Background(), in_connexion, in_destination, in_request, RetransmitPolicyRfc3489())
+}
+
+// This function sends a given request and returns the received packet.
+// The request is retransmitted according to a given policy.
+//
+// INPUT
+// - in_ctx: the context. If the context is cancelled, or if its deadline expires, then the function returns the
+//   context's error.
+// - in_connexion: connexion to use.
+//   Please note that the connexion should not be "connected", since responses may come from a transport address that
+//   differs from the request's destination (see CHANGE-REQUEST).
+// - in_destination: the transport address of the request's destination.
+// - in_request: the request to send.
+// - in_policy: the retransmission policy.
+//
+// OUTPUT
+// - The receive STUN packet.
+//   Its transaction ID is the one of the request. Packets with other transaction IDs are discarded, as well as packets
+//   that are not responses (success or error) to the request's method.
+// - A flag that indicates whether the client received a response or not.
+//   + true: the client received a response.
+//   + false: the client did not receive any response
+// - The error flag. If the response is an error response, then the error flag is a pointer to an ErrorResponse.
+func SendRequestContext (in_ctx context.Context, in_connexion net.PacketConn, in_destination net.Addr, in_request StunPacket, in_policy RetransmitPolicy)  (StunPacket, bool, error) {
+	packet, _, _, received, err := __transaction(in_ctx, in_connexion, in_destination, in_request, in_policy, nil)
+	if (nil != err) || (! received) { return packet, received, err }
+	return packet, received, __errorResponse(packet)
+}
+
+// This function sends a given indication.
+// RFC 5389: Indications are not retransmitted; thus, reliability is not provided for indications.
+//
+// INPUT
+// - in_connexion: connexion to use.
+// - in_destination: the transport address of the indication's destination.
+// - in_indication: the indication to send.
+//
+// OUTPUT
 // - The error flag.
-func SendRequest (in_connexion net.Conn, in_request StunPacket)  (StunPacket, bool, error) {
+func SendIndication (in_connexion net.PacketConn, in_destination net.Addr, in_indication StunPacket) error {
+	if (STUN_CLASS_INDICATION != in_indication.GetClass()) {
+		return errors.New(fmt.Sprintf("Can not send STUN UDP packet: the packet is not an indication (type 0x%04X).", in_indication.GetType()))
+	}
+	if (verbosity > 0) {
+		tools.AddText(output, fmt.Sprintf("Sending INDICATION to \"%s\"\n\n%s\n", in_destination, Bytes2String(in_indication.ToBytes(), 4)))
+		tools.AddText(output, fmt.Sprintf("%s\n", in_indication.String(4)))
+	}
+	count, err := in_connexion.WriteTo(in_indication.ToBytes(), in_destination)
+	if (nil != err) { return errors.New(fmt.Sprintf("Can not send STUN UDP packet: %s", err)) }
+	if (len(in_indication.ToBytes()) != count) {
+		return errors.New("Can not send STUN UDP packet: The number of bytes sent is not valid.")
+	}
+	return nil
+}
+
+// This function sends a given request and returns the received packet, along with the raw response and the round trip time.
+//
+// INPUT
+// - in_ctx: the context.
+// - in_connexion: connexion to use.
+// - in_destination: the transport address of the request's destination.
+// - in_request: the request to send.
+// - in_policy: the retransmission policy.
+// - in_check: this function checks a response before it is accepted (nil: no check). If it returns an error, then the
+//   response is discarded and the function keeps waiting, as for a packet that does not match the transaction.
+//
+// OUTPUT
+// - The receive STUN packet.
+// - The list of bytes received from the network.
+// - The round trip time. It is measured from the last transmission of the request (retransmissions included).
+// - A flag that indicates whether the client received a response or not.
+// - The error flag.
+func __transaction (in_ctx context.Context, in_connexion net.PacketConn, in_destination net.Addr, in_request StunPacket, in_policy RetransmitPolicy, in_check func(StunPacket) error)  (StunPacket, []byte, time.Duration, bool, error) {
 	var rcv_packet StunPacket
-	var request_timeout int = 100
-	var retries_count int = 0
+	var sent_at time.Time
+	var err error
 	
-	sent := false
+	err = in_policy.Check()
+	if (nil != err) { return rcv_packet, nil, 0, false, err }
+	if (nil != in_ctx.Err()) { return rcv_packet, nil, 0, false, in_ctx.Err() }
+	
+	// If the context is cancelled while we are waiting for a response, then unblock the reading.
+	if (nil != in_ctx.Done()) {
+		done     := make(chan struct{})
+		finished := make(chan struct{})
+		go func() {
+			defer close(finished)
+			select {
+				case <-in_ctx.Done():
+					in_connexion.SetReadDeadline(time.Now())
+				case <-done:
+			}
+		}()
+		defer func() {
+			close(done)
+			<-finished
+		}()
+	}
 	
-	for {
-		var err error
+	// The buffer must hold the largest UDP datagram: a larger response would be truncated, and thus rejected.
+	var b []byte = make([]byte, 65536, 65536)
+	for retries_count := 0; retries_count < in_policy.Rc; retries_count++ {
 		var count int
-		var b []byte = make([]byte, 1000, 1000)
 		
 		// Dump the packet.
-		if (verbosity > 0) && !sent {	
-			tools.AddText(output, fmt.Sprintf("Sending REQUEST to \"%s\"\n\n%s\n", in_connexion.RemoteAddr(), Bytes2String(in_request.ToBytes(), 4)))
+		if (verbosity > 0) && (0 == retries_count) {	
+			tools.AddText(output, fmt.Sprintf("Sending REQUEST to \"%s\"\n\n%s\n", in_destination, Bytes2String(in_request.ToBytes(), 4)))
 			tools.AddText(output, fmt.Sprintf("%s\n", in_request.String(4)))
-			sent = true
 		}
 		
 		// Send the packet.
-		count, err = in_connexion.Write(in_request.ToBytes())
+		sent_at = time.Now()
+		count, err = in_connexion.WriteTo(in_request.ToBytes(), in_destination)
 		if err != nil {
-			return rcv_packet, false, errors.New(fmt.Sprintf("Can not send STUN UDP packet to server: %s", err))
+			return rcv_packet, nil, 0, false, errors.New(fmt.Sprintf("Can not send STUN UDP packet to server: %s", err))
 		}
 		if (len(in_request.ToBytes()) != count) {
-			return rcv_packet, false, errors.New(fmt.Sprintf("Can not send STUN UDP packet to server: The number of bytes sent is not valid."))
+			return rcv_packet, nil, 0, false, errors.New(fmt.Sprintf("Can not send STUN UDP packet to server: The number of bytes sent is not valid."))
 		}
 		
-		// RFC 3489: Wait for a response.
-		// Clients SHOULD retransmit the request starting with an interval of 100ms, doubling
-   		// every retransmit until the interval reaches 1.6s.  Retransmissions
-   		// continue with intervals of 1.6s until a response is received, or a
-   		// total of 9 requests have been sent.
-		in_connexion.SetReadDeadline(time.Now().Add( time.Duration(request_timeout) * time.Millisecond )) 
-		if (request_timeout < 1600) {
-			request_timeout *= 2
-		} else {
-			retries_count++
-		}
+		// Wait for a response, no longer than the context allows.
+		request_timeout := in_policy.__timeout(retries_count)
+		deadline        := sent_at.Add(request_timeout)
+		if ctx_deadline, ok := in_ctx.Deadline(); ok && ctx_deadline.Before(deadline) { deadline = ctx_deadline }
+		in_connexion.SetReadDeadline(deadline)
 		
 		// Wait for a response.
-		count, err = in_connexion.Read(b)
-		if (err != nil) {
-			if err.(net.Error).Timeout() { // See http://golang.org/src/pkg/net/timeout_test.go?h=Timeout%28%29
-				if retries_count >= 9 {
+		// Packets that do not match the request's transaction ID are discarded (strays or spoofs), without sending the
+		// request again.
+		timeout := false
+		for {
+			// The context may have been cancelled before the deadline was set: then the deadline set on cancellation
+			// has been overwritten.
+			if (nil != in_ctx.Err()) { return rcv_packet, nil, 0, false, in_ctx.Err() }
+			count, _, err = in_connexion.ReadFrom(b)
+			if (err != nil) {
+				if (nil != in_ctx.Err()) { return rcv_packet, nil, 0, false, in_ctx.Err() }
+				if ne, ok := err.(net.Error); ok && ne.Timeout() { // See http://golang.org/src/pkg/net/timeout_test.go?h=Timeout%28%29
+					timeout = true
 					break;
 				}
-				if verbosity > 0 {
-					tools.AddText(output, fmt.Sprintf("%sTimeout (%04d ms) exceeded, retry...", strings.Repeat(" ", 4), request_timeout))
+				return rcv_packet, nil, 0, false, errors.New(fmt.Sprintf("Error while reading packet: %s", err))
+			}
+			
+			// For nice output.
+			if (verbosity > 0) && (retries_count > 0) { tools.AddText(output, "\n") } 
+			
+			// Build the packet from the list of bytes.
+			rcv_packet, err = FromBytes(b[0:count])
+			if (nil != err) {
+				// The packet is not valid.
+				if (verbosity > 0) {
+					tools.AddText(output, fmt.Sprintf("%sThe received packet is not valid. Continue.", strings.Repeat(" ", 4)))
 				}
 				continue;
 			}
-			return rcv_packet, false, errors.New(fmt.Sprintf("Error while reading packet: %s", err))
+			
+			// Make sure that the packet is the response to the request.
+			if (! bytes.Equal(rcv_packet.GetId(), in_request.GetId())) {
+				if (verbosity > 0) {
+					tools.AddText(output, fmt.Sprintf("%sThe received packet does not match the transaction ID (% x). Discard.", strings.Repeat(" ", 4), rcv_packet.GetId()))
+				}
+				continue;
+			}
+			
+			// Make sure that the packet is a response to the request's method. A packet with the same transaction ID may
+			// be the request itself (reflected) or an indication.
+			class := rcv_packet.GetClass()
+			if ((STUN_CLASS_SUCCESS_RESPONSE != class) && (STUN_CLASS_ERROR_RESPONSE != class)) || (rcv_packet.GetMethod() != in_request.GetMethod()) {
+				if (verbosity > 0) {
+					tools.AddText(output, fmt.Sprintf("%sThe received packet (type 0x%04X) is not a response to the request. Discard.", strings.Repeat(" ", 4), rcv_packet.GetType()))
+				}
+				continue;
+			}
+			
+			// Make sure that the response is genuine (for example, that its MESSAGE-INTEGRITY is valid). A forged
+			// response must not abort the transaction.
+			if (nil != in_check) {
+				if err = in_check(rcv_packet); nil != err {
+					if (verbosity > 0) {
+						tools.AddText(output, fmt.Sprintf("%sThe received packet is rejected (%s). Discard.", strings.Repeat(" ", 4), err))
+					}
+					continue;
+				}
+			}
+			break;
 		}
 		
-		// For nice output.
-		if (verbosity > 0) && (retries_count > 0) { tools.AddText(output, "\n") } 
-		
-		// Build the packet from the list of bytes.
-		rcv_packet, err = FromBytes(b[0:count])
-		if (nil != err) {
-			// The packet is not valid.
-			if (verbosity > 0) {
-				tools.AddText(output, fmt.Sprintf("%sThe received packet is not valid. Continue.", strings.Repeat(" ", 4)))
+		if (timeout) {
+			if ctx_deadline, ok := in_ctx.Deadline(); ok && !time.Now().Before(ctx_deadline) {
+				return rcv_packet, nil, 0, false, context.DeadlineExceeded
+			}
+			if (verbosity > 0) && (retries_count < in_policy.Rc - 1) {
+				tools.AddText(output, fmt.Sprintf("%sTimeout (%04d ms) exceeded, retry...", strings.Repeat(" ", 4), request_timeout / time.Millisecond))
 			}
 			continue;
 		}
+		
 		if (verbosity > 0) { 
 			tools.AddText(output, fmt.Sprintf("Received\n\n%s\n", Bytes2String(rcv_packet.ToBytes(), 4)))
 			tools.AddText(output, fmt.Sprintf("%s\n", rcv_packet.String(4)))
 		}
 
 		// OK, a valid response has been received.		
-		return rcv_packet, true, nil
+		return rcv_packet, b[0:count], time.Since(sent_at), true, nil
 	}
 	
 	// No valid packet has been received.
 	if (verbosity > 0) { tools.AddText(output, fmt.Sprintf("")) }
-	return rcv_packet, false, nil
+	return rcv_packet, nil, 0, false, nil
 }
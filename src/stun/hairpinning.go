@@ -0,0 +1,150 @@
+// Copyright (C) 2012 Denis BEURIVE
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stun
+
+import "fmt"
+import "errors"
+import "context"
+import "tools"
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Hairpinning detection (RFC 5780, section 4.5).                                                   */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This type indicates whether the NAT supports hairpinning or not.
+// If it does, then two hosts behind the same NAT can communicate using their mapped addresses.
+type Hairpinning int
+
+// This value indicates that hairpinning has not been tested.
+const STUN_HAIRPINNING_UNKNOWN       Hairpinning = 0
+
+// This value indicates that the NAT supports hairpinning.
+const STUN_HAIRPINNING_SUPPORTED     Hairpinning = 1
+
+// This value indicates that the NAT does not support hairpinning.
+const STUN_HAIRPINNING_NOT_SUPPORTED Hairpinning = 2
+
+// This map associates a hairpinning support with its name.
+// Note: These names are used for textual serialization. They must not be changed.
+var hairpinning_names = map[Hairpinning] string {
+	STUN_HAIRPINNING_UNKNOWN:       "UNKNOWN",
+	STUN_HAIRPINNING_SUPPORTED:     "SUPPORTED",
+	STUN_HAIRPINNING_NOT_SUPPORTED: "NOT_SUPPORTED",
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* API                                                                                              */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function returns the name of the hairpinning support.
+//
+// OUTPUT
+// - The name of the hairpinning support.
+func (v Hairpinning) String() string {
+	name, ok := hairpinning_names[v]
+	if (! ok) { return fmt.Sprintf("Hairpinning(%d)", int(v)) }
+	return name
+}
+
+// This function returns the textual representation of the hairpinning support.
+// It implements the interface "encoding.TextMarshaler".
+//
+// OUTPUT
+// - The textual representation.
+// - The error flag.
+func (v Hairpinning) MarshalText() ([]byte, error) {
+	name, ok := hairpinning_names[v]
+	if (! ok) { return nil, errors.New(fmt.Sprintf("Invalid hairpinning support (%d).", int(v))) }
+	return []byte(name), nil
+}
+
+// This function sets the hairpinning support from its textual representation.
+// It implements the interface "encoding.TextUnmarshaler".
+//
+// INPUT
+// - in_text: the textual representation.
+//
+// OUTPUT
+// - The error flag.
+func (v *Hairpinning) UnmarshalText(in_text []byte) error {
+	for h, name := range hairpinning_names {
+		if (name == string(in_text)) {
+			*v = h
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("Invalid hairpinning support \"%s\".", in_text))
+}
+
+// This function tests whether the NAT supports hairpinning or not.
+// RFC 5780: The client begins by initiating test I. Using a different source address, the client then sends a second
+//           Binding Request to the mapped address from the first test. If the client receives its own request on the
+//           first socket, then the NAT supports hairpinning.
+//
+// INPUT
+// - in_ctx: the context. It can be used to cancel the test.
+//
+// OUTPUT
+// - The hairpinning support.
+//   If the server does not answer the first request, then the function returns STUN_HAIRPINNING_UNKNOWN.
+// - The tests performed, in chronological order.
+// - The error flag.
+//
+// WARNING
+// While the test runs, the client's socket must not be used for anything else.
+func (v *Client) ClientTestHairpinning(in_ctx context.Context) (Hairpinning, []DiscoveryTest, error) {
+	var tests []DiscoveryTest
+	var response requestResponse
+	var mapped string
+	var attribute StunAttribute
+	var err error
+
+	// Learn the mapped address of the client's socket.
+	if verbosity > 0 { tools.AddText(output, "Hairpinning test\n") }
+	response, err = v.ClientSendBinding(in_ctx, nil)
+	tests = append(tests, __discoveryTest("Hairpinning (binding)", response))
+	if (nil != err) { return STUN_HAIRPINNING_UNKNOWN, tests, err }
+	if (! response.response) { return STUN_HAIRPINNING_UNKNOWN, tests, nil }
+	mapped, err = __mappedAddress(response.packet)
+	if (nil != err) { return STUN_HAIRPINNING_UNKNOWN, tests, err }
+
+	// Send a request to the mapped address, from a second socket.
+	secondary, err := v.__secondarySocket()
+	if (nil != err) { return STUN_HAIRPINNING_UNKNOWN, tests, err }
+	defer secondary.Close()
+
+	packet := PacketCreate()
+	packet.SetType(STUN_TYPE_BINDING_REQUEST)
+	err = packet.SetRandomId()
+	if (nil != err) { return STUN_HAIRPINNING_UNKNOWN, tests, err }
+	attribute, err = AttributeCreateSoftware(&packet, "TestClient01")
+	if (nil != err) { return STUN_HAIRPINNING_UNKNOWN, tests, err }
+	packet.AddAttribute(attribute)
+	attribute, err = AttributeCreateFingerprint(&packet)
+	if (nil != err) { return STUN_HAIRPINNING_UNKNOWN, tests, err }
+	packet.AddAttribute(attribute)
+
+	response, _, err = v.__crossExchange(in_ctx, secondary, mapped, packet)
+	tests = append(tests, __discoveryTest("Hairpinning", response))
+	if (nil != err) { return STUN_HAIRPINNING_UNKNOWN, tests, err }
+
+	if (response.response) {
+		if verbosity > 0 { tools.AddText(output, fmt.Sprintf("% -25s: %s", "Hairpinning", "The request has been received on the mapped address.")) }
+		return STUN_HAIRPINNING_SUPPORTED, tests, nil
+	}
+	if verbosity > 0 { tools.AddText(output, fmt.Sprintf("% -25s: %s", "Hairpinning", "The request has not been received on the mapped address.")) }
+	return STUN_HAIRPINNING_NOT_SUPPORTED, tests, nil
+}
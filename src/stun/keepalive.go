@@ -0,0 +1,202 @@
+// Copyright (C) 2012 Denis BEURIVE
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stun
+
+import "fmt"
+import "errors"
+import "context"
+import "sync"
+import "time"
+import "tools"
+
+/* ------------------------------------------------------------------------------------------------ */
+/* NAT keepalive.                                                                                   */
+/* The keepalive periodically sends BINDING indications from the client's socket, so that the       */
+/* NAT bindings do not expire.                                                                      */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This type represents the parameters of the keepalive.
+type KeepalivePolicy struct {
+	// The interval between two keepalives.
+	// It should be less than the binding lifetime (see ClientProbeLifetime()).
+	Interval time.Duration
+	// Every "CheckEvery" keepalives, a BINDING request is sent instead of a BINDING indication, in order to detect changes
+	// of the mapped address. The value 0 means that the mapped address is never checked.
+	CheckEvery int
+}
+
+// This type represents a running keepalive.
+type Keepalive struct {
+	// The client.
+	client *Client
+	// The parameters.
+	policy KeepalivePolicy
+	// The function called when the mapped address changes (may be nil).
+	on_change func(string, string)
+	// The function that stops the keepalive.
+	cancel context.CancelFunc
+	// This channel is closed when the keepalive is stopped.
+	done chan struct{}
+	// This mutex protects the following fields.
+	mutex sync.Mutex
+	// The last mapped address ("" if unknown).
+	mapped string
+	// The last error.
+	err error
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* API                                                                                              */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function returns the default parameters for the keepalive.
+// RFC 5626: [...] the User Agent SHOULD send keep-alives at an interval of [...] 25 seconds for UDP.
+//
+// OUTPUT
+// - The parameters.
+func KeepalivePolicyDefault() KeepalivePolicy {
+	return KeepalivePolicy{ Interval: 25 * time.Second, CheckEvery: 0 }
+}
+
+// This function checks that the parameters are valid.
+//
+// OUTPUT
+// - The error flag.
+func (v KeepalivePolicy) Check() error {
+	if (v.Interval <= 0) { return errors.New(fmt.Sprintf("Invalid keepalive policy: the interval must be positive (%s).", v.Interval)) }
+	if (v.CheckEvery < 0) { return errors.New(fmt.Sprintf("Invalid keepalive policy: invalid check period (%d).", v.CheckEvery)) }
+	return nil
+}
+
+// This function starts a keepalive on the client's socket.
+// The keepalive runs in the background, until it is stopped (see Stop()) or until the context is cancelled.
+//
+// INPUT
+// - in_ctx: the context.
+// - in_policy: the parameters of the keepalive.
+// - in_on_change: the function called when the mapped address changes (may be nil).
+//   The function is called from the keepalive's goroutine, with the previous and the new mapped addresses.
+//   Note: this function is called only if the mapped address is checked (see KeepalivePolicy.CheckEvery).
+//
+// OUTPUT
+// - The keepalive.
+// - The error flag.
+//
+// WARNING
+// If the mapped address is checked, then the client's socket must not be used for other requests while the keepalive
+// runs. Indications can be sent at any time.
+func (v *Client) ClientKeepalive(in_ctx context.Context, in_policy KeepalivePolicy, in_on_change func(string, string)) (*Keepalive, error) {
+	err := in_policy.Check()
+	if (nil != err) { return nil, err }
+
+	ctx, cancel := context.WithCancel(in_ctx)
+	keepalive := &Keepalive{ client: v, policy: in_policy, on_change: in_on_change, cancel: cancel, done: make(chan struct{}) }
+	go keepalive.__run(ctx)
+	return keepalive, nil
+}
+
+// This function stops the keepalive. It returns once the keepalive's goroutine has terminated.
+func (v *Keepalive) Stop() {
+	v.cancel()
+	<-v.done
+}
+
+// This function returns the last mapped address learned by the keepalive.
+//
+// OUTPUT
+// - The mapped address ("" if unknown).
+//   This value is written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+func (v *Keepalive) MappedAddress() string {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.mapped
+}
+
+// This function returns the last error that occurred while sending a keepalive.
+// Errors do not stop the keepalive.
+//
+// OUTPUT
+// - The last error (nil if none).
+func (v *Keepalive) Err() error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.err
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Privates                                                                                         */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function runs the keepalive.
+//
+// INPUT
+// - in_ctx: the context.
+func (v *Keepalive) __run(in_ctx context.Context) {
+	defer close(v.done)
+
+	// Learn the initial mapped address.
+	if (v.policy.CheckEvery > 0) { v.__check(in_ctx) }
+
+	ticker := time.NewTicker(v.policy.Interval)
+	defer ticker.Stop()
+	for count := 1; ; count++ {
+		select {
+			case <-in_ctx.Done():
+				return
+			case <-ticker.C:
+		}
+
+		if (v.policy.CheckEvery > 0) && (0 == count % v.policy.CheckEvery) {
+			v.__check(in_ctx)
+			continue
+		}
+		err := v.client.ClientSendBindingIndication(nil)
+		if (nil != err) { v.__setError(err) }
+	}
+}
+
+// This function sends a BINDING request and checks the mapped address.
+//
+// INPUT
+// - in_ctx: the context.
+func (v *Keepalive) __check(in_ctx context.Context) {
+	response, err := v.client.ClientSendBinding(in_ctx, nil)
+	if (nil != in_ctx.Err()) { return }
+	if (nil != err) { v.__setError(err); return }
+	if (! response.response) { v.__setError(errors.New("The server did not answer the keepalive request.")); return }
+	mapped, err := __mappedAddress(response.packet)
+	if (nil != err) { v.__setError(err); return }
+
+	v.mutex.Lock()
+	previous := v.mapped
+	v.mapped = mapped
+	v.mutex.Unlock()
+
+	if ("" != previous) && (previous != mapped) {
+		if verbosity > 0 { tools.AddText(output, fmt.Sprintf("% -25s: %s -> %s", "Mapped address changed", previous, mapped)) }
+		if (nil != v.on_change) { v.on_change(previous, mapped) }
+	}
+}
+
+// This function records an error.
+//
+// INPUT
+// - in_err: the error.
+func (v *Keepalive) __setError(in_err error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.err = in_err
+}
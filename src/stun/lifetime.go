@@ -0,0 +1,241 @@
+// Copyright (C) 2012 Denis BEURIVE
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stun
+
+import "fmt"
+import "net"
+import "errors"
+import "context"
+import "time"
+import "tools"
+
+/* ------------------------------------------------------------------------------------------------ */
+/* NAT binding lifetime discovery (RFC 5780, section 4.6).                                          */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This type represents the parameters of the binding lifetime discovery.
+type LifetimePolicy struct {
+	// The first interval tested. The interval is doubled until the binding expires.
+	Initial time.Duration
+	// The longest interval tested.
+	Max time.Duration
+	// Once the binding expired, a binary search is performed between the longest interval after which the binding
+	// was alive and the shortest interval after which the binding had expired. The search stops when the difference
+	// between these intervals is less than, or equal to, this value.
+	Precision time.Duration
+}
+
+// This type represents the result of the binding lifetime discovery.
+type LifetimeResult struct {
+	// The longest interval after which the binding was still alive (0 if the binding never survived).
+	// This is the estimated binding lifetime: keepalives should be sent more often than that.
+	Lifetime time.Duration
+	// The shortest interval after which the binding had expired (0 if the binding survived all the intervals).
+	Expired time.Duration
+	// This flag indicates whether the server supports the attribute RESPONSE-PORT or not.
+	// If it does not, then the client checks the binding by sending a request from the client's socket, and by
+	// comparing the mapped addresses. This method is less reliable: a NAT may allocate the same mapping again.
+	ResponsePort bool
+	// The tests performed, in chronological order.
+	Tests []DiscoveryTest
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* API                                                                                              */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function returns the default parameters for the binding lifetime discovery.
+//
+// OUTPUT
+// - The parameters.
+func LifetimePolicyDefault() LifetimePolicy {
+	return LifetimePolicy{ Initial: 10 * time.Second, Max: 20 * time.Minute, Precision: 5 * time.Second }
+}
+
+// This function checks that the parameters are valid.
+//
+// OUTPUT
+// - The error flag.
+func (v LifetimePolicy) Check() error {
+	if (v.Initial <= 0) { return errors.New(fmt.Sprintf("Invalid lifetime policy: the initial interval must be positive (%s).", v.Initial)) }
+	if (v.Max < v.Initial) { return errors.New(fmt.Sprintf("Invalid lifetime policy: invalid maximum interval (%s).", v.Max)) }
+	if (v.Precision <= 0) { return errors.New(fmt.Sprintf("Invalid lifetime policy: the precision must be positive (%s).", v.Precision)) }
+	return nil
+}
+
+// This function measures how long a NAT binding survives without traffic.
+// RFC 5780: The client begins by sending a Binding Request from socket X to the server. After a time T, the client
+//           sends a Binding Request from a second socket Y, with the RESPONSE-PORT attribute set to the port of the
+//           mapped address learned from X. If the response is received on X, the binding is still alive.
+// The interval T is doubled until the binding expires, then a binary search is performed.
+//
+// INPUT
+// - in_ctx: the context. It can be used to cancel the discovery process.
+// - in_policy: the parameters of the discovery process.
+//
+// OUTPUT
+// - The result of the discovery process.
+// - The error flag.
+//
+// WARNING
+// The discovery process may take a long time (several times the binding lifetime). While it runs, the client's socket
+// must not be used for anything else.
+func (v *Client) ClientProbeLifetime(in_ctx context.Context, in_policy LifetimePolicy) (LifetimeResult, error) {
+	var result LifetimeResult
+	var err error
+	var alive bool
+	var secondary *net.UDPConn
+	var lower, upper time.Duration = 0, 0
+
+	err = in_policy.Check()
+	if (nil != err) { return result, err }
+
+	// Open socket Y, on the same IP address as socket X.
+	secondary, err = v.__secondarySocket()
+	if (nil != err) { return result, err }
+	defer secondary.Close()
+
+	// Increase the interval until the binding expires.
+	result.ResponsePort = true
+	interval := in_policy.Initial
+	for {
+		alive, err = v.__probeLifetime(in_ctx, secondary, interval, &result)
+		if (nil != err) { return result, err }
+		if (! alive) { upper = interval; break }
+		lower = interval
+		if (interval >= in_policy.Max) { break }
+		interval *= 2
+		if (interval > in_policy.Max) { interval = in_policy.Max }
+	}
+
+	// Binary search.
+	for (upper > 0) && (upper - lower > in_policy.Precision) {
+		interval = lower + (upper - lower) / 2
+		alive, err = v.__probeLifetime(in_ctx, secondary, interval, &result)
+		if (nil != err) { return result, err }
+		if (alive) { lower = interval } else { upper = interval }
+	}
+
+	result.Lifetime = lower
+	result.Expired  = upper
+	if verbosity > 0 { tools.AddText(output, fmt.Sprintf("% -25s: %s", "Binding lifetime", result.Lifetime)) }
+	return result, nil
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Privates                                                                                         */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function checks whether a binding survives a given interval without traffic.
+//
+// INPUT
+// - in_ctx: the context.
+// - in_secondary: socket Y.
+// - in_interval: the interval.
+// - out_result: the result of the discovery process.
+//
+// OUTPUT
+// - This flag indicates whether the binding was still alive after the interval.
+// - The error flag.
+func (v *Client) __probeLifetime(in_ctx context.Context, in_secondary net.PacketConn, in_interval time.Duration, out_result *LifetimeResult) (bool, error) {
+	var err error
+	var response requestResponse
+	var mapped, mapped_again string
+	var supported, alive bool
+
+	// Open (or refresh) the binding from socket X.
+	if verbosity > 0 { tools.AddText(output, fmt.Sprintf("Binding lifetime: test %s\n", in_interval)) }
+	response, err = v.ClientSendBinding(in_ctx, nil)
+	out_result.Tests = append(out_result.Tests, __discoveryTest(fmt.Sprintf("Binding (T=%s)", in_interval), response))
+	if (nil != err) { return false, err }
+	if (! response.response) { return false, errors.New("The server did not answer the request.") }
+	mapped, err = __mappedAddress(response.packet)
+	if (nil != err) { return false, err }
+
+	// Wait.
+	select {
+		case <-in_ctx.Done():
+			return false, in_ctx.Err()
+		case <-time.After(in_interval):
+	}
+
+	// Check the binding from socket Y.
+	if (out_result.ResponsePort) {
+		_, port, err := tools.InetSplit(mapped)
+		if (nil != err) { return false, err }
+		alive, supported, err = v.__probeResponsePort(in_ctx, in_secondary, uint16(port), fmt.Sprintf("Probe (T=%s)", in_interval), out_result)
+		if (nil != err) { return false, err }
+		if (supported) { return alive, nil }
+		if verbosity > 0 { tools.AddText(output, "The server does not support RESPONSE-PORT. Check the binding from the client's socket.") }
+		out_result.ResponsePort = false
+	}
+
+	// The server does not support RESPONSE-PORT: check the binding from socket X.
+	response, err = v.ClientSendBinding(in_ctx, nil)
+	out_result.Tests = append(out_result.Tests, __discoveryTest(fmt.Sprintf("Probe (T=%s)", in_interval), response))
+	if (nil != err) { return false, err }
+	if (! response.response) { return false, errors.New("The server did not answer the request.") }
+	mapped_again, err = __mappedAddress(response.packet)
+	if (nil != err) { return false, err }
+	return mapped_again == mapped, nil
+}
+
+// This function sends a BINDING request from socket Y, with the attribute RESPONSE-PORT, and waits for the response on
+// the client's socket (X).
+//
+// INPUT
+// - in_ctx: the context.
+// - in_secondary: socket Y.
+// - in_port: the port of the mapped address of socket X.
+// - in_name: the name of the test.
+// - out_result: the result of the discovery process.
+//
+// OUTPUT
+// - This flag indicates whether the response has been received on socket X.
+// - This flag indicates whether the server supports RESPONSE-PORT.
+// - The error flag.
+func (v *Client) __probeResponsePort(in_ctx context.Context, in_secondary net.PacketConn, in_port uint16, in_name string, out_result *LifetimeResult) (bool, bool, error) {
+	var attribute StunAttribute
+	var err error
+	var response requestResponse
+	var answered bool
+
+	packet := PacketCreate()
+	packet.SetType(STUN_TYPE_BINDING_REQUEST)
+	err = packet.SetRandomId()
+	if (nil != err) { return false, false, err }
+	attribute, err = AttributeCreateSoftware(&packet, "TestClient01")
+	if (nil != err) { return false, false, err }
+	packet.AddAttribute(attribute)
+	attribute, err = AttributeCreateResponsePort(&packet, in_port)
+	if (nil != err) { return false, false, err }
+	packet.AddAttribute(attribute)
+	attribute, err = AttributeCreateFingerprint(&packet)
+	if (nil != err) { return false, false, err }
+	packet.AddAttribute(attribute)
+
+	response, answered, err = v.__crossExchange(in_ctx, in_secondary, v.server_transport_address, packet)
+	out_result.Tests = append(out_result.Tests, __discoveryTest(in_name, response))
+	if (nil != err) { return false, true, err }
+	if (response.response) { return true, true, nil }
+
+	// The response has been sent to socket Y: the server ignored RESPONSE-PORT (or rejected it).
+	if (answered) {
+		if e, ok := __errorResponse(response.packet).(*ErrorResponse); ok && (STUN_ERROR_UNKNOWN_ATTRIBUTE != e.Code) { return false, true, e }
+		return false, false, nil
+	}
+	return false, true, nil
+}
@@ -16,6 +16,8 @@
 package stun
 
 import "bytes"
+import "crypto/rand"
+import "crypto/hmac"
 import "encoding/binary"
 import "fmt"
 import "errors"
@@ -44,6 +46,10 @@ const STUN_TYPE_BINDING_RESPONSE					= 0x0101
 //      http://www.iana.org/assignments/stun-parameters/stun-parameters.xml
 const STUN_TYPE_BINDING_ERROR_RESPONSE				= 0x0111
 
+// See: Session Traversal Utilities for NAT (STUN) Parameters
+//      http://www.iana.org/assignments/stun-parameters/stun-parameters.xml
+const STUN_TYPE_BINDING_INDICATION					= 0x0011
+
 // See: Session Traversal Utilities for NAT (STUN) Parameters
 //      http://www.iana.org/assignments/stun-parameters/stun-parameters.xml
 const STUN_TYPE_SHARED_SECRET_REQUEST				= 0x0002
@@ -104,6 +110,14 @@ const STUN_TYPE_DATA_RESPONSE						= 0x0107
 //      http://www.iana.org/assignments/stun-parameters/stun-parameters.xml
 const STUN_TYPE_DATA_ERROR_RESPONSE					= 0x0117
 
+// See: Session Traversal Utilities for NAT (STUN) Parameters
+//      http://www.iana.org/assignments/stun-parameters/stun-parameters.xml
+const STUN_TYPE_SEND_INDICATION						= 0x0016
+
+// See: Session Traversal Utilities for NAT (STUN) Parameters
+//      http://www.iana.org/assignments/stun-parameters/stun-parameters.xml
+const STUN_TYPE_DATA_INDICATION						= 0x0017
+
 // See: Session Traversal Utilities for NAT (STUN) Parameters
 //      http://www.iana.org/assignments/stun-parameters/stun-parameters.xml
 const STUN_TYPE_CREATE_PERMISIION					= 0x0008
@@ -170,6 +184,7 @@ var message_types = map[uint16] string {
 	STUN_TYPE_BINDING_REQUEST:                         "BINDING_REQUEST",
 	STUN_TYPE_BINDING_RESPONSE:                        "BINDING_RESPONSE",
 	STUN_TYPE_BINDING_ERROR_RESPONSE:                  "BINDING_ERROR_RESPONSE",
+	STUN_TYPE_BINDING_INDICATION:                      "BINDING_INDICATION",
 	STUN_TYPE_SHARED_SECRET_REQUEST:                   "SHARED_SECRET_REQUEST",
 	STUN_TYPE_SHARED_SECRET_RESPONSE:                  "SHARED_SECRET_RESPONSE",
 	STUN_TYPE_SHARED_ERROR_RESPONSE:                   "SHARED_ERROR_RESPONSE",
@@ -185,6 +200,8 @@ var message_types = map[uint16] string {
 	STUN_TYPE_DATA:                                    "DATA",
 	STUN_TYPE_DATA_RESPONSE:                           "DATA_RESPONSE",
 	STUN_TYPE_DATA_ERROR_RESPONSE:                     "DATA_ERROR_RESPONSE",
+	STUN_TYPE_SEND_INDICATION:                         "SEND_INDICATION",
+	STUN_TYPE_DATA_INDICATION:                         "DATA_INDICATION",
 	STUN_TYPE_CREATE_PERMISIION:                       "CREATE_PERMISIION",
 	STUN_TYPE_CREATE_PERMISIION_RESPONSE:              "CREATE_PERMISIION_RESPONSE",
 	STUN_TYPE_CREATE_PERMISIION_ERROR_RESPONSE:        "CREATE_PERMISIION_ERROR_RESPONSE",
@@ -202,6 +219,139 @@ var message_types = map[uint16] string {
 	STUN_TYPE_CONNECTION_ATTEMPT_ERROR_RESPONSE:       "CONNECTION_ATTEMPT_ERROR_RESPONSE",
 }
 
+/* ------------------------------------------------------------------------------------------------ */
+/* Message classes and methods.                                                                     */
+/*                                                                                                  */
+/* RFC 5389: The message type field is decomposed further into the following structure:            */
+/*                                                                                                  */
+/*                 0                 1                                                              */
+/*                 2  3  4 5 6 7 8 9 0 1 2 3 4 5                                                    */
+/*                +--+--+-+-+-+-+-+-+-+-+-+-+-+-+                                                   */
+/*                |M |M |M|M|M|C|M|M|M|C|M|M|M|M|                                                   */
+/*                |11|10|9|8|7|1|6|5|4|0|3|2|1|0|                                                   */
+/*                +--+--+-+-+-+-+-+-+-+-+-+-+-+-+                                                   */
+/* ------------------------------------------------------------------------------------------------ */
+
+// Class: request.
+const STUN_CLASS_REQUEST					= 0x00
+
+// Class: indication.
+const STUN_CLASS_INDICATION					= 0x01
+
+// Class: success response.
+const STUN_CLASS_SUCCESS_RESPONSE			= 0x02
+
+// Class: error response.
+const STUN_CLASS_ERROR_RESPONSE				= 0x03
+
+// This map associates a class with its name.
+var class_names = map[uint16] string {
+	STUN_CLASS_REQUEST:				"Request",
+	STUN_CLASS_INDICATION:			"Indication",
+	STUN_CLASS_SUCCESS_RESPONSE:	"Success Response",
+	STUN_CLASS_ERROR_RESPONSE:		"Error Response",
+}
+
+// Method: Binding (RFC 5389).
+const STUN_METHOD_BINDING					= 0x001
+
+// Method: Shared Secret (RFC 3489).
+const STUN_METHOD_SHARED_SECRET				= 0x002
+
+// Method: Allocate (RFC 5766).
+const STUN_METHOD_ALLOCATE					= 0x003
+
+// Method: Refresh (RFC 5766).
+const STUN_METHOD_REFRESH					= 0x004
+
+// Method: Send (RFC 5766).
+const STUN_METHOD_SEND						= 0x006
+
+// Method: Data (RFC 5766).
+const STUN_METHOD_DATA						= 0x007
+
+// Method: CreatePermission (RFC 5766).
+const STUN_METHOD_CREATE_PERMISSION			= 0x008
+
+// Method: ChannelBind (RFC 5766).
+const STUN_METHOD_CHANNEL_BIND				= 0x009
+
+// Method: Connect (RFC 6062).
+const STUN_METHOD_CONNECT					= 0x00A
+
+// Method: ConnectionBind (RFC 6062).
+const STUN_METHOD_CONNECTION_BIND			= 0x00B
+
+// Method: ConnectionAttempt (RFC 6062).
+const STUN_METHOD_CONNECTION_ATTEMPT		= 0x00C
+
+// This map associates a method with its name.
+var method_names = map[uint16] string {
+	STUN_METHOD_BINDING:				"Binding",
+	STUN_METHOD_SHARED_SECRET:			"Shared Secret",
+	STUN_METHOD_ALLOCATE:				"Allocate",
+	STUN_METHOD_REFRESH:				"Refresh",
+	STUN_METHOD_SEND:					"Send",
+	STUN_METHOD_DATA:					"Data",
+	STUN_METHOD_CREATE_PERMISSION:		"CreatePermission",
+	STUN_METHOD_CHANNEL_BIND:			"ChannelBind",
+	STUN_METHOD_CONNECT:				"Connect",
+	STUN_METHOD_CONNECTION_BIND:		"ConnectionBind",
+	STUN_METHOD_CONNECTION_ATTEMPT:		"ConnectionAttempt",
+}
+
+// This function extracts the method from a message type.
+//
+// INPUT
+// - in_type: the message type.
+//
+// OUTPUT
+// - The method (12 bits, constant STUN_METHOD_...).
+func TypeGetMethod(in_type uint16) uint16 {
+	return (in_type & 0x000F) | ((in_type & 0x00E0) >> 1) | ((in_type & 0x3E00) >> 2)
+}
+
+// This function extracts the class from a message type.
+//
+// INPUT
+// - in_type: the message type.
+//
+// OUTPUT
+// - The class (constant STUN_CLASS_...).
+func TypeGetClass(in_type uint16) uint16 {
+	return ((in_type & 0x0010) >> 4) | ((in_type & 0x0100) >> 7)
+}
+
+// This function composes a message type from a method and a class.
+//
+// INPUT
+// - in_method: the method (12 bits, constant STUN_METHOD_...).
+// - in_class: the class (constant STUN_CLASS_...).
+//
+// OUTPUT
+// - The message type.
+// - The error flag.
+func TypeCreate(in_method uint16, in_class uint16) (uint16, error) {
+	if (in_method > 0x0FFF) { return 0, errors.New(fmt.Sprintf("Invalid method (0x%04x). A method is 12 bits long.", in_method)) }
+	if (in_class > 0x03) { return 0, errors.New(fmt.Sprintf("Invalid class (0x%02x).", in_class)) }
+	return (in_method & 0x000F) | ((in_method & 0x0070) << 1) | ((in_method & 0x0F80) << 2) |
+	       ((in_class & 0x01) << 4) | ((in_class & 0x02) << 7), nil
+}
+
+// This function returns the name of a message type.
+// Example: "Binding Success Response".
+//
+// INPUT
+// - in_type: the message type.
+//
+// OUTPUT
+// - The name of the message type.
+func TypeString(in_type uint16) string {
+	method, ok := method_names[TypeGetMethod(in_type)]
+	if (! ok) { method = fmt.Sprintf("Method 0x%03x", TypeGetMethod(in_type)) }
+	return method + " " + class_names[TypeGetClass(in_type)]
+}
+
 /* ------------------------------------------------------------------------------------------------ */
 /* Error values.                                                                                    */
 /*                                                                                                  */
@@ -368,6 +518,22 @@ func (v *StunPacket) GetType() uint16 {
 	return v.stype
 }
 
+// Get the packet's method.
+//
+// OUTPUT
+// - The packet's method (constant STUN_METHOD_...).
+func (v *StunPacket) GetMethod() uint16 {
+	return TypeGetMethod(v.stype)
+}
+
+// Get the packet's class.
+//
+// OUTPUT
+// - The packet's class (constant STUN_CLASS_...).
+func (v *StunPacket) GetClass() uint16 {
+	return TypeGetClass(v.stype)
+}
+
 // Set the packet's length.
 //
 // INPUT
@@ -402,6 +568,32 @@ func (v *StunPacket) GetId() []byte {
 	return v.id
 }
 
+// Set a new transaction ID to the packet.
+// The ID is made of 96 random bits, produced by a cryptographically secure generator.
+//
+// OUTPUT
+// - The error flag.
+func (v *StunPacket) SetRandomId() error {
+	id, err := TransactionIdCreate()
+	if (nil != err) { return err }
+	v.SetId(id)
+	return nil
+}
+
+// This function creates a new transaction ID.
+// RFC 5389: The transaction ID MUST be uniformly and randomly chosen from the interval 0 .. 2**96-1,
+//           and SHOULD be cryptographically random.
+//
+// OUTPUT
+// - The transaction ID (12 bytes).
+// - The error flag.
+func TransactionIdCreate() ([]byte, error) {
+	var id []byte = make([]byte, 12, 12)
+	_, err := rand.Read(id)
+	if (nil != err) { return nil, errors.New(fmt.Sprintf("Can not generate a transaction ID: %s", err)) }
+	return id, nil
+}
+
 // Set the packet's magic cookie.
 //
 // INPUT
@@ -501,41 +693,54 @@ func (v *StunPacket) ToBytes() []byte {
 }
 
 // This function converts a sequence of bytes into a STUN packet.
+// The sequence of bytes is considered untrusted: it is fully validated, and the function never panics.
+// If FINGERPRINT verification is activated (see SetFingerprintCheck()), then the function checks that the FINGERPRINT
+// attribute, if present, is the last attribute and that its value is valid.
 //
 // INPUT
 // - in_bin: the sequence of bytes.
 //
 // OUTPUT
 // - The STUN packet.
-// - The error flag.
+// - The error flag. If the sequence of bytes is not a valid STUN packet, then the error flag is a pointer to a
+//   DecodeError.
 func FromBytes(in_bin []byte) (StunPacket, error) {
 	var res StunPacket = PacketCreate()
 	var err error
 	
 	if (len(in_bin) < 20) {
-		return res, errors.New(fmt.Sprintf("The given list of bytes does not represent a STUN packet. Only %d bytes.", len(in_bin)))
+		return res, __decodeError(STUN_DECODE_ERROR_SIZE, 0, fmt.Sprintf("only %d bytes, the header is 20 bytes long", len(in_bin)))
 	}
 	if (len(in_bin) > 65535) {
-		return res, errors.New(fmt.Sprintf("The given list of bytes does not represent a STUN packet. %d bytes.", len(in_bin)))
+		return res, __decodeError(STUN_DECODE_ERROR_SIZE, 0, fmt.Sprintf("%d bytes, more than 65535 bytes", len(in_bin)))
 	}
 	
 	// Decode the message's type.
-	var stype uint16
-	err = binary.Read(bytes.NewBuffer(in_bin[0:2]), binary.BigEndian, &stype)
-	if (nil != err) { panic("Internal error") }
+	// RFC 5389: The most significant 2 bits of every STUN message MUST be zeroes.
+	stype := binary.BigEndian.Uint16(in_bin[0:2])
+	if (0 != stype & 0xC000) {
+		return res, __decodeError(STUN_DECODE_ERROR_TYPE, 0, fmt.Sprintf("the two leading bits of the type (0x%04x) are not zeroes", stype))
+	}
 	res.SetType(stype)
 	
-	// Get the length
-	var length uint16
-	err = binary.Read(bytes.NewBuffer(in_bin[2:4]), binary.BigEndian, &length)
-	if (nil != err) { panic("Internal error") }
-	res.SetLength(length)
+	// Get the length.
+	// RFC 5389: The message length MUST contain the size, in bytes, of the message not including the 20-byte STUN
+	//           header. [...] the last 2 bits of this field are always zero.
+	// Note: the length is calculated while attributes are added to the packet (see AddAttribute()).
+	length := binary.BigEndian.Uint16(in_bin[2:4])
+	if (0 != length % 4) {
+		return res, __decodeError(STUN_DECODE_ERROR_LENGTH, 2, fmt.Sprintf("the length (%d) is not a multiple of 4", length))
+	}
+	if (int(length) != len(in_bin) - 20) {
+		return res, __decodeError(STUN_DECODE_ERROR_LENGTH, 2, fmt.Sprintf("the length (%d) does not match the size of the datagram (%d bytes)", length, len(in_bin)))
+	}
 	
-	// Get the magik cookie
-	var cookie uint32
-	err = binary.Read(bytes.NewBuffer(in_bin[4:8]), binary.BigEndian, &cookie)
-	if (nil != err) { panic("Internal error") }
-	// if (STUN_MAGIC_COOKIE != cookie) { return res, errors.New(fmt.Sprintf("The value of the magic cookie is not correct (%d).", cookie)) }
+	// Get the magik cookie.
+	// Note: RFC 3489 does not define the magic cookie (these bytes are part of the transaction ID).
+	cookie := binary.BigEndian.Uint32(in_bin[4:8])
+	if (STUN_RFC_5389 == rfc) && (STUN_MAGIC_COOKIE != cookie) {
+		return res, __decodeError(STUN_DECODE_ERROR_COOKIE, 4, fmt.Sprintf("the value of the magic cookie is not correct (0x%08x)", cookie))
+	}
 	res.SetCookie(cookie)
 	
 	// Get the ID
@@ -545,37 +750,59 @@ func FromBytes(in_bin []byte) (StunPacket, error) {
 	// For RFC 5389 only:
 	//     Please keep in mind that values contain padding.
 	//     Lengthes of attribltes' values don't include the padding's length.
-	var pos uint16 = 20
-	for	{
-		var vtype  uint16
-		var length uint16
-		var value  []byte
+	var pos int = 20
+	var fingerprint_pos int = -1
+	for	pos < len(in_bin) {
 		var attribute StunAttribute
-		if (pos >= uint16(len(in_bin))) { break }
 		
-		// Type of the attribute.
-		err = binary.Read(bytes.NewBuffer(in_bin[pos:pos+2]), binary.BigEndian, &vtype)
-		if (nil != err) { return res, errors.New("Invalid STUN packet: can not decode attributes!") }
+		if (pos + 4 > len(in_bin)) {
+			return res, __decodeError(STUN_DECODE_ERROR_ATTRIBUTE, pos, "truncated attribute's header")
+		}
 		
-		// Length of the attribute (without the padding !!!!!!)
-		err = binary.Read(bytes.NewBuffer(in_bin[pos+2:pos+4]), binary.BigEndian, &length)
-		if (nil != err) { return res, errors.New("Invalid STUN packet: can not decode attributes!") }
+		// Type and length of the attribute (without the padding !!!!!!)
+		vtype  := binary.BigEndian.Uint16(in_bin[pos:pos+2])
+		length := int(binary.BigEndian.Uint16(in_bin[pos+2:pos+4]))
 		
-		// The value.
-		value          = in_bin[pos+4:pos+4+length]
-		attribute, err = AttributeCreate(vtype, value, &res)
-		if (nil != err) {
-			return res, err
+		// Take care of the padding.
+		padded := length
+		if (STUN_RFC_5389 == rfc) {
+			padded = int(__nextBoundary(uint16(length)))
+		} else if (0 != length % 4) {
+			return res, __decodeError(STUN_DECODE_ERROR_PADDING, pos + 2, fmt.Sprintf("STUN is configured to be compliant with RFC 3489: the length of attribute 0x%04x (%d) must be a multiple of 4", vtype, length))
+		}
+		if (pos + 4 + length > len(in_bin)) {
+			return res, __decodeError(STUN_DECODE_ERROR_ATTRIBUTE, pos, fmt.Sprintf("the value of attribute 0x%04x (%d bytes) exceeds the packet", vtype, length))
+		}
+		if (pos + 4 + padded > len(in_bin)) {
+			return res, __decodeError(STUN_DECODE_ERROR_PADDING, pos, fmt.Sprintf("the padding of attribute 0x%04x exceeds the packet", vtype))
+		}
+		
+		// RFC 5389: the FINGERPRINT attribute MUST be the last attribute in the message.
+		if (fingerprint_pos >= 0) && (__fingerprintCheck()) {
+			return res, __decodeError(STUN_DECODE_ERROR_FINGERPRINT, pos, fmt.Sprintf("attribute 0x%04x follows FINGERPRINT", vtype))
 		}
+		if (STUN_ATTRIBUT_FINGERPRINT == vtype) { fingerprint_pos = pos }
+		
+		// The value.
+		attribute, err = AttributeCreate(vtype, in_bin[pos+4:pos+4+length], &res)
+		if (nil != err) { return res, __decodeError(STUN_DECODE_ERROR_ATTRIBUTE, pos, err.Error()) }
+		
+		// RFC 5389: the padding bits may be any value. Keep them, since they are covered by MESSAGE-INTEGRITY.
+		copy(attribute.Value[length:], in_bin[pos+4+length:pos+4+padded])
 		res.AddAttribute(attribute)
 		
 		// 4 bytes: for the attribute's header.
-		if (STUN_RFC_3489 == rfc) {
-			pos += 4 + length
-			if (0 != pos % 4) { panic("STUN is configured to be compliant with RFC 3489! Value's length must be a multiple of 4 bytes!") }
-		} else {
-			// RFC 5389 only: we must take care of the padding.
-			pos += 4 + __nextBoundary(length)
+		pos += 4 + padded
+	}
+	
+	// Verify the fingerprint.
+	if (fingerprint_pos >= 0) && (__fingerprintCheck()) {
+		a := res.GetAttribute(res.GetAttributesCount() - 1)
+		crc, err := a.AttributeGetFingerprint()
+		if (nil != err) { return res, __decodeError(STUN_DECODE_ERROR_FINGERPRINT, fingerprint_pos, err.Error()) }
+		expected := __stunCrc32(in_bin[0:fingerprint_pos])
+		if (expected != crc) {
+			return res, __decodeError(STUN_DECODE_ERROR_FINGERPRINT, fingerprint_pos, fmt.Sprintf("FINGERPRINT mismatch (received 0x%08x, expected 0x%08x)", crc, expected))
 		}
 	}
 	
@@ -590,10 +817,8 @@ func (v *StunPacket) String(in_indent int) (string) {
 	indent := strings.Repeat(" ", in_indent)
 	lines  := make([]string, 0, 10)
 	var mt string;
-	var ok bool
 	
-	mt, ok = message_types[v.GetType()]
-	if (! ok) { mt = "Unknown message type" }
+	mt = TypeString(v.GetType())
 	
 	lines = append(lines, fmt.Sprintf("%s% -21s: 0x%04x (%s)",	indent,	"Type",   				v.GetType(),	mt))
 	lines = append(lines, fmt.Sprintf("%s% -21s: %d (0x%04x)",	indent, "Length", 				v.GetLength(),	v.GetLength()))
@@ -652,7 +877,7 @@ func Bytes2String(in_bytes []byte, in_indent int) string {
 				tokens = append(tokens, fmt.Sprintf("%02x", in_bytes[nb*4+i]))
 			}
 		}
-		text = append(text, fmt.Sprintf("%s %s %s %s", indent, tokens[0], tokens[1], tokens[2], tokens[3]))
+		text = append(text, fmt.Sprintf("%s%s %s %s %s", indent, tokens[0], tokens[1], tokens[2], tokens[3]))
 	}
 	
 	return strings.Join(text, "\n")	
@@ -698,6 +923,46 @@ func (v *StunPacket) GetChangedAddress() (bool, uint16, string, uint16, error) {
 	return false, 0, "", 0, nil
 }
 
+// This function extracts the "other" address from a packet (RFC 5780).
+//
+// OUTPUT
+// - This flag indicates whether the packet contains the searched attribute.
+//   + true: the packet contains the searched attribute.
+//   + false: the packet does not contain the searched attribute.
+// - The IP family.
+// - The IP address.
+// - The port number.
+// - The error flag.
+func (v *StunPacket) GetOtherAddress() (bool, uint16, string, uint16, error) {
+	for i := 0; i < v.GetAttributesCount(); i++ {
+		a := v.GetAttribute(i)
+		if STUN_ATTRIBUT_OTHER_ADDRESS != a.Type { continue; }
+		f, ip, p, err := a.__getAddress()
+		return true, f, ip, p, err
+	}
+	return false, 0, "", 0, nil
+}
+
+// This function extracts the "response origin" address from a packet (RFC 5780).
+//
+// OUTPUT
+// - This flag indicates whether the packet contains the searched attribute.
+//   + true: the packet contains the searched attribute.
+//   + false: the packet does not contain the searched attribute.
+// - The IP family.
+// - The IP address.
+// - The port number.
+// - The error flag.
+func (v *StunPacket) GetResponseOrigin() (bool, uint16, string, uint16, error) {
+	for i := 0; i < v.GetAttributesCount(); i++ {
+		a := v.GetAttribute(i)
+		if STUN_ATTRIBUT_RESPONSE_ORIGIN != a.Type { continue; }
+		f, ip, p, err := a.__getAddress()
+		return true, f, ip, p, err
+	}
+	return false, 0, "", 0, nil
+}
+
 // This function extracts the xored mapped address from a packet.
 //
 // OUTPUT
@@ -721,4 +986,206 @@ func (v *StunPacket) GetXorMappedAddress() (bool, uint16, string, uint16, error)
 	return false, 0, "", 0, nil
 }
 
+// This function extracts the "xored" peer address from a packet (RFC 5766).
+//
+// OUTPUT
+// - This flag indicates whether the packet contains the searched attribute.
+//   + true: the packet contains the searched attribute.
+//   + false: the packet does not contain the searched attribute.
+// - The IP family.
+// - The IP address.
+// - The port number.
+// - The error flag.
+func (v *StunPacket) GetXorPeerAddress() (bool, uint16, string, uint16, error) {
+	for i := 0; i < v.GetAttributesCount(); i++ {
+		a := v.GetAttribute(i)
+		if (STUN_ATTRIBUT_XOR_PEER_ADDRESS != a.Type) { continue; }
+		family, ip, port, err := a.AttributeGetXorPeerAddress()
+		return true, family, ip, port, err
+	}
+	return false, 0, "", 0, nil
+}
+
+// This function extracts the "xored" relayed address from a packet (RFC 5766).
+//
+// OUTPUT
+// - This flag indicates whether the packet contains the searched attribute.
+//   + true: the packet contains the searched attribute.
+//   + false: the packet does not contain the searched attribute.
+// - The IP family.
+// - The IP address.
+// - The port number.
+// - The error flag.
+func (v *StunPacket) GetXorRelayedAddress() (bool, uint16, string, uint16, error) {
+	for i := 0; i < v.GetAttributesCount(); i++ {
+		a := v.GetAttribute(i)
+		if (STUN_ATTRIBUT_XOR_RELAYED_ADDRESS != a.Type) { continue; }
+		family, ip, port, err := a.AttributeGetXorRelayedAddress()
+		return true, family, ip, port, err
+	}
+	return false, 0, "", 0, nil
+}
+
+// This function extracts the lifetime from a packet (RFC 5766).
+//
+// OUTPUT
+// - This flag indicates whether the packet contains the searched attribute.
+//   + true: the packet contains the searched attribute.
+//   + false: the packet does not contain the searched attribute.
+// - The number of seconds.
+// - The error flag.
+func (v *StunPacket) GetLifetime() (bool, uint32, error) {
+	for i := 0; i < v.GetAttributesCount(); i++ {
+		a := v.GetAttribute(i)
+		if (STUN_ATTRIBUT_LIFETIME != a.Type) { continue; }
+		seconds, err := a.AttributeGetLifetime()
+		return true, seconds, err
+	}
+	return false, 0, nil
+}
 
+// This function extracts the requested transport protocol from a packet (RFC 5766).
+//
+// OUTPUT
+// - This flag indicates whether the packet contains the searched attribute.
+//   + true: the packet contains the searched attribute.
+//   + false: the packet does not contain the searched attribute.
+// - The IANA protocol number (for example: STUN_TRANSPORT_UDP).
+// - The error flag.
+func (v *StunPacket) GetRequestedTransport() (bool, byte, error) {
+	for i := 0; i < v.GetAttributesCount(); i++ {
+		a := v.GetAttribute(i)
+		if (STUN_ATTRIBUT_REQUESTED_TRANSPORT != a.Type) { continue; }
+		protocol, err := a.AttributeGetRequestedTransport()
+		return true, protocol, err
+	}
+	return false, 0, nil
+}
+
+// This function extracts the channel number from a packet (RFC 5766).
+//
+// OUTPUT
+// - This flag indicates whether the packet contains the searched attribute.
+//   + true: the packet contains the searched attribute.
+//   + false: the packet does not contain the searched attribute.
+// - The channel number.
+// - The error flag.
+func (v *StunPacket) GetChannelNumber() (bool, uint16, error) {
+	for i := 0; i < v.GetAttributesCount(); i++ {
+		a := v.GetAttribute(i)
+		if (STUN_ATTRIBUT_CHANNEL_NUMBER != a.Type) { continue; }
+		number, err := a.AttributeGetChannelNumber()
+		return true, number, err
+	}
+	return false, 0, nil
+}
+
+// This function extracts the application data from a packet (RFC 5766).
+//
+// OUTPUT
+// - This flag indicates whether the packet contains the searched attribute.
+//   + true: the packet contains the searched attribute.
+//   + false: the packet does not contain the searched attribute.
+// - The application data.
+func (v *StunPacket) GetData() (bool, []byte) {
+	for i := 0; i < v.GetAttributesCount(); i++ {
+		a := v.GetAttribute(i)
+		if (STUN_ATTRIBUT_DATA != a.Type) { continue; }
+		return true, a.AttributeGetData()
+	}
+	return false, nil
+}
+
+// This function extracts the error code from a packet.
+//
+// OUTPUT
+// - This flag indicates whether the packet contains the searched attribute.
+//   + true: the packet contains the searched attribute.
+//   + false: the packet does not contain the searched attribute.
+// - The error code (for example: 401).
+// - The reason phrase.
+// - The error flag.
+func (v *StunPacket) GetErrorCode() (bool, uint16, string, error) {
+	for i := 0; i < v.GetAttributesCount(); i++ {
+		a := v.GetAttribute(i)
+		if (STUN_ATTRIBUT_ERROR_CODE != a.Type) { continue }
+		code, reason, err := a.AttributeGetErrorCode()
+		return true, code, reason, err
+	}
+	return false, 0, "", nil
+}
+
+// This function extracts the realm from a packet.
+//
+// OUTPUT
+// - This flag indicates whether the packet contains the searched attribute.
+// - The realm.
+func (v *StunPacket) GetRealm() (bool, string) {
+	return v.__getText(STUN_ATTRIBUT_REALM)
+}
+
+// This function extracts the nonce from a packet.
+//
+// OUTPUT
+// - This flag indicates whether the packet contains the searched attribute.
+// - The nonce.
+func (v *StunPacket) GetNonce() (bool, string) {
+	return v.__getText(STUN_ATTRIBUT_NONCE)
+}
+
+// This function extracts the user name from a packet.
+//
+// OUTPUT
+// - This flag indicates whether the packet contains the searched attribute.
+// - The user name.
+func (v *StunPacket) GetUsername() (bool, string) {
+	return v.__getText(STUN_ATTRIBUT_USERNAME)
+}
+
+// This function checks the attribute MESSAGE-INTEGRITY of the packet.
+// Attributes that follow the MESSAGE-INTEGRITY attribute (FINGERPRINT) are ignored, as required by RFC 5389.
+//
+// INPUT
+// - in_key: the key used to calculate the HMAC.
+//   + For short-term credentials, the key is the password (see ShortTermKey()).
+//   + For long-term credentials, the key is MD5(username ":" realm ":" password) (see LongTermKey()).
+//
+// OUTPUT
+// - This flag indicates whether the HMAC is valid or not.
+// - The error flag. An error is returned if the packet does not contain any MESSAGE-INTEGRITY attribute.
+func (v *StunPacket) CheckMessageIntegrity(in_key []byte) (bool, error) {
+	var length uint16 = 0
+	
+	for i := 0; i < v.GetAttributesCount(); i++ {
+		a := v.GetAttribute(i)
+		if (STUN_ATTRIBUT_MESSAGE_INTEGRITY == a.Type) {
+			if (20 != len(a.Value)) { return false, errors.New(fmt.Sprintf("Invalid MESSAGE-INTEGRITY (% x).", a.Value)) }
+			
+			// Keep the header and the attributes that precede MESSAGE-INTEGRITY.
+			packet := *v
+			packet.attributes = v.attributes[0:i]
+			packet.length     = length
+			return hmac.Equal(__hmac(packet.ToBytes(), in_key), a.Value), nil
+		}
+		// Please keep in mind that values contain padding.
+		length += uint16(len(a.Value)) + 4
+	}
+	return false, errors.New("The packet does not contain any MESSAGE-INTEGRITY attribute.")
+}
+
+// This function returns the text of the first attribute of a given type.
+//
+// INPUT
+// - in_type: the attribute's type (constant STUN_ATTRIBUT_...).
+//
+// OUTPUT
+// - This flag indicates whether the packet contains the searched attribute.
+// - The text.
+func (v *StunPacket) __getText(in_type uint16) (bool, string) {
+	for i := 0; i < v.GetAttributesCount(); i++ {
+		a := v.GetAttribute(i)
+		if (in_type != a.Type) { continue }
+		return true, a.AttributeGetText()
+	}
+	return false, ""
+}
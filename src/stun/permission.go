@@ -0,0 +1,349 @@
+// Copyright (C) 2012 Denis BEURIVE
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stun
+
+import "fmt"
+import "net"
+import "errors"
+import "context"
+import "time"
+import "tools"
+
+/* ------------------------------------------------------------------------------------------------ */
+/* TURN permissions and channels (RFC 5766).                                                        */
+/* A permission allows the peers that have a given IP address to send packets to the relayed        */
+/* transport address. A channel binds a number to a peer's transport address, so that the data      */
+/* can be exchanged with less overhead (see ChannelData).                                           */
+/* ------------------------------------------------------------------------------------------------ */
+
+// The lowest channel number.
+const STUN_CHANNEL_MIN = 0x4000
+
+// The highest channel number.
+// RFC 5766: The channel number is in the range 0x4000 through 0x7FFE (inclusive).
+const STUN_CHANNEL_MAX = 0x7FFE
+
+// The lifetime of a permission.
+// RFC 5766: The Permission Lifetime MUST be 300 seconds (= 5 minutes).
+const turn_permission_lifetime = 5 * time.Minute
+
+// The lifetime of a channel binding.
+// RFC 5766: [...] a channel binding lasts for 10 minutes unless refreshed.
+const turn_channel_lifetime = 10 * time.Minute
+
+/* ------------------------------------------------------------------------------------------------ */
+/* API                                                                                              */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function installs permissions for a list of peers.
+// If the allocation is refreshed automatically, then the permissions are refreshed one minute before they expire.
+// RFC 5766: [...] the IP address portion of XOR-PEER-ADDRESS is significant; the port portion is ignored.
+//
+// INPUT
+// - in_ctx: the context. It can be used to cancel the request.
+// - in_peers: the transport addresses of the peers.
+//   These values should be written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+//
+// OUTPUT
+// - The error flag. If the server refuses the request, then the error flag is a pointer to an ErrorResponse (for
+//   example: 403 Forbidden or 508 Insufficient Capacity).
+func (v *Allocation) CreatePermission(in_ctx context.Context, in_peers []string) error {
+	var ips []string
+	var seen = make(map[string]bool)
+
+	if (0 == len(in_peers)) { return errors.New("The list of peers is empty.") }
+	for i := 0; i < len(in_peers); i++ {
+		peer, err := net.ResolveUDPAddr("udp", in_peers[i])
+		if (nil != err) { return err }
+		if (seen[peer.IP.String()]) { continue }
+		seen[peer.IP.String()] = true
+		ips = append(ips, peer.IP.String())
+	}
+	return v.__createPermission(in_ctx, ips)
+}
+
+// This function binds a channel to a peer.
+// If a channel is already bound to the peer, then the binding is refreshed. Otherwise, the first channel available is
+// used. The binding also installs a permission for the peer's IP address.
+// If the allocation is refreshed automatically, then the binding is refreshed one minute before it expires.
+//
+// INPUT
+// - in_ctx: the context. It can be used to cancel the request.
+// - in_peer: the transport address of the peer.
+//   This value should be written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+//
+// OUTPUT
+// - The channel number (between STUN_CHANNEL_MIN and STUN_CHANNEL_MAX).
+// - The error flag. If the server refuses the request, then the error flag is a pointer to an ErrorResponse (for
+//   example: 400 Bad Request if the channel is already bound to another peer).
+func (v *Allocation) ChannelBind(in_ctx context.Context, in_peer string) (uint16, error) {
+	peer, err := __peerAddress(in_peer)
+	if (nil != err) { return 0, err }
+	return v.__channelBind(in_ctx, peer)
+}
+
+// This function returns the channel bound to a peer.
+//
+// INPUT
+// - in_peer: the transport address of the peer.
+//   This value should be written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+//
+// OUTPUT
+// - The channel number.
+// - This flag indicates whether a channel is bound to the peer or not.
+func (v *Allocation) Channel(in_peer string) (uint16, bool) {
+	peer, err := __peerAddress(in_peer)
+	if (nil != err) { return 0, false }
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	lease, ok := v.channels[peer]
+	if (! ok) { return 0, false }
+	return lease.number, true
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Privates                                                                                         */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function sends a CREATE-PERMISSION request.
+//
+// INPUT
+// - in_ctx: the context.
+// - in_ips: the IP addresses of the peers.
+//
+// OUTPUT
+// - The error flag.
+func (v *Allocation) __createPermission(in_ctx context.Context, in_ips []string) error {
+	v.transaction.Lock()
+	defer v.transaction.Unlock()
+
+	packet, err := __turnRequest(STUN_TYPE_CREATE_PERMISIION)
+	if (nil != err) { return err }
+	for i := 0; i < len(in_ips); i++ {
+		attribute, err := AttributeCreateXorPeerAddress(&packet, in_ips[i], 0)
+		if (nil != err) { return err }
+		packet.AddAttribute(attribute)
+	}
+	response, err := v.__request(in_ctx, packet)
+	if (nil == err) && (! response.response) { err = errors.New("The TURN server did not answer the CREATE-PERMISSION request.") }
+	if (nil != err) { return err }
+
+	now := time.Now()
+	v.mutex.Lock()
+	for i := 0; i < len(in_ips); i++ { __leaseRenew(v.permissions, in_ips[i], 0, turn_permission_lifetime, now) }
+	v.mutex.Unlock()
+	v.__wake()
+	if verbosity > 0 { tools.AddText(output, fmt.Sprintf("% -25s: %v", "Permissions installed", in_ips)) }
+	return nil
+}
+
+// This function sends a CHANNEL-BIND request.
+//
+// INPUT
+// - in_ctx: the context.
+// - in_peer: the transport address of the peer (see __peerAddress()).
+//
+// OUTPUT
+// - The channel number.
+// - The error flag.
+func (v *Allocation) __channelBind(in_ctx context.Context, in_peer string) (uint16, error) {
+	var number uint16 = 0
+
+	// The lock is held while the channel is chosen, so that a channel can not be given to two peers.
+	v.transaction.Lock()
+	defer v.transaction.Unlock()
+
+	v.mutex.Lock()
+	if lease, ok := v.channels[in_peer]; ok {
+		number = lease.number
+	} else {
+		number = v.__freeChannel()
+	}
+	v.mutex.Unlock()
+	if (0 == number) { return 0, errors.New("All the channels are bound.") }
+
+	ip, port, err := tools.InetSplit(in_peer)
+	if (nil != err) { return 0, err }
+	packet, err := __turnRequest(STUN_TYPE_CHANNEL_BINDING)
+	if (nil != err) { return 0, err }
+	attribute, err := AttributeCreateChannelNumber(&packet, number)
+	if (nil != err) { return 0, err }
+	packet.AddAttribute(attribute)
+	attribute, err = AttributeCreateXorPeerAddress(&packet, ip, uint16(port))
+	if (nil != err) { return 0, err }
+	packet.AddAttribute(attribute)
+	response, err := v.__request(in_ctx, packet)
+	if (nil == err) && (! response.response) { err = errors.New("The TURN server did not answer the CHANNEL-BIND request.") }
+	if (nil != err) { return 0, err }
+
+	now := time.Now()
+	v.mutex.Lock()
+	__leaseRenew(v.channels, in_peer, number, turn_channel_lifetime, now)
+	__leaseRenew(v.permissions, ip, 0, turn_permission_lifetime, now)
+	v.mutex.Unlock()
+	v.__wake()
+	if verbosity > 0 { tools.AddText(output, fmt.Sprintf("% -25s: 0x%04X => %s", "Channel bound", number, in_peer)) }
+	return number, nil
+}
+
+// This function refreshes the permissions that must be refreshed.
+// All the permissions are refreshed by a single request.
+//
+// INPUT
+// - in_ctx: the context.
+// - in_now: the current date.
+func (v *Allocation) __refreshPermissions(in_ctx context.Context, in_now time.Time) {
+	var ips []string
+
+	v.mutex.Lock()
+	for ip, lease := range v.permissions {
+		if (! in_now.Before(lease.refresh)) { ips = append(ips, ip) }
+	}
+	v.mutex.Unlock()
+	if (0 == len(ips)) { return }
+
+	err := v.__createPermission(in_ctx, ips)
+	if (nil == err) || (nil != in_ctx.Err()) { return }
+	v.__setError(err)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for i := 0; i < len(ips); i++ { v.__leasePostpone(v.permissions, ips[i], "permission", in_now) }
+}
+
+// This function refreshes the channels that must be refreshed.
+//
+// INPUT
+// - in_ctx: the context.
+// - in_now: the current date.
+func (v *Allocation) __refreshChannels(in_ctx context.Context, in_now time.Time) {
+	var peers []string
+
+	v.mutex.Lock()
+	for peer, lease := range v.channels {
+		if (! in_now.Before(lease.refresh)) { peers = append(peers, peer) }
+	}
+	v.mutex.Unlock()
+
+	for i := 0; i < len(peers); i++ {
+		_, err := v.__channelBind(in_ctx, peers[i])
+		if (nil != in_ctx.Err()) { return }
+		if (nil == err) { continue }
+		v.__setError(err)
+		v.mutex.Lock()
+		v.__leasePostpone(v.channels, peers[i], "channel", in_now)
+		v.mutex.Unlock()
+	}
+}
+
+// This function tells whether the allocation has a permission for a peer's IP address.
+//
+// INPUT
+// - in_ip: the peer's IP address.
+//
+// OUTPUT
+// - true: the allocation has a permission for the IP address.
+// - false: the allocation has no permission for the IP address.
+func (v *Allocation) __hasPermission(in_ip string) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	_, ok := v.permissions[in_ip]
+	return ok
+}
+
+// This function returns the peer bound to a channel.
+//
+// INPUT
+// - in_number: the channel number.
+//
+// OUTPUT
+// - The transport address of the peer.
+// - This flag indicates whether the channel is bound or not.
+func (v *Allocation) __channelPeer(in_number uint16) (string, bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for peer, lease := range v.channels {
+		if (in_number == lease.number) { return peer, true }
+	}
+	return "", false
+}
+
+// This function returns the first channel available.
+// The caller must hold the mutex.
+//
+// OUTPUT
+// - The channel number (0 if all the channels are bound).
+func (v *Allocation) __freeChannel() uint16 {
+	used := make(map[uint16]bool)
+	for _, lease := range v.channels { used[lease.number] = true }
+	for number := STUN_CHANNEL_MIN; number <= STUN_CHANNEL_MAX; number++ {
+		if (! used[uint16(number)]) { return uint16(number) }
+	}
+	return 0
+}
+
+// This function postpones the refresh of a lease, after a failure. If the lease has expired, then it is removed.
+// The caller must hold the mutex.
+//
+// INPUT
+// - in_leases: the leases.
+// - in_key: the key of the lease.
+// - in_name: the kind of lease ("permission" or "channel").
+// - in_now: the current date.
+func (v *Allocation) __leasePostpone(in_leases map[string]*turnLease, in_key string, in_name string, in_now time.Time) {
+	lease, ok := in_leases[in_key]
+	if (! ok) || (lease.__postpone(in_now)) { return }
+	delete(in_leases, in_key)
+	v.err = errors.New(fmt.Sprintf("The %s for %s has expired.", in_name, in_key))
+}
+
+// This function wakes up the automatic refresh, so that it takes the new leases into account.
+func (v *Allocation) __wake() {
+	select {
+		case v.wake <- struct{}{}:
+		default:
+	}
+}
+
+// This function renews a lease within a set of leases. If the lease does not exist, then it is created.
+//
+// INPUT
+// - in_leases: the leases.
+// - in_key: the key of the lease.
+// - in_number: the channel number (channels only).
+// - in_lifetime: the lifetime.
+// - in_now: the current date.
+func __leaseRenew(in_leases map[string]*turnLease, in_key string, in_number uint16, in_lifetime time.Duration, in_now time.Time) {
+	lease, ok := in_leases[in_key]
+	if (! ok) {
+		lease = &turnLease{ number: in_number }
+		in_leases[in_key] = lease
+	}
+	lease.__renew(in_lifetime, in_now)
+}
+
+// This function normalizes the transport address of a peer.
+//
+// INPUT
+// - in_peer: the transport address of the peer.
+//
+// OUTPUT
+// - The transport address, written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+// - The error flag.
+func __peerAddress(in_peer string) (string, error) {
+	peer, err := net.ResolveUDPAddr("udp", in_peer)
+	if (nil != err) { return "", err }
+	return tools.MakeTransportAddress(peer.IP.String(), peer.Port)
+}
@@ -0,0 +1,470 @@
+// Copyright (C) 2012 Denis BEURIVE
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stun
+
+import "fmt"
+import "net"
+import "os"
+import "errors"
+import "context"
+import "sync"
+import "time"
+import "tools"
+
+/* ------------------------------------------------------------------------------------------------ */
+/* TURN relayed connection (RFC 5766).                                                              */
+/* The relayed connection implements net.PacketConn, so that UDP code can run over a TURN relay.    */
+/* The packets are sent to the peers within SEND indications (or ChannelData messages, if a         */
+/* channel is bound to the peer), and received within DATA indications (or ChannelData messages).  */
+/* ------------------------------------------------------------------------------------------------ */
+
+// The number of packets that can be queued, waiting to be read. If the queue is full, then the packets are dropped.
+const relay_queue_size = 64
+
+// The maximum size of a packet received from the server.
+const relay_packet_size = 65536
+
+// This type represents a packet waiting to be read.
+type queuedPacket struct {
+	// The content of the packet.
+	data []byte
+	// The sender.
+	from net.Addr
+}
+
+// This type represents a queue of packets, with a read deadline.
+type packetQueue struct {
+	// The packets.
+	packets chan queuedPacket
+	// This channel is closed when the queue is closed.
+	closed chan struct{}
+	// This object makes sure that the queue is closed only once.
+	once sync.Once
+	// This mutex protects the following fields.
+	mutex sync.Mutex
+	// The read deadline (zero means "no deadline").
+	deadline time.Time
+	// This channel is closed when the deadline changes.
+	changed chan struct{}
+}
+
+// This type represents the client's socket, once the relayed connection is running.
+// The relayed connection reads the socket. The STUN messages that are not DATA indications are forwarded to this
+// object, so that the client can still perform transactions (REFRESH, CREATE-PERMISSION...).
+type relayDemux struct {
+	// The client's socket.
+	conn net.PacketConn
+	// The STUN messages received from the server.
+	queue *packetQueue
+}
+
+// This type represents a relayed connection.
+// It implements the interface net.PacketConn.
+type RelayConn struct {
+	// The allocation.
+	allocation *Allocation
+	// The client's socket.
+	conn net.PacketConn
+	// The server's transport address.
+	server *net.UDPAddr
+	// The relayed transport address.
+	local *net.UDPAddr
+	// The STUN messages received from the server (other than DATA indications).
+	stun *packetQueue
+	// The data received from the peers.
+	data *packetQueue
+	// This channel is closed when the socket is not read anymore.
+	done chan struct{}
+	// This mutex protects the following fields.
+	mutex sync.Mutex
+	// The write deadline (zero means "no deadline").
+	write_deadline time.Time
+	// This flag indicates whether the relayed connection has been closed or not.
+	closed bool
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* API                                                                                              */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function returns a relayed connection that uses the allocation.
+// The permissions are installed automatically, when a packet is sent to a new peer. If a channel is bound to the peer
+// (see ChannelBind()), then the packets are sent within ChannelData messages.
+//
+// OUTPUT
+// - The relayed connection.
+// - The error flag.
+//
+// WARNING
+// The allocation can have only one relayed connection. Closing the relayed connection closes the allocation, and closing
+// the allocation closes the relayed connection.
+func (v *Allocation) PacketConn() (*RelayConn, error) {
+	v.transaction.Lock()
+	defer v.transaction.Unlock()
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if (v.closed) { return nil, errors.New("The allocation is closed.") }
+	if (nil != v.relay) { return nil, errors.New("The allocation already has a relayed connection.") }
+
+	server, err := net.ResolveUDPAddr("udp", v.client.server_transport_address)
+	if (nil != err) { return nil, err }
+	local, err := net.ResolveUDPAddr("udp", v.relayed)
+	if (nil != err) { return nil, err }
+
+	relay := &RelayConn{ allocation: v, conn: v.client.connection, server: server, local: local, stun: __packetQueueCreate(), data: __packetQueueCreate(), done: make(chan struct{}) }
+	// The last transaction may have left a read deadline on the socket.
+	relay.conn.SetReadDeadline(time.Time{})
+	v.client.connection = &relayDemux{ conn: relay.conn, queue: relay.stun }
+	v.relay = relay
+	go relay.__read()
+	return relay, nil
+}
+
+// This function reads a packet sent by a peer.
+//
+// INPUT
+// - in_b: the buffer. If the buffer is too small, then the packet is truncated.
+//
+// OUTPUT
+// - The number of bytes read.
+// - The peer's transport address (*net.UDPAddr).
+// - The error flag.
+func (v *RelayConn) ReadFrom(in_b []byte) (int, net.Addr, error) {
+	return v.data.__pop(in_b)
+}
+
+// This function sends a packet to a peer, through the relay.
+// If the allocation has no permission for the peer's IP address, then a permission is installed first.
+//
+// INPUT
+// - in_b: the packet.
+// - in_addr: the peer's transport address.
+//
+// OUTPUT
+// - The number of bytes sent.
+// - The error flag. If the server refuses the permission, then the error flag is a pointer to an ErrorResponse.
+func (v *RelayConn) WriteTo(in_b []byte, in_addr net.Addr) (int, error) {
+	var message []byte
+
+	v.mutex.Lock()
+	closed   := v.closed
+	deadline := v.write_deadline
+	v.mutex.Unlock()
+	if (closed) { return 0, net.ErrClosed }
+	if (! deadline.IsZero()) && (! time.Now().Before(deadline)) { return 0, os.ErrDeadlineExceeded }
+
+	peer, err := __peerAddress(in_addr.String())
+	if (nil != err) { return 0, err }
+	ip, port, err := tools.InetSplit(peer)
+	if (nil != err) { return 0, err }
+
+	if (! v.allocation.__hasPermission(ip)) {
+		ctx := context.Background()
+		if (! deadline.IsZero()) {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+		err = v.allocation.__createPermission(ctx, []string{ ip })
+		if (nil != err) { return 0, err }
+	}
+
+	if number, ok := v.allocation.Channel(peer); ok {
+		var data ChannelData
+		data, err = ChannelDataCreate(number, in_b)
+		message = data.ToBytes(false)
+	} else {
+		message, err = __sendIndication(ip, uint16(port), in_b)
+	}
+	if (nil != err) { return 0, err }
+	_, err = v.conn.WriteTo(message, v.server)
+	if (nil != err) { return 0, err }
+	return len(in_b), nil
+}
+
+// This function closes the relayed connection and the allocation (see Allocation.Close()).
+// The client's socket is not closed. It can be used again for STUN requests.
+//
+// OUTPUT
+// - The error flag.
+func (v *RelayConn) Close() error {
+	v.mutex.Lock()
+	closed := v.closed
+	v.closed = true
+	v.mutex.Unlock()
+	if (closed) { return nil }
+	return v.allocation.Close()
+}
+
+// This function returns the relayed transport address.
+//
+// OUTPUT
+// - The relayed transport address (*net.UDPAddr).
+func (v *RelayConn) LocalAddr() net.Addr {
+	return v.local
+}
+
+// This function sets the read and write deadlines.
+//
+// INPUT
+// - in_t: the deadline (zero means "no deadline").
+//
+// OUTPUT
+// - The error flag.
+func (v *RelayConn) SetDeadline(in_t time.Time) error {
+	v.SetReadDeadline(in_t)
+	return v.SetWriteDeadline(in_t)
+}
+
+// This function sets the read deadline.
+//
+// INPUT
+// - in_t: the deadline (zero means "no deadline").
+//
+// OUTPUT
+// - The error flag.
+func (v *RelayConn) SetReadDeadline(in_t time.Time) error {
+	v.data.__setDeadline(in_t)
+	return nil
+}
+
+// This function sets the write deadline.
+// The write deadline limits the time spent installing a permission.
+//
+// INPUT
+// - in_t: the deadline (zero means "no deadline").
+//
+// OUTPUT
+// - The error flag.
+func (v *RelayConn) SetWriteDeadline(in_t time.Time) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.write_deadline = in_t
+	return nil
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Privates                                                                                         */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function stops reading the client's socket, and gives the socket back to the client.
+// The pending and future reads return net.ErrClosed.
+//
+// WARNING
+// This function is called once, when the allocation is closed (see Allocation.Close()).
+func (v *RelayConn) __detach() {
+	v.mutex.Lock()
+	v.closed = true
+	v.mutex.Unlock()
+
+	v.allocation.transaction.Lock()
+	v.conn.SetReadDeadline(time.Now())
+	<-v.done
+	v.conn.SetReadDeadline(time.Time{})
+	v.allocation.client.connection = v.conn
+	v.allocation.transaction.Unlock()
+
+	v.stun.__close()
+	v.data.__close()
+}
+
+// This function reads the client's socket and dispatches the packets sent by the server, until the socket's read
+// deadline is reached (see __detach()) or the socket is closed.
+func (v *RelayConn) __read() {
+	defer close(v.done)
+	b := make([]byte, relay_packet_size)
+	for {
+		count, from, err := v.conn.ReadFrom(b)
+		if (nil != err) {
+			// If the socket has been closed, then nothing can be read anymore.
+			if (! errors.Is(err, os.ErrDeadlineExceeded)) {
+				v.stun.__close()
+				v.data.__close()
+			}
+			return
+		}
+		if (from.String() != v.server.String()) { continue }
+
+		kind := Demultiplex(b[0:count])
+		if (STUN_MESSAGE_CHANNEL_DATA == kind) {
+			message, err := ChannelDataFromBytes(b[0:count])
+			if (nil != err) { continue }
+			peer, ok := v.allocation.__channelPeer(message.Number)
+			if (! ok) { continue }
+			addr, err := net.ResolveUDPAddr("udp", peer)
+			if (nil != err) { continue }
+			v.data.__push(message.Data, addr)
+			continue
+		}
+		if (STUN_MESSAGE_STUN != kind) { continue }
+
+		packet, err := FromBytes(b[0:count])
+		if (nil != err) { continue }
+		if (STUN_TYPE_DATA_INDICATION != packet.GetType()) {
+			v.stun.__push(b[0:count], from)
+			continue
+		}
+		found, _, ip, port, err := packet.GetXorPeerAddress()
+		if (nil != err) || (! found) { continue }
+		found, data := packet.GetData()
+		if (! found) { continue }
+		v.data.__push(data, &net.UDPAddr{ IP: net.ParseIP(ip), Port: int(port) })
+	}
+}
+
+// This function reads a STUN message received from the server.
+func (v *relayDemux) ReadFrom(in_b []byte) (int, net.Addr, error) {
+	return v.queue.__pop(in_b)
+}
+
+// This function sends a packet from the client's socket.
+func (v *relayDemux) WriteTo(in_b []byte, in_addr net.Addr) (int, error) {
+	return v.conn.WriteTo(in_b, in_addr)
+}
+
+// This function closes the client's socket.
+func (v *relayDemux) Close() error {
+	return v.conn.Close()
+}
+
+// This function returns the client's local transport address.
+func (v *relayDemux) LocalAddr() net.Addr {
+	return v.conn.LocalAddr()
+}
+
+// This function sets the read and write deadlines.
+func (v *relayDemux) SetDeadline(in_t time.Time) error {
+	v.queue.__setDeadline(in_t)
+	return v.conn.SetWriteDeadline(in_t)
+}
+
+// This function sets the read deadline.
+func (v *relayDemux) SetReadDeadline(in_t time.Time) error {
+	v.queue.__setDeadline(in_t)
+	return nil
+}
+
+// This function sets the write deadline.
+func (v *relayDemux) SetWriteDeadline(in_t time.Time) error {
+	return v.conn.SetWriteDeadline(in_t)
+}
+
+// This function creates a queue of packets.
+//
+// OUTPUT
+// - The queue.
+func __packetQueueCreate() *packetQueue {
+	return &packetQueue{ packets: make(chan queuedPacket, relay_queue_size), closed: make(chan struct{}), changed: make(chan struct{}) }
+}
+
+// This function adds a packet to the queue. If the queue is full, then the packet is dropped.
+//
+// INPUT
+// - in_data: the content of the packet. It is copied.
+// - in_from: the sender.
+func (v *packetQueue) __push(in_data []byte, in_from net.Addr) {
+	data := make([]byte, len(in_data))
+	copy(data, in_data)
+	select {
+		case v.packets <- queuedPacket{ data: data, from: in_from }:
+		default:
+			if verbosity > 0 { tools.AddText(output, fmt.Sprintf("The queue is full. Drop a packet from %s.", in_from)) }
+	}
+}
+
+// This function removes a packet from the queue. It waits until a packet is available, the deadline is reached or
+// the queue is closed.
+//
+// INPUT
+// - in_b: the buffer. If the buffer is too small, then the packet is truncated.
+//
+// OUTPUT
+// - The number of bytes read.
+// - The sender.
+// - The error flag. If the deadline is reached, then the error is a timeout (see net.Error).
+func (v *packetQueue) __pop(in_b []byte) (int, net.Addr, error) {
+	for {
+		var timer *time.Timer
+		var expired <-chan time.Time
+
+		v.mutex.Lock()
+		deadline := v.deadline
+		changed  := v.changed
+		v.mutex.Unlock()
+
+		if (! deadline.IsZero()) {
+			delay := time.Until(deadline)
+			if (delay <= 0) { return 0, nil, os.ErrDeadlineExceeded }
+			timer   = time.NewTimer(delay)
+			expired = timer.C
+		}
+
+		select {
+			case packet := <-v.packets:
+				if (nil != timer) { timer.Stop() }
+				return copy(in_b, packet.data), packet.from, nil
+			case <-v.closed:
+				if (nil != timer) { timer.Stop() }
+				return 0, nil, net.ErrClosed
+			case <-expired:
+				return 0, nil, os.ErrDeadlineExceeded
+			case <-changed:
+				if (nil != timer) { timer.Stop() }
+		}
+	}
+}
+
+// This function sets the read deadline. The pending reads take the new deadline into account.
+//
+// INPUT
+// - in_t: the deadline (zero means "no deadline").
+func (v *packetQueue) __setDeadline(in_t time.Time) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.deadline = in_t
+	close(v.changed)
+	v.changed = make(chan struct{})
+}
+
+// This function closes the queue. The pending reads return net.ErrClosed.
+func (v *packetQueue) __close() {
+	v.once.Do(func() { close(v.closed) })
+}
+
+// This function creates a SEND indication.
+//
+// INPUT
+// - in_ip: the peer's IP address.
+// - in_port: the peer's port number.
+// - in_data: the application data.
+//
+// OUTPUT
+// - The indication, as a list of bytes.
+// - The error flag.
+func __sendIndication(in_ip string, in_port uint16, in_data []byte) ([]byte, error) {
+	packet, err := __turnRequest(STUN_TYPE_SEND_INDICATION)
+	if (nil != err) { return nil, err }
+	attribute, err := AttributeCreateXorPeerAddress(&packet, in_ip, in_port)
+	if (nil != err) { return nil, err }
+	packet.AddAttribute(attribute)
+	attribute, err = AttributeCreateData(&packet, in_data)
+	if (nil != err) { return nil, err }
+	packet.AddAttribute(attribute)
+	packet, err = __turnFinalize(packet)
+	if (nil != err) { return nil, err }
+	return packet.ToBytes(), nil
+}
@@ -0,0 +1,534 @@
+// Copyright (C) 2012 Denis BEURIVE
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stun
+
+import "fmt"
+import "net"
+import "errors"
+import "sync"
+import "tools"
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Server.                                                                                          */
+/* ------------------------------------------------------------------------------------------------ */
+
+// The default value of the attribute SOFTWARE sent by the server.
+const STUN_SERVER_SOFTWARE = "GoStun server"
+
+// The number of attempts to find ports available on two IP addresses.
+const server_port_attempts = 10
+
+// This map lists the comprehension-required attributes (type below 0x8000) understood by the server.
+// RFC 5389: If the request contains one or more unknown comprehension-required attributes, the server replies with an
+//           error response with an error code of 420 (Unknown Attribute), and includes an UNKNOWN-ATTRIBUTES attribute
+//           in the response that lists the unknown comprehension-required attributes.
+// Note: the attributes related to authentication are accepted (and ignored), since the server does not authenticate
+//       the requests. The attribute RESPONSE-ADDRESS is understood, but the requests that contain it are rejected.
+var server_attributes = map[uint16] bool {
+	STUN_ATTRIBUT_MAPPED_ADDRESS:     true,
+	STUN_ATTRIBUT_USERNAME:           true,
+	STUN_ATTRIBUT_MESSAGE_INTEGRITY:  true,
+	STUN_ATTRIBUT_ERROR_CODE:         true,
+	STUN_ATTRIBUT_UNKNOWN_ATTRIBUTES: true,
+	STUN_ATTRIBUT_REALM:              true,
+	STUN_ATTRIBUT_NONCE:              true,
+	STUN_ATTRIBUT_XOR_MAPPED_ADDRESS: true,
+	STUN_ATTRIBUT_RESPONSE_ADDRESS:   true,
+	STUN_ATTRIBUT_PADDING:            true,
+	STUN_ATTRIBUT_RESPONSE_PORT:      true,
+}
+
+// This type represents a STUN server.
+// The server listens on one or more UDP sockets, and answers the BINDING requests.
+// The server is compliant with the RFC selected by the functions SetRfc3489() and SetRfc5389().
+// If RFC 5389 is selected, then the server also implements RFC 5780 (NAT behavior discovery).
+type Server struct {
+	// The sockets.
+	connections []net.PacketConn
+	// The value of the attribute SOFTWARE.
+	software string
+	// This flag indicates whether the server has an alternate IP address and an alternate port (see
+	// ServerCreateRfc3489()). If so, the sockets are: IP1:P1, IP1:P2, IP2:P1 and IP2:P2 (in this order).
+	alternate bool
+	// This group is used to wait for the termination of the goroutines.
+	wg sync.WaitGroup
+	// This mutex protects the following field.
+	mutex sync.Mutex
+	// This flag indicates whether the server has been started or not.
+	started bool
+}
+
+// This type represents a response to send.
+type serverResponse struct {
+	// The response.
+	packet StunPacket
+	// The index of the socket used to send the response.
+	sender int
+	// The transport address of the response's destination.
+	destination net.Addr
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* API                                                                                              */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function creates a server. The server does not answer until it is started (see Start()).
+//
+// INPUT
+// - in_addresses: the local transport addresses the server listens on.
+//   These values should be written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6). The port 0 means "any port".
+//
+// OUTPUT
+// - The server.
+// - The error flag.
+func ServerCreate(in_addresses []string) (*Server, error) {
+	var server Server
+
+	if (0 == len(in_addresses)) { return nil, errors.New("The server needs at least one transport address.") }
+	server.software = STUN_SERVER_SOFTWARE
+	for i := 0; i < len(in_addresses); i++ {
+		connection, err := net.ListenPacket("udp", in_addresses[i])
+		if (nil != err) {
+			server.__close()
+			return nil, err
+		}
+		server.connections = append(server.connections, connection)
+	}
+	return &server, nil
+}
+
+// This function creates a server that listens on two IP addresses and two ports (RFC 3489 and RFC 5780).
+// The server honors the attribute CHANGE-REQUEST. If RFC 3489 is selected, then its responses contain the attributes
+// SOURCE-ADDRESS and CHANGED-ADDRESS. If RFC 5389 is selected, then its responses contain the attributes
+// RESPONSE-ORIGIN and OTHER-ADDRESS (RFC 5780). The server does not answer until it is started (see Start()).
+// RFC 3489: The server [...] requires that the server have two different IP addresses and two different ports.
+//
+// INPUT
+// - in_ip1: the primary IP address.
+// - in_ip2: the alternate IP address.
+//   Please note that loopback addresses may be used (for example: "127.0.0.1" and "127.0.0.2").
+// - in_port1: the primary port.
+// - in_port2: the alternate port.
+//   If both ports are 0, then the server chooses two ports that are available on both IP addresses.
+//
+// OUTPUT
+// - The server.
+// - The error flag.
+func ServerCreateRfc3489(in_ip1 string, in_ip2 string, in_port1 int, in_port2 int) (*Server, error) {
+	var server *Server
+	var err error
+
+	if (in_ip1 == in_ip2) { return nil, errors.New(fmt.Sprintf("The alternate IP address must differ from the primary one (%s).", in_ip1)) }
+	if (in_port1 == in_port2) && (0 != in_port1) { return nil, errors.New(fmt.Sprintf("The alternate port must differ from the primary one (%d).", in_port1)) }
+
+	for attempt := 0; attempt < server_port_attempts; attempt++ {
+		ports := []int{ in_port1, in_port2 }
+		if (0 == in_port1) && (0 == in_port2) {
+			ports, err = __serverPorts(in_ip1, in_ip2)
+			if (nil != err) { return nil, err }
+		}
+
+		var addresses []string
+		for _, ip := range []string{ in_ip1, in_ip2 } {
+			for _, port := range ports {
+				address, err := tools.MakeTransportAddress(ip, port)
+				if (nil != err) { return nil, err }
+				addresses = append(addresses, address)
+			}
+		}
+
+		server, err = ServerCreate(addresses)
+		if (nil == err) {
+			server.alternate = true
+			return server, nil
+		}
+		// The ports have been chosen by the server: they may have been taken in the meantime.
+		if (0 != in_port1) || (0 != in_port2) { return nil, err }
+	}
+	return nil, err
+}
+
+// This function sets the value of the attribute SOFTWARE sent by the server.
+// It must be called before the server is started.
+//
+// INPUT
+// - in_name: the value of the attribute SOFTWARE ("" means "no attribute SOFTWARE").
+func (v *Server) SetSoftware(in_name string) {
+	v.software = in_name
+}
+
+// This function returns the local transport addresses of the server's sockets.
+//
+// OUTPUT
+// - The local transport addresses, in the order given to ServerCreate().
+//   These values are written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+func (v *Server) Addresses() []string {
+	var res []string
+	for i := 0; i < len(v.connections); i++ { res = append(res, v.connections[i].LocalAddr().String()) }
+	return res
+}
+
+// This function starts the server. The requests are processed in the background, until the server is closed.
+//
+// OUTPUT
+// - The error flag.
+func (v *Server) Start() error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if (v.started) { return errors.New("The server has already been started.") }
+	v.started = true
+	for i := 0; i < len(v.connections); i++ {
+		v.wg.Add(1)
+		go v.__serve(i)
+	}
+	return nil
+}
+
+// This function closes the server's sockets. It returns once all the requests being processed are done.
+//
+// OUTPUT
+// - The error flag.
+func (v *Server) Close() error {
+	err := v.__close()
+	v.wg.Wait()
+	return err
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Privates                                                                                         */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function processes the requests received on a socket, until the socket is closed.
+//
+// INPUT
+// - in_index: the index of the socket.
+func (v *Server) __serve(in_index int) {
+	defer v.wg.Done()
+	b := make([]byte, 65536)
+	for {
+		count, from, err := v.connections[in_index].ReadFrom(b)
+		if (nil != err) { return }
+
+		response, ok := v.__handle(in_index, b[0:count], from)
+		if (! ok) { continue }
+		if verbosity > 0 {
+			tools.AddText(output, fmt.Sprintf("Sending RESPONSE to \"%s\"\n\n%s\n", response.destination, Bytes2String(response.packet.ToBytes(), 4)))
+			tools.AddText(output, fmt.Sprintf("%s\n", response.packet.String(4)))
+		}
+		v.connections[response.sender].WriteTo(response.packet.ToBytes(), response.destination)
+	}
+}
+
+// This function processes a request.
+//
+// INPUT
+// - in_index: the index of the socket that received the request.
+// - in_bytes: the request, as received from the network.
+// - in_from: the transport address of the request's source.
+//
+// OUTPUT
+// - The response.
+// - This flag indicates whether a response must be sent or not.
+//   RFC 5389: messages that are not valid STUN messages, indications and responses are silently discarded.
+func (v *Server) __handle(in_index int, in_bytes []byte, in_from net.Addr) (serverResponse, bool) {
+	var unknown []uint16
+	var ok bool
+	reply := serverResponse{ sender: in_index, destination: in_from }
+
+	request, err := FromBytes(in_bytes)
+	if (nil != err) {
+		// If the header is valid, then the message is a STUN message with invalid attributes.
+		de, is_decode := err.(*DecodeError)
+		if (! is_decode) || ((STUN_DECODE_ERROR_ATTRIBUTE != de.Kind) && (STUN_DECODE_ERROR_PADDING != de.Kind)) { return reply, false }
+		if (STUN_CLASS_REQUEST != request.GetClass()) { return reply, false }
+		reply.packet, ok = v.__error(request, STUN_ERROR_BAD_REQUEST, de.Message, nil)
+		return reply, ok
+	}
+	if (STUN_CLASS_REQUEST != request.GetClass()) { return reply, false }
+	if (STUN_METHOD_BINDING != request.GetMethod()) {
+		reply.packet, ok = v.__error(request, STUN_ERROR_BAD_REQUEST, fmt.Sprintf("Unsupported method 0x%03x", request.GetMethod()), nil)
+		return reply, ok
+	}
+
+	// Look for unknown comprehension-required attributes.
+	for i := 0; i < request.GetAttributesCount(); i++ {
+		t := request.GetAttribute(i).Type
+		if (t < 0x8000) && (! v.__understands(t)) { unknown = append(unknown, t) }
+	}
+	if (len(unknown) > 0) {
+		reply.packet, ok = v.__error(request, STUN_ERROR_UNKNOWN_ATTRIBUTE, "", unknown)
+		return reply, ok
+	}
+
+	return v.__binding(request, reply)
+}
+
+// This function tells whether the server understands a given attribute or not.
+//
+// INPUT
+// - in_type: the attribute's type.
+//
+// OUTPUT
+// - true: the server understands the attribute.
+// - false: the server does not understand the attribute.
+func (v *Server) __understands(in_type uint16) bool {
+	if (STUN_ATTRIBUT_CHANGE_REQUEST == in_type) { return v.alternate }
+	return server_attributes[in_type]
+}
+
+// This function builds the response to a BINDING request.
+// RFC 3489: The server MUST send the response from the IP address and port specified by the CHANGE-REQUEST flags.
+//           [...] The SOURCE-ADDRESS attribute [...] contains the source IP address and port where the response was
+//           sent from. The CHANGED-ADDRESS attribute [...] MUST be the IP address and port that would be used if the
+//           client had sent a request with the "change IP" and "change port" flags set.
+// RFC 5780: The server MUST include RESPONSE-ORIGIN [...]. If the server has an alternate address, it MUST include
+//           OTHER-ADDRESS. [...] When a server receives a RESPONSE-PORT attribute, it MUST send the response to the
+//           source IP address of the request, at the port given by RESPONSE-PORT. [...] The server MUST use the length
+//           of the PADDING attribute in the request as the length of the PADDING attribute in the response.
+// Note: the attribute RESPONSE-ADDRESS (RFC 3489) is rejected. Otherwise, the server could be used to flood any host.
+//
+// INPUT
+// - in_request: the request.
+// - in_reply: the response's sender and destination (the socket that received the request, and the request's source).
+//
+// OUTPUT
+// - The response.
+// - This flag indicates whether a response must be sent or not.
+func (v *Server) __binding(in_request StunPacket, in_reply serverResponse) (serverResponse, bool) {
+	var attributes []StunAttribute
+	var ok bool
+	var response_port uint16 = 0
+	var padding int = -1
+
+	response := __responseCreate(in_request, STUN_TYPE_BINDING_RESPONSE)
+	ip, port, err := tools.InetSplit(in_reply.destination.String())
+	if (nil != err) { return in_reply, false }
+	received := in_reply.sender
+
+	for i := 0; i < in_request.GetAttributesCount(); i++ {
+		a := in_request.GetAttribute(i)
+		switch a.Type {
+			case STUN_ATTRIBUT_RESPONSE_ADDRESS:
+				in_reply.packet, ok = v.__error(in_request, STUN_ERROR_BAD_REQUEST, "RESPONSE-ADDRESS is not supported", nil)
+				return in_reply, ok
+			case STUN_ATTRIBUT_RESPONSE_PORT:
+				response_port, err = a.AttributeGetResponsePort()
+				if (nil == err) && (0 == response_port) { err = errors.New("Invalid RESPONSE-PORT (0).") }
+			case STUN_ATTRIBUT_PADDING:
+				padding = int(a.Length)
+			case STUN_ATTRIBUT_CHANGE_REQUEST:
+				// This attribute is understood only if the server has an alternate address.
+				var change_ip, change_port bool
+				change_ip, change_port, err = a.AttributeGetChangeRequest()
+				if (change_ip) { in_reply.sender ^= 2 }
+				if (change_port) { in_reply.sender ^= 1 }
+		}
+		if (nil != err) {
+			in_reply.packet, ok = v.__error(in_request, STUN_ERROR_BAD_REQUEST, err.Error(), nil)
+			return in_reply, ok
+		}
+	}
+
+	if (0 != response_port) {
+		destination, err := tools.MakeTransportAddress(ip, int(response_port))
+		if (nil != err) { return in_reply, false }
+		in_reply.destination, err = net.ResolveUDPAddr("udp", destination)
+		if (nil != err) { return in_reply, false }
+	}
+
+	attribute, err := __createAddress(STUN_ATTRIBUT_MAPPED_ADDRESS, &response, ip, uint16(port))
+	if (nil != err) { return in_reply, false }
+	attributes = append(attributes, attribute)
+	if (STUN_RFC_3489 == rfc) && (v.alternate) {
+		attribute, err = v.__localAddress(STUN_ATTRIBUT_SOURCE_ADDRESS, &response, in_reply.sender)
+		if (nil != err) { return in_reply, false }
+		attributes = append(attributes, attribute)
+		attribute, err = v.__localAddress(STUN_ATTRIBUT_CHANGED_ADDRESS, &response, received ^ 3)
+		if (nil != err) { return in_reply, false }
+		attributes = append(attributes, attribute)
+	}
+	attribute, err = AttributeCreateXorMappedAddress(&response, ip, uint16(port))
+	if (nil != err) { return in_reply, false }
+	attributes = append(attributes, attribute)
+	if (STUN_RFC_5389 == rfc) {
+		attribute, err = v.__localAddress(STUN_ATTRIBUT_RESPONSE_ORIGIN, &response, in_reply.sender)
+		if (nil != err) { return in_reply, false }
+		attributes = append(attributes, attribute)
+		if (v.alternate) {
+			attribute, err = v.__localAddress(STUN_ATTRIBUT_OTHER_ADDRESS, &response, received ^ 3)
+			if (nil != err) { return in_reply, false }
+			attributes = append(attributes, attribute)
+		}
+	}
+	if (padding >= 0) {
+		attribute, err = AttributeCreate(STUN_ATTRIBUT_PADDING, make([]byte, padding), &response)
+		if (nil != err) { return in_reply, false }
+		attributes = append(attributes, attribute)
+	}
+
+	in_reply.packet, ok = v.__finalize(response, attributes)
+	return in_reply, ok
+}
+
+// This function creates an attribute that contains the local transport address of one of the server's sockets.
+//
+// INPUT
+// - in_type: the attribute's type.
+// - in_packet: pointer to the STUN packet.
+// - in_index: the index of the socket.
+//
+// OUTPUT
+// - The STUN's attribute.
+// - The error flag.
+func (v *Server) __localAddress(in_type uint16, in_packet *StunPacket, in_index int) (StunAttribute, error) {
+	ip, port, err := tools.InetSplit(v.connections[in_index].LocalAddr().String())
+	if (nil != err) { return StunAttribute{}, err }
+	return __createAddress(in_type, in_packet, ip, uint16(port))
+}
+
+// This function builds an error response.
+//
+// INPUT
+// - in_request: the request.
+// - in_code: the error code (constant STUN_ERROR_...).
+// - in_reason: the reason phrase ("" means "use the error's name").
+// - in_unknown: the types of the unknown attributes (error 420 only, nil otherwise).
+//
+// OUTPUT
+// - The error response.
+// - This flag indicates whether a response must be sent or not.
+func (v *Server) __error(in_request StunPacket, in_code uint16, in_reason string, in_unknown []uint16) (StunPacket, bool) {
+	var attributes []StunAttribute
+
+	t, err := TypeCreate(in_request.GetMethod(), STUN_CLASS_ERROR_RESPONSE)
+	if (nil != err) { return in_request, false }
+	response := __responseCreate(in_request, t)
+	attribute, err := AttributeCreateErrorCode(&response, in_code, in_reason)
+	if (nil != err) { return response, false }
+	attributes = append(attributes, attribute)
+	if (len(in_unknown) > 0) {
+		attribute, err = AttributeCreateUnknownAttributes(&response, in_unknown)
+		if (nil != err) { return response, false }
+		attributes = append(attributes, attribute)
+	}
+	return v.__finalize(response, attributes)
+}
+
+// This function adds attributes to a response, followed by the attributes SOFTWARE and FINGERPRINT.
+//
+// INPUT
+// - in_response: the response.
+// - in_attributes: the attributes to add.
+//
+// OUTPUT
+// - The response.
+// - This flag indicates whether a response must be sent or not.
+func (v *Server) __finalize(in_response StunPacket, in_attributes []StunAttribute) (StunPacket, bool) {
+	return v.__finalizeSigned(in_response, in_attributes, nil)
+}
+
+// This function adds attributes to a response, followed by the attributes SOFTWARE, MESSAGE-INTEGRITY (if a key is
+// given) and FINGERPRINT.
+//
+// INPUT
+// - in_response: the response.
+// - in_attributes: the attributes to add.
+// - in_key: the key used to calculate MESSAGE-INTEGRITY (nil means "no attribute MESSAGE-INTEGRITY").
+//
+// OUTPUT
+// - The response.
+// - This flag indicates whether a response must be sent or not.
+func (v *Server) __finalizeSigned(in_response StunPacket, in_attributes []StunAttribute, in_key []byte) (StunPacket, bool) {
+	for i := 0; i < len(in_attributes); i++ { in_response.AddAttribute(in_attributes[i]) }
+	if ("" != v.software) {
+		// RFC 3489: the length of the value must be a multiple of 4 bytes.
+		name := v.software
+		for (STUN_RFC_3489 == rfc) && (0 != len(name) % 4) { name += " " }
+		attribute, err := AttributeCreateSoftware(&in_response, name)
+		if (nil != err) { return in_response, false }
+		in_response.AddAttribute(attribute)
+	}
+	if (nil != in_key) {
+		attribute, err := AttributeCreateMessageIntegrity(&in_response, in_key)
+		if (nil != err) { return in_response, false }
+		in_response.AddAttribute(attribute)
+	}
+	attribute, err := AttributeCreateFingerprint(&in_response)
+	if (nil != err) { return in_response, false }
+	in_response.AddAttribute(attribute)
+	return in_response, true
+}
+
+// This function closes the server's sockets.
+//
+// OUTPUT
+// - The error flag (the first error that occurred).
+func (v *Server) __close() error {
+	var res error
+	for i := 0; i < len(v.connections); i++ {
+		err := v.connections[i].Close()
+		if (nil == res) { res = err }
+	}
+	return res
+}
+
+// This function creates a response to a request: the response has the request's transaction ID (and, for RFC 3489,
+// the request's "magic cookie", which is part of the transaction ID).
+//
+// INPUT
+// - in_request: the request.
+// - in_type: the response's type.
+//
+// OUTPUT
+// - The response.
+func __responseCreate(in_request StunPacket, in_type uint16) StunPacket {
+	response := PacketCreate()
+	response.SetType(in_type)
+	response.SetCookie(in_request.GetCookie())
+	response.SetId(in_request.GetId())
+	return response
+}
+
+// This function finds two ports that are available on two IP addresses.
+//
+// INPUT
+// - in_ip1: the first IP address.
+// - in_ip2: the second IP address.
+//
+// OUTPUT
+// - The ports.
+// - The error flag.
+func __serverPorts(in_ip1 string, in_ip2 string) ([]int, error) {
+	var ports []int
+	for attempt := 0; len(ports) < 2; attempt++ {
+		if (attempt == server_port_attempts) {
+			return nil, errors.New(fmt.Sprintf("Can not find two ports available on %s and %s.", in_ip1, in_ip2))
+		}
+		address, err := tools.MakeTransportAddress(in_ip1, 0)
+		if (nil != err) { return nil, err }
+		c1, err := net.ListenPacket("udp", address)
+		if (nil != err) { return nil, err }
+		port := c1.LocalAddr().(*net.UDPAddr).Port
+		address, err = tools.MakeTransportAddress(in_ip2, port)
+		if (nil != err) { c1.Close(); return nil, err }
+		c2, err := net.ListenPacket("udp", address)
+		c1.Close()
+		if (nil != err) { continue }
+		c2.Close()
+		if (0 == len(ports)) || (ports[0] != port) { ports = append(ports, port) }
+	}
+	return ports, nil
+}
@@ -16,6 +16,20 @@
 package stun
 
 import "testing"
+import "bytes"
+import "net"
+import "time"
+import "context"
+import "sync/atomic"
+import "sync"
+import "fmt"
+import "encoding/hex"
+import "math/rand"
+import "os"
+import "errors"
+import "os/exec"
+import "path/filepath"
+import "tools"
 
 // This function test types conversions.
 func test_go_conv(in_test *testing.T) {
@@ -52,3 +66,2377 @@ func test_fingerprint(in_test *testing.T) {
 }
 
 
+
+// This function starts a fake RFC 3489 server on 127.0.0.1 and 127.0.0.2. The server simulates a port restricted
+// cone NAT: it drops the requests that contain a CHANGE-REQUEST attribute with a flag set.
+//
+// OUTPUT
+// - The transport address of the server.
+// - The function that returns the source addresses of the requests received since its last call.
+// - The function that stops the server.
+func __testSourceServer(in_test *testing.T) (string, func() []string, func()) {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var sources []string
+	var sockets []*net.UDPConn
+
+	for _, ip := range []net.IP{ net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2) } {
+		socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if (nil != err) { in_test.Fatalf("Error: %s", err) }
+		sockets = append(sockets, socket)
+	}
+	changed := sockets[1].LocalAddr().(*net.UDPAddr)
+
+	for _, socket := range sockets {
+		wg.Add(1)
+		go func(socket *net.UDPConn) {
+			defer wg.Done()
+			b := make([]byte, 1000)
+			for {
+				count, from, err := socket.ReadFrom(b)
+				if (nil != err) { return }
+				request, err := FromBytes(b[0:count])
+				if (nil != err) { continue }
+				mutex.Lock()
+				sources = append(sources, from.String())
+				mutex.Unlock()
+
+				drop := false
+				for n := 0; n < request.GetAttributesCount(); n++ {
+					a := request.GetAttribute(n)
+					if (STUN_ATTRIBUT_CHANGE_REQUEST != a.Type) { continue }
+					ip, port, _ := a.AttributeGetChangeRequest()
+					drop = ip || port
+				}
+				if (drop) { continue }
+
+				response := PacketCreate()
+				response.SetType(STUN_TYPE_BINDING_RESPONSE)
+				response.SetId(request.GetId())
+				a, _ := __createAddress(STUN_ATTRIBUT_MAPPED_ADDRESS, &response, "203.0.113.1", 40000)
+				response.AddAttribute(a)
+				a, _ = __createAddress(STUN_ATTRIBUT_CHANGED_ADDRESS, &response, changed.IP.String(), uint16(changed.Port))
+				response.AddAttribute(a)
+				socket.WriteTo(response.ToBytes(), from)
+			}
+		}(socket)
+	}
+
+	return sockets[0].LocalAddr().String(), func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		res := sources
+		sources = nil
+		return res
+	}, func() {
+		for _, socket := range sockets { socket.Close() }
+		wg.Wait()
+	}
+}
+
+// Client: all the requests of the discovery process are sent from the client's socket.
+func Test_ClientSocket(in_test *testing.T) {
+	server, sources, stop := __testSourceServer(in_test)
+	defer stop()
+
+	client, err := ClientCreate(server)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer client.Close()
+	client.SetRetransmitPolicy(RetransmitPolicy{ InitialRto: 20 * time.Millisecond, Rc: 2, Rm: 2 })
+
+	for round := 0; round < 2; round++ {
+		local := client.LocalAddr()
+		result, err := client.ClientDiscover()
+		if (nil != err) { in_test.Fatalf("Round %d: %s", round, err) }
+		if (STUN_NAT_PORT_RESTRICTED != result.NatType) { in_test.Errorf("Round %d: unexpected NAT type %s.", round, result.NatType) }
+		if (local != client.LocalAddr()) || (local != result.LocalAddress) { in_test.Errorf("Round %d: the local address has changed (%s, %s, %s).", round, local, client.LocalAddr(), result.LocalAddress) }
+		names := make(map[string]bool)
+		for _, test := range result.Tests { names[test.Name] = true }
+		for _, name := range []string{ "Test I", "Test II", "Test I(b)", "Test III" } {
+			if (! names[name]) { in_test.Errorf("Round %d: %s has not been performed.", round, name) }
+		}
+		// Test I, Test II (twice: no response), Test I(b), Test III (twice: no response) and the hairpinning test.
+		received := sources()
+		if (len(received) < 7) { in_test.Errorf("Round %d: unexpected number of requests (%d).", round, len(received)) }
+		for _, source := range received {
+			if (local != source) { in_test.Errorf("Round %d: request sent from %s instead of %s.", round, source, local) }
+		}
+
+		// The socket is renewed, as it is when a TURN server replies 437 (Allocation Mismatch). The previous socket is
+		// closed, and the next discovery process uses the new socket only.
+		previous := client.connection
+		if err := client.__renewSocket(); nil != err { in_test.Fatalf("Error: %s", err) }
+		if (local == client.LocalAddr()) { in_test.Errorf("Round %d: the socket has not been renewed.", round) }
+		if _, err := previous.WriteTo([]byte{ 0 }, previous.LocalAddr()); nil == err { in_test.Errorf("Round %d: the previous socket is still open.", round) }
+	}
+}
+
+// TransactionIdCreate()
+func Test_TransactionIdCreate(in_test *testing.T) {
+	id1, err := TransactionIdCreate()
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	id2, err := TransactionIdCreate()
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	if (12 != len(id1)) { in_test.Errorf("Invalid transaction ID length. Got %d, expected 12.", len(id1)) }
+	if (bytes.Equal(id1, id2)) { in_test.Errorf("Two transaction IDs are identical (% x).", id1) }
+}
+
+// SendRequest() must discard packets which transaction IDs don't match the request's one.
+func Test_SendRequestTransactionMatching(in_test *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer server.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer client.Close()
+
+	request := PacketCreate()
+	request.SetType(STUN_TYPE_BINDING_REQUEST)
+	err = request.SetRandomId()
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+
+	go func() {
+		b := make([]byte, 1000)
+		count, from, err := server.ReadFrom(b)
+		if (nil != err) { return }
+		received, err := FromBytes(b[0:count])
+		if (nil != err) { return }
+
+		// First, a stray response.
+		stray := PacketCreate()
+		stray.SetType(STUN_TYPE_BINDING_RESPONSE)
+		stray.SetRandomId()
+		server.WriteTo(stray.ToBytes(), from)
+
+		// The request itself (reflected), an indication and a response to another method, with the same transaction ID.
+		server.WriteTo(b[0:count], from)
+		for _, t := range [][2]uint16{ { STUN_METHOD_BINDING, STUN_CLASS_INDICATION }, { STUN_METHOD_ALLOCATE, STUN_CLASS_SUCCESS_RESPONSE } } {
+			spoof := PacketCreate()
+			stype, _ := TypeCreate(t[0], t[1])
+			spoof.SetType(stype)
+			spoof.SetId(received.GetId())
+			server.WriteTo(spoof.ToBytes(), from)
+		}
+
+		// Then, the real one.
+		response := PacketCreate()
+		response.SetType(STUN_TYPE_BINDING_RESPONSE)
+		response.SetId(received.GetId())
+		server.WriteTo(response.ToBytes(), from)
+	}()
+
+	response, ok, err := SendRequest(client, server.LocalAddr(), request)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	if (! ok) { in_test.Fatalf("No response received.") }
+	if (! bytes.Equal(response.GetId(), request.GetId())) {
+		in_test.Errorf("Invalid transaction ID. Got % x, expected % x.", response.GetId(), request.GetId())
+	}
+	if (STUN_TYPE_BINDING_RESPONSE != response.GetType()) { in_test.Errorf("Invalid type 0x%04X.", response.GetType()) }
+}
+
+// NatType.MarshalText() and NatType.UnmarshalText()
+func Test_NatTypeText(in_test *testing.T) {
+	for nat := range nat_type_names {
+		var decoded NatType
+		text, err := nat.MarshalText()
+		if (nil != err) { in_test.Fatalf("Error: %s", err) }
+		err = decoded.UnmarshalText(text)
+		if (nil != err) { in_test.Fatalf("Error: %s", err) }
+		if (decoded != nat) { in_test.Errorf("Invalid NAT type. Got %s, expected %s.", decoded, nat) }
+	}
+	if ("FULL_CONE" != STUN_NAT_FULL_CONE.String()) { in_test.Errorf("Invalid name: %s", STUN_NAT_FULL_CONE) }
+	if _, err := NatType(100).MarshalText(); nil == err { in_test.Errorf("The test should fail.") }
+}
+
+// RetransmitPolicy
+func Test_RetransmitPolicy(in_test *testing.T) {
+	policy   := RetransmitPolicyRfc5389()
+	expected := []time.Duration{ 500, 1000, 2000, 4000, 8000, 16000, 8000 }
+	for i := 0; i < policy.Rc; i++ {
+		if (expected[i] * time.Millisecond != policy.__timeout(i)) {
+			in_test.Errorf("Invalid timeout for transmission %d. Got %s, expected %s.", i, policy.__timeout(i), expected[i] * time.Millisecond)
+		}
+	}
+
+	policy = RetransmitPolicyRfc3489()
+	if (1600 * time.Millisecond != policy.__timeout(6)) { in_test.Errorf("Invalid timeout: %s.", policy.__timeout(6)) }
+
+	policy.Rc = 0
+	if (nil == policy.Check()) { in_test.Errorf("The test should fail.") }
+}
+
+// SendRequest(): a response larger than a typical MTU is received in full.
+func Test_SendRequestLargeResponse(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer server.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer client.Close()
+
+	request := PacketCreate()
+	request.SetType(STUN_TYPE_BINDING_REQUEST)
+	request.SetRandomId()
+
+	go func() {
+		b := make([]byte, 1000)
+		count, from, err := server.ReadFrom(b)
+		if (nil != err) { return }
+		received, err := FromBytes(b[0:count])
+		if (nil != err) { return }
+		response := PacketCreate()
+		response.SetType(STUN_TYPE_BINDING_RESPONSE)
+		response.SetId(received.GetId())
+		a, _ := AttributeCreate(STUN_ATTRIBUT_PADDING, make([]byte, 4000), &response)
+		response.AddAttribute(a)
+		server.WriteTo(response.ToBytes(), from)
+	}()
+
+	response, ok, err := SendRequestContext(context.Background(), client, server.LocalAddr(), request, RetransmitPolicy{ InitialRto: time.Second, Rc: 1, Rm: 1 })
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	if (! ok) { in_test.Fatalf("No response received.") }
+	if (1 != response.GetAttributesCount()) || (4000 != response.GetAttribute(0).Length) {
+		in_test.Errorf("Unexpected response (%d attributes).", response.GetAttributesCount())
+	}
+}
+
+// SendRequestContext() must return as soon as the context expires.
+func Test_SendRequestContextDeadline(in_test *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer server.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer client.Close()
+
+	request := PacketCreate()
+	request.SetType(STUN_TYPE_BINDING_REQUEST)
+	request.SetRandomId()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300 * time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, ok, err := SendRequestContext(ctx, client, server.LocalAddr(), request, RetransmitPolicyRfc5389())
+	if (ok) { in_test.Errorf("No response should have been received.") }
+	if (context.DeadlineExceeded != err) { in_test.Errorf("Unexpected error: %v", err) }
+	if (time.Since(start) > 2 * time.Second) { in_test.Errorf("The deadline has not been honoured (%s).", time.Since(start)) }
+}
+
+// This type represents a socket that reproduces a race: the context is cancelled while the read deadline is being set.
+// The deadline set by the cancellation (now) is then overwritten by the deadline of the request.
+type testRaceConn struct {
+	net.PacketConn
+	// The function that cancels the context.
+	cancel context.CancelFunc
+	// This channel is closed when the deadline "now" has been set.
+	now chan struct{}
+	// This object makes sure that the race is reproduced only once.
+	once sync.Once
+}
+
+// This function sets the read deadline of the socket (see net.PacketConn).
+func (v *testRaceConn) SetReadDeadline(in_t time.Time) error {
+	if (! in_t.After(time.Now())) {
+		err := v.PacketConn.SetReadDeadline(in_t)
+		close(v.now)
+		return err
+	}
+	v.once.Do(func() {
+		v.cancel()
+		<-v.now
+	})
+	return v.PacketConn.SetReadDeadline(in_t)
+}
+
+// SendRequestContext(): the context is cancelled while the read deadline is being set.
+func Test_SendRequestContextCancelRace(in_test *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer server.Close()
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer socket.Close()
+
+	request := PacketCreate()
+	request.SetType(STUN_TYPE_BINDING_REQUEST)
+	request.SetRandomId()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &testRaceConn{ PacketConn: socket, cancel: cancel, now: make(chan struct{}) }
+	start := time.Now()
+	_, ok, err := SendRequestContext(ctx, client, server.LocalAddr(), request, RetransmitPolicy{ InitialRto: 5 * time.Second, Rc: 1, Rm: 1 })
+	if (ok) { in_test.Errorf("No response should have been received.") }
+	if (context.Canceled != err) { in_test.Errorf("Unexpected error: %v", err) }
+	if (time.Since(start) > 2 * time.Second) { in_test.Errorf("The cancellation has not been honoured (%s).", time.Since(start)) }
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* RFC 5769 test vectors.                                                                           */
+/* See http://www.armware.dk/RFC/rfc/rfc5769.html                                                   */
+/* ------------------------------------------------------------------------------------------------ */
+
+// The password used by the test vectors for short-term credentials.
+const rfc5769_password = "VOkJxbRl1RmTxUk/WvJxBt"
+
+// Sample request (RFC 5769, section 2.1).
+var rfc5769_request []byte = []byte{
+	0x00, 0x01, 0x00, 0x58, 0x21, 0x12, 0xa4, 0x42, 0xb7, 0xe7, 0xa7, 0x01, 0xbc, 0x34, 0xd6, 0x86,
+	0xfa, 0x87, 0xdf, 0xae, 0x80, 0x22, 0x00, 0x10, 0x53, 0x54, 0x55, 0x4e, 0x20, 0x74, 0x65, 0x73,
+	0x74, 0x20, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x00, 0x24, 0x00, 0x04, 0x6e, 0x00, 0x01, 0xff,
+	0x80, 0x29, 0x00, 0x08, 0x93, 0x2f, 0xf9, 0xb1, 0x51, 0x26, 0x3b, 0x36, 0x00, 0x06, 0x00, 0x09,
+	0x65, 0x76, 0x74, 0x6a, 0x3a, 0x68, 0x36, 0x76, 0x59, 0x20, 0x20, 0x20, 0x00, 0x08, 0x00, 0x14,
+	0x9a, 0xea, 0xa7, 0x0c, 0xbf, 0xd8, 0xcb, 0x56, 0x78, 0x1e, 0xf2, 0xb5, 0xb2, 0xd3, 0xf2, 0x49,
+	0xc1, 0xb5, 0x71, 0xa2, 0x80, 0x28, 0x00, 0x04, 0xe5, 0x7a, 0x3b, 0xcf }
+
+// Sample IPv4 response (RFC 5769, section 2.2).
+var rfc5769_response_ipv4 []byte = []byte{
+	0x01, 0x01, 0x00, 0x3c, 0x21, 0x12, 0xa4, 0x42, 0xb7, 0xe7, 0xa7, 0x01, 0xbc, 0x34, 0xd6, 0x86,
+	0xfa, 0x87, 0xdf, 0xae, 0x80, 0x22, 0x00, 0x0b, 0x74, 0x65, 0x73, 0x74, 0x20, 0x76, 0x65, 0x63,
+	0x74, 0x6f, 0x72, 0x20, 0x00, 0x20, 0x00, 0x08, 0x00, 0x01, 0xa1, 0x47, 0xe1, 0x12, 0xa6, 0x43,
+	0x00, 0x08, 0x00, 0x14, 0x2b, 0x91, 0xf5, 0x99, 0xfd, 0x9e, 0x90, 0xc3, 0x8c, 0x74, 0x89, 0xf9,
+	0x2a, 0xf9, 0xba, 0x53, 0xf0, 0x6b, 0xe7, 0xd7, 0x80, 0x28, 0x00, 0x04, 0xc0, 0x7d, 0x4c, 0x96 }
+
+// Sample IPv6 response (RFC 5769, section 2.3).
+var rfc5769_response_ipv6 []byte = []byte{
+	0x01, 0x01, 0x00, 0x48, 0x21, 0x12, 0xa4, 0x42, 0xb7, 0xe7, 0xa7, 0x01, 0xbc, 0x34, 0xd6, 0x86,
+	0xfa, 0x87, 0xdf, 0xae, 0x80, 0x22, 0x00, 0x0b, 0x74, 0x65, 0x73, 0x74, 0x20, 0x76, 0x65, 0x63,
+	0x74, 0x6f, 0x72, 0x20, 0x00, 0x20, 0x00, 0x14, 0x00, 0x02, 0xa1, 0x47, 0x01, 0x13, 0xa9, 0xfa,
+	0xa5, 0xd3, 0xf1, 0x79, 0xbc, 0x25, 0xf4, 0xb5, 0xbe, 0xd2, 0xb9, 0xd9, 0x00, 0x08, 0x00, 0x14,
+	0xa3, 0x82, 0x95, 0x4e, 0x4b, 0xe6, 0x7b, 0xf1, 0x17, 0x84, 0xc9, 0x7c, 0x82, 0x92, 0xc2, 0x75,
+	0xbf, 0xe3, 0xed, 0x41, 0x80, 0x28, 0x00, 0x04, 0xc8, 0xfb, 0x0b, 0x4c }
+
+// StunPacket.CheckMessageIntegrity() and AttributeCreateMessageIntegrity()
+func Test_MessageIntegrity(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	vectors := [][]byte{ rfc5769_request, rfc5769_response_ipv4, rfc5769_response_ipv6 }
+	for n := range vectors {
+		packet, err := FromBytes(vectors[n])
+		if (nil != err) { in_test.Fatalf("Vector %d: %s", n, err) }
+
+		// Verification (FINGERPRINT follows MESSAGE-INTEGRITY).
+		ok, err := packet.CheckMessageIntegrity(ShortTermKey(rfc5769_password))
+		if (nil != err) { in_test.Fatalf("Vector %d: %s", n, err) }
+		if (! ok) { in_test.Errorf("Vector %d: MESSAGE-INTEGRITY is not valid.", n) }
+		ok, err = packet.CheckMessageIntegrity(ShortTermKey("bad password"))
+		if (nil != err) { in_test.Fatalf("Vector %d: %s", n, err) }
+		if (ok) { in_test.Errorf("Vector %d: MESSAGE-INTEGRITY should not be valid.", n) }
+
+		// Creation: rebuild the packet up to MESSAGE-INTEGRITY.
+		rebuilt := PacketCreate()
+		rebuilt.SetType(packet.GetType())
+		rebuilt.SetId(packet.GetId())
+		var expected []byte
+		for i := 0; i < packet.GetAttributesCount(); i++ {
+			a := packet.GetAttribute(i)
+			if (STUN_ATTRIBUT_MESSAGE_INTEGRITY == a.Type) { expected = a.Value; break }
+			rebuilt.AddAttribute(a)
+		}
+		a, err := AttributeCreateMessageIntegrity(&rebuilt, ShortTermKey(rfc5769_password))
+		if (nil != err) { in_test.Fatalf("Vector %d: %s", n, err) }
+		if (! bytes.Equal(expected, a.Value)) { in_test.Errorf("Vector %d: invalid HMAC. Got % x, expected % x.", n, a.Value, expected) }
+	}
+
+	// A packet without MESSAGE-INTEGRITY.
+	packet := PacketCreate()
+	packet.SetType(STUN_TYPE_BINDING_REQUEST)
+	if _, err := packet.CheckMessageIntegrity(ShortTermKey(rfc5769_password)); nil == err { in_test.Errorf("The test should fail.") }
+}
+
+// SetRfc3489() and SetRfc5389()
+func Test_RfcVersion(in_test *testing.T) {
+	if (STUN_RFC_3489 == STUN_RFC_5389) { in_test.Fatalf("The two RFC versions have the same value.") }
+
+	// RFC 3489: the length of the attributes must be a multiple of 4.
+	SetRfc3489()
+	packet := PacketCreate()
+	if _, err := AttributeCreate(STUN_ATTRIBUT_SOFTWARE, []byte("abc"), &packet); nil == err { in_test.Errorf("RFC 3489: unpadded attribute accepted.") }
+	if _, err := FromBytes(rfc5769_request); nil == err { in_test.Errorf("RFC 3489: padded attribute accepted.") }
+
+	// RFC 5389: the attributes are padded.
+	SetRfc5389()
+	defer SetRfc3489()
+	a, err := AttributeCreate(STUN_ATTRIBUT_SOFTWARE, []byte("abc"), &packet)
+	if (nil != err) || (3 != a.Length) || (4 != len(a.Value)) { in_test.Errorf("RFC 5389: unexpected attribute (%v).", err) }
+	if _, err := FromBytes(rfc5769_request); nil != err { in_test.Errorf("RFC 5389: %s", err) }
+}
+
+// Client.SetCredentials(): 401 challenge, stale nonce (438) and wrong password.
+func Test_LongTermCredentials(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer server.Close()
+
+	// The server accepts the user "user" with the password "pass", and the current nonce only.
+	nonces   := make(chan string, 1)
+	var requests int32 = 0
+	nonces <- "nonce-1"
+	go func() {
+		b := make([]byte, 1000)
+		for {
+			count, from, err := server.ReadFrom(b)
+			if (nil != err) { return }
+			request, err := FromBytes(b[0:count])
+			if (nil != err) { continue }
+			atomic.AddInt32(&requests, 1)
+			nonce := <-nonces
+			nonces <- nonce
+
+			response := PacketCreate()
+			response.SetId(request.GetId())
+			response.SetType(STUN_TYPE_BINDING_ERROR_RESPONSE)
+			key := LongTermKey("user", "example.org", "pass")
+			code := uint16(STUN_ERROR_UNAUTHORIZED)
+			if _, found := __hasMessageIntegrity(request); found {
+				_, n := request.GetNonce()
+				ok, _ := request.CheckMessageIntegrity(key)
+				if (n != nonce) {
+					code = STUN_ERROR_STALE_NONCE
+				} else if (ok) {
+					response.SetType(STUN_TYPE_BINDING_RESPONSE)
+				}
+			}
+			if (STUN_TYPE_BINDING_ERROR_RESPONSE == response.GetType()) {
+				a, _ := AttributeCreateErrorCode(&response, code, "")
+				response.AddAttribute(a)
+				a, _ = AttributeCreateRealm(&response, "example.org")
+				response.AddAttribute(a)
+				a, _ = AttributeCreateNonce(&response, nonce)
+				response.AddAttribute(a)
+			} else {
+				a, _ := AttributeCreateMessageIntegrity(&response, key)
+				response.AddAttribute(a)
+			}
+			server.WriteTo(response.ToBytes(), from)
+		}
+	}()
+
+	client, err := ClientCreate(server.LocalAddr().String())
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer client.Close()
+	client.SetCredentials("user", "pass")
+
+	// 401, then success.
+	response, err := client.ClientSendBinding(context.Background(), nil)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	if (STUN_TYPE_BINDING_RESPONSE != response.packet.GetType()) { in_test.Errorf("Unexpected response (0x%04x).", response.packet.GetType()) }
+	if (2 != atomic.LoadInt32(&requests)) { in_test.Errorf("Unexpected number of requests: %d (expected 2).", atomic.LoadInt32(&requests)) }
+
+	// The nonce expires: 438, then success.
+	<-nonces
+	nonces <- "nonce-2"
+	response, err = client.ClientSendBinding(context.Background(), nil)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	if (STUN_TYPE_BINDING_RESPONSE != response.packet.GetType()) { in_test.Errorf("Unexpected response (0x%04x).", response.packet.GetType()) }
+	if (4 != atomic.LoadInt32(&requests)) { in_test.Errorf("Unexpected number of requests: %d (expected 4).", atomic.LoadInt32(&requests)) }
+
+	// Wrong password: the request is sent once with credentials, then the 401 is returned.
+	client.SetCredentials("user", "wrong")
+	response, err = client.ClientSendBinding(context.Background(), nil)
+	if e, ok := err.(*ErrorResponse); (! ok) || (STUN_ERROR_UNAUTHORIZED != e.Code) { in_test.Errorf("Unexpected error: %v", err) }
+	if (STUN_TYPE_BINDING_ERROR_RESPONSE != response.packet.GetType()) { in_test.Errorf("Unexpected response (0x%04x).", response.packet.GetType()) }
+	if (6 != atomic.LoadInt32(&requests)) { in_test.Errorf("Unexpected number of requests: %d (expected 6).", atomic.LoadInt32(&requests)) }
+}
+
+// Client.SetCredentials(): a forged response (invalid MESSAGE-INTEGRITY) is discarded, the genuine response is accepted.
+func Test_ForgedResponse(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer server.Close()
+
+	go func() {
+		b := make([]byte, 1000)
+		for {
+			count, from, err := server.ReadFrom(b)
+			if (nil != err) { return }
+			request, err := FromBytes(b[0:count])
+			if (nil != err) { continue }
+
+			if _, found := __hasMessageIntegrity(request); ! found {
+				response := PacketCreate()
+				response.SetId(request.GetId())
+				response.SetType(STUN_TYPE_BINDING_ERROR_RESPONSE)
+				a, _ := AttributeCreateErrorCode(&response, STUN_ERROR_UNAUTHORIZED, "")
+				response.AddAttribute(a)
+				a, _ = AttributeCreateRealm(&response, "example.org")
+				response.AddAttribute(a)
+				a, _ = AttributeCreateNonce(&response, "nonce")
+				response.AddAttribute(a)
+				server.WriteTo(response.ToBytes(), from)
+				continue
+			}
+
+			// The forged response comes first.
+			for _, key := range [][]byte{ LongTermKey("user", "example.org", "forged"), LongTermKey("user", "example.org", "pass") } {
+				response := PacketCreate()
+				response.SetId(request.GetId())
+				response.SetType(STUN_TYPE_BINDING_RESPONSE)
+				a, _ := AttributeCreateMessageIntegrity(&response, key)
+				response.AddAttribute(a)
+				server.WriteTo(response.ToBytes(), from)
+			}
+		}
+	}()
+
+	client, err := ClientCreate(server.LocalAddr().String())
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer client.Close()
+	client.SetCredentials("user", "pass")
+
+	response, err := client.ClientSendBinding(context.Background(), nil)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	if (STUN_TYPE_BINDING_RESPONSE != response.packet.GetType()) { in_test.Errorf("Unexpected response (0x%04x).", response.packet.GetType()) }
+	if ok, _ := response.packet.CheckMessageIntegrity(LongTermKey("user", "example.org", "pass")); ! ok {
+		in_test.Errorf("The forged response has been accepted.")
+	}
+}
+
+// AttributeCreateErrorCode(), AttributeGetErrorCode() and ErrorResponse.
+func Test_ErrorCode(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	packet := PacketCreate()
+	packet.SetType(STUN_TYPE_BINDING_ERROR_RESPONSE)
+	a, err := AttributeCreateErrorCode(&packet, STUN_ERROR_STALE_NONCE, "Stale Nonce")
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	if (! bytes.Equal([]byte{ 0x00, 0x00, 0x04, 0x26 }, a.Value[0:4])) { in_test.Errorf("Invalid value (% x).", a.Value) }
+	packet.AddAttribute(a)
+
+	decoded, err := FromBytes(packet.ToBytes())
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	found, code, reason, err := decoded.GetErrorCode()
+	if (nil != err) || (! found) { in_test.Fatalf("Can not find ERROR-CODE: %v", err) }
+	if (STUN_ERROR_STALE_NONCE != code) || ("Stale Nonce" != reason) { in_test.Errorf("Unexpected error code: %d %s", code, reason) }
+	a = decoded.GetAttribute(0)
+	if text, _ := a.String(); "438 STALE_NONCE (Stale Nonce)" != text { in_test.Errorf("Unexpected representation: %s", text) }
+
+	e, ok := __errorResponse(decoded).(*ErrorResponse)
+	if (! ok) || (STUN_ERROR_STALE_NONCE != e.Code) || ("Stale Nonce" != e.Reason) { in_test.Errorf("Unexpected error: %v", e) }
+
+	// Invalid codes.
+	if _, err = AttributeCreateErrorCode(&packet, 200, ""); nil == err { in_test.Errorf("The test should fail.") }
+	a, _ = AttributeCreate(STUN_ATTRIBUT_ERROR_CODE, []byte{ 0x00, 0x00, 0x02, 0x00 }, &packet)
+	if _, _, err = a.AttributeGetErrorCode(); nil == err { in_test.Errorf("The test should fail.") }
+
+	// Success responses are not errors.
+	packet.SetType(STUN_TYPE_BINDING_RESPONSE)
+	if nil != __errorResponse(packet) { in_test.Errorf("A success response is not an error.") }
+}
+
+// FINGERPRINT verification while decoding packets.
+func Test_Fingerprint(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	// Valid fingerprints.
+	vectors := [][]byte{ rfc5769_request, rfc5769_response_ipv4, rfc5769_response_ipv6 }
+	for n := range vectors {
+		if _, err := FromBytes(vectors[n]); nil != err { in_test.Errorf("Vector %d: %s", n, err) }
+	}
+
+	// Corrupted packet.
+	corrupted := make([]byte, len(rfc5769_response_ipv4))
+	copy(corrupted, rfc5769_response_ipv4)
+	corrupted[30] ^= 0x01
+	if _, err := FromBytes(corrupted); nil == err { in_test.Errorf("The test should fail (corrupted packet).") }
+
+	// The verification can be disabled.
+	SetFingerprintCheck(STUN_FINGERPRINT_CHECK_OFF)
+	_, err := FromBytes(corrupted)
+	SetFingerprintCheck(STUN_FINGERPRINT_CHECK_AUTO)
+	if (nil != err) { in_test.Errorf("Error: %s", err) }
+
+	// Packet created by AttributeCreateFingerprint().
+	packet := PacketCreate()
+	packet.SetType(STUN_TYPE_BINDING_REQUEST)
+	packet.SetRandomId()
+	a, _ := AttributeCreateSoftware(&packet, "test")
+	packet.AddAttribute(a)
+	a, err = AttributeCreateFingerprint(&packet)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	packet.AddAttribute(a)
+	if _, err = FromBytes(packet.ToBytes()); nil != err { in_test.Errorf("Error: %s", err) }
+
+	// FINGERPRINT must be the last attribute.
+	a, _ = AttributeCreateSoftware(&packet, "last")
+	packet.AddAttribute(a)
+	if _, err = FromBytes(packet.ToBytes()); nil == err { in_test.Errorf("The test should fail (FINGERPRINT is not the last attribute).") }
+}
+
+// FromBytes() must reject malformed packets with a DecodeError.
+func Test_FromBytesErrors(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	header := []byte{ 0x00, 0x01, 0x00, 0x00, 0x21, 0x12, 0xa4, 0x42, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12 }
+	build  := func(in_patch func([]byte) []byte) []byte {
+		b := make([]byte, len(header))
+		copy(b, header)
+		return in_patch(b)
+	}
+	withAttribute := func(in_attribute []byte) []byte {
+		b := build(func(b []byte) []byte { return append(b, in_attribute...) })
+		copy(b[2:4], []byte{ byte((len(b) - 20) >> 8), byte(len(b) - 20) })
+		return b
+	}
+
+	tests := []struct {
+		name string
+		bin  []byte
+		kind int
+	}{
+		{ "short",             header[0:19],                                                               STUN_DECODE_ERROR_SIZE },
+		{ "leading bits",      build(func(b []byte) []byte { b[0] = 0x40; return b }),                     STUN_DECODE_ERROR_TYPE },
+		{ "unaligned length",  build(func(b []byte) []byte { b[3] = 0x02; return append(b, 0, 0) }),       STUN_DECODE_ERROR_LENGTH },
+		{ "length too long",   build(func(b []byte) []byte { b[3] = 0x08; return append(b, 0, 0, 0, 0) }), STUN_DECODE_ERROR_LENGTH },
+		{ "trailing bytes",    build(func(b []byte) []byte { return append(b, 0, 0, 0, 0) }),              STUN_DECODE_ERROR_LENGTH },
+		{ "cookie",            build(func(b []byte) []byte { b[4] = 0; return b }),                        STUN_DECODE_ERROR_COOKIE },
+		{ "value overflow",    withAttribute([]byte{ 0x80, 0x22, 0x00, 0x08, 'a', 'b', 'c', 'd' }),        STUN_DECODE_ERROR_ATTRIBUTE },
+		{ "value overflow max", withAttribute([]byte{ 0x80, 0x22, 0xff, 0xff, 'a', 'b', 'c', 'd' }),       STUN_DECODE_ERROR_ATTRIBUTE },
+		{ "odd size",          withAttribute([]byte{ 0x80, 0x22, 0x00, 0x00, 0x80, 0x22, 0x00, 0x00 })[0:26], STUN_DECODE_ERROR_LENGTH },
+	}
+
+	for _, test := range tests {
+		_, err := FromBytes(test.bin)
+		e, ok := err.(*DecodeError)
+		if (! ok) { in_test.Errorf("%s: unexpected error: %v", test.name, err); continue }
+		if (test.kind != e.Kind) { in_test.Errorf("%s: unexpected kind of error %d (expected %d): %s", test.name, e.Kind, test.kind, e) }
+	}
+
+	// RFC 3489: unaligned attributes are rejected (no panic).
+	SetRfc3489()
+	_, err := FromBytes(withAttribute([]byte{ 0x80, 0x22, 0x00, 0x03, 'a', 'b', 'c', 0 }))
+	if e, ok := err.(*DecodeError); (! ok) || (STUN_DECODE_ERROR_PADDING != e.Kind) { in_test.Errorf("Unexpected error: %v", err) }
+}
+
+// FromBytes() must never panic. Valid packets are encoded back to the same sequence of bytes.
+func FuzzFromBytes(in_fuzz *testing.F) {
+	in_fuzz.Add(rfc5769_request)
+	in_fuzz.Add(rfc5769_response_ipv4)
+	in_fuzz.Add(rfc5769_response_ipv6)
+	in_fuzz.Fuzz(func(in_test *testing.T, in_bin []byte) {
+		SetRfc5389()
+		defer SetRfc3489()
+		packet, err := FromBytes(in_bin)
+		if (nil != err) {
+			if _, ok := err.(*DecodeError); ! ok { in_test.Errorf("Unexpected type of error: %v", err) }
+			return
+		}
+		if (! bytes.Equal(in_bin, packet.ToBytes())) { in_test.Errorf("Invalid encoding.\n% x\n% x", in_bin, packet.ToBytes()) }
+		packet.String(0)
+	})
+}
+
+// TypeGetMethod(), TypeGetClass(), TypeCreate() and TypeString().
+func Test_MessageType(in_test *testing.T) {
+	tests := []struct {
+		stype  uint16
+		method uint16
+		class  uint16
+		name   string
+	}{
+		{ STUN_TYPE_BINDING_REQUEST,                STUN_METHOD_BINDING,           STUN_CLASS_REQUEST,          "Binding Request" },
+		{ 0x0011,                                   STUN_METHOD_BINDING,           STUN_CLASS_INDICATION,       "Binding Indication" },
+		{ STUN_TYPE_BINDING_RESPONSE,               STUN_METHOD_BINDING,           STUN_CLASS_SUCCESS_RESPONSE, "Binding Success Response" },
+		{ STUN_TYPE_BINDING_ERROR_RESPONSE,         STUN_METHOD_BINDING,           STUN_CLASS_ERROR_RESPONSE,   "Binding Error Response" },
+		{ STUN_TYPE_ALLOCATE_ERROR_RESPONSE,        STUN_METHOD_ALLOCATE,          STUN_CLASS_ERROR_RESPONSE,   "Allocate Error Response" },
+		{ 0x0016,                                   STUN_METHOD_SEND,              STUN_CLASS_INDICATION,       "Send Indication" },
+		{ STUN_TYPE_CHANNEL_BINDING_RESPONSE,       STUN_METHOD_CHANNEL_BIND,      STUN_CLASS_SUCCESS_RESPONSE, "ChannelBind Success Response" },
+		{ 0x3EEF,                                   0x0FFF,                        STUN_CLASS_REQUEST,          "Method 0xfff Request" },
+		{ 0x0120,                                   0x010,                         STUN_CLASS_SUCCESS_RESPONSE, "Method 0x010 Success Response" },
+	}
+
+	for _, test := range tests {
+		if m := TypeGetMethod(test.stype); test.method != m { in_test.Errorf("0x%04x: invalid method 0x%03x (expected 0x%03x).", test.stype, m, test.method) }
+		if c := TypeGetClass(test.stype); test.class != c { in_test.Errorf("0x%04x: invalid class %d (expected %d).", test.stype, c, test.class) }
+		if n := TypeString(test.stype); test.name != n { in_test.Errorf("0x%04x: invalid name \"%s\" (expected \"%s\").", test.stype, n, test.name) }
+		t, err := TypeCreate(test.method, test.class)
+		if (nil != err) || (test.stype != t) { in_test.Errorf("Invalid type 0x%04x (expected 0x%04x): %v", t, test.stype, err) }
+	}
+
+	if _, err := TypeCreate(0x1000, STUN_CLASS_REQUEST); nil == err { in_test.Errorf("The test should fail.") }
+	if _, err := TypeCreate(STUN_METHOD_BINDING, 4); nil == err { in_test.Errorf("The test should fail.") }
+}
+
+// AttributeCreateXorMappedAddress() and AttributeGetXorMappedAddress(), using the RFC 5769 vectors.
+func Test_XorAddress(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	tests := []struct {
+		vector []byte
+		family uint16
+		ip     string
+		port   uint16
+	}{
+		{ rfc5769_response_ipv4, STUN_ATTRIBUT_FAMILY_IPV4, "192.0.2.1", 32853 },
+		{ rfc5769_response_ipv6, STUN_ATTRIBUT_FAMILY_IPV6, "2001:0db8:1234:5678:0011:2233:4455:6677", 32853 },
+	}
+
+	for _, test := range tests {
+		packet, err := FromBytes(test.vector)
+		if (nil != err) { in_test.Fatalf("Error: %s", err) }
+
+		// Decode.
+		found, family, ip, port, err := packet.GetXorMappedAddress()
+		if (nil != err) || (! found) { in_test.Fatalf("Can not find XOR-MAPPED-ADDRESS: %v", err) }
+		if (test.family != family) || (test.ip != ip) || (test.port != port) {
+			in_test.Errorf("Invalid address: %d %s %d (expected %d %s %d).", family, ip, port, test.family, test.ip, test.port)
+		}
+
+		// Encode.
+		expected := packet.GetAttribute(1)
+		a, err := AttributeCreateXorMappedAddress(&packet, test.ip, test.port)
+		if (nil != err) { in_test.Fatalf("Error: %s", err) }
+		if (! bytes.Equal(expected.Value, a.Value)) { in_test.Errorf("Invalid value: % x (expected % x).", a.Value, expected.Value) }
+	}
+
+	// XOR-PEER-ADDRESS and XOR-RELAYED-ADDRESS.
+	packet := PacketCreate()
+	packet.SetType(STUN_TYPE_ALLOCATE_RESPONSE)
+	packet.SetRandomId()
+	a, err := AttributeCreateXorPeerAddress(&packet, "2001:0db8:0000:0000:0000:0000:0000:0001", 3478)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	packet.AddAttribute(a)
+	a, err = AttributeCreateXorRelayedAddress(&packet, "10.0.0.1", 49152)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	packet.AddAttribute(a)
+	decoded, err := FromBytes(packet.ToBytes())
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	found, _, ip, port, err := decoded.GetXorPeerAddress()
+	if (nil != err) || (! found) || ("2001:0db8:0000:0000:0000:0000:0000:0001" != ip) || (3478 != port) {
+		in_test.Errorf("Invalid peer address: %s %d (%v)", ip, port, err)
+	}
+	found, _, ip, port, err = decoded.GetXorRelayedAddress()
+	if (nil != err) || (! found) || ("10.0.0.1" != ip) || (49152 != port) {
+		in_test.Errorf("Invalid relayed address: %s %d (%v)", ip, port, err)
+	}
+}
+
+// AttributeCreateChangeRequest() and StunAttribute.AttributeGetChangeRequest()
+func Test_ChangeRequest(in_test *testing.T) {
+	packet := PacketCreate()
+	for _, change_ip := range []bool{ false, true } {
+		for _, change_port := range []bool{ false, true } {
+			a, err := AttributeCreateChangeRequest(&packet, change_ip, change_port)
+			if (nil != err) { in_test.Fatalf("Error: %s", err) }
+			ip, port, err := a.AttributeGetChangeRequest()
+			if (nil != err) || (change_ip != ip) || (change_port != port) {
+				in_test.Errorf("Flags (%v, %v): decoded (%v, %v) (%v).", change_ip, change_port, ip, port, err)
+			}
+		}
+	}
+}
+
+// This function starts a fake RFC 5780 server on 127.0.0.1 and 127.0.0.2 (primary and alternate IP addresses).
+// The server simulates a NAT in front of the client: the mapped address depends on the simulated mapping behavior, and
+// responses to CHANGE-REQUEST are dropped according to the simulated filtering behavior.
+//
+// OUTPUT
+// - The primary transport address of the server.
+// - The function that stops the server.
+func __testBehaviorServer(in_test *testing.T, in_mapping NatBehavior, in_filtering NatBehavior) (string, func()) {
+	var sockets [2][2]*net.UDPConn
+	var wg sync.WaitGroup
+	ips := []net.IP{ net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2) }
+
+	// Find two ports available on both IP addresses.
+	for j := 0; j < 2; j++ {
+		for attempt := 0; nil == sockets[1][j]; attempt++ {
+			if (attempt > 10) { in_test.Fatalf("Can not find an available port.") }
+			s0, err := net.ListenUDP("udp", &net.UDPAddr{IP: ips[0]})
+			if (nil != err) { in_test.Fatalf("Error: %s", err) }
+			s1, err := net.ListenUDP("udp", &net.UDPAddr{IP: ips[1], Port: s0.LocalAddr().(*net.UDPAddr).Port})
+			if (nil != err) { s0.Close(); continue }
+			sockets[0][j] = s0
+			sockets[1][j] = s1
+		}
+	}
+	other := sockets[1][1].LocalAddr().(*net.UDPAddr)
+
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(i int, j int) {
+				defer wg.Done()
+				b := make([]byte, 1000)
+				for {
+					count, from, err := sockets[i][j].ReadFrom(b)
+					if (nil != err) { return }
+					request, err := FromBytes(b[0:count])
+					if (nil != err) { continue }
+
+					// Filtering.
+					ci, cp := 0, 0
+					for n := 0; n < request.GetAttributesCount(); n++ {
+						a := request.GetAttribute(n)
+						if (STUN_ATTRIBUT_CHANGE_REQUEST != a.Type) { continue }
+						ip, port, _ := a.AttributeGetChangeRequest()
+						if (ip) { ci = 1 }
+						if (port) { cp = 1 }
+					}
+					if (STUN_BEHAVIOR_ADDRESS_DEPENDENT == in_filtering) && (1 == ci) { continue }
+					if (STUN_BEHAVIOR_ADDRESS_AND_PORT_DEPENDENT == in_filtering) && (ci + cp > 0) { continue }
+
+					// Mapping.
+					port := uint16(40000)
+					if (STUN_BEHAVIOR_ADDRESS_DEPENDENT == in_mapping) { port += uint16(i) }
+					if (STUN_BEHAVIOR_ADDRESS_AND_PORT_DEPENDENT == in_mapping) { port += uint16(i * 2 + j) }
+
+					sender   := sockets[i ^ ci][j ^ cp]
+					origin   := sender.LocalAddr().(*net.UDPAddr)
+					response := PacketCreate()
+					response.SetType(STUN_TYPE_BINDING_RESPONSE)
+					response.SetId(request.GetId())
+					a, _ := AttributeCreateXorMappedAddress(&response, "203.0.113.1", port)
+					response.AddAttribute(a)
+					a, _ = __createAddress(STUN_ATTRIBUT_OTHER_ADDRESS, &response, other.IP.String(), uint16(other.Port))
+					response.AddAttribute(a)
+					a, _ = __createAddress(STUN_ATTRIBUT_RESPONSE_ORIGIN, &response, origin.IP.String(), uint16(origin.Port))
+					response.AddAttribute(a)
+					sender.WriteTo(response.ToBytes(), from)
+				}
+			}(i, j)
+		}
+	}
+
+	return sockets[0][0].LocalAddr().String(), func() {
+		for i := 0; i < 2; i++ {
+			for j := 0; j < 2; j++ { sockets[i][j].Close() }
+		}
+		wg.Wait()
+	}
+}
+
+// Client.ClientDiscoverBehavior()
+func Test_DiscoverBehavior(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	tests := [][2]NatBehavior{
+		{ STUN_BEHAVIOR_ENDPOINT_INDEPENDENT,       STUN_BEHAVIOR_ENDPOINT_INDEPENDENT },
+		{ STUN_BEHAVIOR_ADDRESS_DEPENDENT,          STUN_BEHAVIOR_ADDRESS_DEPENDENT },
+		{ STUN_BEHAVIOR_ADDRESS_AND_PORT_DEPENDENT, STUN_BEHAVIOR_ADDRESS_AND_PORT_DEPENDENT },
+		{ STUN_BEHAVIOR_ENDPOINT_INDEPENDENT,       STUN_BEHAVIOR_ADDRESS_AND_PORT_DEPENDENT },
+	}
+
+	for _, test := range tests {
+		func() {
+			server, stop := __testBehaviorServer(in_test, test[0], test[1])
+			defer stop()
+			client, err := ClientCreate(server)
+			if (nil != err) { in_test.Fatalf("Error: %s", err) }
+			defer client.Close()
+			client.SetRetransmitPolicy(RetransmitPolicy{ InitialRto: 20 * time.Millisecond, Rc: 2, Rm: 2 })
+
+			name := fmt.Sprintf("%s/%s", test[0], test[1])
+			result, err := client.ClientDiscoverBehavior(context.Background())
+			if (nil != err) { in_test.Fatalf("%s: %s", name, err) }
+			if (test[0] != result.Mapping) { in_test.Errorf("%s: unexpected mapping %s.", name, result.Mapping) }
+			if (test[1] != result.Filtering) { in_test.Errorf("%s: unexpected filtering %s.", name, result.Filtering) }
+			if ("203.0.113.1:40000" != result.MappedAddress) { in_test.Errorf("%s: unexpected mapped address %s.", name, result.MappedAddress) }
+			if (result.NoNat || result.Blocked) { in_test.Errorf("%s: unexpected flags.", name) }
+		}()
+	}
+}
+
+// This function starts a fake server on 127.0.0.1 that simulates a NAT binding with a given lifetime.
+// If RESPONSE-PORT is supported, then a probe is answered only if the binding is still alive. Otherwise, the probe is
+// rejected (error 420) and a new mapping is allocated once the binding has expired.
+//
+// OUTPUT
+// - The transport address of the server.
+// - The function that stops the server.
+func __testLifetimeServer(in_test *testing.T, in_lifetime time.Duration, in_response_port bool) (string, func()) {
+	var wg sync.WaitGroup
+	var last time.Time
+	var generation uint16 = 0
+
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b := make([]byte, 1000)
+		for {
+			count, from, err := socket.ReadFrom(b)
+			if (nil != err) { return }
+			request, err := FromBytes(b[0:count])
+			if (nil != err) { continue }
+			destination := from.(*net.UDPAddr)
+
+			var port uint16 = 0
+			for n := 0; n < request.GetAttributesCount(); n++ {
+				a := request.GetAttribute(n)
+				if (STUN_ATTRIBUT_RESPONSE_PORT == a.Type) { port, _ = a.AttributeGetResponsePort() }
+			}
+
+			response := PacketCreate()
+			response.SetId(request.GetId())
+			switch {
+				case (0 != port) && (! in_response_port):
+					response.SetType(STUN_TYPE_BINDING_ERROR_RESPONSE)
+					a, _ := AttributeCreateErrorCode(&response, STUN_ERROR_UNKNOWN_ATTRIBUTE, "")
+					response.AddAttribute(a)
+				case (0 != port):
+					if (time.Since(last) >= in_lifetime) { continue }
+					destination = &net.UDPAddr{ IP: destination.IP, Port: int(port) }
+					response.SetType(STUN_TYPE_BINDING_RESPONSE)
+					a, _ := AttributeCreateXorMappedAddress(&response, destination.IP.String(), port)
+					response.AddAttribute(a)
+				case (in_response_port):
+					last = time.Now()
+					response.SetType(STUN_TYPE_BINDING_RESPONSE)
+					a, _ := AttributeCreateXorMappedAddress(&response, destination.IP.String(), uint16(destination.Port))
+					response.AddAttribute(a)
+				default:
+					if (! last.IsZero()) && (time.Since(last) >= in_lifetime) { generation++ }
+					last = time.Now()
+					response.SetType(STUN_TYPE_BINDING_RESPONSE)
+					a, _ := AttributeCreateXorMappedAddress(&response, "203.0.113.1", 40000 + generation)
+					response.AddAttribute(a)
+			}
+			socket.WriteTo(response.ToBytes(), destination)
+		}
+	}()
+
+	return socket.LocalAddr().String(), func() {
+		socket.Close()
+		wg.Wait()
+	}
+}
+
+// Client.ClientProbeLifetime()
+func Test_ProbeLifetime(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	lifetime := 275 * time.Millisecond
+	policy   := LifetimePolicy{ Initial: 50 * time.Millisecond, Max: time.Second, Precision: 50 * time.Millisecond }
+	if err := (LifetimePolicy{ Initial: 0, Max: time.Second, Precision: time.Second }).Check(); nil == err {
+		in_test.Errorf("Invalid policy accepted.")
+	}
+
+	for _, response_port := range []bool{ true, false } {
+		func() {
+			server, stop := __testLifetimeServer(in_test, lifetime, response_port)
+			defer stop()
+			client, err := ClientCreate(server)
+			if (nil != err) { in_test.Fatalf("Error: %s", err) }
+			defer client.Close()
+			client.SetRetransmitPolicy(RetransmitPolicy{ InitialRto: 20 * time.Millisecond, Rc: 2, Rm: 2 })
+
+			result, err := client.ClientProbeLifetime(context.Background(), policy)
+			if (nil != err) { in_test.Fatalf("RESPONSE-PORT=%v: %s", response_port, err) }
+			if (response_port != result.ResponsePort) { in_test.Errorf("RESPONSE-PORT=%v: unexpected flag.", response_port) }
+			if (result.Lifetime < 200 * time.Millisecond) || (result.Lifetime >= lifetime) || (result.Expired <= result.Lifetime) || (result.Expired - result.Lifetime > policy.Precision) {
+				in_test.Errorf("RESPONSE-PORT=%v: unexpected lifetime %s (expired after %s).", response_port, result.Lifetime, result.Expired)
+			}
+			if (0 == len(result.Tests)) { in_test.Errorf("RESPONSE-PORT=%v: no test recorded.", response_port) }
+		}()
+	}
+}
+
+// This function starts a fake server on 127.0.0.1 that answers BINDING requests with a given mapped address.
+//
+// INPUT
+// - in_mapped: the mapped address ("" means the source address of the request).
+//
+// OUTPUT
+// - The transport address of the server.
+// - The function that stops the server.
+func __testMappedServer(in_test *testing.T, in_mapped string) (string, func()) {
+	var wg sync.WaitGroup
+
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b := make([]byte, 1000)
+		for {
+			count, from, err := socket.ReadFrom(b)
+			if (nil != err) { return }
+			request, err := FromBytes(b[0:count])
+			if (nil != err) { continue }
+			mapped := from.(*net.UDPAddr)
+			if ("" != in_mapped) { mapped, _ = net.ResolveUDPAddr("udp", in_mapped) }
+			response := PacketCreate()
+			response.SetType(STUN_TYPE_BINDING_RESPONSE)
+			response.SetId(request.GetId())
+			a, _ := AttributeCreateXorMappedAddress(&response, mapped.IP.String(), uint16(mapped.Port))
+			response.AddAttribute(a)
+			socket.WriteTo(response.ToBytes(), from)
+		}
+	}()
+
+	return socket.LocalAddr().String(), func() {
+		socket.Close()
+		wg.Wait()
+	}
+}
+
+// Client.ClientTestHairpinning()
+func Test_Hairpinning(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	// A socket that stands for a NAT that drops hairpinned packets.
+	blackhole, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer blackhole.Close()
+
+	tests := map[string]Hairpinning{
+		"":                                 STUN_HAIRPINNING_SUPPORTED,
+		blackhole.LocalAddr().String():     STUN_HAIRPINNING_NOT_SUPPORTED,
+	}
+
+	for mapped, expected := range tests {
+		func() {
+			server, stop := __testMappedServer(in_test, mapped)
+			defer stop()
+			client, err := ClientCreate(server)
+			if (nil != err) { in_test.Fatalf("Error: %s", err) }
+			defer client.Close()
+			client.SetRetransmitPolicy(RetransmitPolicy{ InitialRto: 20 * time.Millisecond, Rc: 2, Rm: 2 })
+
+			hairpinning, tests, err := client.ClientTestHairpinning(context.Background())
+			if (nil != err) { in_test.Fatalf("Error: %s", err) }
+			if (expected != hairpinning) { in_test.Errorf("Mapped address \"%s\": unexpected result %s.", mapped, hairpinning) }
+			if (2 != len(tests)) { in_test.Errorf("Mapped address \"%s\": unexpected number of tests (%d).", mapped, len(tests)) }
+
+			// The client's socket must still be usable.
+			response, err := client.ClientSendBinding(context.Background(), nil)
+			if (nil != err) || (! response.response) { in_test.Errorf("Mapped address \"%s\": the client's socket is not usable (%v).", mapped, err) }
+		}()
+	}
+
+	// The hairpinning test fails (the secondary socket cannot send to the mapped port 0): the discovery process still
+	// returns the NAT type, without error.
+	func() {
+		server, stop := __testMappedServer(in_test, "127.0.0.1:0")
+		defer stop()
+		client, err := ClientCreate(server)
+		if (nil != err) { in_test.Fatalf("Error: %s", err) }
+		defer client.Close()
+		client.SetRetransmitPolicy(RetransmitPolicy{ InitialRto: 20 * time.Millisecond, Rc: 2, Rm: 2 })
+
+		result, err := client.ClientDiscover()
+		if (nil != err) { in_test.Fatalf("Error: %s", err) }
+		if (STUN_NAT_NO_NAT == result.NatType) || (STUN_NAT_ERROR == result.NatType) { in_test.Errorf("Unexpected NAT type %s.", result.NatType) }
+		if (STUN_HAIRPINNING_UNKNOWN != result.Hairpinning) { in_test.Errorf("Unexpected hairpinning %s.", result.Hairpinning) }
+
+		// The context is cancelled: the error is returned.
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := client.ClientDiscoverContext(ctx); nil == err { in_test.Errorf("Cancelled discovery: no error.") }
+	}()
+
+	var h Hairpinning
+	if err := h.UnmarshalText([]byte("NOT_SUPPORTED")); (nil != err) || (STUN_HAIRPINNING_NOT_SUPPORTED != h) { in_test.Errorf("Invalid hairpinning %s (%v).", h, err) }
+	if ("Hairpinning(9)" != Hairpinning(9).String()) { in_test.Errorf("Invalid name %s.", Hairpinning(9)) }
+}
+
+// Simulated port allocation: the NAT preserves the local ports.
+const test_allocation_preserving = 0
+// Simulated port allocation: the NAT allocates the ports sequentially (step 2).
+const test_allocation_sequential = 1
+// Simulated port allocation: the NAT allocates the ports randomly.
+const test_allocation_random     = 2
+
+// This function starts two fake servers on 127.0.0.1. Together, they simulate a symmetric NAT: a new mapping is
+// allocated for each pair (source, server), according to the given allocation mode.
+//
+// OUTPUT
+// - The transport addresses of the servers.
+// - The function that stops the servers.
+func __testAllocationServer(in_test *testing.T, in_mode int) ([]string, func()) {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var sockets []*net.UDPConn
+	var addresses []string
+	mappings := make(map[string]uint16)
+	random   := rand.New(rand.NewSource(1))
+	next     := uint16(30000)
+
+	for i := 0; i < 2; i++ {
+		socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if (nil != err) { in_test.Fatalf("Error: %s", err) }
+		sockets   = append(sockets, socket)
+		addresses = append(addresses, socket.LocalAddr().String())
+	}
+
+	for i := 0; i < len(sockets); i++ {
+		wg.Add(1)
+		go func(socket *net.UDPConn) {
+			defer wg.Done()
+			b := make([]byte, 1000)
+			for {
+				count, from, err := socket.ReadFrom(b)
+				if (nil != err) { return }
+				request, err := FromBytes(b[0:count])
+				if (nil != err) { continue }
+
+				mutex.Lock()
+				key := from.String() + "|" + socket.LocalAddr().String()
+				port, found := mappings[key]
+				if (! found) {
+					switch in_mode {
+						case test_allocation_preserving: port = uint16(from.(*net.UDPAddr).Port)
+						case test_allocation_sequential: port = next; next += 2
+						default: port = uint16(1024 + random.Intn(60000))
+					}
+					mappings[key] = port
+				}
+				mutex.Unlock()
+
+				response := PacketCreate()
+				response.SetType(STUN_TYPE_BINDING_RESPONSE)
+				response.SetId(request.GetId())
+				a, _ := AttributeCreateXorMappedAddress(&response, "203.0.113.1", port)
+				response.AddAttribute(a)
+				socket.WriteTo(response.ToBytes(), from)
+			}
+		}(sockets[i])
+	}
+
+	return addresses, func() {
+		for i := 0; i < len(sockets); i++ { sockets[i].Close() }
+		wg.Wait()
+	}
+}
+
+// Client.ClientAnalyzePortAllocation()
+func Test_PortAllocation(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	for _, mode := range []int{ test_allocation_preserving, test_allocation_sequential, test_allocation_random } {
+		func() {
+			servers, stop := __testAllocationServer(in_test, mode)
+			defer stop()
+			client, err := ClientCreate(servers[0])
+			if (nil != err) { in_test.Fatalf("Error: %s", err) }
+			defer client.Close()
+			client.SetRetransmitPolicy(RetransmitPolicy{ InitialRto: 20 * time.Millisecond, Rc: 2, Rm: 2 })
+
+			result, err := client.ClientAnalyzePortAllocation(context.Background(), 5, servers)
+			if (nil != err) { in_test.Fatalf("Mode %d: %s", mode, err) }
+			if (10 != len(result.Samples)) { in_test.Fatalf("Mode %d: unexpected number of samples (%d).", mode, len(result.Samples)) }
+			port, ok := result.PredictNextPort(1234)
+
+			switch mode {
+				case test_allocation_preserving:
+					if (! result.Preservation) || (! result.Parity) || (result.Random) { in_test.Errorf("Mode %d: unexpected result %+v.", mode, result) }
+					if (! ok) || (1234 != port) { in_test.Errorf("Mode %d: unexpected prediction %d.", mode, port) }
+				case test_allocation_sequential:
+					if (result.Preservation) || (! result.Sequential) || (2 != result.Delta) || (result.Random) { in_test.Errorf("Mode %d: unexpected result %+v.", mode, result) }
+					if (! ok) || (30020 != port) { in_test.Errorf("Mode %d: unexpected prediction %d.", mode, port) }
+				default:
+					if (result.Preservation) || (result.Sequential) || (! result.Random) { in_test.Errorf("Mode %d: unexpected result %+v.", mode, result) }
+					if (ok) { in_test.Errorf("Mode %d: unexpected prediction %d.", mode, port) }
+			}
+		}()
+	}
+
+	if _, err := (&Client{}).ClientAnalyzePortAllocation(context.Background(), 1, nil); nil == err {
+		in_test.Errorf("Invalid number of sockets accepted.")
+	}
+}
+
+// AllocationResult.__analyze() (two deltas as frequent as each other, with the same absolute value)
+func Test_PortAllocationTie(in_test *testing.T) {
+	// The most frequent delta is a strict majority: the result must not depend on the order of iteration over the deltas.
+	for _, ports := range [][]uint16{ { 10000, 10002, 10004, 10006, 10004, 10002 }, { 10006, 10004, 10002, 10000, 10002, 10004 } } {
+		expected := int(int16(ports[1] - ports[0]))
+		for n := 0; n < 20; n++ {
+			result := __testAnalyze(ports)
+			if (! result.Sequential) || (expected != result.Delta) || (result.Random) { in_test.Fatalf("Ports %v: unexpected result %+v.", ports, result) }
+		}
+	}
+
+	// A tie is not a majority.
+	for _, ports := range [][]uint16{ { 10000, 10002, 10004, 10002, 10000 }, { 10004, 10002, 10000, 10002, 10004 } } {
+		for n := 0; n < 20; n++ {
+			result := __testAnalyze(ports)
+			if (result.Sequential) || (0 != result.Delta) || (! result.Random) { in_test.Fatalf("Ports %v: unexpected result %+v.", ports, result) }
+		}
+	}
+}
+
+// AllocationResult.__analyze() (random ports)
+func Test_PortAllocationRandom(in_test *testing.T) {
+	ports := [][]uint16{
+		// Only one delta.
+		{ 10000, 10002 },
+		// All the deltas differ.
+		{ 10000, 10002, 10010, 10003, 10020 },
+		// The most frequent delta is seen only once.
+		{ 40000, 12345, 23456 },
+		// The most frequent delta is seen twice, but not as a majority.
+		{ 10000, 10002, 10004, 10100, 10050, 10075 },
+	}
+	for _, p := range ports {
+		result := __testAnalyze(p)
+		if (result.Sequential) || (0 != result.Delta) || (! result.Random) { in_test.Errorf("Ports %v: unexpected result %+v.", p, result) }
+	}
+}
+
+// This function analyzes a list of mapped ports. All the mapped addresses are new, and the local port is 5000.
+//
+// INPUT
+// - in_ports: the mapped ports.
+//
+// OUTPUT
+// - The result of the analysis.
+func __testAnalyze(in_ports []uint16) AllocationResult {
+	var result AllocationResult
+	for i, port := range in_ports {
+		// The second half of the mappings uses another IP address, so that the mapped addresses are all new.
+		ip := "192.0.2.1"
+		if (i > len(in_ports) / 2) { ip = "192.0.2.2" }
+		mapped, _ := tools.MakeTransportAddress(ip, int(port))
+		result.Samples = append(result.Samples, PortSample{ MappedAddress: mapped, LocalPort: 5000, MappedPort: port })
+	}
+	result.__analyze()
+	return result
+}
+
+// Client.ClientKeepalive()
+func Test_Keepalive(in_test *testing.T) {
+	var indications, requests int32
+	var wg sync.WaitGroup
+
+	SetRfc5389()
+	defer SetRfc3489()
+
+	// The server answers BINDING requests, and counts BINDING indications.
+	// The mapped port changes after the second request.
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b := make([]byte, 1000)
+		for {
+			count, from, err := socket.ReadFrom(b)
+			if (nil != err) { return }
+			request, err := FromBytes(b[0:count])
+			if (nil != err) { continue }
+			if (STUN_TYPE_BINDING_INDICATION == request.GetType()) {
+				atomic.AddInt32(&indications, 1)
+				continue
+			}
+			port := uint16(40000)
+			if (atomic.AddInt32(&requests, 1) > 2) { port = 40001 }
+			response := PacketCreate()
+			response.SetType(STUN_TYPE_BINDING_RESPONSE)
+			response.SetId(request.GetId())
+			a, _ := AttributeCreateXorMappedAddress(&response, "203.0.113.1", port)
+			response.AddAttribute(a)
+			socket.WriteTo(response.ToBytes(), from)
+		}
+	}()
+	defer func() { socket.Close(); wg.Wait() }()
+
+	client, err := ClientCreate(socket.LocalAddr().String())
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer client.Close()
+	client.SetRetransmitPolicy(RetransmitPolicy{ InitialRto: 20 * time.Millisecond, Rc: 2, Rm: 2 })
+
+	if _, err := client.ClientKeepalive(context.Background(), KeepalivePolicy{ Interval: 0 }, nil); nil == err {
+		in_test.Errorf("Invalid policy accepted.")
+	}
+
+	changes := make(chan [2]string, 10)
+	keepalive, err := client.ClientKeepalive(context.Background(), KeepalivePolicy{ Interval: 10 * time.Millisecond, CheckEvery: 3 }, func(in_old string, in_new string) {
+		changes <- [2]string{ in_old, in_new }
+	})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+
+	select {
+		case change := <-changes:
+			if ("203.0.113.1:40000" != change[0]) || ("203.0.113.1:40001" != change[1]) { in_test.Errorf("Unexpected change %v.", change) }
+		case <-time.After(2 * time.Second):
+			in_test.Errorf("The change of mapped address has not been detected.")
+	}
+	keepalive.Stop()
+
+	if (atomic.LoadInt32(&indications) < 2) { in_test.Errorf("Unexpected number of indications (%d).", atomic.LoadInt32(&indications)) }
+	if ("203.0.113.1:40001" != keepalive.MappedAddress()) { in_test.Errorf("Unexpected mapped address %s.", keepalive.MappedAddress()) }
+	if (nil != keepalive.Err()) { in_test.Errorf("Unexpected error: %s", keepalive.Err()) }
+}
+
+// WatcherCreate()
+func Test_Watcher(in_test *testing.T) {
+	var port, drops int32 = 40000, 0
+	var wg sync.WaitGroup
+
+	// The server drops the requests while "drops" is positive.
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b := make([]byte, 1000)
+		for {
+			count, from, err := socket.ReadFrom(b)
+			if (nil != err) { return }
+			request, err := FromBytes(b[0:count])
+			if (nil != err) { continue }
+			if (atomic.AddInt32(&drops, -1) >= 0) { continue }
+			response := PacketCreate()
+			response.SetType(STUN_TYPE_BINDING_RESPONSE)
+			response.SetId(request.GetId())
+			a, _ := __createAddress(STUN_ATTRIBUT_MAPPED_ADDRESS, &response, "203.0.113.1", uint16(atomic.LoadInt32(&port)))
+			response.AddAttribute(a)
+			socket.WriteTo(response.ToBytes(), from)
+		}
+	}()
+	defer func() { socket.Close(); wg.Wait() }()
+
+	policy := WatcherPolicy{ Interval: 10 * time.Millisecond, Failures: 3, Retransmit: RetransmitPolicy{ InitialRto: 10 * time.Millisecond, Rc: 1, Rm: 1 } }
+	if _, err := WatcherCreate(context.Background(), []string{ socket.LocalAddr().String() }, WatcherPolicy{}, nil); nil == err {
+		in_test.Errorf("Invalid policy accepted.")
+	}
+
+	watcher, err := WatcherCreate(context.Background(), []string{ socket.LocalAddr().String() }, policy, nil)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer watcher.Stop()
+
+	next := func() WatcherEvent {
+		select {
+			case event := <-watcher.Events():
+				return event
+			case <-time.After(2 * time.Second):
+				in_test.Fatalf("No event received.")
+		}
+		return WatcherEvent{}
+	}
+
+	// Initial address.
+	event := next()
+	if ("" != event.OldAddress) || ("203.0.113.1:40000" != event.NewAddress) { in_test.Errorf("Unexpected event %+v.", event) }
+
+	// Transient failures are not reported.
+	atomic.StoreInt32(&drops, 2)
+	atomic.StoreInt32(&port, 40001)
+	event = next()
+	if ("203.0.113.1:40000" != event.OldAddress) || ("203.0.113.1:40001" != event.NewAddress) { in_test.Errorf("Unexpected event %+v.", event) }
+	if ("203.0.113.1:40001" != watcher.Address()) { in_test.Errorf("Unexpected address %s.", watcher.Address()) }
+
+	// The address is lost.
+	atomic.StoreInt32(&drops, 1000000)
+	event = next()
+	if ("203.0.113.1:40001" != event.OldAddress) || ("" != event.NewAddress) { in_test.Errorf("Unexpected event %+v.", event) }
+	watcher.Stop()
+
+	// Callback and command.
+	if _, err := exec.LookPath("sh"); nil != err { return }
+	file := filepath.Join(in_test.TempDir(), "address")
+	atomic.StoreInt32(&drops, 0)
+	events := make(chan WatcherEvent, 10)
+	policy.Command = []string{ "sh", "-c", "echo \"$STUN_NEW_ADDRESS $STUN_NAT_TYPE\" > " + file }
+	watcher, err = WatcherCreate(context.Background(), []string{ socket.LocalAddr().String() }, policy, func(in_event WatcherEvent) { events <- in_event })
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer watcher.Stop()
+	select {
+		case event = <-events:
+		case <-time.After(2 * time.Second):
+			in_test.Fatalf("No event received.")
+	}
+	content, err := os.ReadFile(file)
+	if (nil != err) || ("203.0.113.1:40001 UNKNOWN\n" != string(content)) { in_test.Errorf("Unexpected command output \"%s\" (%v).", content, err) }
+}
+
+// WatcherCreate(): the server sends the XOR-MAPPED-ADDRESS only (RFC 5389).
+func Test_WatcherXorMappedAddress(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer socket.Close()
+	go func() {
+		b := make([]byte, 1000)
+		for {
+			count, from, err := socket.ReadFrom(b)
+			if (nil != err) { return }
+			request, err := FromBytes(b[0:count])
+			if (nil != err) { continue }
+			response := PacketCreate()
+			response.SetType(STUN_TYPE_BINDING_RESPONSE)
+			response.SetId(request.GetId())
+			a, _ := AttributeCreateXorMappedAddress(&response, "203.0.113.1", 40000)
+			response.AddAttribute(a)
+			socket.WriteTo(response.ToBytes(), from)
+		}
+	}()
+
+	policy := WatcherPolicy{ Interval: 10 * time.Millisecond, Failures: 3, Retransmit: RetransmitPolicy{ InitialRto: 50 * time.Millisecond, Rc: 2, Rm: 1 } }
+	watcher, err := WatcherCreate(context.Background(), []string{ socket.LocalAddr().String() }, policy, nil)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer watcher.Stop()
+
+	select {
+		case event := <-watcher.Events():
+			if ("" != event.OldAddress) || ("203.0.113.1:40000" != event.NewAddress) { in_test.Errorf("Unexpected event %+v.", event) }
+		case <-time.After(2 * time.Second):
+			in_test.Fatalf("No event received (%v).", watcher.Err())
+	}
+}
+
+// Server
+func Test_Server(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	server, err := ServerCreate([]string{ "127.0.0.1:0" })
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer server.Close()
+	if err := server.Start(); nil != err { in_test.Fatalf("Error: %s", err) }
+	if err := server.Start(); nil == err { in_test.Errorf("The server has been started twice.") }
+
+	client, err := ClientCreate(server.Addresses()[0])
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer client.Close()
+	client.SetRetransmitPolicy(RetransmitPolicy{ InitialRto: 50 * time.Millisecond, Rc: 3, Rm: 2 })
+
+	// Binding request.
+	response, err := client.ClientSendBinding(context.Background(), nil)
+	if (nil != err) || (! response.response) { in_test.Fatalf("No response (%v).", err) }
+	found, _, ip, port, err := response.packet.GetMappedAddress()
+	mapped, _ := tools.MakeTransportAddress(ip, int(port))
+	if (nil != err) || (! found) || (client.LocalAddr() != mapped) { in_test.Errorf("Unexpected MAPPED-ADDRESS %s (%v).", mapped, err) }
+	found, _, ip, port, err = response.packet.GetXorMappedAddress()
+	mapped, _ = tools.MakeTransportAddress(ip, int(port))
+	if (nil != err) || (! found) || (client.LocalAddr() != mapped) { in_test.Errorf("Unexpected XOR-MAPPED-ADDRESS %s (%v).", mapped, err) }
+	last := response.packet.GetAttribute(response.packet.GetAttributesCount() - 1)
+	if (STUN_ATTRIBUT_FINGERPRINT != last.Type) { in_test.Errorf("The last attribute is not FINGERPRINT.") }
+
+	// Unknown attributes.
+	destination, _ := net.ResolveUDPAddr("udp", server.Addresses()[0])
+	for _, t := range []uint16{ 0x7FFF, 0xC001 } {
+		packet := PacketCreate()
+		packet.SetType(STUN_TYPE_BINDING_REQUEST)
+		packet.SetRandomId()
+		a, _ := AttributeCreate(t, []byte{ 1, 2, 3, 4 }, &packet)
+		packet.AddAttribute(a)
+		response, _, err := SendRequestContext(context.Background(), client.connection, destination, packet, client.policy)
+		if (0x7FFF == t) {
+			e, ok := err.(*ErrorResponse)
+			if (! ok) || (STUN_ERROR_UNKNOWN_ATTRIBUTE != e.Code) { in_test.Fatalf("Unexpected error %v.", err) }
+			var types []uint16
+			for i := 0; i < response.GetAttributesCount(); i++ {
+				a := response.GetAttribute(i)
+				if (STUN_ATTRIBUT_UNKNOWN_ATTRIBUTES == a.Type) { types, err = a.AttributeGetUnknownAttributes() }
+			}
+			if (nil != err) || (1 != len(types)) || (0x7FFF != types[0]) { in_test.Errorf("Unexpected UNKNOWN-ATTRIBUTES %v (%v).", types, err) }
+		} else if (nil != err) {
+			in_test.Errorf("Comprehension-optional attribute: unexpected error %v.", err)
+		}
+	}
+
+	// Malformed request: the length of the attribute exceeds the packet.
+	malformed := PacketCreate()
+	malformed.SetType(STUN_TYPE_BINDING_REQUEST)
+	malformed.SetRandomId()
+	raw := append(malformed.ToBytes(), 0x80, 0x22, 0x00, 0x08, 'a', 'b', 'c', 'd')
+	raw[3] = 8
+	client.connection.WriteTo(raw, destination)
+	client.connection.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 1000)
+	count, _, err := client.connection.ReadFrom(b)
+	client.connection.SetReadDeadline(time.Time{})
+	if (nil != err) { in_test.Fatalf("No response to the malformed request (%v).", err) }
+	p, err := FromBytes(b[0:count])
+	found, code, _, _ := p.GetErrorCode()
+	if (nil != err) || (! found) || (STUN_ERROR_BAD_REQUEST != code) || (! bytes.Equal(malformed.GetId(), p.GetId())) {
+		in_test.Errorf("Unexpected response to the malformed request (%v).", err)
+	}
+
+	// Other classes and garbage are discarded.
+	indication := PacketCreate()
+	indication.SetType(STUN_TYPE_BINDING_INDICATION)
+	indication.SetRandomId()
+	if _, ok := server.__handle(0, indication.ToBytes(), client.connection.LocalAddr()); ok { in_test.Errorf("The server answered an indication.") }
+	if _, ok := server.__handle(0, []byte("not a STUN message"), client.connection.LocalAddr()); ok { in_test.Errorf("The server answered garbage.") }
+}
+
+// Server (RFC 3489)
+func Test_ServerRfc3489(in_test *testing.T) {
+	server, err := ServerCreate([]string{ "127.0.0.1:0" })
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer server.Close()
+	server.Start()
+
+	client, err := ClientCreate(server.Addresses()[0])
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer client.Close()
+	client.SetRetransmitPolicy(RetransmitPolicy{ InitialRto: 50 * time.Millisecond, Rc: 3, Rm: 2 })
+
+	response, err := client.ClientSendBinding(context.Background(), nil)
+	if (nil != err) || (! response.response) { in_test.Fatalf("No response (%v).", err) }
+	found, _, ip, port, err := response.packet.GetMappedAddress()
+	mapped, _ := tools.MakeTransportAddress(ip, int(port))
+	if (nil != err) || (! found) || (client.LocalAddr() != mapped) { in_test.Errorf("Unexpected MAPPED-ADDRESS %s (%v).", mapped, err) }
+}
+
+// ServerCreateRfc3489()
+func Test_ServerChangeRequest(in_test *testing.T) {
+	server, err := ServerCreateRfc3489("127.0.0.1", "127.0.0.2", 0, 0)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer server.Close()
+	server.Start()
+	addresses := server.Addresses()
+	if (4 != len(addresses)) { in_test.Fatalf("Unexpected addresses %v.", addresses) }
+
+	client, err := ClientCreate(addresses[0])
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer client.Close()
+	client.SetRetransmitPolicy(RetransmitPolicy{ InitialRto: 50 * time.Millisecond, Rc: 3, Rm: 2 })
+
+	// The responses come from the socket selected by the CHANGE-REQUEST flags. CHANGED-ADDRESS is relative to the socket
+	// that received the request, whatever the flags.
+	for received := 0; received < 4; received++ {
+		for _, change_ip := range []bool{ false, true } {
+			for _, change_port := range []bool{ false, true } {
+				packet := PacketCreate()
+				packet.SetType(STUN_TYPE_BINDING_REQUEST)
+				packet.SetRandomId()
+				a, _ := AttributeCreateChangeRequest(&packet, change_ip, change_port)
+				packet.AddAttribute(a)
+				response, err := client.__send(context.Background(), addresses[received], packet)
+				if (nil != err) || (! response.response) { in_test.Fatalf("No response (%v).", err) }
+				var source, changed string
+				for i := 0; i < response.packet.GetAttributesCount(); i++ {
+					a := response.packet.GetAttribute(i)
+					switch a.Type {
+						case STUN_ATTRIBUT_SOURCE_ADDRESS:
+							_, ip, port, _ := a.AttributeGetSourceAddress()
+							source, _ = tools.MakeTransportAddress(ip, int(port))
+						case STUN_ATTRIBUT_CHANGED_ADDRESS:
+							_, ip, port, _ := a.AttributeGetChangeedAddress()
+							changed, _ = tools.MakeTransportAddress(ip, int(port))
+					}
+				}
+				expected := received
+				if (change_ip) { expected ^= 2 }
+				if (change_port) { expected ^= 1 }
+				if (addresses[expected] != source) { in_test.Errorf("Socket %d, change IP %v, change port %v: unexpected SOURCE-ADDRESS %s (expected %s).", received, change_ip, change_port, source, addresses[expected]) }
+				if (addresses[received ^ 3] != changed) { in_test.Errorf("Socket %d, change IP %v, change port %v: unexpected CHANGED-ADDRESS %s (expected %s).", received, change_ip, change_port, changed, addresses[received ^ 3]) }
+			}
+		}
+	}
+
+	// End to end discovery.
+	result, err := client.ClientDiscover()
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	if (STUN_NAT_NO_NAT != result.NatType) { in_test.Errorf("Unexpected NAT type %s.", result.NatType) }
+	if (addresses[3] != result.ChangedAddress) { in_test.Errorf("Unexpected CHANGED-ADDRESS %s.", result.ChangedAddress) }
+
+	if _, err := ServerCreateRfc3489("127.0.0.1", "127.0.0.1", 0, 0); nil == err { in_test.Errorf("Identical IP addresses accepted.") }
+}
+
+// ServerCreateRfc3489() (RFC 5780)
+func Test_ServerRfc5780(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	server, err := ServerCreateRfc3489("127.0.0.1", "127.0.0.2", 0, 0)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer server.Close()
+	server.Start()
+	addresses := server.Addresses()
+
+	client, err := ClientCreate(addresses[0])
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer client.Close()
+	client.SetRetransmitPolicy(RetransmitPolicy{ InitialRto: 50 * time.Millisecond, Rc: 3, Rm: 2 })
+
+	// End to end behavior discovery.
+	result, err := client.ClientDiscoverBehavior(context.Background())
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	if (! result.NoNat) || (STUN_BEHAVIOR_ENDPOINT_INDEPENDENT != result.Mapping) || (STUN_BEHAVIOR_ENDPOINT_INDEPENDENT != result.Filtering) {
+		in_test.Errorf("Unexpected behavior: no NAT %v, mapping %s, filtering %s.", result.NoNat, result.Mapping, result.Filtering)
+	}
+	if (addresses[3] != result.OtherAddress) { in_test.Errorf("Unexpected OTHER-ADDRESS %s.", result.OtherAddress) }
+	if (addresses[0] != result.ResponseOrigin) { in_test.Errorf("Unexpected RESPONSE-ORIGIN %s.", result.ResponseOrigin) }
+
+	// RESPONSE-PORT and PADDING: the response is sent to another socket, and it is padded.
+	// The length of the PADDING is not a multiple of 4: the response's PADDING has the same length, not the padded one.
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer other.Close()
+	packet := PacketCreate()
+	packet.SetType(STUN_TYPE_BINDING_REQUEST)
+	packet.SetRandomId()
+	a, _ := AttributeCreateResponsePort(&packet, uint16(other.LocalAddr().(*net.UDPAddr).Port))
+	packet.AddAttribute(a)
+	a, _ = AttributeCreate(STUN_ATTRIBUT_PADDING, make([]byte, 61), &packet)
+	packet.AddAttribute(a)
+	destination, _ := net.ResolveUDPAddr("udp", addresses[0])
+	client.connection.WriteTo(packet.ToBytes(), destination)
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 1000)
+	count, _, err := other.ReadFrom(b)
+	if (nil != err) { in_test.Fatalf("No response on the RESPONSE-PORT (%v).", err) }
+	p, err := FromBytes(b[0:count])
+	if (nil != err) || (! bytes.Equal(packet.GetId(), p.GetId())) { in_test.Fatalf("Unexpected response (%v).", err) }
+	padding := -1
+	for i := 0; i < p.GetAttributesCount(); i++ {
+		if (STUN_ATTRIBUT_PADDING == p.GetAttribute(i).Type) { padding = int(p.GetAttribute(i).Length) }
+	}
+	if (61 != padding) { in_test.Errorf("Unexpected PADDING length %d.", padding) }
+	found, _, ip, port, err := p.GetXorMappedAddress()
+	mapped, _ := tools.MakeTransportAddress(ip, int(port))
+	if (nil != err) || (! found) || (client.LocalAddr() != mapped) { in_test.Errorf("Unexpected XOR-MAPPED-ADDRESS %s (%v).", mapped, err) }
+
+	// RESPONSE-ADDRESS is rejected.
+	packet = PacketCreate()
+	packet.SetType(STUN_TYPE_BINDING_REQUEST)
+	packet.SetRandomId()
+	a, _ = __createAddress(STUN_ATTRIBUT_RESPONSE_ADDRESS, &packet, "127.0.0.1", 9)
+	packet.AddAttribute(a)
+	_, _, err = SendRequestContext(context.Background(), client.connection, destination, packet, client.policy)
+	e, ok := err.(*ErrorResponse)
+	if (! ok) || (STUN_ERROR_BAD_REQUEST != e.Code) { in_test.Errorf("RESPONSE-ADDRESS: unexpected error %v.", err) }
+}
+
+// The state of the TURN server used by the tests.
+type testTurnState struct {
+	mutex sync.Mutex
+	// The allocations (client's transport address => lifetime requested by the last REFRESH).
+	allocations map[string]uint32
+	// The number of REFRESH requests.
+	refreshes int
+	// The number of ALLOCATE requests to answer with 437 (Allocation Mismatch).
+	mismatch int
+	// This flag indicates whether the ALLOCATE requests are answered with 486 (Allocation Quota Reached).
+	quota bool
+	// This flag indicates whether the successful responses to the REFRESH requests omit the LIFETIME attribute.
+	no_lifetime bool
+	// The number of permissions installed or refreshed, per peer's IP address.
+	permissions map[string]int
+	// The channels (channel number => peer's transport address).
+	channels map[uint16]string
+	// The number of CHANNEL-BIND requests.
+	binds int
+	// The relayed transport address.
+	relayed string
+	// The transport address of the client that owns the last allocation.
+	client net.Addr
+}
+
+// This function starts a TURN server that accepts the user "user" with the password "pass".
+// The allocations are granted the given lifetime (in seconds). The permissions for 127.0.0.9 are forbidden.
+// All the allocations share the same relay socket. The data received from the peers is sent to the last client.
+func __testTurnServer(in_test *testing.T, in_lifetime uint32) (string, *testTurnState, func()) {
+	var wg sync.WaitGroup
+	state := &testTurnState{ allocations: make(map[string]uint32), permissions: make(map[string]int), channels: make(map[uint16]string) }
+	key   := LongTermKey("user", "example.org", "pass")
+
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	state.relayed = relay.LocalAddr().String()
+
+	// Peers => client.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b := make([]byte, 1000)
+		for {
+			count, from, err := relay.ReadFrom(b)
+			if (nil != err) { return }
+			peer := from.(*net.UDPAddr)
+			var message []byte = nil
+
+			state.mutex.Lock()
+			client := state.client
+			if (state.permissions[peer.IP.String()] > 0) {
+				for number, bound := range state.channels {
+					if (bound != from.String()) { continue }
+					data, _ := ChannelDataCreate(number, b[0:count])
+					message = data.ToBytes(false)
+				}
+				if (nil == message) {
+					indication := PacketCreate()
+					indication.SetType(STUN_TYPE_DATA_INDICATION)
+					indication.SetRandomId()
+					a, _ := AttributeCreateXorPeerAddress(&indication, peer.IP.String(), uint16(peer.Port))
+					indication.AddAttribute(a)
+					a, _ = AttributeCreateData(&indication, b[0:count])
+					indication.AddAttribute(a)
+					message = indication.ToBytes()
+				}
+			}
+			state.mutex.Unlock()
+			if (nil != message) && (nil != client) { socket.WriteTo(message, client) }
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b := make([]byte, 1000)
+		for {
+			count, from, err := socket.ReadFrom(b)
+			if (nil != err) { return }
+
+			// Client => peers.
+			if (STUN_MESSAGE_CHANNEL_DATA == Demultiplex(b[0:count])) {
+				message, err := ChannelDataFromBytes(b[0:count])
+				if (nil != err) { continue }
+				state.mutex.Lock()
+				peer, ok := state.channels[message.Number]
+				state.mutex.Unlock()
+				if (! ok) { continue }
+				addr, _ := net.ResolveUDPAddr("udp", peer)
+				relay.WriteTo(message.Data, addr)
+				continue
+			}
+			request, err := FromBytes(b[0:count])
+			if (nil != err) { continue }
+			if (STUN_TYPE_SEND_INDICATION == request.GetType()) {
+				_, _, ip, port, _ := request.GetXorPeerAddress()
+				_, data := request.GetData()
+				state.mutex.Lock()
+				allowed := state.permissions[ip] > 0
+				state.mutex.Unlock()
+				if (allowed) { relay.WriteTo(data, &net.UDPAddr{ IP: net.ParseIP(ip), Port: int(port) }) }
+				continue
+			}
+
+			var code uint16 = 0
+			var lifetime uint32 = in_lifetime
+			response := PacketCreate()
+			response.SetId(request.GetId())
+			t, _ := TypeCreate(request.GetMethod(), STUN_CLASS_SUCCESS_RESPONSE)
+			response.SetType(t)
+
+			state.mutex.Lock()
+			_, exists := state.allocations[from.String()]
+			ok, _ := request.CheckMessageIntegrity(key)
+			switch {
+				case (! ok):
+					code = STUN_ERROR_UNAUTHORIZED
+				case (STUN_METHOD_ALLOCATE == request.GetMethod()) && (state.mismatch > 0):
+					state.mismatch--
+					code = STUN_ERROR_ALLOCATION_MISMATCH
+				case (STUN_METHOD_ALLOCATE == request.GetMethod()) && (state.quota):
+					code = STUN_ERROR_ALLOCATION_QUOTA_REACHED
+				case (STUN_METHOD_ALLOCATE == request.GetMethod()):
+					state.allocations[from.String()] = in_lifetime
+					state.client = from
+					a, _ := AttributeCreateXorRelayedAddress(&response, "127.0.0.1", uint16(relay.LocalAddr().(*net.UDPAddr).Port))
+					response.AddAttribute(a)
+					a, _ = AttributeCreateXorMappedAddress(&response, "127.0.0.1", uint16(from.(*net.UDPAddr).Port))
+					response.AddAttribute(a)
+				case (! exists):
+					code = STUN_ERROR_ALLOCATION_MISMATCH
+				case (STUN_METHOD_CREATE_PERMISSION == request.GetMethod()):
+					for n := 0; n < request.GetAttributesCount(); n++ {
+						a := request.GetAttribute(n)
+						if (STUN_ATTRIBUT_XOR_PEER_ADDRESS != a.Type) { continue }
+						_, ip, _, _ := a.AttributeGetXorPeerAddress()
+						if ("127.0.0.9" == ip) { code = STUN_ERROR_FORBIDDEN }
+						state.permissions[ip]++
+					}
+				case (STUN_METHOD_CHANNEL_BIND == request.GetMethod()):
+					state.binds++
+					_, number, _ := request.GetChannelNumber()
+					_, _, ip, port, _ := request.GetXorPeerAddress()
+					peer, _ := tools.MakeTransportAddress(ip, int(port))
+					if bound, ok := state.channels[number]; ok && (bound != peer) {
+						code = STUN_ERROR_BAD_REQUEST
+					} else {
+						state.channels[number] = peer
+						state.permissions[ip]++
+					}
+				default:
+					state.refreshes++
+					if found, requested, _ := request.GetLifetime(); found { lifetime = requested }
+					state.allocations[from.String()] = lifetime
+					if (0 == lifetime) { delete(state.allocations, from.String()) }
+			}
+			no_lifetime := state.no_lifetime && (STUN_METHOD_REFRESH == request.GetMethod())
+			state.mutex.Unlock()
+
+			if (0 != code) {
+				t, _ = TypeCreate(request.GetMethod(), STUN_CLASS_ERROR_RESPONSE)
+				response.SetType(t)
+				a, _ := AttributeCreateErrorCode(&response, code, "")
+				response.AddAttribute(a)
+				a, _ = AttributeCreateRealm(&response, "example.org")
+				response.AddAttribute(a)
+				a, _ = AttributeCreateNonce(&response, "nonce")
+				response.AddAttribute(a)
+			} else {
+				if ((STUN_METHOD_ALLOCATE == request.GetMethod()) || (STUN_METHOD_REFRESH == request.GetMethod())) && (! no_lifetime) {
+					a, _ := AttributeCreateLifetime(&response, lifetime)
+					response.AddAttribute(a)
+				}
+				a, _ := AttributeCreateMessageIntegrity(&response, key)
+				response.AddAttribute(a)
+			}
+			socket.WriteTo(response.ToBytes(), from)
+		}
+	}()
+
+	return socket.LocalAddr().String(), state, func() {
+		socket.Close()
+		relay.Close()
+		wg.Wait()
+	}
+}
+
+// Client.ClientAllocate()
+func Test_TurnAllocate(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	server, state, stop := __testTurnServer(in_test, 1)
+	defer stop()
+
+	client, err := ClientCreate(server)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer client.Close()
+	client.SetRetransmitPolicy(RetransmitPolicy{ InitialRto: 50 * time.Millisecond, Rc: 3, Rm: 2 })
+	client.SetCredentials("user", "pass")
+
+	// 437: the client tries again from another local port.
+	state.mutex.Lock()
+	state.mismatch = 1
+	state.mutex.Unlock()
+	local := client.LocalAddr()
+	allocation, err := client.ClientAllocate(context.Background(), AllocatePolicyDefault())
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	if (local == client.LocalAddr()) { in_test.Errorf("The local port has not been changed after the error 437.") }
+	if (state.relayed != allocation.RelayedAddress()) { in_test.Errorf("Unexpected relayed address %s.", allocation.RelayedAddress()) }
+	if (client.LocalAddr() != allocation.MappedAddress()) { in_test.Errorf("Unexpected mapped address %s.", allocation.MappedAddress()) }
+	if (time.Second != allocation.Lifetime()) { in_test.Errorf("Unexpected lifetime %s.", allocation.Lifetime()) }
+
+	// The allocation is refreshed at half-time.
+	refreshes := 0
+	deadline  := time.Now().Add(10 * time.Second)
+	for (refreshes < 2) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		state.mutex.Lock()
+		refreshes = state.refreshes
+		state.mutex.Unlock()
+	}
+	if (refreshes < 2) { in_test.Errorf("Unexpected number of refreshes: %d.", refreshes) }
+	if (nil != allocation.Err()) { in_test.Errorf("Unexpected error: %s", allocation.Err()) }
+	if (! allocation.Expires().After(time.Now())) { in_test.Errorf("The allocation has expired.") }
+
+	// Close: the allocation is deleted.
+	if err := allocation.Close(); nil != err { in_test.Errorf("Error: %s", err) }
+	state.mutex.Lock()
+	count := len(state.allocations)
+	state.mutex.Unlock()
+	if (0 != count) { in_test.Errorf("The allocation has not been deleted.") }
+	if err := allocation.Close(); nil != err { in_test.Errorf("Second close: %s", err) }
+
+	// The allocation does not exist anymore: 437.
+	err = allocation.Refresh(context.Background())
+	if e, ok := err.(*ErrorResponse); (! ok) || (STUN_ERROR_ALLOCATION_MISMATCH != e.Code) { in_test.Errorf("Unexpected error: %v", err) }
+
+	// 437 from every local port: the request is sent turn_mismatch_attempts times.
+	state.mutex.Lock()
+	state.mismatch = turn_mismatch_attempts + 1
+	state.mutex.Unlock()
+	_, err = client.ClientAllocate(context.Background(), AllocatePolicy{ Lifetime: time.Minute, Refresh: false })
+	if e, ok := err.(*ErrorResponse); (! ok) || (STUN_ERROR_ALLOCATION_MISMATCH != e.Code) { in_test.Errorf("Unexpected error: %v", err) }
+	state.mutex.Lock()
+	remaining := state.mismatch
+	state.mismatch = 0
+	state.mutex.Unlock()
+	if (1 != remaining) { in_test.Errorf("Unexpected number of attempts: %d.", turn_mismatch_attempts + 1 - remaining) }
+
+	// 486.
+	state.mutex.Lock()
+	state.quota = true
+	state.mutex.Unlock()
+	_, err = client.ClientAllocate(context.Background(), AllocatePolicy{ Lifetime: time.Minute, Refresh: false })
+	if e, ok := err.(*ErrorResponse); (! ok) || (STUN_ERROR_ALLOCATION_QUOTA_REACHED != e.Code) { in_test.Errorf("Unexpected error: %v", err) }
+
+	if _, err := client.ClientAllocate(context.Background(), AllocatePolicy{ Lifetime: -time.Second }); nil == err { in_test.Errorf("Negative lifetime accepted.") }
+}
+
+// Allocation.__refresh() (the response has no LIFETIME)
+func Test_TurnRefreshNoLifetime(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	server, state, stop := __testTurnServer(in_test, 2)
+	defer stop()
+
+	client, err := ClientCreate(server)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer client.Close()
+	client.SetRetransmitPolicy(RetransmitPolicy{ InitialRto: 50 * time.Millisecond, Rc: 3, Rm: 2 })
+	client.SetCredentials("user", "pass")
+
+	allocation, err := client.ClientAllocate(context.Background(), AllocatePolicyDefault())
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	state.mutex.Lock()
+	state.no_lifetime = true
+	state.mutex.Unlock()
+
+	// The first refresh fails (at half-time). The next one is postponed: it is not sent immediately.
+	deadline := time.Now().Add(3 * time.Second)
+	for (nil == allocation.Err()) && time.Now().Before(deadline) { time.Sleep(10 * time.Millisecond) }
+	if (nil == allocation.Err()) { in_test.Fatalf("The refresh did not fail.") }
+	time.Sleep(200 * time.Millisecond)
+	state.mutex.Lock()
+	refreshes := state.refreshes
+	state.no_lifetime = false
+	state.mutex.Unlock()
+	if (refreshes > 2) { in_test.Errorf("The failed refresh has not been postponed (%d refreshes).", refreshes) }
+
+	if err := allocation.Close(); nil != err { in_test.Errorf("Error: %s", err) }
+}
+
+// Allocation.CreatePermission() and Allocation.ChannelBind()
+func Test_TurnPermissions(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	server, state, stop := __testTurnServer(in_test, 600)
+	defer stop()
+
+	client, err := ClientCreate(server)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer client.Close()
+	client.SetRetransmitPolicy(RetransmitPolicy{ InitialRto: 50 * time.Millisecond, Rc: 3, Rm: 2 })
+	client.SetCredentials("user", "pass")
+	allocation, err := client.ClientAllocate(context.Background(), AllocatePolicyDefault())
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer allocation.Close()
+
+	// Permissions: a single permission per IP address.
+	err = allocation.CreatePermission(context.Background(), []string{ "127.0.0.5:1000", "127.0.0.5:2000", "127.0.0.6:1000" })
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	state.mutex.Lock()
+	if (1 != state.permissions["127.0.0.5"]) || (1 != state.permissions["127.0.0.6"]) { in_test.Errorf("Unexpected permissions %v.", state.permissions) }
+	state.mutex.Unlock()
+	err = allocation.CreatePermission(context.Background(), []string{ "127.0.0.9:1000" })
+	if e, ok := err.(*ErrorResponse); (! ok) || (STUN_ERROR_FORBIDDEN != e.Code) { in_test.Errorf("Unexpected error: %v", err) }
+	if err := allocation.CreatePermission(context.Background(), nil); nil == err { in_test.Errorf("Empty list of peers accepted.") }
+
+	// Channels: the same peer keeps its channel.
+	number, err := allocation.ChannelBind(context.Background(), "127.0.0.5:1000")
+	if (nil != err) || (STUN_CHANNEL_MIN != number) { in_test.Fatalf("Unexpected channel 0x%04X (%v).", number, err) }
+	number, err = allocation.ChannelBind(context.Background(), "127.0.0.5:1000")
+	if (nil != err) || (STUN_CHANNEL_MIN != number) { in_test.Errorf("Unexpected channel 0x%04X (%v).", number, err) }
+	number, err = allocation.ChannelBind(context.Background(), "127.0.0.6:1000")
+	if (nil != err) || (STUN_CHANNEL_MIN + 1 != number) { in_test.Errorf("Unexpected channel 0x%04X (%v).", number, err) }
+	if n, ok := allocation.Channel("127.0.0.6:1000"); (! ok) || (number != n) { in_test.Errorf("Unexpected channel 0x%04X.", n) }
+	if _, ok := allocation.Channel("127.0.0.7:1000"); ok { in_test.Errorf("Unexpected channel for an unknown peer.") }
+
+	// The server refuses to bind a channel already bound to another peer.
+	state.mutex.Lock()
+	state.channels[STUN_CHANNEL_MIN + 2] = "127.0.0.8:1000"
+	state.mutex.Unlock()
+	_, err = allocation.ChannelBind(context.Background(), "127.0.0.7:1000")
+	if e, ok := err.(*ErrorResponse); (! ok) || (STUN_ERROR_BAD_REQUEST != e.Code) { in_test.Errorf("Unexpected error: %v", err) }
+	if _, ok := allocation.Channel("127.0.0.7:1000"); ok { in_test.Errorf("Unexpected channel for a refused binding.") }
+
+	// Automatic refresh.
+	state.mutex.Lock()
+	permissions := state.permissions["127.0.0.6"]
+	binds       := state.binds
+	state.mutex.Unlock()
+	allocation.mutex.Lock()
+	for _, lease := range allocation.permissions { lease.refresh = time.Now() }
+	for _, lease := range allocation.channels { lease.refresh = time.Now() }
+	allocation.mutex.Unlock()
+	allocation.__wake()
+	time.Sleep(300 * time.Millisecond)
+	state.mutex.Lock()
+	if (state.permissions["127.0.0.6"] < permissions + 2) { in_test.Errorf("The permission has not been refreshed (%d).", state.permissions["127.0.0.6"]) }
+	if (state.binds != binds + 2) { in_test.Errorf("Unexpected number of CHANNEL-BIND requests: %d (expected %d).", state.binds, binds + 2) }
+	state.mutex.Unlock()
+	if (nil != allocation.Err()) { in_test.Errorf("Unexpected error: %s", allocation.Err()) }
+	allocation.mutex.Lock()
+	for peer, lease := range allocation.channels {
+		if (time.Until(lease.refresh) < 8 * time.Minute) { in_test.Errorf("Unexpected refresh date for %s: %s.", peer, lease.refresh) }
+	}
+	allocation.mutex.Unlock()
+}
+
+// Allocation.PacketConn()
+func Test_TurnRelay(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	server, state, stop := __testTurnServer(in_test, 600)
+	defer stop()
+
+	client, err := ClientCreate(server)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer client.Close()
+	client.SetRetransmitPolicy(RetransmitPolicy{ InitialRto: 50 * time.Millisecond, Rc: 3, Rm: 2 })
+	client.SetCredentials("user", "pass")
+	allocation, err := client.ClientAllocate(context.Background(), AllocatePolicyDefault())
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	relay, err := allocation.PacketConn()
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer relay.Close()
+	if _, err := allocation.PacketConn(); nil == err { in_test.Errorf("Second relayed connection accepted.") }
+	if (state.relayed != relay.LocalAddr().String()) { in_test.Errorf("Unexpected local address %s.", relay.LocalAddr()) }
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer peer.Close()
+	b := make([]byte, 1000)
+
+	// Exchange data with the peer, with SEND/DATA indications and then with ChannelData messages.
+	// The first packet installs the permission.
+	for _, channel := range []bool{ false, true } {
+		if (channel) {
+			if _, err := allocation.ChannelBind(context.Background(), peer.LocalAddr().String()); nil != err { in_test.Fatalf("Error: %s", err) }
+		}
+		if _, err := relay.WriteTo([]byte("ping"), peer.LocalAddr()); nil != err { in_test.Fatalf("Error: %s", err) }
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		count, from, err := peer.ReadFrom(b)
+		if (nil != err) { in_test.Fatalf("Error: %s", err) }
+		if ("ping" != string(b[0:count])) || (state.relayed != from.String()) { in_test.Errorf("Unexpected packet \"%s\" from %s.", b[0:count], from) }
+
+		if _, err := peer.WriteTo([]byte("pong"), from); nil != err { in_test.Fatalf("Error: %s", err) }
+		relay.SetReadDeadline(time.Now().Add(time.Second))
+		count, from, err = relay.ReadFrom(b)
+		if (nil != err) { in_test.Fatalf("Error: %s", err) }
+		if ("pong" != string(b[0:count])) || (peer.LocalAddr().String() != from.String()) { in_test.Errorf("Unexpected packet \"%s\" from %s.", b[0:count], from) }
+	}
+	state.mutex.Lock()
+	if (2 != state.permissions["127.0.0.1"]) { in_test.Errorf("Unexpected permissions %v.", state.permissions) }
+	state.mutex.Unlock()
+
+	// The transactions still work while the relayed connection reads the socket.
+	if err := allocation.Refresh(context.Background()); nil != err { in_test.Errorf("Error: %s", err) }
+
+	// Read deadline.
+	relay.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err = relay.ReadFrom(b)
+	if e, ok := err.(net.Error); (! ok) || (! e.Timeout()) { in_test.Errorf("Unexpected error: %v", err) }
+
+	// The server refuses the permission.
+	_, err = relay.WriteTo([]byte("ping"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 9), Port: 1000})
+	if e, ok := err.(*ErrorResponse); (! ok) || (STUN_ERROR_FORBIDDEN != e.Code) { in_test.Errorf("Unexpected error: %v", err) }
+
+	// Close: the allocation is deleted, and the client's socket is given back to the client.
+	if err := relay.Close(); nil != err { in_test.Errorf("Error: %s", err) }
+	state.mutex.Lock()
+	count := len(state.allocations)
+	state.mutex.Unlock()
+	if (0 != count) { in_test.Errorf("The allocation has not been deleted.") }
+	if (client.connection != relay.conn) { in_test.Errorf("The client's socket has not been restored.") }
+	if _, _, err := relay.ReadFrom(b); nil == err { in_test.Errorf("Read after close.") }
+	if _, err := relay.WriteTo([]byte("ping"), peer.LocalAddr()); nil == err { in_test.Errorf("Write after close.") }
+	if _, err := allocation.PacketConn(); nil == err { in_test.Errorf("Relayed connection accepted for a closed allocation.") }
+}
+
+// Allocation.Close(): the relayed connection is closed too, and the client's socket is given back to the client.
+func Test_TurnRelayAllocationClose(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+
+	server, state, stop := __testTurnServer(in_test, 600)
+	defer stop()
+
+	client, err := ClientCreate(server)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer client.Close()
+	client.SetRetransmitPolicy(RetransmitPolicy{ InitialRto: 50 * time.Millisecond, Rc: 3, Rm: 2 })
+	client.SetCredentials("user", "pass")
+	allocation, err := client.ClientAllocate(context.Background(), AllocatePolicyDefault())
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	relay, err := allocation.PacketConn()
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+
+	// A pending read is unblocked.
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := relay.ReadFrom(make([]byte, 1000))
+		read <- err
+	}()
+
+	if err := allocation.Close(); nil != err { in_test.Errorf("Error: %s", err) }
+	state.mutex.Lock()
+	count := len(state.allocations)
+	state.mutex.Unlock()
+	if (0 != count) { in_test.Errorf("The allocation has not been deleted.") }
+	if (client.connection != relay.conn) { in_test.Errorf("The client's socket has not been restored.") }
+	select {
+		case err := <-read:
+			if (! errors.Is(err, net.ErrClosed)) { in_test.Errorf("Unexpected error: %v", err) }
+		case <-time.After(time.Second):
+			in_test.Errorf("The pending read has not been unblocked.")
+	}
+	if _, err := relay.WriteTo([]byte("ping"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}); nil == err { in_test.Errorf("Write after close.") }
+	if err := relay.Close(); nil != err { in_test.Errorf("Error: %s", err) }
+
+	// The client's socket can be used for requests again.
+	allocation, err = client.ClientAllocate(context.Background(), AllocatePolicyDefault())
+	if (nil != err) { in_test.Fatalf("The client's socket is not usable (%v).", err) }
+	if err := allocation.Close(); nil != err { in_test.Errorf("Error: %s", err) }
+}
+
+// ChannelDataCreate(), ChannelData.ToBytes(), ChannelDataFromBytes(), Demultiplex() and MessageSize()
+func Test_ChannelData(in_test *testing.T) {
+	message, err := ChannelDataCreate(0x4001, []byte("hello"))
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+
+	// UDP: no padding. TCP: padding.
+	udp := message.ToBytes(false)
+	if (! bytes.Equal([]byte{ 0x40, 0x01, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o' }, udp)) { in_test.Errorf("Unexpected message % x.", udp) }
+	tcp := message.ToBytes(true)
+	if (! bytes.Equal([]byte{ 0x40, 0x01, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o', 0, 0, 0 }, tcp)) { in_test.Errorf("Unexpected message % x.", tcp) }
+	for _, b := range [][]byte{ udp, tcp } {
+		decoded, err := ChannelDataFromBytes(b)
+		if (nil != err) { in_test.Errorf("Error: %s", err); continue }
+		if (0x4001 != decoded.Number) || ("hello" != string(decoded.Data)) { in_test.Errorf("Unexpected message 0x%04X \"%s\".", decoded.Number, decoded.Data) }
+	}
+	if size, err := MessageSize(udp, false); (nil != err) || (9 != size) { in_test.Errorf("Unexpected size %d (%v).", size, err) }
+	if size, err := MessageSize(tcp, true); (nil != err) || (12 != size) { in_test.Errorf("Unexpected size %d (%v).", size, err) }
+
+	// Invalid messages.
+	if _, err := ChannelDataCreate(0x3FFF, nil); nil == err { in_test.Errorf("Invalid channel number accepted.") }
+	if _, err := ChannelDataCreate(0x7FFF, nil); nil == err { in_test.Errorf("Invalid channel number accepted.") }
+	if _, err := ChannelDataCreate(0x8000, nil); nil == err { in_test.Errorf("Invalid channel number accepted.") }
+	tests := []struct {
+		name string
+		bin  []byte
+		kind int
+	}{
+		{ "short",         []byte{ 0x40, 0x01, 0x00 },                                    STUN_DECODE_ERROR_SIZE },
+		{ "channel",       []byte{ 0x80, 0x00, 0x00, 0x00 },                              STUN_DECODE_ERROR_CHANNEL },
+		{ "truncated",     []byte{ 0x40, 0x01, 0x00, 0x05, 'h', 'e' },                    STUN_DECODE_ERROR_LENGTH },
+		{ "extra bytes",   []byte{ 0x40, 0x01, 0x00, 0x01, 'h', 0, 0, 0, 0 },             STUN_DECODE_ERROR_PADDING },
+	}
+	for _, test := range tests {
+		_, err := ChannelDataFromBytes(test.bin)
+		e, ok := err.(*DecodeError)
+		if (! ok) || (test.kind != e.Kind) { in_test.Errorf("%s: unexpected error %v.", test.name, err) }
+	}
+
+	// Demultiplexing.
+	packet := PacketCreate()
+	packet.SetType(STUN_TYPE_BINDING_REQUEST)
+	packet.SetRandomId()
+	if (STUN_MESSAGE_STUN != Demultiplex(packet.ToBytes())) { in_test.Errorf("The STUN message is not recognized.") }
+	if size, err := MessageSize(packet.ToBytes(), true); (nil != err) || (20 != size) { in_test.Errorf("Unexpected size %d (%v).", size, err) }
+	if (STUN_MESSAGE_CHANNEL_DATA != Demultiplex(udp)) { in_test.Errorf("The ChannelData message is not recognized.") }
+	if (STUN_MESSAGE_UNKNOWN != Demultiplex([]byte{ 0x80 })) || (STUN_MESSAGE_UNKNOWN != Demultiplex(nil)) { in_test.Errorf("Unexpected message kind.") }
+	if _, err := MessageSize([]byte{ 0xC0, 0, 0, 0 }, false); nil == err { in_test.Errorf("Unknown message accepted.") }
+	if ("CHANNEL_DATA" != STUN_MESSAGE_CHANNEL_DATA.String()) { in_test.Errorf("Unexpected name %s.", STUN_MESSAGE_CHANNEL_DATA) }
+}
+
+// TurnServerCreate()
+func Test_TurnServer(in_test *testing.T) {
+	SetRfc5389()
+	defer SetRfc3489()
+	retransmit := RetransmitPolicy{ InitialRto: 50 * time.Millisecond, Rc: 3, Rm: 2 }
+
+	// Find a range of ports for the relay sockets.
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	first := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+	if (first > 65000) { first = 65000 }
+
+	policy := TurnServerPolicyDefault()
+	policy.Realm          = "example.org"
+	policy.Users["user"]  = "pass"
+	policy.MinPort        = first
+	policy.MaxPort        = first + 20
+	policy.MaxAllocations = 1
+	if _, err := TurnServerCreate("127.0.0.1:0", TurnServerPolicyDefault()); nil == err { in_test.Errorf("Server without user accepted.") }
+	if _, err := TurnServerCreate("0.0.0.0:0", policy); nil == err { in_test.Errorf("Server without relay IP address accepted.") }
+	server, err := TurnServerCreate("127.0.0.1:0", policy)
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer server.Close()
+	if err := server.Start(); nil != err { in_test.Fatalf("Error: %s", err) }
+
+	client, err := ClientCreate(server.Address())
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer client.Close()
+	client.SetRetransmitPolicy(retransmit)
+
+	// The server is also a STUN server.
+	response, err := client.ClientSendBinding(context.Background(), nil)
+	if (nil != err) || (! response.response) { in_test.Fatalf("BINDING: %v", err) }
+
+	// Wrong credentials.
+	client.SetCredentials("user", "wrong")
+	_, err = client.ClientAllocate(context.Background(), AllocatePolicyDefault())
+	if e, ok := err.(*ErrorResponse); (! ok) || (STUN_ERROR_UNAUTHORIZED != e.Code) { in_test.Errorf("Unexpected error: %v", err) }
+
+	// Allocation.
+	client.SetCredentials("user", "pass")
+	allocation, err := client.ClientAllocate(context.Background(), AllocatePolicyDefault())
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	_, port, _ := tools.InetSplit(allocation.RelayedAddress())
+	if (port < policy.MinPort) || (port > policy.MaxPort) { in_test.Errorf("Unexpected relayed address %s.", allocation.RelayedAddress()) }
+	if (client.LocalAddr() != allocation.MappedAddress()) { in_test.Errorf("Unexpected mapped address %s.", allocation.MappedAddress()) }
+	if (policy.DefaultLifetime != allocation.Lifetime()) { in_test.Errorf("Unexpected lifetime %s.", allocation.Lifetime()) }
+	if addresses := server.Allocations(); (1 != len(addresses)) || (allocation.RelayedAddress() != addresses[0]) { in_test.Errorf("Unexpected allocations %v.", addresses) }
+
+	// Quota.
+	other, err := ClientCreate(server.Address())
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer other.Close()
+	other.SetRetransmitPolicy(retransmit)
+	other.SetCredentials("user", "pass")
+	_, err = other.ClientAllocate(context.Background(), AllocatePolicy{ Lifetime: time.Minute, Refresh: false })
+	if e, ok := err.(*ErrorResponse); (! ok) || (STUN_ERROR_ALLOCATION_QUOTA_REACHED != e.Code) { in_test.Errorf("Unexpected error: %v", err) }
+
+	// Relayed data: SEND/DATA indications, then ChannelData messages.
+	relay, err := allocation.PacketConn()
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer relay.Close()
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer peer.Close()
+	b := make([]byte, 1000)
+	for _, channel := range []bool{ false, true } {
+		if (channel) {
+			number, err := allocation.ChannelBind(context.Background(), peer.LocalAddr().String())
+			if (nil != err) || (STUN_CHANNEL_MIN != number) { in_test.Fatalf("Unexpected channel 0x%04X (%v).", number, err) }
+		}
+		if _, err := relay.WriteTo([]byte("ping"), peer.LocalAddr()); nil != err { in_test.Fatalf("Error: %s", err) }
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		count, from, err := peer.ReadFrom(b)
+		if (nil != err) { in_test.Fatalf("Error: %s", err) }
+		if ("ping" != string(b[0:count])) || (allocation.RelayedAddress() != from.String()) { in_test.Errorf("Unexpected packet \"%s\" from %s.", b[0:count], from) }
+
+		if _, err := peer.WriteTo([]byte("pong"), from); nil != err { in_test.Fatalf("Error: %s", err) }
+		relay.SetReadDeadline(time.Now().Add(time.Second))
+		count, from, err = relay.ReadFrom(b)
+		if (nil != err) { in_test.Fatalf("Error: %s", err) }
+		if ("pong" != string(b[0:count])) || (peer.LocalAddr().String() != from.String()) { in_test.Errorf("Unexpected packet \"%s\" from %s.", b[0:count], from) }
+	}
+
+	// The channel 0x7FFF is not a valid channel.
+	request, _ := __turnRequest(STUN_TYPE_CHANNEL_BINDING)
+	a, _ := AttributeCreateChannelNumber(&request, 0x7FFF)
+	request.AddAttribute(a)
+	a, _ = AttributeCreateXorPeerAddress(&request, "127.0.0.1", 1000)
+	request.AddAttribute(a)
+	_, err = allocation.__request(context.Background(), request)
+	if e, ok := err.(*ErrorResponse); (! ok) || (STUN_ERROR_BAD_REQUEST != e.Code) { in_test.Errorf("Unexpected error: %v", err) }
+
+	// A peer without permission can not reach the client.
+	intruder, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer intruder.Close()
+	relayed, _ := net.ResolveUDPAddr("udp", allocation.RelayedAddress())
+	intruder.WriteTo([]byte("intrusion"), relayed)
+	relay.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if count, from, err := relay.ReadFrom(b); nil == err { in_test.Errorf("Unexpected packet \"%s\" from %s.", b[0:count], from) }
+
+	// Expired permissions are checked on every relayed packet.
+	server.mutex.Lock()
+	for _, a := range server.allocations { a.permissions["127.0.0.1"] = time.Now() }
+	server.mutex.Unlock()
+	peer.WriteTo([]byte("late"), relayed)
+	relay.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if count, from, err := relay.ReadFrom(b); nil == err { in_test.Errorf("Unexpected packet \"%s\" from %s.", b[0:count], from) }
+
+	// Raw requests: unknown attribute, stale nonce.
+	raw, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	defer raw.Close()
+	destination, _ := net.ResolveUDPAddr("udp", server.Address())
+	request, _ = __turnRequest(STUN_TYPE_ALLOCATE)
+	a, _ = AttributeCreateRequestedTransport(&request, STUN_TRANSPORT_UDP)
+	request.AddAttribute(a)
+	a, _ = AttributeCreate(STUN_ATTRIBUT_EVEN_PORT, []byte{ 0x80, 0, 0, 0 }, &request)
+	request.AddAttribute(a)
+	_, _, err = SendRequestContext(context.Background(), raw, destination, request, retransmit)
+	if e, ok := err.(*ErrorResponse); (! ok) || (STUN_ERROR_UNKNOWN_ATTRIBUTE != e.Code) { in_test.Errorf("Unexpected error: %v", err) }
+
+	expired := fmt.Sprintf("%016x", time.Now().Unix() - 1)
+	request, _ = __turnRequest(STUN_TYPE_ALLOCATE)
+	a, _ = AttributeCreateRequestedTransport(&request, STUN_TRANSPORT_UDP)
+	request.AddAttribute(a)
+	a, _ = AttributeCreateUsername(&request, "user")
+	request.AddAttribute(a)
+	a, _ = AttributeCreateRealm(&request, "example.org")
+	request.AddAttribute(a)
+	a, _ = AttributeCreateNonce(&request, expired + hex.EncodeToString(__hmac([]byte(expired), server.secret)))
+	request.AddAttribute(a)
+	a, _ = AttributeCreateMessageIntegrity(&request, LongTermKey("user", "example.org", "pass"))
+	request.AddAttribute(a)
+	_, _, err = SendRequestContext(context.Background(), raw, destination, request, retransmit)
+	if e, ok := err.(*ErrorResponse); (! ok) || (STUN_ERROR_STALE_NONCE != e.Code) { in_test.Errorf("Unexpected error: %v", err) }
+
+	// Wrong realm: 401, with the right realm.
+	valid := fmt.Sprintf("%016x", time.Now().Add(time.Minute).Unix())
+	request, _ = __turnRequest(STUN_TYPE_ALLOCATE)
+	a, _ = AttributeCreateRequestedTransport(&request, STUN_TRANSPORT_UDP)
+	request.AddAttribute(a)
+	a, _ = AttributeCreateUsername(&request, "user")
+	request.AddAttribute(a)
+	a, _ = AttributeCreateRealm(&request, "example.com")
+	request.AddAttribute(a)
+	a, _ = AttributeCreateNonce(&request, valid + hex.EncodeToString(__hmac([]byte(valid), server.secret)))
+	request.AddAttribute(a)
+	a, _ = AttributeCreateMessageIntegrity(&request, LongTermKey("user", "example.com", "pass"))
+	request.AddAttribute(a)
+	response_packet, _, err := SendRequestContext(context.Background(), raw, destination, request, retransmit)
+	if e, ok := err.(*ErrorResponse); (! ok) || (STUN_ERROR_UNAUTHORIZED != e.Code) { in_test.Errorf("Unexpected error: %v", err) }
+	if found, realm := response_packet.GetRealm(); (! found) || ("example.org" != realm) { in_test.Errorf("Unexpected realm \"%s\".", realm) }
+
+	// Close: the allocation is deleted.
+	if err := relay.Close(); nil != err { in_test.Errorf("Error: %s", err) }
+	if (0 != len(server.Allocations())) { in_test.Errorf("The allocation has not been deleted.") }
+
+	// Expiration.
+	allocation, err = other.ClientAllocate(context.Background(), AllocatePolicy{ Lifetime: time.Minute, Refresh: false })
+	if (nil != err) { in_test.Fatalf("Error: %s", err) }
+	server.mutex.Lock()
+	for _, a := range server.allocations { a.expires = time.Now() }
+	server.mutex.Unlock()
+	if (0 != len(server.Allocations())) { in_test.Errorf("The allocation has not expired.") }
+	time.Sleep(turn_server_sweep_interval + 200 * time.Millisecond)
+	server.mutex.Lock()
+	count := len(server.allocations)
+	server.mutex.Unlock()
+	if (0 != count) { in_test.Errorf("The expired allocation has not been removed.") }
+	err = allocation.Refresh(context.Background())
+	if e, ok := err.(*ErrorResponse); (! ok) || (STUN_ERROR_ALLOCATION_MISMATCH != e.Code) { in_test.Errorf("Unexpected error: %v", err) }
+}
+
+// TurnServer.__relaySocket() (no port available)
+func Test_TurnServerPortAttempts(in_test *testing.T) {
+	// 192.0.2.1 (TEST-NET-1) is not a local address: no relay socket can be opened.
+	policy := TurnServerPolicyDefault()
+	server := TurnServer{ policy: policy, relay_ip: "192.0.2.1", next_port: policy.MinPort }
+	if _, err := server.__relaySocket(); nil == err { in_test.Fatalf("A relay socket has been opened on 192.0.2.1.") }
+	if (policy.MinPort + turn_server_port_attempts != server.next_port) { in_test.Errorf("Unexpected number of ports tried: %d.", server.next_port - policy.MinPort) }
+
+	// A small range of ports is not tried more than once.
+	server.policy.MinPort = 50000
+	server.policy.MaxPort = 50009
+	server.next_port      = 50000
+	if _, err := server.__relaySocket(); nil == err { in_test.Fatalf("A relay socket has been opened on 192.0.2.1.") }
+	if (50000 != server.next_port) { in_test.Errorf("Unexpected next port %d.", server.next_port) }
+}
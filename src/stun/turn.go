@@ -0,0 +1,511 @@
+// Copyright (C) 2012 Denis BEURIVE
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stun
+
+import "fmt"
+import "errors"
+import "context"
+import "sync"
+import "time"
+import "tools"
+
+/* ------------------------------------------------------------------------------------------------ */
+/* TURN client (RFC 5766).                                                                          */
+/* An allocation is a relayed transport address, reserved by a TURN server for the client's         */
+/* transport address. The allocation lives until it expires, unless it is refreshed.               */
+/* ------------------------------------------------------------------------------------------------ */
+
+// The IANA protocol number of UDP (see REQUESTED-TRANSPORT).
+const STUN_TRANSPORT_UDP = 17
+
+// The lifetime of an allocation, if the server does not tell it.
+// RFC 5766: The default value of the allocation lifetime is 10 minutes.
+const turn_default_lifetime = 10 * time.Minute
+
+// The allocations are refreshed this long before they expire.
+const turn_refresh_margin = time.Minute
+
+// The number of local ports tried, when the server replies 437 (Allocation Mismatch) to an ALLOCATE request.
+const turn_mismatch_attempts = 3
+
+// This type represents the parameters of an allocation.
+type AllocatePolicy struct {
+	// The requested lifetime (0 means "let the server decide"). The server may grant another lifetime.
+	Lifetime time.Duration
+	// This flag indicates whether the allocation is refreshed automatically, before it expires.
+	Refresh bool
+}
+
+// This type represents something that expires unless it is refreshed (allocation, permission or channel).
+type turnLease struct {
+	// The channel number (channels only).
+	number uint16
+	// The date of expiration.
+	expires time.Time
+	// The date of the next refresh.
+	refresh time.Time
+}
+
+// This type represents an allocation on a TURN server.
+type Allocation struct {
+	// The client that owns the allocation.
+	client *Client
+	// The parameters.
+	policy AllocatePolicy
+	// The relayed transport address.
+	relayed string
+	// The mapped transport address ("" if the server did not send it).
+	mapped string
+	// The function that stops the automatic refresh (nil if the allocation is not refreshed automatically).
+	cancel context.CancelFunc
+	// This channel is closed when the automatic refresh is stopped.
+	done chan struct{}
+	// This channel wakes up the automatic refresh, when a permission or a channel is installed.
+	wake chan struct{}
+	// This mutex serializes the transactions on the client's socket.
+	transaction sync.Mutex
+	// This mutex protects the following fields.
+	mutex sync.Mutex
+	// The lifetime granted by the server.
+	lifetime time.Duration
+	// The allocation's lease.
+	lease turnLease
+	// The permissions (peer's IP address => lease).
+	permissions map[string]*turnLease
+	// The channels (peer's transport address => lease).
+	channels map[string]*turnLease
+	// The relayed connection (nil if none, see PacketConn()).
+	relay *RelayConn
+	// This flag indicates whether the allocation has been closed or not.
+	closed bool
+	// The last error.
+	err error
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* API                                                                                              */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function returns the default parameters for an allocation.
+//
+// OUTPUT
+// - The parameters.
+func AllocatePolicyDefault() AllocatePolicy {
+	return AllocatePolicy{ Lifetime: 0, Refresh: true }
+}
+
+// This function checks that the parameters are valid.
+//
+// OUTPUT
+// - The error flag.
+func (v AllocatePolicy) Check() error {
+	if (v.Lifetime < 0) { return errors.New(fmt.Sprintf("Invalid allocate policy: the lifetime must not be negative (%s).", v.Lifetime)) }
+	return nil
+}
+
+// This function asks the server for an allocation (UDP relay).
+// If the server requires authentication, then the client's credentials are used (see SetCredentials()).
+// RFC 5766: 437 (Allocation Mismatch): This indicates that the client has picked a 5-tuple that the server sees as
+//           already in use. [...] The client might choose to try again using a different 5-tuple (e.g., by using a
+//           different local port).
+//
+// INPUT
+// - in_ctx: the context. It can be used to cancel the request.
+// - in_policy: the parameters of the allocation.
+//
+// OUTPUT
+// - The allocation.
+// - The error flag. If the server refuses the allocation, then the error flag is a pointer to an ErrorResponse.
+//   + 437 (Allocation Mismatch): the request is sent from up to 3 local ports (the client's socket is replaced up to 2
+//     times) before this error is returned.
+//   + 486 (Allocation Quota Reached): the client should wait before trying again.
+//
+// WARNING
+// TURN servers are RFC 5389 servers. STUN should be configured to be compliant with RFC 5389 (see SetRfc5389()).
+// Once the allocation is created, the client's socket must not be used for anything else.
+func (v *Client) ClientAllocate(in_ctx context.Context, in_policy AllocatePolicy) (*Allocation, error) {
+	var packet StunPacket
+	var attribute StunAttribute
+	var response requestResponse
+	var found bool
+	var ip string
+	var port uint16
+	var seconds uint32
+
+	err := in_policy.Check()
+	if (nil != err) { return nil, err }
+
+	for attempt := 1; ; attempt++ {
+		packet, err = __turnRequest(STUN_TYPE_ALLOCATE)
+		if (nil != err) { return nil, err }
+		attribute, err = AttributeCreateRequestedTransport(&packet, STUN_TRANSPORT_UDP)
+		if (nil != err) { return nil, err }
+		packet.AddAttribute(attribute)
+		if (in_policy.Lifetime > 0) {
+			attribute, err = AttributeCreateLifetime(&packet, __seconds(in_policy.Lifetime))
+			if (nil != err) { return nil, err }
+			packet.AddAttribute(attribute)
+		}
+		packet, err = __turnFinalize(packet)
+		if (nil != err) { return nil, err }
+		response, err = v.__send(in_ctx, v.server_transport_address, packet)
+		if (nil == err) || (attempt == turn_mismatch_attempts) { break }
+		if e, ok := err.(*ErrorResponse); (! ok) || (STUN_ERROR_ALLOCATION_MISMATCH != e.Code) { return nil, err }
+		if verbosity > 0 { tools.AddText(output, "The server replied 437 (Allocation Mismatch). Try again from another local port.") }
+		err = v.__renewSocket()
+		if (nil != err) { return nil, err }
+	}
+	if (nil != err) { return nil, err }
+	if (! response.response) { return nil, errors.New("The TURN server did not answer the ALLOCATE request.") }
+
+	allocation := Allocation{ client: v, policy: in_policy, lifetime: turn_default_lifetime, permissions: make(map[string]*turnLease), channels: make(map[string]*turnLease) }
+	found, _, ip, port, err = response.packet.GetXorRelayedAddress()
+	if (nil != err) { return nil, err }
+	if (! found) { return nil, errors.New("The response to the ALLOCATE request does not contain any XOR-RELAYED-ADDRESS attribute.") }
+	allocation.relayed, err = tools.MakeTransportAddress(ip, int(port))
+	if (nil != err) { return nil, err }
+	found, _, ip, port, err = response.packet.GetXorMappedAddress()
+	if (nil != err) { return nil, err }
+	if (found) {
+		allocation.mapped, err = tools.MakeTransportAddress(ip, int(port))
+		if (nil != err) { return nil, err }
+	}
+	found, seconds, err = response.packet.GetLifetime()
+	if (nil != err) { return nil, err }
+	if (found) { allocation.lifetime = time.Duration(seconds) * time.Second }
+	allocation.lease.__renew(allocation.lifetime, time.Now())
+
+	if verbosity > 0 {
+		tools.AddText(output, fmt.Sprintf("% -25s: %s", "Relayed address", allocation.relayed))
+		tools.AddText(output, fmt.Sprintf("% -25s: %s", "Lifetime", allocation.lifetime))
+	}
+
+	if (in_policy.Refresh) {
+		ctx, cancel := context.WithCancel(context.Background())
+		allocation.cancel = cancel
+		allocation.done   = make(chan struct{})
+		allocation.wake   = make(chan struct{}, 1)
+		go allocation.__run(ctx)
+	}
+	return &allocation, nil
+}
+
+// This function returns the relayed transport address.
+// The peers send their packets to this address.
+//
+// OUTPUT
+// - The relayed transport address.
+//   This value is written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+func (v *Allocation) RelayedAddress() string {
+	return v.relayed
+}
+
+// This function returns the client's mapped transport address, as seen by the server.
+//
+// OUTPUT
+// - The mapped transport address ("" if the server did not send it).
+//   This value is written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+func (v *Allocation) MappedAddress() string {
+	return v.mapped
+}
+
+// This function returns the lifetime granted by the server, for the last ALLOCATE or REFRESH request.
+//
+// OUTPUT
+// - The lifetime.
+func (v *Allocation) Lifetime() time.Duration {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.lifetime
+}
+
+// This function returns the date of expiration of the allocation.
+//
+// OUTPUT
+// - The date of expiration.
+func (v *Allocation) Expires() time.Time {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.lease.expires
+}
+
+// This function returns the last error that occurred while refreshing the allocation, its permissions or its channels.
+// If the server replies 437 (Allocation Mismatch) to a REFRESH request, then the allocation does not exist anymore, and
+// the automatic refresh stops.
+//
+// OUTPUT
+// - The last error (nil if none).
+func (v *Allocation) Err() error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.err
+}
+
+// This function refreshes the allocation, with the lifetime requested by the allocation's parameters.
+//
+// INPUT
+// - in_ctx: the context. It can be used to cancel the request.
+//
+// OUTPUT
+// - The error flag. If the server refuses the request, then the error flag is a pointer to an ErrorResponse.
+func (v *Allocation) Refresh(in_ctx context.Context) error {
+	return v.__refresh(in_ctx, false)
+}
+
+// This function stops the automatic refresh and deletes the allocation (REFRESH request with a lifetime of 0).
+// The client's socket is not closed.
+// If the allocation has a relayed connection (see PacketConn()), then the relayed connection is closed too, and the
+// client's socket is given back to the client.
+//
+// OUTPUT
+// - The error flag.
+func (v *Allocation) Close() error {
+	v.mutex.Lock()
+	closed := v.closed
+	v.closed = true
+	relay  := v.relay
+	v.mutex.Unlock()
+	if (closed) { return nil }
+
+	if (nil != v.cancel) {
+		v.cancel()
+		<-v.done
+	}
+	// The allocation is deleted while the relayed connection still reads the socket, so that the response can be received.
+	err := v.__refresh(context.Background(), true)
+	if (nil != relay) { relay.__detach() }
+	// The allocation may have already expired.
+	if e, ok := err.(*ErrorResponse); ok && (STUN_ERROR_ALLOCATION_MISMATCH == e.Code) { return nil }
+	return err
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Privates                                                                                         */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function refreshes the allocation, its permissions and its channels automatically, until it is closed.
+// If a refresh fails, then it is attempted again, at half of the remaining time.
+//
+// INPUT
+// - in_ctx: the context.
+func (v *Allocation) __run(in_ctx context.Context) {
+	defer close(v.done)
+	for {
+		next, err := v.__nextRefresh()
+		if (nil != err) {
+			v.__setError(err)
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+			case <-in_ctx.Done():
+				timer.Stop()
+				return
+			case <-v.wake:
+				timer.Stop()
+				continue
+			case <-timer.C:
+		}
+
+		now := time.Now()
+		v.mutex.Lock()
+		due := ! now.Before(v.lease.refresh)
+		v.mutex.Unlock()
+		if (due) {
+			err = v.__refresh(in_ctx, false)
+			if (nil != in_ctx.Err()) { return }
+			if (nil != err) {
+				v.__setError(err)
+				if e, ok := err.(*ErrorResponse); ok && (STUN_ERROR_ALLOCATION_MISMATCH == e.Code) { return }
+			}
+		}
+		v.__refreshPermissions(in_ctx, now)
+		v.__refreshChannels(in_ctx, now)
+	}
+}
+
+// This function returns the date of the next refresh (allocation, permission or channel).
+//
+// OUTPUT
+// - The date of the next refresh.
+// - The error flag. An error is returned if the allocation has expired.
+func (v *Allocation) __nextRefresh() (time.Time, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if (! time.Now().Before(v.lease.expires)) { return time.Time{}, errors.New(fmt.Sprintf("The allocation %s has expired.", v.relayed)) }
+	next := v.lease.refresh
+	for _, lease := range v.permissions {
+		if (lease.refresh.Before(next)) { next = lease.refresh }
+	}
+	for _, lease := range v.channels {
+		if (lease.refresh.Before(next)) { next = lease.refresh }
+	}
+	return next, nil
+}
+
+// This function sends a REFRESH request.
+//
+// INPUT
+// - in_ctx: the context.
+// - in_delete: this flag indicates whether the allocation must be deleted (lifetime 0) or not. If not, then the
+//   lifetime requested by the allocation's parameters is used.
+//
+// OUTPUT
+// - The error flag.
+//
+// WARNING
+// Whatever the failure, the next refresh is postponed. Otherwise, the allocation would be refreshed again immediately.
+func (v *Allocation) __refresh(in_ctx context.Context, in_delete bool) (err error) {
+	v.transaction.Lock()
+	defer v.transaction.Unlock()
+	defer func() {
+		if (nil == err) { return }
+		v.mutex.Lock()
+		v.lease.__postpone(time.Now())
+		v.mutex.Unlock()
+	}()
+
+	packet, err := __turnRequest(STUN_TYPE_REFRESH)
+	if (nil != err) { return err }
+	if (in_delete) || (v.policy.Lifetime > 0) {
+		var seconds uint32 = 0
+		if (! in_delete) { seconds = __seconds(v.policy.Lifetime) }
+		attribute, err := AttributeCreateLifetime(&packet, seconds)
+		if (nil != err) { return err }
+		packet.AddAttribute(attribute)
+	}
+	response, err := v.__request(in_ctx, packet)
+	if (nil == err) && (! response.response) { err = errors.New("The TURN server did not answer the REFRESH request.") }
+	if (nil != err) { return err }
+
+	found, seconds, err := response.packet.GetLifetime()
+	if (nil != err) { return err }
+	if (! found) { return errors.New("The response to the REFRESH request does not contain any LIFETIME attribute.") }
+
+	v.mutex.Lock()
+	v.lifetime = time.Duration(seconds) * time.Second
+	v.lease.__renew(v.lifetime, time.Now())
+	v.mutex.Unlock()
+	if verbosity > 0 { tools.AddText(output, fmt.Sprintf("% -25s: %s", "Allocation refreshed", v.lifetime)) }
+	return nil
+}
+
+// This function finalizes a TURN request and sends it to the server.
+// The caller must hold the lock that serializes the transactions.
+//
+// INPUT
+// - in_ctx: the context.
+// - in_packet: the request, without FINGERPRINT.
+//
+// OUTPUT
+// - The response.
+// - The error flag. If the response is an error response, then the error flag is a pointer to an ErrorResponse.
+func (v *Allocation) __request(in_ctx context.Context, in_packet StunPacket) (requestResponse, error) {
+	packet, err := __turnFinalize(in_packet)
+	if (nil != err) { return requestResponse{}, err }
+	return v.client.__send(in_ctx, v.client.server_transport_address, packet)
+}
+
+// This function records an error.
+//
+// INPUT
+// - in_err: the error.
+func (v *Allocation) __setError(in_err error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.err = in_err
+}
+
+// This function returns the delay before the next refresh.
+// The allocation is refreshed one minute before it expires. Short lifetimes are refreshed at half-time.
+//
+// INPUT
+// - in_remaining: the time remaining before the expiration.
+//
+// OUTPUT
+// - The delay.
+func __refreshDelay(in_remaining time.Duration) time.Duration {
+	if (in_remaining > 2 * turn_refresh_margin) { return in_remaining - turn_refresh_margin }
+	return in_remaining / 2
+}
+
+// This function renews a lease.
+//
+// INPUT
+// - in_lifetime: the lifetime granted by the server.
+// - in_now: the current date.
+func (v *turnLease) __renew(in_lifetime time.Duration, in_now time.Time) {
+	v.expires = in_now.Add(in_lifetime)
+	v.refresh = in_now.Add(__refreshDelay(in_lifetime))
+}
+
+// This function postpones the refresh of a lease, after a failure.
+// The next refresh is attempted at half of the remaining time.
+//
+// INPUT
+// - in_now: the current date.
+//
+// OUTPUT
+// - true: the refresh has been postponed.
+// - false: the lease has expired.
+func (v *turnLease) __postpone(in_now time.Time) bool {
+	remaining := v.expires.Sub(in_now)
+	if (remaining <= 0) { return false }
+	v.refresh = in_now.Add(__refreshDelay(remaining))
+	return true
+}
+
+// This function converts a duration into a number of seconds, rounded up.
+//
+// INPUT
+// - in_duration: the duration.
+//
+// OUTPUT
+// - The number of seconds.
+func __seconds(in_duration time.Duration) uint32 {
+	return uint32((in_duration + time.Second - 1) / time.Second)
+}
+
+// This function creates a TURN request, without attributes.
+//
+// INPUT
+// - in_type: the request's type (for example: STUN_TYPE_ALLOCATE).
+//
+// OUTPUT
+// - The request.
+// - The error flag.
+func __turnRequest(in_type uint16) (StunPacket, error) {
+	packet := PacketCreate()
+	packet.SetType(in_type)
+	err := packet.SetRandomId()
+	return packet, err
+}
+
+// This function adds the attribute FINGERPRINT to a TURN request.
+//
+// INPUT
+// - in_packet: the request.
+//
+// OUTPUT
+// - The request.
+// - The error flag.
+func __turnFinalize(in_packet StunPacket) (StunPacket, error) {
+	attribute, err := AttributeCreateFingerprint(&in_packet)
+	if (nil != err) { return in_packet, err }
+	in_packet.AddAttribute(attribute)
+	return in_packet, nil
+}
@@ -0,0 +1,899 @@
+// Copyright (C) 2012 Denis BEURIVE
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stun
+
+import "fmt"
+import "net"
+import "bytes"
+import "errors"
+import "crypto/hmac"
+import "crypto/rand"
+import "encoding/hex"
+import "strconv"
+import "sync"
+import "time"
+import "tools"
+
+/* ------------------------------------------------------------------------------------------------ */
+/* TURN server (RFC 5766).                                                                          */
+/* The TURN server is a STUN server that also relays UDP packets between its clients and their      */
+/* peers. Each allocation has its own relay socket. The requests are authenticated with the         */
+/* long-term credential mechanism (RFC 5389).                                                       */
+/* ------------------------------------------------------------------------------------------------ */
+
+// The interval between two removals of the expired allocations, permissions and channels.
+const turn_server_sweep_interval = time.Second
+
+// The size of the key used to sign the nonces.
+const turn_server_secret_size = 20
+
+// The maximum number of ports tried for a relay socket. The mutex is held meanwhile: the whole range of ports
+// (16384 ports by default) must not be tried.
+const turn_server_port_attempts = 64
+
+// This map lists the comprehension-required attributes understood by the TURN server, in addition to the attributes
+// understood by the STUN server (see server_attributes).
+// RFC 5766: EVEN-PORT, RESERVATION-TOKEN and DONT-FRAGMENT are optional. The server rejects them (420).
+var turn_server_attributes = map[uint16] bool {
+	STUN_ATTRIBUT_CHANNEL_NUMBER:      true,
+	STUN_ATTRIBUT_LIFETIME:            true,
+	STUN_ATTRIBUT_XOR_PEER_ADDRESS:    true,
+	STUN_ATTRIBUT_DATA:                true,
+	STUN_ATTRIBUT_REQUESTED_TRANSPORT: true,
+}
+
+// This type represents the parameters of a TURN server.
+type TurnServerPolicy struct {
+	// The realm.
+	Realm string
+	// The users (user name => password).
+	Users map[string]string
+	// The lowest port of the relay sockets.
+	MinPort int
+	// The highest port of the relay sockets.
+	MaxPort int
+	// The IP address of the relay sockets ("" means "the IP address of the server's socket").
+	RelayIp string
+	// The lifetime of an allocation, if the client does not request a longer one.
+	DefaultLifetime time.Duration
+	// The maximum lifetime of an allocation.
+	MaxLifetime time.Duration
+	// The lifetime of a nonce. Once the nonce has expired, the client must use a new one (438).
+	NonceLifetime time.Duration
+	// The maximum number of allocations per user (0 means "no limit").
+	MaxAllocations int
+}
+
+// This type represents a TURN server.
+type TurnServer struct {
+	// The STUN server. It owns the server's socket, and it answers the BINDING requests.
+	server *Server
+	// The parameters.
+	policy TurnServerPolicy
+	// The IP address of the relay sockets.
+	relay_ip string
+	// The key used to sign the nonces.
+	secret []byte
+	// This channel is closed when the server is closed.
+	done chan struct{}
+	// This group is used to wait for the termination of the goroutines.
+	wg sync.WaitGroup
+	// This mutex protects the following fields.
+	mutex sync.Mutex
+	// The allocations (client's transport address => allocation).
+	allocations map[string]*turnServerAllocation
+	// The next port to try for a relay socket.
+	next_port int
+	// This flag indicates whether the server has been started or not.
+	started bool
+	// This flag indicates whether the server has been closed or not.
+	closed bool
+}
+
+// This type represents an allocation on the TURN server.
+type turnServerAllocation struct {
+	// The client's transport address.
+	client net.Addr
+	// The user that created the allocation.
+	username string
+	// The transaction ID of the ALLOCATE request (retransmissions get the same response).
+	transaction []byte
+	// The relay socket.
+	relay net.PacketConn
+	// The relayed transport address.
+	relayed string
+	// The date of expiration.
+	expires time.Time
+	// The permissions (peer's IP address => date of expiration).
+	permissions map[string]time.Time
+	// The channels (channel number => channel).
+	channels map[uint16]*turnServerChannel
+}
+
+// This type represents a channel bound on the TURN server.
+type turnServerChannel struct {
+	// The peer's transport address.
+	peer string
+	// The date of expiration.
+	expires time.Time
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* API                                                                                              */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function returns the default parameters for a TURN server. The users must be added.
+// RFC 5766: [...] the server SHOULD [...] allocate ports from the range 49152 - 65535 (the Dynamic and/or Private
+//           Port range). [...] The default value of the allocation lifetime is 10 minutes. [...] the server can
+//           enforce a maximum lifetime [...] 3600 seconds (1 hour) is recommended.
+//
+// OUTPUT
+// - The parameters.
+func TurnServerPolicyDefault() TurnServerPolicy {
+	return TurnServerPolicy{ Realm: "gostun", Users: make(map[string]string), MinPort: 49152, MaxPort: 65535, RelayIp: "", DefaultLifetime: turn_default_lifetime, MaxLifetime: time.Hour, NonceLifetime: time.Hour, MaxAllocations: 0 }
+}
+
+// This function checks that the parameters are valid.
+//
+// OUTPUT
+// - The error flag.
+func (v TurnServerPolicy) Check() error {
+	if ("" == v.Realm) { return errors.New("Invalid TURN server policy: the realm is empty.") }
+	if (0 == len(v.Users)) { return errors.New("Invalid TURN server policy: no user is defined.") }
+	if (v.MinPort < 1) || (v.MaxPort > 65535) || (v.MinPort > v.MaxPort) { return errors.New(fmt.Sprintf("Invalid TURN server policy: invalid range of ports (%d-%d).", v.MinPort, v.MaxPort)) }
+	if ("" != v.RelayIp) && (nil == net.ParseIP(v.RelayIp)) { return errors.New(fmt.Sprintf("Invalid TURN server policy: invalid relay IP address \"%s\".", v.RelayIp)) }
+	if (v.DefaultLifetime < time.Second) { return errors.New(fmt.Sprintf("Invalid TURN server policy: the default lifetime is too short (%s).", v.DefaultLifetime)) }
+	if (v.MaxLifetime < v.DefaultLifetime) { return errors.New(fmt.Sprintf("Invalid TURN server policy: the maximum lifetime (%s) is shorter than the default lifetime (%s).", v.MaxLifetime, v.DefaultLifetime)) }
+	if (v.NonceLifetime <= 0) { return errors.New(fmt.Sprintf("Invalid TURN server policy: the lifetime of the nonces must be positive (%s).", v.NonceLifetime)) }
+	if (v.MaxAllocations < 0) { return errors.New(fmt.Sprintf("Invalid TURN server policy: invalid number of allocations (%d).", v.MaxAllocations)) }
+	return nil
+}
+
+// This function creates a TURN server. The server does not answer until it is started (see Start()).
+//
+// INPUT
+// - in_address: the local transport address the server listens on.
+//   This value should be written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6). The port 0 means "any port".
+// - in_policy: the parameters of the server.
+//
+// OUTPUT
+// - The server.
+// - The error flag.
+//
+// WARNING
+// TURN servers are RFC 5389 servers. STUN should be configured to be compliant with RFC 5389 (see SetRfc5389()).
+func TurnServerCreate(in_address string, in_policy TurnServerPolicy) (*TurnServer, error) {
+	err := in_policy.Check()
+	if (nil != err) { return nil, err }
+
+	turn := TurnServer{ policy: in_policy, relay_ip: in_policy.RelayIp, done: make(chan struct{}), allocations: make(map[string]*turnServerAllocation), next_port: in_policy.MinPort }
+	turn.secret = make([]byte, turn_server_secret_size)
+	_, err = rand.Read(turn.secret)
+	if (nil != err) { return nil, err }
+
+	turn.server, err = ServerCreate([]string{ in_address })
+	if (nil != err) { return nil, err }
+	if ("" == turn.relay_ip) {
+		ip, _, err := tools.InetSplit(turn.server.Addresses()[0])
+		if (nil != err) {
+			turn.server.Close()
+			return nil, err
+		}
+		if (net.ParseIP(ip).IsUnspecified()) {
+			turn.server.Close()
+			return nil, errors.New("The relay IP address must be given when the server listens on all interfaces.")
+		}
+		turn.relay_ip = ip
+	}
+	return &turn, nil
+}
+
+// This function sets the value of the attribute SOFTWARE sent by the server.
+// It must be called before the server is started.
+//
+// INPUT
+// - in_name: the value of the attribute SOFTWARE ("" means "no attribute SOFTWARE").
+func (v *TurnServer) SetSoftware(in_name string) {
+	v.server.SetSoftware(in_name)
+}
+
+// This function returns the local transport address of the server's socket.
+//
+// OUTPUT
+// - The local transport address.
+//   This value is written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+func (v *TurnServer) Address() string {
+	return v.server.Addresses()[0]
+}
+
+// This function returns the relayed transport addresses of the current allocations.
+//
+// OUTPUT
+// - The relayed transport addresses.
+//   These values are written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+func (v *TurnServer) Allocations() []string {
+	var res []string
+	now := time.Now()
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for _, allocation := range v.allocations {
+		if (now.Before(allocation.expires)) { res = append(res, allocation.relayed) }
+	}
+	return res
+}
+
+// This function starts the server. The requests are processed in the background, until the server is closed.
+//
+// OUTPUT
+// - The error flag.
+func (v *TurnServer) Start() error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if (v.closed) { return errors.New("The server has been closed.") }
+	if (v.started) { return errors.New("The server has already been started.") }
+	v.started = true
+	v.wg.Add(2)
+	go v.__serve()
+	go v.__sweep()
+	return nil
+}
+
+// This function closes the server's socket and the relay sockets. It returns once all the goroutines are done.
+//
+// OUTPUT
+// - The error flag.
+func (v *TurnServer) Close() error {
+	v.mutex.Lock()
+	if (v.closed) {
+		v.mutex.Unlock()
+		return nil
+	}
+	v.closed = true
+	close(v.done)
+	for key, allocation := range v.allocations {
+		allocation.relay.Close()
+		delete(v.allocations, key)
+	}
+	v.mutex.Unlock()
+
+	err := v.server.Close()
+	v.wg.Wait()
+	return err
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Privates                                                                                         */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function processes the messages received on the server's socket, until the socket is closed.
+func (v *TurnServer) __serve() {
+	defer v.wg.Done()
+	connection := v.server.connections[0]
+	b := make([]byte, 65536)
+	for {
+		count, from, err := connection.ReadFrom(b)
+		if (nil != err) { return }
+
+		switch (Demultiplex(b[0:count])) {
+			case STUN_MESSAGE_CHANNEL_DATA:
+				v.__channelData(b[0:count], from)
+			case STUN_MESSAGE_STUN:
+				response, ok := v.__handle(b[0:count], from)
+				if (! ok) { continue }
+				if verbosity > 0 {
+					tools.AddText(output, fmt.Sprintf("Sending RESPONSE to \"%s\"\n\n%s\n", response.destination, Bytes2String(response.packet.ToBytes(), 4)))
+					tools.AddText(output, fmt.Sprintf("%s\n", response.packet.String(4)))
+				}
+				connection.WriteTo(response.packet.ToBytes(), response.destination)
+		}
+	}
+}
+
+// This function processes a STUN message.
+//
+// INPUT
+// - in_bytes: the message, as received from the network.
+// - in_from: the transport address of the message's source.
+//
+// OUTPUT
+// - The response.
+// - This flag indicates whether a response must be sent or not.
+func (v *TurnServer) __handle(in_bytes []byte, in_from net.Addr) (serverResponse, bool) {
+	var unknown []uint16
+	var ok bool
+	reply := serverResponse{ sender: 0, destination: in_from }
+
+	request, err := FromBytes(in_bytes)
+	// The STUN server knows how to answer invalid requests and BINDING requests.
+	if (nil != err) || (STUN_METHOD_BINDING == request.GetMethod()) { return v.server.__handle(0, in_bytes, in_from) }
+	if (STUN_TYPE_SEND_INDICATION == request.GetType()) {
+		v.__sendIndication(request, in_from)
+		return reply, false
+	}
+	if (STUN_CLASS_REQUEST != request.GetClass()) { return reply, false }
+	switch (request.GetMethod()) {
+		case STUN_METHOD_ALLOCATE, STUN_METHOD_REFRESH, STUN_METHOD_CREATE_PERMISSION, STUN_METHOD_CHANNEL_BIND:
+		default:
+			reply.packet, ok = v.server.__error(request, STUN_ERROR_BAD_REQUEST, fmt.Sprintf("Unsupported method 0x%03x", request.GetMethod()), nil)
+			return reply, ok
+	}
+
+	// Look for unknown comprehension-required attributes.
+	for i := 0; i < request.GetAttributesCount(); i++ {
+		t := request.GetAttribute(i).Type
+		if (t < 0x8000) && (! server_attributes[t]) && (! turn_server_attributes[t]) { unknown = append(unknown, t) }
+	}
+	if (len(unknown) > 0) {
+		reply.packet, ok = v.server.__error(request, STUN_ERROR_UNKNOWN_ATTRIBUTE, "", unknown)
+		return reply, ok
+	}
+
+	username, key, code := v.__authenticate(request)
+	if (0 != code) {
+		reply.packet, ok = v.__error(request, code, "", nil)
+		return reply, ok
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if (v.closed) { return reply, false }
+	allocation := v.__allocation(in_from)
+	if (nil != allocation) && (username != allocation.username) && (STUN_METHOD_ALLOCATE != request.GetMethod()) {
+		// RFC 5766: [...] the server MUST check that the USERNAME [...] is the same as the one used to create the
+		//           allocation. If not, the server MUST reject the request with a 441 (Wrong Credentials) error.
+		reply.packet, ok = v.__error(request, STUN_ERROR_WRONG_CREDENTIALS, "", key)
+		return reply, ok
+	}
+
+	switch (request.GetMethod()) {
+		case STUN_METHOD_ALLOCATE:
+			reply.packet, ok = v.__allocate(request, in_from, allocation, username, key)
+		case STUN_METHOD_REFRESH:
+			reply.packet, ok = v.__refresh(request, allocation, key)
+		case STUN_METHOD_CREATE_PERMISSION:
+			reply.packet, ok = v.__createPermission(request, allocation, key)
+		default:
+			reply.packet, ok = v.__channelBind(request, allocation, key)
+	}
+	return reply, ok
+}
+
+// This function checks the long-term credentials of a request.
+// RFC 5389: If the message does not contain a MESSAGE-INTEGRITY attribute, the server MUST generate an error response
+//           with an error code of 401 (Unauthorized). [...] If the message contains a MESSAGE-INTEGRITY attribute, but
+//           is missing the USERNAME, REALM, or NONCE attribute, the server MUST generate an error response with an
+//           error code of 400 (Bad Request). [...] If the NONCE is no longer valid, the server MUST generate an error
+//           response with an error code of 438 (Stale Nonce). [...] If the username [...] is not valid, [...] 401.
+//           [...] If the resulting value does not match the contents of the MESSAGE-INTEGRITY attribute, the server
+//           MUST reject the request with an error response. This response MUST use an error code of 401.
+//
+// INPUT
+// - in_request: the request.
+//
+// OUTPUT
+// - The user name.
+// - The key used to calculate MESSAGE-INTEGRITY.
+// - The error code (0 if the request is authenticated).
+func (v *TurnServer) __authenticate(in_request StunPacket) (string, []byte, uint16) {
+	if _, found := __hasMessageIntegrity(in_request); ! found { return "", nil, STUN_ERROR_UNAUTHORIZED }
+	found_username, username := in_request.GetUsername()
+	found_realm, realm := in_request.GetRealm()
+	found_nonce, nonce := in_request.GetNonce()
+	if (! found_username) || (! found_realm) || (! found_nonce) { return "", nil, STUN_ERROR_BAD_REQUEST }
+	// A wrong realm is not a stale nonce: the error response gives the right realm (see __error()).
+	if (realm != v.policy.Realm) { return "", nil, STUN_ERROR_UNAUTHORIZED }
+	if (! v.__checkNonce(nonce)) { return "", nil, STUN_ERROR_STALE_NONCE }
+	password, ok := v.policy.Users[username]
+	if (! ok) { return "", nil, STUN_ERROR_UNAUTHORIZED }
+	key := LongTermKey(username, realm, password)
+	ok, err := in_request.CheckMessageIntegrity(key)
+	if (nil != err) || (! ok) { return "", nil, STUN_ERROR_UNAUTHORIZED }
+	return username, key, 0
+}
+
+// This function processes an ALLOCATE request.
+// The caller must hold the mutex.
+// RFC 5766: If the 5-tuple is currently in use by an existing allocation, the server rejects the request with a 437
+//           (Allocation Mismatch) error [...] unless the request is a retransmission.
+//
+// INPUT
+// - in_request: the request.
+// - in_from: the client's transport address.
+// - in_allocation: the client's current allocation (nil if none).
+// - in_username: the user name.
+// - in_key: the key used to calculate MESSAGE-INTEGRITY.
+//
+// OUTPUT
+// - The response.
+// - This flag indicates whether a response must be sent or not.
+func (v *TurnServer) __allocate(in_request StunPacket, in_from net.Addr, in_allocation *turnServerAllocation, in_username string, in_key []byte) (StunPacket, bool) {
+	if (nil != in_allocation) {
+		if (! bytes.Equal(in_allocation.transaction, in_request.GetId())) { return v.__error(in_request, STUN_ERROR_ALLOCATION_MISMATCH, "", in_key) }
+		return v.__allocateResponse(in_request, in_from, in_allocation, in_key)
+	}
+
+	found, protocol, err := in_request.GetRequestedTransport()
+	if (nil != err) || (! found) { return v.__error(in_request, STUN_ERROR_BAD_REQUEST, "REQUESTED-TRANSPORT is missing or invalid", in_key) }
+	if (STUN_TRANSPORT_UDP != protocol) { return v.__error(in_request, STUN_ERROR_UNSUPPORTED_TRANSPORT_PROTOCOL, "", in_key) }
+	if (v.policy.MaxAllocations > 0) && (v.__count(in_username) >= v.policy.MaxAllocations) { return v.__error(in_request, STUN_ERROR_ALLOCATION_QUOTA_REACHED, "", in_key) }
+	lifetime, err := v.__lifetime(in_request)
+	if (nil != err) { return v.__error(in_request, STUN_ERROR_BAD_REQUEST, err.Error(), in_key) }
+	if (lifetime < v.policy.DefaultLifetime) { lifetime = v.policy.DefaultLifetime }
+
+	relay, err := v.__relaySocket()
+	if (nil != err) { return v.__error(in_request, STUN_ERROR_INSUFFICIENT_CAPACITY, "", in_key) }
+	allocation := &turnServerAllocation{ client: in_from, username: in_username, transaction: in_request.GetId(), relay: relay, relayed: relay.LocalAddr().String(), expires: time.Now().Add(lifetime), permissions: make(map[string]time.Time), channels: make(map[uint16]*turnServerChannel) }
+	v.allocations[in_from.String()] = allocation
+	v.wg.Add(1)
+	go v.__relay(allocation)
+	if verbosity > 0 { tools.AddText(output, fmt.Sprintf("% -25s: %s => %s (%s)", "Allocation created", in_from, allocation.relayed, lifetime)) }
+	return v.__allocateResponse(in_request, in_from, allocation, in_key)
+}
+
+// This function builds the success response to an ALLOCATE request.
+//
+// INPUT
+// - in_request: the request.
+// - in_from: the client's transport address.
+// - in_allocation: the allocation.
+// - in_key: the key used to calculate MESSAGE-INTEGRITY.
+//
+// OUTPUT
+// - The response.
+// - This flag indicates whether a response must be sent or not.
+func (v *TurnServer) __allocateResponse(in_request StunPacket, in_from net.Addr, in_allocation *turnServerAllocation, in_key []byte) (StunPacket, bool) {
+	var attributes []StunAttribute
+
+	response := __responseCreate(in_request, STUN_TYPE_ALLOCATE_RESPONSE)
+	ip, port, err := tools.InetSplit(in_allocation.relayed)
+	if (nil != err) { return response, false }
+	attribute, err := AttributeCreateXorRelayedAddress(&response, ip, uint16(port))
+	if (nil != err) { return response, false }
+	attributes = append(attributes, attribute)
+	attribute, err = AttributeCreateLifetime(&response, __seconds(time.Until(in_allocation.expires)))
+	if (nil != err) { return response, false }
+	attributes = append(attributes, attribute)
+	ip, port, err = tools.InetSplit(in_from.String())
+	if (nil != err) { return response, false }
+	attribute, err = AttributeCreateXorMappedAddress(&response, ip, uint16(port))
+	if (nil != err) { return response, false }
+	attributes = append(attributes, attribute)
+	return v.server.__finalizeSigned(response, attributes, in_key)
+}
+
+// This function processes a REFRESH request.
+// The caller must hold the mutex.
+// RFC 5766: If the requested lifetime is zero, then the server MUST immediately delete the allocation. [...] Otherwise,
+//           the server computes a lifetime [...] the minimum of the client's requested lifetime and the server's
+//           maximum allowed lifetime.
+//
+// INPUT
+// - in_request: the request.
+// - in_allocation: the client's allocation (nil if none).
+// - in_key: the key used to calculate MESSAGE-INTEGRITY.
+//
+// OUTPUT
+// - The response.
+// - This flag indicates whether a response must be sent or not.
+func (v *TurnServer) __refresh(in_request StunPacket, in_allocation *turnServerAllocation, in_key []byte) (StunPacket, bool) {
+	if (nil == in_allocation) { return v.__error(in_request, STUN_ERROR_ALLOCATION_MISMATCH, "", in_key) }
+	lifetime, err := v.__lifetime(in_request)
+	if (nil != err) { return v.__error(in_request, STUN_ERROR_BAD_REQUEST, err.Error(), in_key) }
+
+	if (0 == lifetime) {
+		v.__delete(in_allocation)
+		if verbosity > 0 { tools.AddText(output, fmt.Sprintf("% -25s: %s", "Allocation deleted", in_allocation.relayed)) }
+	} else {
+		in_allocation.expires = time.Now().Add(lifetime)
+	}
+
+	response := __responseCreate(in_request, STUN_TYPE_REFRESH_RESPONSE)
+	attribute, err := AttributeCreateLifetime(&response, __seconds(lifetime))
+	if (nil != err) { return response, false }
+	return v.server.__finalizeSigned(response, []StunAttribute{ attribute }, in_key)
+}
+
+// This function processes a CREATE-PERMISSION request.
+// The caller must hold the mutex.
+// RFC 5766: The CreatePermission request MUST contain at least one XOR-PEER-ADDRESS attribute [...]. If the request is
+//           valid, then the server installs or refreshes a permission for the IP address contained in each
+//           XOR-PEER-ADDRESS attribute.
+//
+// INPUT
+// - in_request: the request.
+// - in_allocation: the client's allocation (nil if none).
+// - in_key: the key used to calculate MESSAGE-INTEGRITY.
+//
+// OUTPUT
+// - The response.
+// - This flag indicates whether a response must be sent or not.
+func (v *TurnServer) __createPermission(in_request StunPacket, in_allocation *turnServerAllocation, in_key []byte) (StunPacket, bool) {
+	var ips []string
+
+	if (nil == in_allocation) { return v.__error(in_request, STUN_ERROR_ALLOCATION_MISMATCH, "", in_key) }
+	for i := 0; i < in_request.GetAttributesCount(); i++ {
+		a := in_request.GetAttribute(i)
+		if (STUN_ATTRIBUT_XOR_PEER_ADDRESS != a.Type) { continue }
+		_, ip, _, err := a.AttributeGetXorPeerAddress()
+		if (nil != err) { return v.__error(in_request, STUN_ERROR_BAD_REQUEST, err.Error(), in_key) }
+		if (! v.__sameFamily(ip)) { return v.__error(in_request, STUN_ERROR_PEER_ADDRESS_FAMILY_MISMATCH, "", in_key) }
+		ips = append(ips, ip)
+	}
+	if (0 == len(ips)) { return v.__error(in_request, STUN_ERROR_BAD_REQUEST, "XOR-PEER-ADDRESS is missing", in_key) }
+
+	// The permissions are installed only if the request is valid.
+	expires := time.Now().Add(turn_permission_lifetime)
+	for i := 0; i < len(ips); i++ { in_allocation.permissions[ips[i]] = expires }
+	if verbosity > 0 { tools.AddText(output, fmt.Sprintf("% -25s: %s %v", "Permissions installed", in_allocation.relayed, ips)) }
+	return v.server.__finalizeSigned(__responseCreate(in_request, STUN_TYPE_CREATE_PERMISIION_RESPONSE), nil, in_key)
+}
+
+// This function processes a CHANNEL-BIND request.
+// The caller must hold the mutex.
+// RFC 5766: The server checks the following: The request contains both a CHANNEL-NUMBER and an XOR-PEER-ADDRESS
+//           attribute; The channel number is in the range 0x4000 through 0x7FFE (inclusive); The channel number is not
+//           currently bound to a different transport address (same transport address is OK); The transport address
+//           is not currently bound to a different channel number. If any of these tests fail, the server replies
+//           with a 400 (Bad Request) error.
+//
+// INPUT
+// - in_request: the request.
+// - in_allocation: the client's allocation (nil if none).
+// - in_key: the key used to calculate MESSAGE-INTEGRITY.
+//
+// OUTPUT
+// - The response.
+// - This flag indicates whether a response must be sent or not.
+func (v *TurnServer) __channelBind(in_request StunPacket, in_allocation *turnServerAllocation, in_key []byte) (StunPacket, bool) {
+	if (nil == in_allocation) { return v.__error(in_request, STUN_ERROR_ALLOCATION_MISMATCH, "", in_key) }
+	found_number, number, err := in_request.GetChannelNumber()
+	if (nil != err) || (! found_number) { return v.__error(in_request, STUN_ERROR_BAD_REQUEST, "CHANNEL-NUMBER is missing or invalid", in_key) }
+	found_peer, _, ip, port, err := in_request.GetXorPeerAddress()
+	if (nil != err) || (! found_peer) { return v.__error(in_request, STUN_ERROR_BAD_REQUEST, "XOR-PEER-ADDRESS is missing or invalid", in_key) }
+	if (number < STUN_CHANNEL_MIN) || (number > STUN_CHANNEL_MAX) { return v.__error(in_request, STUN_ERROR_BAD_REQUEST, fmt.Sprintf("Invalid channel number 0x%04X", number), in_key) }
+	if (! v.__sameFamily(ip)) { return v.__error(in_request, STUN_ERROR_PEER_ADDRESS_FAMILY_MISMATCH, "", in_key) }
+	peer, err := tools.MakeTransportAddress(ip, int(port))
+	if (nil != err) { return v.__error(in_request, STUN_ERROR_BAD_REQUEST, err.Error(), in_key) }
+
+	for n, channel := range in_allocation.channels {
+		if (n == number) && (channel.peer != peer) { return v.__error(in_request, STUN_ERROR_BAD_REQUEST, fmt.Sprintf("The channel 0x%04X is bound to another peer", number), in_key) }
+		if (n != number) && (channel.peer == peer) { return v.__error(in_request, STUN_ERROR_BAD_REQUEST, fmt.Sprintf("The peer is bound to the channel 0x%04X", n), in_key) }
+	}
+
+	// RFC 5766: [...] the server [...] installs or refreshes a permission for the IP address.
+	now := time.Now()
+	in_allocation.channels[number] = &turnServerChannel{ peer: peer, expires: now.Add(turn_channel_lifetime) }
+	in_allocation.permissions[ip] = now.Add(turn_permission_lifetime)
+	if verbosity > 0 { tools.AddText(output, fmt.Sprintf("% -25s: %s 0x%04X => %s", "Channel bound", in_allocation.relayed, number, peer)) }
+	return v.server.__finalizeSigned(__responseCreate(in_request, STUN_TYPE_CHANNEL_BINDING_RESPONSE), nil, in_key)
+}
+
+// This function processes a SEND indication: the data is sent to the peer, from the relay socket.
+// RFC 5766: If [...] there is no permission installed for the peer's IP address, then the indication is silently
+//           discarded.
+//
+// INPUT
+// - in_indication: the indication.
+// - in_from: the client's transport address.
+func (v *TurnServer) __sendIndication(in_indication StunPacket, in_from net.Addr) {
+	found, _, ip, port, err := in_indication.GetXorPeerAddress()
+	if (nil != err) || (! found) { return }
+	found, data := in_indication.GetData()
+	if (! found) { return }
+	peer, err := tools.MakeTransportAddress(ip, int(port))
+	if (nil != err) { return }
+	v.__forward(in_from, peer, data)
+}
+
+// This function processes a ChannelData message: the data is sent to the peer bound to the channel.
+//
+// INPUT
+// - in_bytes: the message, as received from the network.
+// - in_from: the client's transport address.
+func (v *TurnServer) __channelData(in_bytes []byte, in_from net.Addr) {
+	message, err := ChannelDataFromBytes(in_bytes)
+	if (nil != err) { return }
+
+	v.mutex.Lock()
+	allocation := v.__allocation(in_from)
+	var peer string
+	if (nil != allocation) {
+		if channel, ok := allocation.channels[message.Number]; ok && time.Now().Before(channel.expires) { peer = channel.peer }
+	}
+	v.mutex.Unlock()
+	if ("" == peer) { return }
+	v.__forward(in_from, peer, message.Data)
+}
+
+// This function sends data from the client's relay socket to a peer, if the client has a permission for the peer.
+//
+// INPUT
+// - in_from: the client's transport address.
+// - in_peer: the peer's transport address.
+// - in_data: the data.
+func (v *TurnServer) __forward(in_from net.Addr, in_peer string, in_data []byte) {
+	ip, _, err := tools.InetSplit(in_peer)
+	if (nil != err) { return }
+	destination, err := net.ResolveUDPAddr("udp", in_peer)
+	if (nil != err) { return }
+
+	v.mutex.Lock()
+	allocation := v.__allocation(in_from)
+	allowed := (nil != allocation) && (allocation.__permitted(ip))
+	v.mutex.Unlock()
+	if (! allowed) {
+		if verbosity > 0 { tools.AddText(output, fmt.Sprintf("No permission for %s. Drop the packet from %s.", in_peer, in_from)) }
+		return
+	}
+	allocation.relay.WriteTo(in_data, destination)
+}
+
+// This function reads the packets sent by the peers to an allocation's relay socket, and sends them to the client
+// (within a ChannelData message if a channel is bound to the peer, within a DATA indication otherwise).
+// RFC 5766: [...] the server [...] checks that a permission exists for the peer's IP address. If no permission exists,
+//           the UDP datagram is silently discarded.
+//
+// INPUT
+// - in_allocation: the allocation.
+func (v *TurnServer) __relay(in_allocation *turnServerAllocation) {
+	defer v.wg.Done()
+	b := make([]byte, 65536)
+	for {
+		count, from, err := in_allocation.relay.ReadFrom(b)
+		if (nil != err) { return }
+		ip, port, err := tools.InetSplit(from.String())
+		if (nil != err) { continue }
+		peer, err := tools.MakeTransportAddress(ip, port)
+		if (nil != err) { continue }
+
+		var number uint16 = 0
+		v.mutex.Lock()
+		allowed := in_allocation.__permitted(ip)
+		now := time.Now()
+		for n, channel := range in_allocation.channels {
+			if (channel.peer == peer) && (now.Before(channel.expires)) { number = n }
+		}
+		v.mutex.Unlock()
+		if (! allowed) { continue }
+
+		var message []byte
+		if (0 != number) {
+			data, err := ChannelDataCreate(number, b[0:count])
+			if (nil != err) { continue }
+			message = data.ToBytes(false)
+		} else {
+			indication, err := __turnRequest(STUN_TYPE_DATA_INDICATION)
+			if (nil != err) { continue }
+			attribute, err := AttributeCreateXorPeerAddress(&indication, ip, uint16(port))
+			if (nil != err) { continue }
+			indication.AddAttribute(attribute)
+			attribute, err = AttributeCreateData(&indication, b[0:count])
+			if (nil != err) { continue }
+			indication.AddAttribute(attribute)
+			indication, err = __turnFinalize(indication)
+			if (nil != err) { continue }
+			message = indication.ToBytes()
+		}
+		v.server.connections[0].WriteTo(message, in_allocation.client)
+	}
+}
+
+// This function removes the expired allocations, permissions and channels, until the server is closed.
+func (v *TurnServer) __sweep() {
+	defer v.wg.Done()
+	ticker := time.NewTicker(turn_server_sweep_interval)
+	defer ticker.Stop()
+	for {
+		select {
+			case <-v.done:
+				return
+			case <-ticker.C:
+		}
+
+		now := time.Now()
+		v.mutex.Lock()
+		for _, allocation := range v.allocations {
+			if (! now.Before(allocation.expires)) {
+				v.__delete(allocation)
+				if verbosity > 0 { tools.AddText(output, fmt.Sprintf("% -25s: %s", "Allocation expired", allocation.relayed)) }
+				continue
+			}
+			for ip, expires := range allocation.permissions {
+				if (! now.Before(expires)) { delete(allocation.permissions, ip) }
+			}
+			for number, channel := range allocation.channels {
+				if (! now.Before(channel.expires)) { delete(allocation.channels, number) }
+			}
+		}
+		v.mutex.Unlock()
+	}
+}
+
+// This function returns the allocation of a client. Expired allocations are ignored.
+// The caller must hold the mutex.
+//
+// INPUT
+// - in_client: the client's transport address.
+//
+// OUTPUT
+// - The allocation (nil if none).
+func (v *TurnServer) __allocation(in_client net.Addr) *turnServerAllocation {
+	allocation, ok := v.allocations[in_client.String()]
+	if (! ok) { return nil }
+	if (! time.Now().Before(allocation.expires)) {
+		v.__delete(allocation)
+		return nil
+	}
+	return allocation
+}
+
+// This function deletes an allocation and closes its relay socket.
+// The caller must hold the mutex.
+//
+// INPUT
+// - in_allocation: the allocation.
+func (v *TurnServer) __delete(in_allocation *turnServerAllocation) {
+	delete(v.allocations, in_allocation.client.String())
+	in_allocation.relay.Close()
+}
+
+// This function counts the allocations of a user.
+// The caller must hold the mutex.
+//
+// INPUT
+// - in_username: the user name.
+//
+// OUTPUT
+// - The number of allocations.
+func (v *TurnServer) __count(in_username string) int {
+	count := 0
+	now := time.Now()
+	for _, allocation := range v.allocations {
+		if (in_username == allocation.username) && (now.Before(allocation.expires)) { count++ }
+	}
+	return count
+}
+
+// This function opens a relay socket, on the first port available within the range of ports.
+// The ports are used in turn, so that a port is not reused right after it has been released. At most
+// turn_server_port_attempts ports are tried.
+// The caller must hold the mutex.
+//
+// OUTPUT
+// - The relay socket.
+// - The error flag.
+func (v *TurnServer) __relaySocket() (net.PacketConn, error) {
+	attempts := v.policy.MaxPort - v.policy.MinPort + 1
+	if (attempts > turn_server_port_attempts) { attempts = turn_server_port_attempts }
+	for attempt := 0; attempt < attempts; attempt++ {
+		port := v.next_port
+		v.next_port++
+		if (v.next_port > v.policy.MaxPort) { v.next_port = v.policy.MinPort }
+		address, err := tools.MakeTransportAddress(v.relay_ip, port)
+		if (nil != err) { return nil, err }
+		relay, err := net.ListenPacket("udp", address)
+		if (nil == err) { return relay, nil }
+	}
+	return nil, errors.New(fmt.Sprintf("No port available between %d and %d (%d ports tried).", v.policy.MinPort, v.policy.MaxPort, attempts))
+}
+
+// This function returns the lifetime requested by a request (ALLOCATE or REFRESH).
+//
+// INPUT
+// - in_request: the request.
+//
+// OUTPUT
+// - The lifetime: the default lifetime if the request does not contain any LIFETIME attribute, the requested lifetime
+//   otherwise, limited to the maximum lifetime.
+// - The error flag.
+func (v *TurnServer) __lifetime(in_request StunPacket) (time.Duration, error) {
+	found, seconds, err := in_request.GetLifetime()
+	if (nil != err) { return 0, err }
+	if (! found) { return v.policy.DefaultLifetime, nil }
+	lifetime := time.Duration(seconds) * time.Second
+	if (lifetime > v.policy.MaxLifetime) { lifetime = v.policy.MaxLifetime }
+	return lifetime, nil
+}
+
+// This function tells whether an IP address has the same family as the relay sockets.
+//
+// INPUT
+// - in_ip: the IP address.
+//
+// OUTPUT
+// - true: same family.
+// - false: different families.
+func (v *TurnServer) __sameFamily(in_ip string) bool {
+	ip := net.ParseIP(in_ip)
+	if (nil == ip) { return false }
+	return (nil == ip.To4()) == (nil == net.ParseIP(v.relay_ip).To4())
+}
+
+// This function builds an error response. The responses 401 and 438 contain a REALM and a NONCE.
+// RFC 5389: [...] the server SHOULD include MESSAGE-INTEGRITY [...] in the error responses to authenticated requests.
+//
+// INPUT
+// - in_request: the request.
+// - in_code: the error code (constant STUN_ERROR_...).
+// - in_reason: the reason phrase ("" means "use the error's name").
+// - in_key: the key used to calculate MESSAGE-INTEGRITY (nil if the request is not authenticated).
+//
+// OUTPUT
+// - The error response.
+// - This flag indicates whether a response must be sent or not.
+func (v *TurnServer) __error(in_request StunPacket, in_code uint16, in_reason string, in_key []byte) (StunPacket, bool) {
+	var attributes []StunAttribute
+
+	t, err := TypeCreate(in_request.GetMethod(), STUN_CLASS_ERROR_RESPONSE)
+	if (nil != err) { return in_request, false }
+	response := __responseCreate(in_request, t)
+	attribute, err := AttributeCreateErrorCode(&response, in_code, in_reason)
+	if (nil != err) { return response, false }
+	attributes = append(attributes, attribute)
+	if (STUN_ERROR_UNAUTHORIZED == in_code) || (STUN_ERROR_STALE_NONCE == in_code) {
+		attribute, err = AttributeCreateRealm(&response, v.policy.Realm)
+		if (nil != err) { return response, false }
+		attributes = append(attributes, attribute)
+		// The nonce of the request is kept while it is valid, so that the client does not retry with wrong credentials.
+		found, nonce := in_request.GetNonce()
+		if (! found) || (STUN_ERROR_STALE_NONCE == in_code) || (! v.__checkNonce(nonce)) { nonce = v.__nonce() }
+		attribute, err = AttributeCreateNonce(&response, nonce)
+		if (nil != err) { return response, false }
+		attributes = append(attributes, attribute)
+	}
+	return v.server.__finalizeSigned(response, attributes, in_key)
+}
+
+// This function creates a nonce. The nonce contains its date of expiration, signed with the server's secret, so that
+// the server does not need to remember the nonces.
+//
+// OUTPUT
+// - The nonce.
+func (v *TurnServer) __nonce() string {
+	expires := fmt.Sprintf("%016x", time.Now().Add(v.policy.NonceLifetime).Unix())
+	return expires + hex.EncodeToString(__hmac([]byte(expires), v.secret))
+}
+
+// This function checks a nonce (see __nonce()).
+//
+// INPUT
+// - in_nonce: the nonce.
+//
+// OUTPUT
+// - true: the nonce is valid.
+// - false: the nonce is not valid, or it has expired.
+func (v *TurnServer) __checkNonce(in_nonce string) bool {
+	if (len(in_nonce) <= 16) { return false }
+	signature, err := hex.DecodeString(in_nonce[16:])
+	if (nil != err) || (! hmac.Equal(__hmac([]byte(in_nonce[0:16]), v.secret), signature)) { return false }
+	expires, err := strconv.ParseInt(in_nonce[0:16], 16, 64)
+	if (nil != err) { return false }
+	return time.Now().Unix() < expires
+}
+
+// This function tells whether the allocation has a valid permission for a peer's IP address.
+// The caller must hold the server's mutex.
+//
+// INPUT
+// - in_ip: the peer's IP address.
+//
+// OUTPUT
+// - true: the permission exists.
+// - false: the permission does not exist, or it has expired.
+func (v *turnServerAllocation) __permitted(in_ip string) bool {
+	expires, ok := v.permissions[in_ip]
+	return ok && time.Now().Before(expires)
+}
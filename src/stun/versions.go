@@ -19,7 +19,8 @@ package stun
 const STUN_RFC_3489 = 0
 
 // RFC 5389
-const STUN_RFC_5389 = 0
+// Note: this value must differ from STUN_RFC_3489. Otherwise, SetRfc5389() would have no effect.
+const STUN_RFC_5389 = 1
 
 // The chosen RFC used for compliance.
 var rfc int = STUN_RFC_3489
@@ -30,3 +31,23 @@ func  SetRfc3489() { rfc = STUN_RFC_3489 }
 // Set RFC to 5389
 func  SetRfc5389() { rfc = STUN_RFC_5389 }
 
+// FINGERPRINT verification: verify only if STUN is configured to be compliant with RFC 5389.
+const STUN_FINGERPRINT_CHECK_AUTO = 0
+
+// FINGERPRINT verification: always verify.
+const STUN_FINGERPRINT_CHECK_ON = 1
+
+// FINGERPRINT verification: never verify.
+const STUN_FINGERPRINT_CHECK_OFF = 2
+
+// The chosen mode for FINGERPRINT verification, while decoding packets (see FromBytes()).
+var fingerprint_check int = STUN_FINGERPRINT_CHECK_AUTO
+
+// Set the mode for FINGERPRINT verification (constant STUN_FINGERPRINT_CHECK_...).
+func  SetFingerprintCheck(in_mode int) { fingerprint_check = in_mode }
+
+// This function tells whether FINGERPRINT must be verified or not.
+func  __fingerprintCheck() bool {
+	if (STUN_FINGERPRINT_CHECK_AUTO == fingerprint_check) { return STUN_RFC_5389 == rfc }
+	return STUN_FINGERPRINT_CHECK_ON == fingerprint_check
+}
@@ -0,0 +1,341 @@
+// Copyright (C) 2012 Denis BEURIVE
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stun
+
+import "fmt"
+import "errors"
+import "context"
+import "os"
+import "os/exec"
+import "sync"
+import "time"
+import "tools"
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Public address watcher.                                                                          */
+/* The watcher periodically performs test I, and reports the changes of the mapped address.         */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This type represents the parameters of the watcher.
+type WatcherPolicy struct {
+	// The interval between two polls.
+	Interval time.Duration
+	// The number of consecutive failed polls (no server answered) after which the mapped address is considered lost.
+	// Transient failures (less than this number) are not reported.
+	Failures int
+	// This flag indicates whether the discovery process should be performed when the mapped address changes, in order
+	// to report the NAT's type.
+	Discover bool
+	// The command executed when the mapped address changes (nil if none).
+	// The first element is the program, the other elements are its arguments. The command's environment contains:
+	// STUN_OLD_ADDRESS, STUN_NEW_ADDRESS, STUN_OLD_NAT_TYPE and STUN_NAT_TYPE.
+	Command []string
+	// The retransmission policy used for the polls.
+	Retransmit RetransmitPolicy
+}
+
+// This type represents a change of the mapped address.
+// Transport addresses are written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6). Empty strings mean "unknown".
+type WatcherEvent struct {
+	// The date of the event.
+	Time time.Time
+	// The transport address of the server that gave the new mapped address ("" if the address is lost).
+	Server string
+	// The previous mapped address ("" for the first event).
+	OldAddress string
+	// The new mapped address ("" if the mapped address is lost).
+	NewAddress string
+	// The previous NAT's type.
+	OldNatType NatType
+	// The NAT's type (STUN_NAT_UNKNOWN if the discovery process is not performed).
+	NatType NatType
+}
+
+// This type represents a running watcher.
+type Watcher struct {
+	// The clients (one per server).
+	clients []*Client
+	// The parameters.
+	policy WatcherPolicy
+	// The function called for each event (may be nil).
+	callback func(WatcherEvent)
+	// The channel used to report the events (if no callback is given).
+	events chan WatcherEvent
+	// The function that stops the watcher.
+	cancel context.CancelFunc
+	// This channel is closed when the watcher is stopped.
+	done chan struct{}
+	// This mutex protects the following fields.
+	mutex sync.Mutex
+	// The current mapped address ("" if unknown).
+	address string
+	// The server that gave the current mapped address.
+	server string
+	// The current NAT's type.
+	nat_type NatType
+	// The last error.
+	err error
+}
+
+// The size of the watcher's channel of events.
+const watcher_events_size = 16
+
+/* ------------------------------------------------------------------------------------------------ */
+/* API                                                                                              */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function returns the default parameters for the watcher.
+//
+// OUTPUT
+// - The parameters.
+func WatcherPolicyDefault() WatcherPolicy {
+	return WatcherPolicy{ Interval: time.Minute, Failures: 3, Discover: false, Command: nil, Retransmit: RetransmitPolicyRfc3489() }
+}
+
+// This function checks that the parameters are valid.
+//
+// OUTPUT
+// - The error flag.
+func (v WatcherPolicy) Check() error {
+	if (v.Interval <= 0) { return errors.New(fmt.Sprintf("Invalid watcher policy: the interval must be positive (%s).", v.Interval)) }
+	if (v.Failures < 1) { return errors.New(fmt.Sprintf("Invalid watcher policy: invalid number of failures (%d).", v.Failures)) }
+	if (nil != v.Command) && (0 == len(v.Command)) { return errors.New("Invalid watcher policy: the command is empty.") }
+	return v.Retransmit.Check()
+}
+
+// This function starts a watcher.
+// The watcher polls the servers (in the given order, until one of them answers) at regular intervals, using test I.
+// It runs in the background, until it is stopped (see Stop()) or until the context is cancelled.
+// Events are reported when the mapped address is learned for the first time, when it changes, and when it is lost.
+//
+// INPUT
+// - in_ctx: the context.
+// - in_servers: the transport addresses of the servers.
+//   These values should be written: "IP:Port" (IPV4) or "[IP]:Port" (IPV6).
+//   Note: Behind a symmetric NAT, each server sees a different port. Therefore, if the server that answers is not the
+//         one that gave the current mapped address, then only the IP addresses are compared.
+// - in_policy: the parameters of the watcher.
+// - in_callback: the function called for each event. It is called from the watcher's goroutine.
+//   If this value is nil, then the events are sent to the channel returned by Events().
+//
+// OUTPUT
+// - The watcher.
+// - The error flag.
+func WatcherCreate(in_ctx context.Context, in_servers []string, in_policy WatcherPolicy, in_callback func(WatcherEvent)) (*Watcher, error) {
+	var watcher Watcher
+
+	err := in_policy.Check()
+	if (nil != err) { return nil, err }
+	if (0 == len(in_servers)) { return nil, errors.New("The watcher needs at least one server.") }
+
+	for i := 0; i < len(in_servers); i++ {
+		client, err := ClientCreate(in_servers[i])
+		if (nil != err) {
+			watcher.__close()
+			return nil, err
+		}
+		client.SetRetransmitPolicy(in_policy.Retransmit)
+		watcher.clients = append(watcher.clients, client)
+	}
+
+	ctx, cancel := context.WithCancel(in_ctx)
+	watcher.policy   = in_policy
+	watcher.callback = in_callback
+	watcher.events   = make(chan WatcherEvent, watcher_events_size)
+	watcher.cancel   = cancel
+	watcher.done     = make(chan struct{})
+	watcher.nat_type = STUN_NAT_UNKNOWN
+	go watcher.__run(ctx)
+	return &watcher, nil
+}
+
+// This function returns the channel used to report the events.
+// The channel is closed when the watcher is stopped. If a callback has been given, then the channel is not used.
+//
+// OUTPUT
+// - The channel.
+func (v *Watcher) Events() <-chan WatcherEvent {
+	return v.events
+}
+
+// This function stops the watcher and closes its sockets. It returns once the watcher's goroutine has terminated.
+func (v *Watcher) Stop() {
+	v.cancel()
+	<-v.done
+}
+
+// This function returns the current mapped address.
+//
+// OUTPUT
+// - The mapped address ("" if unknown).
+func (v *Watcher) Address() string {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.address
+}
+
+// This function returns the last error that occurred (poll, discovery or command).
+// Errors do not stop the watcher.
+//
+// OUTPUT
+// - The last error (nil if none).
+func (v *Watcher) Err() error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.err
+}
+
+/* ------------------------------------------------------------------------------------------------ */
+/* Privates                                                                                         */
+/* ------------------------------------------------------------------------------------------------ */
+
+// This function runs the watcher.
+//
+// INPUT
+// - in_ctx: the context.
+func (v *Watcher) __run(in_ctx context.Context) {
+	var failures int = 0
+
+	defer close(v.done)
+	defer close(v.events)
+	defer v.__close()
+
+	ticker := time.NewTicker(v.policy.Interval)
+	defer ticker.Stop()
+	for {
+		client, address := v.__poll(in_ctx)
+		if (nil != in_ctx.Err()) { return }
+
+		if ("" == address) {
+			failures++
+			if (failures == v.policy.Failures) && ("" != v.address) { v.__change(in_ctx, nil, "") }
+		} else {
+			failures = 0
+			if (v.__changed(client.server_transport_address, address)) { v.__change(in_ctx, client, address) }
+		}
+
+		select {
+			case <-in_ctx.Done():
+				return
+			case <-ticker.C:
+		}
+	}
+}
+
+// This function polls the servers, until one of them answers.
+//
+// INPUT
+// - in_ctx: the context.
+//
+// OUTPUT
+// - The client that received the answer (nil if none).
+// - The mapped address ("" if no server answered).
+func (v *Watcher) __poll(in_ctx context.Context) (*Client, string) {
+	for i := 0; i < len(v.clients); i++ {
+		response, err := v.clients[i].ClientSendBinding(in_ctx, nil)
+		if (nil != in_ctx.Err()) { return nil, "" }
+		if (nil != err) { v.__setError(err); continue }
+		if (! response.response) { continue }
+		// RFC 5389 servers may send the XOR-MAPPED-ADDRESS only.
+		mapped, err := __mappedAddress(response.packet)
+		if (nil != err) {
+			v.__setError(errors.New(fmt.Sprintf("The server %s did not send any mapped address: %s", v.clients[i].server_transport_address, err)))
+			continue
+		}
+		return v.clients[i], mapped
+	}
+	return nil, ""
+}
+
+// This function tells whether a mapped address differs from the current one.
+//
+// INPUT
+// - in_server: the server that gave the mapped address.
+// - in_address: the mapped address.
+//
+// OUTPUT
+// - true: the mapped address has changed.
+// - false: the mapped address has not changed.
+func (v *Watcher) __changed(in_server string, in_address string) bool {
+	if ("" == v.address) { return true }
+	if (in_server == v.server) { return in_address != v.address }
+	ip, _, err := tools.InetSplit(in_address)
+	if (nil != err) { return true }
+	current, _, err := tools.InetSplit(v.address)
+	if (nil != err) { return true }
+	return ip != current
+}
+
+// This function records a change of the mapped address and reports it.
+//
+// INPUT
+// - in_ctx: the context.
+// - in_client: the client that received the new mapped address (nil if the address is lost).
+// - in_address: the new mapped address ("" if the address is lost).
+func (v *Watcher) __change(in_ctx context.Context, in_client *Client, in_address string) {
+	event := WatcherEvent{ Time: time.Now(), OldAddress: v.address, NewAddress: in_address, OldNatType: v.nat_type, NatType: STUN_NAT_UNKNOWN }
+
+	if (nil != in_client) {
+		event.Server = in_client.server_transport_address
+		if (v.policy.Discover) {
+			result, err := in_client.ClientDiscoverContext(in_ctx)
+			if (nil != in_ctx.Err()) { return }
+			if (nil != err) { v.__setError(err) } else { event.NatType = result.NatType }
+		}
+	}
+
+	v.mutex.Lock()
+	v.address  = in_address
+	v.server   = event.Server
+	v.nat_type = event.NatType
+	v.mutex.Unlock()
+	if verbosity > 0 { tools.AddText(output, fmt.Sprintf("% -25s: \"%s\" -> \"%s\"", "Mapped address changed", event.OldAddress, event.NewAddress)) }
+
+	if (nil != v.policy.Command) {
+		command := exec.CommandContext(in_ctx, v.policy.Command[0], v.policy.Command[1:]...)
+		command.Env = append(os.Environ(),
+			"STUN_OLD_ADDRESS="  + event.OldAddress,
+			"STUN_NEW_ADDRESS="  + event.NewAddress,
+			"STUN_OLD_NAT_TYPE=" + event.OldNatType.String(),
+			"STUN_NAT_TYPE="     + event.NatType.String())
+		err := command.Run()
+		if (nil != err) { v.__setError(errors.New(fmt.Sprintf("The command \"%s\" failed: %s", v.policy.Command[0], err))) }
+	}
+
+	if (nil != v.callback) {
+		v.callback(event)
+		return
+	}
+	select {
+		case v.events <- event:
+		case <-in_ctx.Done():
+	}
+}
+
+// This function records an error.
+//
+// INPUT
+// - in_err: the error.
+func (v *Watcher) __setError(in_err error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.err = in_err
+}
+
+// This function closes the clients' sockets.
+func (v *Watcher) __close() {
+	for i := 0; i < len(v.clients); i++ { v.clients[i].Close() }
+}